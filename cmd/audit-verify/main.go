@@ -0,0 +1,71 @@
+// Command audit-verify checks that an audit log has not been tampered with,
+// either in a wallet-manager database or in an export from
+// /admin/v1/audit/export, and prints the last entry it checked. Keep that
+// entry's Seq and Hash: a later check that ends before it has lost entries.
+// A database is opened read-only, and must already exist.
+//
+//	audit-verify --db wallet.db
+//	audit-verify export.ndjson
+//	curl ... | audit-verify -
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/store/sqlite"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "SQLite database file whose audit log to check, instead of an export")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s --db FILE | EXPORT_FILE | -\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var (
+		chain *audit.Chain
+		err   error
+	)
+	switch {
+	case *dbPath != "" && flag.NArg() == 0:
+		store, openErr := sqlite.OpenReadOnly(*dbPath)
+		if openErr != nil {
+			log.Fatalf("opening database %s: %v", *dbPath, openErr)
+		}
+		defer store.Close()
+		chain, err = audit.Verify(store)
+	case *dbPath == "" && flag.NArg() == 1:
+		var r io.Reader = os.Stdin
+		if path := flag.Arg(0); path != "-" {
+			file, openErr := os.Open(path)
+			if openErr != nil {
+				log.Fatalf("opening export %s: %v", path, openErr)
+			}
+			defer file.Close()
+			r = file
+		}
+		chain, err = audit.VerifyExport(r)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		if last := chain.Last(); last != nil {
+			log.Fatalf("%v (entries up to %d are intact)", err, last.Seq)
+		}
+		log.Fatal(err)
+	}
+	last := chain.Last()
+	if last == nil {
+		fmt.Println("The audit log is empty")
+		return
+	}
+	fmt.Printf("Verified %d entries from %d to %d; the last hash is %s\n", chain.Count(), chain.First().Seq, last.Seq, last.Hash)
+}
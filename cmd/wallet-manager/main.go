@@ -1,25 +1,244 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
 	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
 	"github.com/adrianos93/wallet-manager/internal/server"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/store/sqlite"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	dbPath := flag.String("db", "", "SQLite database file to keep state in; state is kept in memory when empty")
+	logLevel := flag.String("log-level", "info", "least severe level to log: debug, info, warn or error")
+	ratesPath := flag.String("fx-rates", "", "JSON file of exchange rates such as {\"EUR/USD\": \"1.0834\"}; payments between currencies fail without one")
+	createAdmin := flag.Bool("create-admin", false, "create an operator on startup and print its API key")
+	spread := flag.String("fx-spread", "0", "fraction taken off every exchange rate, such as 0.005 for half a percent")
+	depositCap := flag.String("unverified-deposit-cap", user.DefaultTiers[user.TierUnverified].DepositCap.String(),
+		"most an unverified user may deposit in total, across all of its wallets and in --tier-currency; 0 for no cap")
+	tierCurrency := flag.String("tier-currency", user.DefaultTiers[user.TierVerified].Currency,
+		"currency tier limits and deposit caps are in; each user's wallets are counted together, valued in it at the mid-market rate")
+	limitsPath := flag.String("tier-limits", "", "JSON file of transaction limits by tier such as {\"verified\": {\"payment\": {\"Daily\": \"5000\"}}}; tiers it leaves out keep the default limits")
+	holdDuration := flag.Duration("hold-duration", wallet.DefaultHoldDuration, "how long an authorization holds funds before it expires")
+	scheduleInterval := flag.Duration("schedule-interval", time.Minute, "how often to look for scheduled payments that are due")
+	scheduleRetries := flag.Int("schedule-retries", schedule.DefaultRetryPolicy.MaxRetries, "how many more times to try a scheduled payment that failed for lack of funds")
+	scheduleRetryInterval := flag.Duration("schedule-retry-interval", schedule.DefaultRetryPolicy.Interval, "how long to wait before retrying a scheduled payment")
+	eventInterval := flag.Duration("event-interval", time.Second, "how often to hand new events to subscribers such as webhooks")
+	webhookInterval := flag.Duration("webhook-interval", 5*time.Second, "how often to look for webhook deliveries that are due")
+	webhookAttempts := flag.Int("webhook-attempts", webhook.DefaultRetryPolicy.MaxAttempts, "how many times to attempt a webhook delivery before it is dead")
+	webhookBackoff := flag.Duration("webhook-backoff", webhook.DefaultRetryPolicy.InitialInterval, "how long to wait before the first retry of a webhook delivery; each later wait doubles")
+	webhookMaxBackoff := flag.Duration("webhook-max-backoff", webhook.DefaultRetryPolicy.MaxInterval, "the longest wait between attempts at a webhook delivery")
+	webhookPrivate := flag.Bool("webhook-private-networks", false, "let webhook endpoints be on loopback, private and link-local addresses")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("parsing --log-level: %v", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, level))
+
+	var store server.Store = memory.New()
+	if *dbPath != "" {
+		sqliteStore, err := sqlite.Open(*dbPath)
+		if err != nil {
+			log.Fatalf("opening database %s: %v", *dbPath, err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	}
+
+	rates := exchange.StaticRates{}
+	if *ratesPath != "" {
+		loaded, err := exchange.LoadRates(*ratesPath)
+		if err != nil {
+			log.Fatalf("loading exchange rates: %v", err)
+		}
+		rates = loaded
+	}
+	fxSpread, err := money.Parse(*spread)
+	if err != nil {
+		log.Fatalf("parsing --fx-spread: %v", err)
+	}
+	quoter, err := exchange.NewQuoter(rates, fxSpread, exchange.DefaultQuoteTTL)
+	if err != nil {
+		log.Fatalf("parsing --fx-spread: %v", err)
+	}
+
+	unverifiedCap, err := money.Parse(*depositCap)
+	if err != nil || unverifiedCap.IsNegative() {
+		log.Fatalf("parsing --unverified-deposit-cap: %q is not an amount", *depositCap)
+	}
+	tiers := user.Tiers{}
+	for name, tier := range user.DefaultTiers {
+		tiers[name] = tier
+	}
+	unverified := tiers[user.TierUnverified]
+	unverified.DepositCap = unverifiedCap
+	tiers[user.TierUnverified] = unverified
+	if *limitsPath != "" {
+		limits, err := user.LoadTierLimits(*limitsPath)
+		if err != nil {
+			log.Fatalf("loading tier limits: %v", err)
+		}
+		for name, tierLimits := range limits {
+			tier := tiers[name]
+			tier.Limits = tierLimits
+			tiers[name] = tier
+		}
+	}
+	currency, err := money.ParseCurrency(*tierCurrency)
+	if err != nil {
+		log.Fatalf("parsing --tier-currency: %v", err)
+	}
+	for name, tier := range tiers {
+		if _, err := tier.Limits.In(currency); err != nil {
+			log.Fatalf("tier limits of %s: %v", name, err)
+		}
+		if _, err := tier.DepositCap.In(currency); err != nil {
+			log.Fatalf("deposit cap of %s: %v", name, err)
+		}
+		tier.Currency = currency
+		tiers[name] = tier
+	}
+
+	if *holdDuration <= 0 {
+		log.Fatalf("--hold-duration must be positive")
+	}
+	if *scheduleInterval <= 0 || *scheduleRetryInterval <= 0 {
+		log.Fatalf("--schedule-interval and --schedule-retry-interval must be positive")
+	}
+	if *scheduleRetries < 0 {
+		log.Fatalf("--schedule-retries must not be negative")
+	}
+
+	if *eventInterval <= 0 {
+		log.Fatalf("--event-interval must be positive")
+	}
+	if *webhookInterval <= 0 || *webhookBackoff <= 0 || *webhookMaxBackoff < *webhookBackoff {
+		log.Fatalf("--webhook-interval and --webhook-backoff must be positive, and --webhook-max-backoff at least --webhook-backoff")
+	}
+	if *webhookAttempts < 1 {
+		log.Fatalf("--webhook-attempts must be at least 1")
+	}
+
+	if *createAdmin {
+		operator, err := user.NewAdmin(context.Background(), store)
+		if err != nil {
+			log.Fatalf("creating operator: %v", err)
+		}
+		credential, err := auth.Issue(store, operator.Id, time.Now())
+		if err != nil {
+			log.Fatalf("issuing operator API key: %v", err)
+		}
+		fmt.Printf("Created operator %s with API key %s\n", operator.Id, credential.ApiKey)
+	}
+
+	webhookOptions := []webhook.Option{webhook.WithRetryPolicy(webhook.RetryPolicy{
+		MaxAttempts:     *webhookAttempts,
+		InitialInterval: *webhookBackoff,
+		MaxInterval:     *webhookMaxBackoff,
+	})}
+	if *webhookPrivate {
+		webhookOptions = append(webhookOptions, webhook.WithPrivateNetworks())
+	}
+	srv := server.New(store, server.WithQuoter(quoter), server.WithTiers(tiers), server.WithHoldDuration(*holdDuration),
+		server.WithScheduleOptions(schedule.WithRetryPolicy(schedule.RetryPolicy{
+			MaxRetries: *scheduleRetries,
+			Interval:   *scheduleRetryInterval,
+		})),
+		server.WithWebhookOptions(webhookOptions...))
+	go srv.Scheduler().Run(context.Background(), *scheduleInterval)
+	go srv.Events().Run(context.Background(), *eventInterval)
+	go srv.Webhooks().Run(context.Background(), *webhookInterval)
 	r := mux.NewRouter()
+	r.Use(server.RequestID, server.LogRequests, srv.Metrics)
 
 	r.HandleFunc(fmt.Sprintf("/v1/health/%s", manager.ServiceName), func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }).Methods(http.MethodGet)
-	r.HandleFunc("/v1/user", server.HandleCreateUser).Methods(http.MethodPost)
-	r.HandleFunc("/v1/user/{user:[A-Za-z0-9]{1,64}}/wallet", server.HandleCreateWallet).Methods(http.MethodPost)
-	r.HandleFunc("/v1/user/{user:[A-Za-z0-9]{1,64}}/wallet/{wallet:[A-Za-z0-9]{1,64}}/balance", server.HandleBalanceCheck).Methods(http.MethodGet)
-	r.HandleFunc("/v1/user/{user:[A-Za-z0-9]{1,64}}/wallet/{wallet:[A-Za-z0-9]{1,64}}/deposit", server.HandleDeposit).Methods(http.MethodPost)
-	r.HandleFunc("/v1/user/{user:[A-Za-z0-9]{1,64}}/wallet/{wallet:[A-Za-z0-9]{1,64}}/withdraw", server.HandleWithdrawal).Methods(http.MethodPost)
-	r.HandleFunc("/v1/user/{user:[A-Za-z0-9]{1,64}}/wallet/{wallet:[A-Za-z0-9]{1,64}}/payment", server.HandlePayment).Methods(http.MethodPost)
-
-	fmt.Println("Listening on port 8080")
-	_ = http.ListenAndServe(":8080", r)
+	r.HandleFunc("/metrics", srv.HandleMetrics).Methods(http.MethodGet)
+	r.Handle("/v1/user", srv.Audit(http.HandlerFunc(srv.HandleCreateUser))).Methods(http.MethodPost)
+
+	// Everything under a user needs that user's API key, and every call that
+	// may change state is audited, even when the key is refused.
+	u := r.PathPrefix("/v1/user/{user:[A-Za-z0-9]{1,64}}").Subrouter()
+	u.Use(srv.Audit, srv.Authenticate)
+	u.HandleFunc("", srv.HandleGetUser).Methods(http.MethodGet)
+	u.HandleFunc("", srv.HandleUpdateProfile).Methods(http.MethodPatch)
+	u.HandleFunc("/kyc", srv.HandleSubmitKyc).Methods(http.MethodPost)
+	u.HandleFunc("/wallets", srv.HandleListWallets).Methods(http.MethodGet)
+	u.HandleFunc("/keys", srv.HandleListKeys).Methods(http.MethodGet)
+	u.HandleFunc("/keys/{key:[A-Za-z0-9]{1,64}}/rotate", srv.HandleRotateKey).Methods(http.MethodPost)
+	u.HandleFunc("/keys/{key:[A-Za-z0-9]{1,64}}", srv.HandleRevokeKey).Methods(http.MethodDelete)
+	u.HandleFunc("/webhooks", srv.HandleCreateWebhook).Methods(http.MethodPost)
+	u.HandleFunc("/webhooks", srv.HandleListWebhooks).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries", srv.HandleListDeliveries).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries/{delivery:[A-Za-z0-9]{1,64}}", srv.HandleGetDelivery).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries/{delivery:[A-Za-z0-9]{1,64}}/replay", srv.HandleReplayDelivery).Methods(http.MethodPost)
+	u.HandleFunc("/webhooks/{endpoint:[A-Za-z0-9]{1,64}}", srv.HandleDeleteWebhook).Methods(http.MethodDelete)
+	u.HandleFunc("/wallet", srv.HandleCreateWallet).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/balance", srv.HandleBalanceCheck).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/deposit", srv.Idempotent(srv.HandleDeposit)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/withdraw", srv.Idempotent(srv.HandleWithdrawal)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/payment", srv.Idempotent(srv.HandlePayment)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/payment/{transaction:[A-Za-z0-9]{1,64}}/refund", srv.Idempotent(srv.HandleRefund)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/quote", srv.HandleQuote).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/authorizations", srv.Idempotent(srv.HandleAuthorize)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/authorizations", srv.HandleListAuthorizations).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/authorizations/{authorization:[A-Za-z0-9]{1,64}}", srv.HandleGetAuthorization).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/authorizations/{authorization:[A-Za-z0-9]{1,64}}/capture", srv.Idempotent(srv.HandleCapture)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/authorizations/{authorization:[A-Za-z0-9]{1,64}}/void", srv.HandleVoid).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules", srv.Idempotent(srv.HandleCreateSchedule)).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules", srv.HandleListSchedules).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules/{schedule:[A-Za-z0-9]{1,64}}", srv.HandleGetSchedule).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules/{schedule:[A-Za-z0-9]{1,64}}/runs", srv.HandleScheduleRuns).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules/{schedule:[A-Za-z0-9]{1,64}}/pause", srv.HandlePauseSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules/{schedule:[A-Za-z0-9]{1,64}}/resume", srv.HandleResumeSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/schedules/{schedule:[A-Za-z0-9]{1,64}}/cancel", srv.HandleCancelSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/transactions", srv.HandleTransactions).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/status", srv.HandleChangeStatus).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/status-changes", srv.HandleStatusChanges).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet:[A-Za-z0-9]{1,64}}/limits", srv.HandleWalletLimits).Methods(http.MethodGet)
+
+	// The admin API needs an operator's API key, and is audited too.
+	a := r.PathPrefix("/admin/v1").Subrouter()
+	a.Use(srv.Audit, srv.RequireAdmin)
+	a.HandleFunc("/operators", srv.HandleAdminCreateOperator).Methods(http.MethodPost)
+	a.HandleFunc("/users", srv.HandleAdminListUsers).Methods(http.MethodGet)
+	a.HandleFunc("/users/{user:[A-Za-z0-9]{1,64}}", srv.HandleAdminGetUser).Methods(http.MethodGet)
+	a.HandleFunc("/users/{user:[A-Za-z0-9]{1,64}}/kyc", srv.HandleAdminReviewKyc).Methods(http.MethodPost)
+	a.HandleFunc("/wallets", srv.HandleAdminListWallets).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}", srv.HandleAdminGetWallet).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}/ledger", srv.HandleAdminLedger).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}/status", srv.HandleAdminChangeStatus).Methods(http.MethodPost)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}/status-changes", srv.HandleAdminStatusChanges).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}/adjustments", srv.HandleAdminAdjust).Methods(http.MethodPost)
+	a.HandleFunc("/wallets/{wallet:[A-Za-z0-9]{1,64}}/limits", srv.HandleAdminSetLimits).Methods(http.MethodPut)
+	a.HandleFunc("/webhooks", srv.HandleAdminCreateWebhook).Methods(http.MethodPost)
+	a.HandleFunc("/webhooks", srv.HandleAdminListWebhooks).Methods(http.MethodGet)
+	a.HandleFunc("/webhooks/deliveries", srv.HandleAdminListDeliveries).Methods(http.MethodGet)
+	a.HandleFunc("/webhooks/deliveries/{delivery:[A-Za-z0-9]{1,64}}", srv.HandleAdminGetDelivery).Methods(http.MethodGet)
+	a.HandleFunc("/webhooks/deliveries/{delivery:[A-Za-z0-9]{1,64}}/replay", srv.HandleAdminReplayDelivery).Methods(http.MethodPost)
+	a.HandleFunc("/webhooks/{endpoint:[A-Za-z0-9]{1,64}}", srv.HandleAdminDeleteWebhook).Methods(http.MethodDelete)
+	a.HandleFunc("/audit/export", srv.HandleAdminExportAudit).Methods(http.MethodGet)
+
+	slog.Info("listening", "addr", ":8080")
+	if err := http.ListenAndServe(":8080", r); err != nil {
+		log.Fatalf("serving: %v", err)
+	}
 }
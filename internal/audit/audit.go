@@ -0,0 +1,244 @@
+// Package audit keeps an append-only record of every call that changed, or
+// tried to change, the service's state. Each entry carries the hash of the
+// one before it, so changing, removing or reordering entries breaks the
+// chain from that entry on, which Verify detects.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTampered is returned by Verify, and by Chain.Add, for entries that do
+// not carry on the chain before them.
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// Entry is one call. ActorId made it: the user in the path of a user's
+// routes, the operator on the admin routes, and no one for user creation,
+// which needs no key. UserId is the user it was about, when there is one.
+// Balances holds each wallet it touched before and after the call.
+//
+// Seq, CreatedAt, PrevHash and Hash are filled in by Log.Append. Hash is the
+// hex SHA-256 of the entry's JSON encoding with an empty Hash, and PrevHash
+// the Hash of the entry before, or empty for the first entry.
+type Entry struct {
+	Seq       int64     `json:"Seq"`
+	Action    string    `json:"Action"`
+	Path      string    `json:"Path"`
+	Status    int       `json:"Status"`
+	ActorId   string    `json:"ActorId,omitempty"`
+	UserId    string    `json:"UserId,omitempty"`
+	SourceIP  string    `json:"SourceIP"`
+	RequestId string    `json:"RequestId"`
+	Balances  []Balance `json:"Balances,omitempty"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	PrevHash  string    `json:"PrevHash"`
+	Hash      string    `json:"Hash"`
+}
+
+// Balance is a wallet's balance before and after a call, in its currency.
+// Before is empty for wallets the call created.
+type Balance struct {
+	WalletId string `json:"WalletId"`
+	Currency string `json:"Currency"`
+	Before   string `json:"Before,omitempty"`
+	After    string `json:"After"`
+}
+
+// Store persists the log. It has no way to change or remove an entry.
+type Store interface {
+	// AppendAuditEntry saves an entry, failing unless its Seq is one more
+	// than the last entry's.
+	AppendAuditEntry(e *Entry) error
+	// LastAuditEntry returns the latest entry, or nil if the log is empty.
+	LastAuditEntry() (*Entry, error)
+	// ListAuditEntries returns up to limit entries whose Seq is greater than
+	// after, in order of Seq.
+	ListAuditEntries(after int64, limit int) ([]*Entry, error)
+}
+
+// Log appends entries to a Store's audit log. Only one Log should append to
+// a Store at a time.
+type Log struct {
+	store Store
+	now   func() time.Time
+
+	// mu stops two entries from claiming the same place in the chain.
+	mu sync.Mutex
+}
+
+// Option configures optional parts of a Log.
+type Option func(*Log)
+
+// WithClock makes the log tell the time with now rather than the system
+// clock.
+func WithClock(now func() time.Time) Option {
+	return func(l *Log) {
+		l.now = now
+	}
+}
+
+func NewLog(store Store, options ...Option) *Log {
+	l := &Log{store: store, now: time.Now}
+	for _, option := range options {
+		option(l)
+	}
+	return l
+}
+
+// Append chains an entry onto the end of the log and saves it.
+func (l *Log) Append(e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	last, err := l.store.LastAuditEntry()
+	if err != nil {
+		return err
+	}
+	e.Seq, e.PrevHash = 1, ""
+	if last != nil {
+		e.Seq, e.PrevHash = last.Seq+1, last.Hash
+	}
+	e.CreatedAt = l.now().UTC()
+	if e.Hash, err = hash(e); err != nil {
+		return err
+	}
+	return l.store.AppendAuditEntry(e)
+}
+
+// hash returns what an entry's Hash should be.
+func hash(e *Entry) (string, error) {
+	unsealed := *e
+	unsealed.Hash = ""
+	encoded, err := json.Marshal(unsealed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Chain checks entries one at a time, in order. The zero Chain expects the
+// first entry of a log. One checking an export, which may begin later in the
+// log, takes its first entry on trust and checks the rest against it.
+type Chain struct {
+	first, last *Entry
+	partial     bool
+	count       int
+}
+
+// Add checks that an entry's hash matches its contents and that it follows
+// the entry added before it.
+func (c *Chain) Add(e *Entry) error {
+	want, err := hash(e)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.Hash != want:
+		return fmt.Errorf("%w: entry %d does not match its hash", ErrTampered, e.Seq)
+	case c.last == nil && !c.partial && (e.Seq != 1 || e.PrevHash != ""):
+		return fmt.Errorf("%w: the log starts at entry %d", ErrTampered, e.Seq)
+	case c.last != nil && e.Seq != c.last.Seq+1:
+		return fmt.Errorf("%w: entry %d follows entry %d", ErrTampered, e.Seq, c.last.Seq)
+	case c.last != nil && e.PrevHash != c.last.Hash:
+		return fmt.Errorf("%w: entry %d does not follow the hash of entry %d", ErrTampered, e.Seq, c.last.Seq)
+	}
+	if c.first == nil {
+		c.first = e
+	}
+	c.last = e
+	c.count++
+	return nil
+}
+
+// First is the first entry checked, or nil if there was none.
+func (c *Chain) First() *Entry {
+	return c.first
+}
+
+// Count is how many entries have been checked.
+func (c *Chain) Count() int {
+	return c.count
+}
+
+// Last is the last entry checked, or nil if there was none. Entries removed
+// from the end of a log leave a valid chain behind, so keep its Seq and Hash
+// somewhere else to compare later verifications with.
+func (c *Chain) Last() *Entry {
+	return c.last
+}
+
+// batchSize is how many entries Verify reads at once.
+const batchSize = 500
+
+// Verify checks the whole of a Store's log, and returns the Chain it checked
+// it with, even when it fails.
+func Verify(store Store) (*Chain, error) {
+	chain := &Chain{}
+	var after int64
+	for {
+		entries, err := store.ListAuditEntries(after, batchSize)
+		if err != nil {
+			return chain, err
+		}
+		for _, e := range entries {
+			if err := chain.Add(e); err != nil {
+				return chain, err
+			}
+			after = e.Seq
+		}
+		if len(entries) < batchSize {
+			return chain, nil
+		}
+	}
+}
+
+// VerifyExport checks an export of the log, one JSON entry per line as
+// written by Export, and returns the Chain it checked it with, even when it
+// fails.
+func VerifyExport(r io.Reader) (*Chain, error) {
+	chain := &Chain{partial: true}
+	decoder := json.NewDecoder(r)
+	for {
+		var e Entry
+		err := decoder.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return chain, nil
+		}
+		if err != nil {
+			return chain, fmt.Errorf("reading entry after %d: %w", chain.Count(), err)
+		}
+		if err := chain.Add(&e); err != nil {
+			return chain, err
+		}
+	}
+}
+
+// Export writes the entries after the given Seq to w, one JSON entry per
+// line, and returns how many it wrote.
+func Export(store Store, after int64, w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	written := 0
+	for {
+		entries, err := store.ListAuditEntries(after, batchSize)
+		if err != nil {
+			return written, err
+		}
+		for _, e := range entries {
+			if err := encoder.Encode(e); err != nil {
+				return written, err
+			}
+			after = e.Seq
+			written++
+		}
+		if len(entries) < batchSize {
+			return written, nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package audit_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// newLog appends three entries to a fresh store's audit log.
+func newLog(t *testing.T) *memory.Store {
+	t.Helper()
+	store := memory.New()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	log := audit.NewLog(store, audit.WithClock(func() time.Time { return now }))
+	for _, action := range []string{"POST /v1/user", "POST /v1/user/{user}/wallet", "POST /v1/user/{user}/wallet/{wallet}/deposit"} {
+		require.NoError(t, log.Append(&audit.Entry{Action: action, Status: 200, UserId: "user1"}))
+	}
+	return store
+}
+
+func TestLog_Append(t *testing.T) {
+	store := newLog(t)
+	entries, err := store.ListAuditEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, e := range entries {
+		require.Equal(t, int64(i+1), e.Seq)
+		require.NotEmpty(t, e.Hash)
+		if i == 0 {
+			require.Empty(t, e.PrevHash)
+		} else {
+			require.Equal(t, entries[i-1].Hash, e.PrevHash)
+		}
+	}
+	chain, err := audit.Verify(store)
+	require.NoError(t, err)
+	require.Equal(t, 3, chain.Count())
+	require.Equal(t, entries[2].Hash, chain.Last().Hash)
+}
+
+func TestVerifyExport(t *testing.T) {
+	var export bytes.Buffer
+	written, err := audit.Export(newLog(t), 0, &export)
+	require.NoError(t, err)
+	require.Equal(t, 3, written)
+	lines := strings.SplitAfter(strings.TrimSuffix(export.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+
+	for name, test := range map[string]struct {
+		export func() string
+
+		wantCount int
+		wantErr   bool
+	}{
+		"whole log": {
+			export:    func() string { return export.String() },
+			wantCount: 3,
+		},
+		"later part of the log": {
+			export:    func() string { return lines[1] + lines[2] },
+			wantCount: 2,
+		},
+		"changed entry": {
+			export: func() string {
+				return lines[0] + strings.Replace(lines[1], `"Status":200`, `"Status":201`, 1) + lines[2]
+			},
+			wantCount: 1,
+			wantErr:   true,
+		},
+		"removed entry": {
+			export:    func() string { return lines[0] + lines[2] },
+			wantCount: 1,
+			wantErr:   true,
+		},
+		"reordered entries": {
+			export:    func() string { return lines[0] + lines[2] + lines[1] },
+			wantCount: 1,
+			wantErr:   true,
+		},
+		"cut short": {
+			export:    func() string { return lines[0] + lines[1][:20] },
+			wantCount: 1,
+			wantErr:   true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chain, err := audit.VerifyExport(strings.NewReader(test.export()))
+			if test.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.wantCount, chain.Count())
+		})
+	}
+}
+
+func TestChain_Add(t *testing.T) {
+	var export bytes.Buffer
+	_, err := audit.Export(newLog(t), 1, &export)
+	require.NoError(t, err)
+	chain, err := audit.VerifyExport(&export)
+	require.NoError(t, err)
+
+	var strict audit.Chain
+	require.ErrorIs(t, strict.Add(chain.First()), audit.ErrTampered, "a whole log starts at entry 1")
+}
@@ -0,0 +1,144 @@
+// Package auth issues the API keys users authenticate with and checks the
+// keys presented with requests.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+)
+
+const (
+	// Scheme is the Authorization scheme API keys are sent with, as in
+	// "Authorization: Bearer <key>".
+	Scheme = "Bearer"
+
+	keyIdSize  = 8
+	secretSize = 32
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid API key")
+	ErrForbidden       = errors.New("API key does not belong to this user")
+	ErrKeyNotFound     = errors.New("API key not found")
+)
+
+// Key is an API key as it is stored: the secret itself is only known to the
+// user it was issued to, and only its hash is kept.
+type Key struct {
+	Id        string     `json:"KeyId"`
+	UserId    string     `json:"-"`
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	RevokedAt *time.Time `json:"RevokedAt,omitempty"`
+}
+
+// Credential is a newly issued API key, including the secret. It is only
+// ever returned once.
+type Credential struct {
+	KeyId     string    `json:"KeyId"`
+	ApiKey    string    `json:"ApiKey"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+// Store persists API keys.
+type Store interface {
+	CreateAPIKey(k *Key) error
+	// GetAPIKey returns ErrKeyNotFound for unknown keys.
+	GetAPIKey(id string) (*Key, error)
+	// ListAPIKeys returns every key issued to the user, oldest first.
+	ListAPIKeys(userId string) ([]*Key, error)
+	// RevokeAPIKey marks one of the user's keys as revoked at the given
+	// time. Revoking a key twice keeps the first time. It returns
+	// ErrKeyNotFound when the user has no such key.
+	RevokeAPIKey(userId, id string, at time.Time) error
+}
+
+// Revoked reports whether the key has been revoked.
+func (k *Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Issue creates a new API key for the user.
+func Issue(store Store, userId string, now time.Time) (*Credential, error) {
+	id, secret := manager.GenerateId(keyIdSize), manager.GenerateId(secretSize)
+	if id == "" || secret == "" {
+		return nil, errors.New("could not generate an API key")
+	}
+	key := &Key{
+		Id:        id,
+		UserId:    userId,
+		Hash:      hash(secret),
+		CreatedAt: now.UTC(),
+	}
+	if err := store.CreateAPIKey(key); err != nil {
+		return nil, err
+	}
+	return &Credential{KeyId: id, ApiKey: id + "." + secret, CreatedAt: key.CreatedAt}, nil
+}
+
+// Authenticate returns the key a presented API key belongs to, as long as it
+// has not been revoked.
+func Authenticate(store Store, apiKey string) (*Key, error) {
+	id, secret, found := strings.Cut(apiKey, ".")
+	if !found || id == "" || secret == "" {
+		return nil, ErrUnauthenticated
+	}
+	key, err := store.GetAPIKey(id)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash(secret))) != 1 || key.Revoked() {
+		return nil, ErrUnauthenticated
+	}
+	return key, nil
+}
+
+// Rotate issues the user a new key and then revokes the old one, so a
+// failure part way leaves the user with a working key.
+func Rotate(store Store, userId, keyId string, now time.Time) (*Credential, error) {
+	old, err := store.GetAPIKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if old.UserId != userId {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyId)
+	}
+	if old.Revoked() {
+		return nil, fmt.Errorf("%w: %s has been revoked", ErrKeyNotFound, keyId)
+	}
+	credential, err := Issue(store, userId, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.RevokeAPIKey(userId, keyId, now); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// FromHeader extracts the API key from an Authorization header value.
+func FromHeader(header string) (string, bool) {
+	scheme, apiKey, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, Scheme) {
+		return "", false
+	}
+	apiKey = strings.TrimSpace(apiKey)
+	return apiKey, apiKey != ""
+}
+
+// hash is the SHA-256 of a secret. Secrets are long and random, so a fast
+// hash is enough.
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
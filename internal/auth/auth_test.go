@@ -0,0 +1,121 @@
+package auth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) *memory.Store {
+	t.Helper()
+	store := memory.New()
+	require.NoError(t, store.CreateUser(&user.User{Id: "user1"}))
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	return store
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := newStore(t)
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	credential, err := auth.Issue(store, "user1", now)
+	require.NoError(t, err)
+	require.Equal(t, now, credential.CreatedAt)
+	revoked, err := auth.Issue(store, "user1", now)
+	require.NoError(t, err)
+	require.NoError(t, store.RevokeAPIKey("user1", revoked.KeyId, now))
+
+	for name, test := range map[string]struct {
+		apiKey string
+
+		wantErr error
+	}{
+		"accepts an issued key": {
+			apiKey: credential.ApiKey,
+		},
+		"rejects a wrong secret": {
+			apiKey:  credential.KeyId + ".0000",
+			wantErr: auth.ErrUnauthenticated,
+		},
+		"rejects an unknown key": {
+			apiKey:  "missing.0000",
+			wantErr: auth.ErrUnauthenticated,
+		},
+		"rejects a malformed key": {
+			apiKey:  credential.KeyId,
+			wantErr: auth.ErrUnauthenticated,
+		},
+		"rejects a revoked key": {
+			apiKey:  revoked.ApiKey,
+			wantErr: auth.ErrUnauthenticated,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := auth.Authenticate(store, test.apiKey)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "user1", got.UserId)
+			require.Equal(t, credential.KeyId, got.Id)
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	store := newStore(t)
+	now := time.Now()
+	old, err := auth.Issue(store, "user1", now)
+	require.NoError(t, err)
+
+	_, err = auth.Rotate(store, "user2", old.KeyId, now)
+	require.ErrorIs(t, err, auth.ErrKeyNotFound, "only the owner can rotate a key")
+
+	rotated, err := auth.Rotate(store, "user1", old.KeyId, now)
+	require.NoError(t, err)
+	require.NotEqual(t, old.KeyId, rotated.KeyId)
+	_, err = auth.Authenticate(store, old.ApiKey)
+	require.ErrorIs(t, err, auth.ErrUnauthenticated)
+	_, err = auth.Authenticate(store, rotated.ApiKey)
+	require.NoError(t, err)
+
+	_, err = auth.Rotate(store, "user1", old.KeyId, now)
+	require.ErrorIs(t, err, auth.ErrKeyNotFound, "a revoked key cannot be rotated again")
+}
+
+func TestFromHeader(t *testing.T) {
+	for name, test := range map[string]struct {
+		header string
+
+		want   string
+		wantOk bool
+	}{
+		"bearer key": {
+			header: "Bearer abc.def",
+			want:   "abc.def",
+			wantOk: true,
+		},
+		"scheme is case insensitive": {
+			header: "bearer abc.def",
+			want:   "abc.def",
+			wantOk: true,
+		},
+		"missing header": {},
+		"other scheme": {
+			header: "Basic dXNlcjpwYXNz",
+		},
+		"no key": {
+			header: "Bearer ",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, ok := auth.FromHeader(test.header)
+			require.Equal(t, test.wantOk, ok)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultBatchSize is how many events a Bus reads from the outbox at once.
+const DefaultBatchSize = 100
+
+// Handler reacts to one event. An error leaves the event to be handled
+// again, so handlers must cope with seeing an event more than once.
+type Handler func(e *Event) error
+
+// Bus hands the events in a Store's outbox to its subscribers. Each
+// subscriber gets every event at least once, in order of Seq, and so a
+// wallet's events in the order their changes were made. A subscriber whose
+// handler fails is retried from the event it failed on at the next dispatch,
+// and gets no later events until then; the other subscribers carry on. Only
+// one Bus should dispatch a Store's events at a time.
+type Bus struct {
+	store Store
+	batch int
+
+	// mu stops two calls to Dispatch from handing out the same events, and
+	// guards subscribers.
+	mu          sync.Mutex
+	subscribers []subscriber
+}
+
+type subscriber struct {
+	name    string
+	handler Handler
+}
+
+// Option configures optional parts of a Bus.
+type Option func(*Bus)
+
+// WithBatchSize replaces DefaultBatchSize.
+func WithBatchSize(size int) Option {
+	return func(b *Bus) {
+		b.batch = size
+	}
+}
+
+func NewBus(store Store, options ...Option) *Bus {
+	b := &Bus{store: store, batch: DefaultBatchSize}
+	for _, option := range options {
+		option(b)
+	}
+	if b.batch < 1 {
+		b.batch = DefaultBatchSize
+	}
+	return b
+}
+
+// Subscribe adds a handler under a name, which the Store keeps its progress
+// under, so it must stay the same between restarts. A new subscriber starts
+// from the first event in the outbox.
+func (b *Bus) Subscribe(name string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, subscriber{name: name, handler: handler})
+}
+
+// Dispatch hands every subscriber the events it has not handled yet, and
+// returns how many events were handled in all.
+func (b *Bus) Dispatch() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	handled := 0
+	var failures []error
+	for _, sub := range b.subscribers {
+		n, err := b.dispatch(sub)
+		handled += n
+		if err != nil {
+			failures = append(failures, fmt.Errorf("subscriber %s: %w", sub.name, err))
+		}
+	}
+	return handled, errors.Join(failures...)
+}
+
+// Run calls Dispatch every interval until ctx is done. Failures are logged
+// and retried on the next tick.
+func (b *Bus) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := b.Dispatch(); err != nil {
+			slog.Error("dispatching events", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch hands one subscriber its events, saving its progress after each
+// one, until it fails or has handled them all.
+func (b *Bus) dispatch(sub subscriber) (int, error) {
+	cursor, err := b.store.EventCursor(sub.name)
+	if err != nil {
+		return 0, err
+	}
+	handled := 0
+	for {
+		events, err := b.store.ListEvents(cursor, b.batch)
+		if err != nil {
+			return handled, err
+		}
+		for _, e := range events {
+			if err := sub.handler(e); err != nil {
+				return handled, fmt.Errorf("event %d (%s): %w", e.Seq, e.Type, err)
+			}
+			if err := b.store.SaveEventCursor(sub.name, e.Seq); err != nil {
+				return handled, err
+			}
+			cursor = e.Seq
+			handled++
+		}
+		if len(events) < b.batch {
+			return handled, nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package event_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) *memory.Store {
+	t.Helper()
+	store := memory.New()
+	for _, id := range []string{"wallet1", "wallet2"} {
+		require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: id, UserId: "user1", Balance: money.MustParse("0")}))
+	}
+	return store
+}
+
+func deposit(t *testing.T, store *memory.Store, id, walletId string) {
+	t.Helper()
+	amount, err := money.MustParse("10").In("EUR")
+	require.NoError(t, err)
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id: id, Type: wallet.TypeDeposit, TargetWalletId: walletId, Amount: amount, Timestamp: time.Now(),
+	}))
+}
+
+// recorder is a subscriber that keeps the IDs of the wallets of the events
+// it handles, and fails on the events in failOn until it is told to stop.
+type recorder struct {
+	wallets []string
+	failOn  map[int64]bool
+}
+
+func (r *recorder) handle(e *event.Event) error {
+	if r.failOn[e.Seq] {
+		return errors.New("subscriber is down")
+	}
+	r.wallets = append(r.wallets, e.WalletId)
+	return nil
+}
+
+func TestBus_Dispatch(t *testing.T) {
+	store := newStore(t)
+	deposit(t, store, "deposit1", "wallet1")
+	deposit(t, store, "deposit2", "wallet2")
+	bus := event.NewBus(store, event.WithBatchSize(2))
+	healthy, flaky := &recorder{}, &recorder{failOn: map[int64]bool{3: true}}
+	bus.Subscribe("healthy", healthy.handle)
+	bus.Subscribe("flaky", flaky.handle)
+
+	handled, err := bus.Dispatch()
+	require.ErrorContains(t, err, "subscriber flaky")
+	require.Equal(t, 6, handled)
+	require.Equal(t, []string{"wallet1", "wallet2", "wallet1", "wallet2"}, healthy.wallets, "every event, in order")
+	require.Equal(t, []string{"wallet1", "wallet2"}, flaky.wallets, "a failing subscriber stops")
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name   string
+		before func()
+
+		wantHandled int
+		wantErr     bool
+		wantFlaky   []string
+	}{
+		{
+			name:        "keeps failing on the same event",
+			wantHandled: 0,
+			wantErr:     true,
+			wantFlaky:   []string{"wallet1", "wallet2"},
+		},
+		{
+			name:        "carries on from it once it recovers",
+			before:      func() { flaky.failOn = nil },
+			wantHandled: 2,
+			wantFlaky:   []string{"wallet1", "wallet2", "wallet1", "wallet2"},
+		},
+		{
+			name:        "hands out new events once",
+			before:      func() { deposit(t, store, "deposit3", "wallet2") },
+			wantHandled: 2,
+			wantFlaky:   []string{"wallet1", "wallet2", "wallet1", "wallet2", "wallet2"},
+		},
+		{
+			name:      "has nothing left",
+			wantFlaky: []string{"wallet1", "wallet2", "wallet1", "wallet2", "wallet2"},
+		},
+	} {
+		if step.before != nil {
+			step.before()
+		}
+		handled, err := bus.Dispatch()
+		if step.wantErr {
+			require.Error(t, err, step.name)
+		} else {
+			require.NoError(t, err, step.name)
+		}
+		require.Equal(t, step.wantHandled, handled, step.name)
+		require.Equal(t, step.wantFlaky, flaky.wallets, step.name)
+	}
+	require.Len(t, healthy.wallets, 5)
+}
+
+func TestBus_KeepsProgress(t *testing.T) {
+	store := newStore(t)
+	deposit(t, store, "deposit1", "wallet1")
+	first := &recorder{}
+	bus := event.NewBus(store)
+	bus.Subscribe("projection", first.handle)
+	_, err := bus.Dispatch()
+	require.NoError(t, err)
+	require.Len(t, first.wallets, 3)
+
+	deposit(t, store, "deposit2", "wallet2")
+	restarted, newcomer := &recorder{}, &recorder{}
+	bus = event.NewBus(store)
+	bus.Subscribe("projection", restarted.handle)
+	bus.Subscribe("audit", newcomer.handle)
+	_, err = bus.Dispatch()
+	require.NoError(t, err)
+	require.Equal(t, []string{"wallet2"}, restarted.wallets, "a subscriber carries on where it left off")
+	require.Len(t, newcomer.wallets, 4, "a new subscriber starts from the first event")
+}
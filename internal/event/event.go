@@ -0,0 +1,58 @@
+// Package event carries what happens to wallets to the rest of the service.
+// Stores record an Event in their outbox in the same step as the change it
+// describes, so an event exists exactly when its change was made, and a Bus
+// hands the recorded events to its subscribers.
+package event
+
+import (
+	"encoding/json"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+)
+
+const idSize = 16
+
+// Event is a change to a wallet. Seq is the event's position in the outbox,
+// assigned by the Store: a wallet's events are numbered in the order their
+// changes were made. Data depends on Type, which the package that made the
+// change defines.
+type Event struct {
+	Seq       int64           `json:"Seq"`
+	Id        string          `json:"Id"`
+	Type      string          `json:"Type"`
+	UserId    string          `json:"UserId"`
+	WalletId  string          `json:"WalletId"`
+	Data      json.RawMessage `json:"Data"`
+	CreatedAt time.Time       `json:"CreatedAt"`
+}
+
+// New returns an event about one of the user's wallets, with data encoded as
+// JSON. It has no Seq until a Store records it.
+func New(eventType, userId, walletId string, at time.Time, data interface{}) (*Event, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		Id:        manager.GenerateId(idSize),
+		Type:      eventType,
+		UserId:    userId,
+		WalletId:  walletId,
+		Data:      encoded,
+		CreatedAt: at.UTC(),
+	}, nil
+}
+
+// Store reads the outbox, and keeps how far each subscriber has read it. The
+// events themselves are recorded by the stores of the packages whose changes
+// they describe.
+type Store interface {
+	// ListEvents returns up to limit events whose Seq is greater than after,
+	// in order of Seq.
+	ListEvents(after int64, limit int) ([]*Event, error)
+	// EventCursor returns the Seq of the last event the subscriber handled,
+	// or zero if it has handled none.
+	EventCursor(subscriber string) (int64, error)
+	SaveEventCursor(subscriber string, seq int64) error
+}
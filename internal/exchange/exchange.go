@@ -0,0 +1,116 @@
+// Package exchange prices payments between wallets holding different
+// currencies.
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// RateScale is the number of decimal places rates are kept to.
+const RateScale = 10
+
+var (
+	ErrRateUnavailable = errors.New("exchange rate unavailable")
+	ErrInvalidRate     = errors.New("invalid exchange rate")
+)
+
+// FXRateProvider returns the mid-market rate for converting one unit of from
+// into to, as an amount without a currency.
+type FXRateProvider interface {
+	Rate(from, to string) (money.Money, error)
+}
+
+// StaticRates is an FXRateProvider backed by a fixed table, keyed by
+// currency pair such as "EUR/USD". A missing pair is derived from its
+// inverse when that is present.
+type StaticRates map[string]money.Money
+
+// LoadRates reads a StaticRates table from a JSON file such as
+// {"EUR/USD": "1.0834", "EUR/GBP": "0.8571"}.
+func LoadRates(path string) (StaticRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]money.Money
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("reading rates from %s: %w", path, err)
+	}
+	rates := StaticRates{}
+	for pair, rate := range raw {
+		from, to, found := strings.Cut(pair, "/")
+		if !found {
+			return nil, fmt.Errorf("%w: pair %q must look like EUR/USD", ErrInvalidRate, pair)
+		}
+		if from, err = money.ParseCurrency(from); err != nil {
+			return nil, err
+		}
+		if to, err = money.ParseCurrency(to); err != nil {
+			return nil, err
+		}
+		if !rate.IsPositive() || rate.Currency != "" {
+			return nil, fmt.Errorf("%w: %s must be a positive number", ErrInvalidRate, pair)
+		}
+		rates[from+"/"+to] = rate
+	}
+	return rates, nil
+}
+
+func (r StaticRates) Rate(from, to string) (money.Money, error) {
+	if from == to {
+		return money.Money{Units: 1}, nil
+	}
+	if rate, found := r[from+"/"+to]; found {
+		return rate, nil
+	}
+	if inverse, found := r[to+"/"+from]; found {
+		return Invert(inverse)
+	}
+	return money.Money{}, fmt.Errorf("%w: %s to %s", ErrRateUnavailable, from, to)
+}
+
+// Invert returns 1/rate, truncated to RateScale decimal places.
+func Invert(rate money.Money) (money.Money, error) {
+	if !rate.IsPositive() {
+		return money.Money{}, fmt.Errorf("%w: %s", ErrInvalidRate, rate)
+	}
+	numerator := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(RateScale+rate.Scale)), nil)
+	units := numerator.Quo(numerator, big.NewInt(rate.Units))
+	if !units.IsInt64() {
+		return money.Money{}, money.ErrOverflow
+	}
+	return trim(money.Money{Units: units.Int64(), Scale: RateScale}), nil
+}
+
+// trim drops the trailing zeros of a rate, so 1.0500000000 reads as 1.05.
+func trim(rate money.Money) money.Money {
+	for rate.Scale > 0 && rate.Units%10 == 0 {
+		rate.Units /= 10
+		rate.Scale--
+	}
+	return rate
+}
+
+// multiply returns a*b truncated towards zero to scale decimal places, in
+// currency.
+func multiply(a, b money.Money, scale int, currency string) (money.Money, error) {
+	product := new(big.Int).Mul(big.NewInt(a.Units), big.NewInt(b.Units))
+	shift := a.Scale + b.Scale - scale
+	ten := big.NewInt(10)
+	if shift > 0 {
+		product.Quo(product, new(big.Int).Exp(ten, big.NewInt(int64(shift)), nil))
+	} else if shift < 0 {
+		product.Mul(product, new(big.Int).Exp(ten, big.NewInt(int64(-shift)), nil))
+	}
+	if !product.IsInt64() {
+		return money.Money{}, money.ErrOverflow
+	}
+	return money.Money{Units: product.Int64(), Scale: scale, Currency: currency}, nil
+}
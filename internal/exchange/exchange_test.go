@@ -0,0 +1,189 @@
+package exchange
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticRates_Rate(t *testing.T) {
+	rates := StaticRates{"EUR/USD": money.MustParse("1.25")}
+	for name, test := range map[string]struct {
+		from, to string
+
+		want    string
+		wantErr error
+	}{
+		"direct pair": {
+			from: "EUR", to: "USD",
+			want: "1.25",
+		},
+		"inverse pair": {
+			from: "USD", to: "EUR",
+			want: "0.8",
+		},
+		"same currency": {
+			from: "GBP", to: "GBP",
+			want: "1",
+		},
+		"unknown pair": {
+			from: "EUR", to: "GBP",
+			wantErr: ErrRateUnavailable,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := rates.Rate(test.from, test.to)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got.String())
+		})
+	}
+}
+
+func TestLoadRates(t *testing.T) {
+	for name, test := range map[string]struct {
+		contents string
+
+		want    StaticRates
+		wantErr bool
+	}{
+		"reads pairs": {
+			contents: `{"eur/USD": "1.0834", "EUR/JPY": 162.5}`,
+			want: StaticRates{
+				"EUR/USD": money.MustParse("1.0834"),
+				"EUR/JPY": money.MustParse("162.5"),
+			},
+		},
+		"rejects malformed pairs": {
+			contents: `{"EURUSD": "1.0834"}`,
+			wantErr:  true,
+		},
+		"rejects unknown currencies": {
+			contents: `{"EUR/ABC": "1.0834"}`,
+			wantErr:  true,
+		},
+		"rejects rates that are not positive": {
+			contents: `{"EUR/USD": "0"}`,
+			wantErr:  true,
+		},
+		"rejects invalid json": {
+			contents: `EUR/USD = 1.0834`,
+			wantErr:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rates.json")
+			require.NoError(t, os.WriteFile(path, []byte(test.contents), 0o600))
+			got, err := LoadRates(path)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestQuote_Convert(t *testing.T) {
+	for name, test := range map[string]struct {
+		quote  Quote
+		amount money.Money
+
+		want    string
+		wantErr error
+	}{
+		"converts at the rate": {
+			quote:  Quote{From: "EUR", To: "USD", Rate: money.MustParse("1.0834")},
+			amount: money.Money{Units: 10000, Scale: 2, Currency: "EUR"},
+			want:   "108.34",
+		},
+		"truncates to the target's minor unit": {
+			quote:  Quote{From: "EUR", To: "USD", Rate: money.MustParse("1.0839")},
+			amount: money.Money{Units: 10, Scale: 2, Currency: "EUR"},
+			want:   "0.10",
+		},
+		"converts into currencies without decimals": {
+			quote:  Quote{From: "EUR", To: "JPY", Rate: money.MustParse("162.57")},
+			amount: money.Money{Units: 1050, Scale: 2, Currency: "EUR"},
+			want:   "1706",
+		},
+		"rejects amounts too small to convert": {
+			quote:   Quote{From: "JPY", To: "EUR", Rate: money.MustParse("0.006")},
+			amount:  money.Money{Units: 1, Currency: "JPY"},
+			wantErr: money.ErrInvalidAmount,
+		},
+		"rejects amounts in another currency": {
+			quote:   Quote{From: "EUR", To: "USD", Rate: money.MustParse("1.0834")},
+			amount:  money.Money{Units: 100, Scale: 2, Currency: "GBP"},
+			wantErr: ErrQuoteMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := test.quote.Convert(test.amount)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got.String())
+			require.Equal(t, test.quote.To, got.Currency)
+		})
+	}
+}
+
+func TestQuoter(t *testing.T) {
+	_, err := NewQuoter(StaticRates{}, money.MustParse("1"), time.Minute)
+	require.ErrorIs(t, err, ErrInvalidRate)
+	_, err = NewQuoter(StaticRates{}, money.MustParse("-0.01"), time.Minute)
+	require.ErrorIs(t, err, ErrInvalidRate)
+
+	quoter, err := NewQuoter(StaticRates{"EUR/USD": money.MustParse("1.2")}, money.MustParse("0.005"), time.Minute)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	quoter.now = func() time.Time { return now }
+
+	quote, err := quoter.Quote("EUR", "USD")
+	require.NoError(t, err)
+	require.Equal(t, "1.2", quote.MidRate.String())
+	require.Equal(t, "1.194", quote.Rate.String(), "the spread comes off the mid rate")
+	require.Empty(t, quote.Id)
+
+	same, err := quoter.Quote("USD", "USD")
+	require.NoError(t, err)
+	require.Equal(t, "1", same.Rate.String(), "no spread within one currency")
+
+	value, err := quoter.Value(money.Money{Units: 1001, Scale: 2, Currency: "EUR"}, "USD")
+	require.NoError(t, err)
+	require.Equal(t, money.Money{Units: 1201, Scale: 2, Currency: "USD"}, value, "valued at the mid rate, truncated")
+	value, err = quoter.Value(money.Money{Units: 1, Scale: 2, Currency: "USD"}, "EUR")
+	require.NoError(t, err)
+	require.True(t, value.IsZero(), "amounts too small to convert are worth nothing")
+	_, err = quoter.Value(money.Money{Units: 1, Currency: "JPY"}, "EUR")
+	require.ErrorIs(t, err, ErrRateUnavailable)
+
+	locked, err := quoter.Lock("EUR", "USD", "scope1")
+	require.NoError(t, err)
+	require.NotEmpty(t, locked.Id)
+	require.Equal(t, now.Add(time.Minute), locked.ExpiresAt)
+
+	got, err := quoter.Locked(locked.Id, "scope1")
+	require.NoError(t, err)
+	require.Equal(t, locked.Rate, got.Rate)
+
+	_, err = quoter.Locked(locked.Id, "scope2")
+	require.ErrorIs(t, err, ErrQuoteNotFound)
+	_, err = quoter.Locked("missing", "scope1")
+	require.ErrorIs(t, err, ErrQuoteNotFound)
+
+	now = now.Add(time.Minute)
+	_, err = quoter.Locked(locked.Id, "scope1")
+	require.ErrorIs(t, err, ErrQuoteExpired)
+}
@@ -0,0 +1,168 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// DefaultQuoteTTL is how long a locked quote can be paid with.
+const DefaultQuoteTTL = 30 * time.Second
+
+const quoteIdSize = 16
+
+var (
+	ErrQuoteNotFound = errors.New("quote not found")
+	ErrQuoteExpired  = errors.New("quote expired")
+	ErrQuoteMismatch = errors.New("quote does not match the payment")
+)
+
+// Quote is the rate offered for converting From into To: the provider's
+// mid-market rate less the spread. Only locked quotes have an Id and an
+// expiry.
+type Quote struct {
+	Id        string      `json:"QuoteId,omitempty"`
+	From      string      `json:"SourceCurrency"`
+	To        string      `json:"TargetCurrency"`
+	MidRate   money.Money `json:"MidRate"`
+	Spread    money.Money `json:"Spread"`
+	Rate      money.Money `json:"Rate"`
+	ExpiresAt time.Time   `json:"ExpiresAt"`
+	scope     string
+}
+
+// Convert prices amount, held in From, in To. The result is truncated to
+// To's minor unit, so rounding never pays out more than the rate allows.
+func (q *Quote) Convert(amount money.Money) (money.Money, error) {
+	if amount.Currency != q.From {
+		return money.Money{}, fmt.Errorf("%w: quote converts %s, not %s", ErrQuoteMismatch, q.From, amount.Currency)
+	}
+	scale, err := money.ScaleOf(q.To)
+	if err != nil {
+		return money.Money{}, err
+	}
+	converted, err := multiply(amount, q.Rate, scale, q.To)
+	if err != nil {
+		return money.Money{}, err
+	}
+	if !converted.IsPositive() {
+		return money.Money{}, fmt.Errorf("%w: %s %s is too small to convert to %s", money.ErrInvalidAmount, amount, q.From, q.To)
+	}
+	return converted, nil
+}
+
+// Quoter prices conversions from an FXRateProvider, applying a spread, and
+// keeps locked quotes in memory until they expire.
+type Quoter struct {
+	provider FXRateProvider
+	spread   money.Money
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	locked map[string]Quote
+}
+
+// NewQuoter returns a Quoter taking spread, a fraction such as 0.005 for half
+// a percent, off every rate, and locking quotes for ttl.
+func NewQuoter(provider FXRateProvider, spread money.Money, ttl time.Duration) (*Quoter, error) {
+	if spread.IsNegative() || spread.Currency != "" {
+		return nil, fmt.Errorf("%w: spread must be a fraction between 0 and 1", ErrInvalidRate)
+	}
+	if cmp, err := spread.Cmp(money.Money{Units: 1}); err != nil || cmp >= 0 {
+		return nil, fmt.Errorf("%w: spread must be a fraction between 0 and 1", ErrInvalidRate)
+	}
+	return &Quoter{
+		provider: provider,
+		spread:   spread,
+		ttl:      ttl,
+		now:      time.Now,
+		locked:   map[string]Quote{},
+	}, nil
+}
+
+// Quote prices a conversion at the current rate without locking it.
+func (q *Quoter) Quote(from, to string) (*Quote, error) {
+	mid, err := q.provider.Rate(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if !mid.IsPositive() {
+		return nil, fmt.Errorf("%w: %s to %s is %s", ErrInvalidRate, from, to, mid)
+	}
+	quote := &Quote{From: from, To: to, MidRate: mid, Spread: q.spread, Rate: mid}
+	if from != to && !q.spread.IsZero() {
+		keep, err := money.Money{Units: 1}.Sub(q.spread)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := multiply(mid, keep, RateScale, "")
+		if err != nil {
+			return nil, err
+		}
+		quote.Rate = trim(rate)
+	}
+	return quote, nil
+}
+
+// Value returns what amount is worth in currency at the mid-market rate,
+// truncated to currency's minor unit. It is for adding up amounts held in
+// different currencies, such as against a limit, rather than for paying.
+func (q *Quoter) Value(amount money.Money, currency string) (money.Money, error) {
+	if amount.Currency == currency {
+		return amount.In(currency)
+	}
+	mid, err := q.provider.Rate(amount.Currency, currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	scale, err := money.ScaleOf(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	return multiply(amount, mid, scale, currency)
+}
+
+// Lock prices a conversion and holds the rate until the quote expires. The
+// quote can only be fetched again with the same scope, which callers use to
+// tie it to the payment it was asked for.
+func (q *Quoter) Lock(from, to, scope string) (*Quote, error) {
+	quote, err := q.Quote(from, to)
+	if err != nil {
+		return nil, err
+	}
+	now := q.now()
+	quote.Id = manager.GenerateId(quoteIdSize)
+	quote.ExpiresAt = now.Add(q.ttl)
+	quote.scope = scope
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, locked := range q.locked {
+		if !now.Before(locked.ExpiresAt) {
+			delete(q.locked, id)
+		}
+	}
+	q.locked[quote.Id] = *quote
+	return quote, nil
+}
+
+// Locked returns a quote made by Lock with the same scope, as long as it has
+// not expired.
+func (q *Quoter) Locked(id, scope string) (*Quote, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quote, found := q.locked[id]
+	if !found || quote.scope != scope {
+		return nil, fmt.Errorf("%w: %s", ErrQuoteNotFound, id)
+	}
+	if !q.now().Before(quote.ExpiresAt) {
+		delete(q.locked, id)
+		return nil, fmt.Errorf("%w: %s expired at %s", ErrQuoteExpired, id, quote.ExpiresAt.Format(time.RFC3339))
+	}
+	return &quote, nil
+}
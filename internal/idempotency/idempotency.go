@@ -0,0 +1,84 @@
+// Package idempotency records the responses sent to requests carrying an
+// Idempotency-Key, so a retried request can be answered without being
+// processed again.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	// Header is the request header clients put their key in.
+	Header = "Idempotency-Key"
+	// MaxKeyLength bounds the keys clients may send.
+	MaxKeyLength = 255
+	// Retention is how long a key is remembered. Once it has passed the key
+	// may be reused for a different request.
+	Retention = 24 * time.Hour
+)
+
+var (
+	ErrRecordNotFound = errors.New("idempotency record not found")
+	ErrInvalidKey     = errors.New("invalid " + Header)
+	ErrKeyReused      = errors.New(Header + " was already used for a different request")
+	ErrInProgress     = errors.New("a request with this " + Header + " is still being processed")
+)
+
+// Record is a key a user has sent, the fingerprint of the request it came
+// with and, once the request has been handled, the response that was sent.
+// A record without a StatusCode is still being handled.
+type Record struct {
+	UserId      string
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Store persists records. Keys are scoped to the user that sent them.
+type Store interface {
+	// ReserveIdempotencyKey saves record unless the user already holds an
+	// unexpired record for the same key, in which case that record is
+	// returned and nothing is saved. Checking and saving happen atomically,
+	// so only one of several concurrent requests gets the reservation.
+	ReserveIdempotencyKey(record *Record) (*Record, error)
+	// CompleteIdempotencyKey stores the response sent for a reserved key.
+	CompleteIdempotencyKey(record *Record) error
+	// ReleaseIdempotencyKey forgets a reserved key so the request can be
+	// retried.
+	ReleaseIdempotencyKey(userId, key string) error
+}
+
+// NewRecord starts a record for a request that has not been handled yet.
+func NewRecord(userId, key, fingerprint string, now time.Time) *Record {
+	return &Record{
+		UserId:      userId,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(Retention),
+	}
+}
+
+// Fingerprint identifies a request by its method, path and body.
+func Fingerprint(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Completed reports whether a response has been stored for the record.
+func (r *Record) Completed() bool {
+	return r.StatusCode != 0
+}
+
+// Expired reports whether the record is past its retention at now.
+func (r *Record) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
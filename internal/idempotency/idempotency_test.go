@@ -0,0 +1,41 @@
+package idempotency_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprint(t *testing.T) {
+	for name, test := range map[string]struct {
+		method, path, body string
+		wantSame           bool
+	}{
+		"same request": {
+			method: "POST", path: "/deposit", body: `{"Amount": "10"}`,
+			wantSame: true,
+		},
+		"different body": {
+			method: "POST", path: "/deposit", body: `{"Amount": "20"}`,
+		},
+		"different path": {
+			method: "POST", path: "/withdraw", body: `{"Amount": "10"}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			original := idempotency.Fingerprint("POST", "/deposit", []byte(`{"Amount": "10"}`))
+			got := idempotency.Fingerprint(test.method, test.path, []byte(test.body))
+			require.Equal(t, test.wantSame, original == got)
+		})
+	}
+}
+
+func TestRecord_Expired(t *testing.T) {
+	now := time.Now()
+	record := idempotency.NewRecord("user1", "key1", "fingerprint", now)
+	require.False(t, record.Expired(now))
+	require.False(t, record.Expired(now.Add(idempotency.Retention-time.Second)))
+	require.True(t, record.Expired(now.Add(idempotency.Retention)))
+}
@@ -0,0 +1,32 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWith(t *testing.T) {
+	var out bytes.Buffer
+	ctx := logging.WithLogger(context.Background(), logging.New(&out, slog.LevelInfo))
+	ctx = logging.With(ctx, "request_id", "request1")
+	logging.FromContext(ctx).Debug("left out")
+	logging.FromContext(logging.With(ctx, "wallet_id", "wallet1")).Info("deposit applied", "amount", "10.00")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line), "one line of JSON")
+	require.Equal(t, "INFO", line["level"])
+	require.Equal(t, "deposit applied", line["msg"])
+	require.Equal(t, "request1", line["request_id"])
+	require.Equal(t, "wallet1", line["wallet_id"])
+	require.Equal(t, "10.00", line["amount"])
+}
+
+func TestFromContext_Default(t *testing.T) {
+	require.Equal(t, slog.Default(), logging.FromContext(context.Background()))
+}
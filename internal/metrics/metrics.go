@@ -0,0 +1,313 @@
+// Package metrics keeps counters, histograms and gauges and serves them in
+// the Prometheus text exposition format, version 0.0.4.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets request
+// latencies are counted in.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics in the order they were added, and serves them over
+// HTTP. Every metric's name must be unique within its Registry.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// family is a metric along with all of its series.
+type family interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Write writes every metric to w, in the order they were added.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP answers a scrape. Nothing is sent unless every metric could be
+// collected, so a scrape never sees half of them.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body bytes.Buffer
+	if err := r.Write(&body); err != nil {
+		http.Error(w, fmt.Sprintf("collecting metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = w.Write(body.Bytes())
+}
+
+// desc is what every metric has: its name, what it measures and the names
+// of the labels that tell its series apart.
+type desc struct {
+	name, help string
+	labels     []string
+}
+
+func (d desc) writeHeader(w io.Writer, metricType string) error {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, metricType)
+	return err
+}
+
+// key identifies a series by its label values. It panics when they do not
+// match the metric's labels, which is a mistake in the caller.
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, not %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// series writes one sample of the metric. extra are label name and value
+// pairs to add after the metric's own, such as a histogram's bucket.
+func (d desc) series(w io.Writer, suffix, key string, value float64, extra ...string) error {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, labelValue := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(labelValue)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s%s%s %s\n", d.name, suffix, labels, formatValue(value))
+	return err
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a metric's series in order, so scrapes list
+// them the same way every time.
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value per series that only goes up.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Counter adds a counter to the registry. Its name should end in _total.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: map[string]float64{}}
+	r.add(c)
+	return c
+}
+
+// Add adds value, which must not be negative, to the series with the given
+// label values.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s cannot go down", c.name))
+	}
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += value
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the series with the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		if err := c.series(w, "", key, c.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations per series in buckets, along with their
+// count and sum.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValues
+}
+
+type histogramValues struct {
+	// counts holds how many observations fell in each bucket and no lower
+	// one; they are added up when written.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram adds a histogram to the registry, counting observations in
+// buckets with the given upper bounds, in increasing order.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: append([]float64{}, buckets...),
+		values:  map[string]*histogramValues{},
+	}
+	r.add(h)
+	return h
+}
+
+// Observe counts value in the series with the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values, ok := h.values[key]
+	if !ok {
+		values = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		values.counts[i]++
+	}
+	values.count++
+	values.sum += value
+}
+
+// Count returns how many observations the series with the given label
+// values has.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if values, ok := h.values[key]; ok {
+		return values.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.values) {
+		values := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += values.counts[i]
+			if err := h.series(w, "_bucket", key, float64(cumulative), "le", formatValue(bound)); err != nil {
+				return err
+			}
+		}
+		if err := h.series(w, "_bucket", key, float64(values.count), "le", "+Inf"); err != nil {
+			return err
+		}
+		if err := h.series(w, "_sum", key, values.sum); err != nil {
+			return err
+		}
+		if err := h.series(w, "_count", key, float64(values.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sample is one series of a gauge: its label values and its value.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// gaugeFunc is a gauge whose series are collected when it is written.
+type gaugeFunc struct {
+	desc
+	collect func() ([]Sample, error)
+}
+
+// GaugeFunc adds a gauge to the registry whose series collect returns at
+// every scrape.
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func() ([]Sample, error)) {
+	r.add(&gaugeFunc{desc: desc{name, help, labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	samples, err := g.collect()
+	if err != nil {
+		return fmt.Errorf("%s: %w", g.name, err)
+	}
+	series := map[string]float64{}
+	for _, sample := range samples {
+		series[g.key(sample.LabelValues)] = sample.Value
+	}
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(series) {
+		if err := g.series(w, "", key, series[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
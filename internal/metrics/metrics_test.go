@@ -0,0 +1,74 @@
+package metrics_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.Counter("requests_total", "Requests handled.", "route", "status")
+	latency := registry.Histogram("request_duration_seconds", "How long requests took.", []float64{0.1, 1}, "route")
+	registry.GaugeFunc("wallets", "Wallets by currency.", []string{"currency"}, func() ([]metrics.Sample, error) {
+		return []metrics.Sample{
+			{LabelValues: []string{"GBP"}, Value: 1},
+			{LabelValues: []string{"EUR"}, Value: 2},
+		}, nil
+	})
+
+	requests.Inc("/v1/user", "200")
+	requests.Add(2, "/v1/user", "200")
+	requests.Inc(`/a"b\c`, "404")
+	latency.Observe(0.05, "/v1/user")
+	latency.Observe(0.5, "/v1/user")
+	latency.Observe(3, "/v1/user")
+	require.Equal(t, float64(3), requests.Value("/v1/user", "200"))
+	require.Equal(t, uint64(3), latency.Count("/v1/user"))
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+	require.Equal(t, strings.Join([]string{
+		"# HELP requests_total Requests handled.",
+		"# TYPE requests_total counter",
+		`requests_total{route="/a\"b\\c",status="404"} 1`,
+		`requests_total{route="/v1/user",status="200"} 3`,
+		"# HELP request_duration_seconds How long requests took.",
+		"# TYPE request_duration_seconds histogram",
+		`request_duration_seconds_bucket{route="/v1/user",le="0.1"} 1`,
+		`request_duration_seconds_bucket{route="/v1/user",le="1"} 2`,
+		`request_duration_seconds_bucket{route="/v1/user",le="+Inf"} 3`,
+		`request_duration_seconds_sum{route="/v1/user"} 3.55`,
+		`request_duration_seconds_count{route="/v1/user"} 3`,
+		"# HELP wallets Wallets by currency.",
+		"# TYPE wallets gauge",
+		`wallets{currency="EUR"} 2`,
+		`wallets{currency="GBP"} 1`,
+	}, "\n")+"\n", w.Body.String())
+}
+
+func TestRegistry_ServeHTTP_CollectFails(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("requests_total", "Requests handled.").Inc()
+	registry.GaugeFunc("users", "Users.", nil, func() ([]metrics.Sample, error) {
+		return nil, errors.New("store unavailable")
+	})
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.NotContains(t, w.Body.String(), "requests_total", "a failed scrape sends nothing")
+}
+
+func TestCounter_WrongLabels(t *testing.T) {
+	counter := metrics.NewRegistry().Counter("requests_total", "Requests handled.", "route")
+	require.Panics(t, func() { counter.Inc() })
+	require.Panics(t, func() { counter.Add(-1, "/v1/user") })
+}
@@ -0,0 +1,327 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount held as an integer number of minor units.
+// Units of 10025 with a Scale of 2 represent 100.25.
+type Money struct {
+	Units    int64
+	Scale    int
+	Currency string
+}
+
+const (
+	DefaultCurrency = "EUR"
+	maxScale        = 18
+)
+
+var (
+	ErrInvalidAmount    = errors.New("invalid amount")
+	ErrTooManyDecimals  = errors.New("amount has more decimal places than the currency allows")
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrOverflow         = errors.New("amount out of range")
+)
+
+// currencies maps ISO 4217 codes to the number of minor unit digits they use.
+var currencies = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HUF": 2,
+	"JPY": 0,
+	"KWD": 3,
+	"NOK": 2,
+	"NZD": 2,
+	"PLN": 2,
+	"RON": 2,
+	"SEK": 2,
+	"USD": 2,
+}
+
+func ScaleOf(currency string) (int, error) {
+	scale, found := currencies[currency]
+	if !found {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return scale, nil
+}
+
+// ParseCurrency reads an ISO 4217 code, in either case, and checks it is one
+// of the supported currencies.
+func ParseCurrency(code string) (string, error) {
+	currency := strings.ToUpper(strings.TrimSpace(code))
+	if _, err := ScaleOf(currency); err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+func Zero(currency string) (Money, error) {
+	return New(0, currency)
+}
+
+func New(units int64, currency string) (Money, error) {
+	scale, err := ScaleOf(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Units: units, Scale: scale, Currency: currency}, nil
+}
+
+// Parse reads a plain decimal string such as "100.25" or "-3" into an amount
+// without a currency. Exponents are accepted so that any JSON number can be read.
+func Parse(s string) (Money, error) {
+	if s == "" {
+		return Money{}, ErrInvalidAmount
+	}
+	mantissa, exponent := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+		mantissa, exponent = s[:i], exp
+	}
+	negative := false
+	switch {
+	case strings.HasPrefix(mantissa, "-"):
+		negative, mantissa = true, mantissa[1:]
+	case strings.HasPrefix(mantissa, "+"):
+		mantissa = mantissa[1:]
+	}
+	whole, fraction := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		whole, fraction = mantissa[:i], mantissa[i+1:]
+	}
+	if whole == "" && fraction == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	digits := whole + fraction
+	scale := len(fraction) - exponent
+	if scale < -maxScale {
+		return Money{}, fmt.Errorf("%w: %q", ErrOverflow, s)
+	}
+	for scale < 0 {
+		digits += "0"
+		scale++
+	}
+	// Trailing zeros after the decimal point carry no value, so drop them
+	// before checking the scale against a currency.
+	for scale > 0 && strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		scale--
+	}
+	if scale > maxScale {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		return Money{}, nil
+	}
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrOverflow, s)
+	}
+	if negative {
+		units = -units
+	}
+	return Money{Units: units, Scale: scale}, nil
+}
+
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// WithCurrency tags an amount with the currency it was requested in. An empty
+// code leaves the amount as it is.
+func (m Money) WithCurrency(code string) (Money, error) {
+	if code == "" {
+		return m, nil
+	}
+	currency, err := ParseCurrency(code)
+	if err != nil {
+		return Money{}, err
+	}
+	if m.Currency != "" && m.Currency != currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, currency)
+	}
+	m.Currency = currency
+	return m, nil
+}
+
+// In returns the amount expressed in the minor units of the given currency,
+// failing if that would lose precision.
+func (m Money) In(currency string) (Money, error) {
+	if m.Currency != "" && m.Currency != currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, currency)
+	}
+	scale, err := ScaleOf(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if m.Scale > scale {
+		return Money{}, fmt.Errorf("%w: %s allows %d", ErrTooManyDecimals, currency, scale)
+	}
+	units, err := rescale(m.Units, m.Scale, scale)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Units: units, Scale: scale, Currency: currency}, nil
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	a, b, err := align(m, o)
+	if err != nil {
+		return Money{}, err
+	}
+	sum := a.Units + b.Units
+	if (b.Units > 0 && sum < a.Units) || (b.Units < 0 && sum > a.Units) {
+		return Money{}, ErrOverflow
+	}
+	a.Units = sum
+	return a, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Units == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+	o.Units = -o.Units
+	return m.Add(o)
+}
+
+// Cmp returns -1, 0 or +1 depending on whether m is less than, equal to or
+// greater than o. Amounts in different currencies cannot be compared.
+func (m Money) Cmp(o Money) (int, error) {
+	a, b, err := align(m, o)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case a.Units < b.Units:
+		return -1, nil
+	case a.Units > b.Units:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Units < 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Units > 0
+}
+
+func (m Money) String() string {
+	units := m.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absUint(units), 10)
+	if m.Scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= m.Scale {
+		digits = strings.Repeat("0", m.Scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-m.Scale] + "." + digits[len(digits)-m.Scale:]
+}
+
+// MarshalJSON writes the amount as a decimal string so that clients never
+// have to round-trip it through a float.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts both JSON strings ("100.25") and numbers (100.25).
+// The result carries no currency; callers convert it with In.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	raw := string(data)
+	if strings.HasPrefix(raw, `"`) {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		raw = strings.TrimSpace(raw)
+	}
+	parsed, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func align(a, b Money) (Money, Money, error) {
+	if a.Currency != "" && b.Currency != "" && a.Currency != b.Currency {
+		return Money{}, Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.Currency, b.Currency)
+	}
+	if a.Currency == "" {
+		a.Currency = b.Currency
+	}
+	b.Currency = a.Currency
+	var err error
+	switch {
+	case a.Scale < b.Scale:
+		a.Units, err = rescale(a.Units, a.Scale, b.Scale)
+		a.Scale = b.Scale
+	case b.Scale < a.Scale:
+		b.Units, err = rescale(b.Units, b.Scale, a.Scale)
+		b.Scale = a.Scale
+	}
+	return a, b, err
+}
+
+func rescale(units int64, from, to int) (int64, error) {
+	for ; from < to; from++ {
+		if units > math.MaxInt64/10 || units < math.MinInt64/10 {
+			return 0, ErrOverflow
+		}
+		units *= 10
+	}
+	return units, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func absUint(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
@@ -0,0 +1,252 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoney_Parse(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+
+		want    Money
+		wantErr bool
+	}{
+		"parses a whole number": {
+			input: "100",
+			want:  Money{Units: 100},
+		},
+		"parses a decimal": {
+			input: "100.25",
+			want:  Money{Units: 10025, Scale: 2},
+		},
+		"drops trailing zeros": {
+			input: "100.2500",
+			want:  Money{Units: 10025, Scale: 2},
+		},
+		"parses a negative decimal": {
+			input: "-0.5",
+			want:  Money{Units: -5, Scale: 1},
+		},
+		"parses an exponent": {
+			input: "1.5e2",
+			want:  Money{Units: 150},
+		},
+		"fails on garbage": {
+			input:   "ten",
+			wantErr: true,
+		},
+		"fails on an empty string": {
+			input:   "",
+			wantErr: true,
+		},
+		"fails on overflow": {
+			input:   "99999999999999999999",
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := Parse(test.input)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMoney_In(t *testing.T) {
+	for name, test := range map[string]struct {
+		amount   Money
+		currency string
+
+		want    Money
+		wantErr error
+	}{
+		"scales up to the currency": {
+			amount:   MustParse("100.5"),
+			currency: "EUR",
+			want:     Money{Units: 10050, Scale: 2, Currency: "EUR"},
+		},
+		"keeps zero decimal currencies whole": {
+			amount:   MustParse("100"),
+			currency: "JPY",
+			want:     Money{Units: 100, Currency: "JPY"},
+		},
+		"rejects too many decimals": {
+			amount:   MustParse("100.255"),
+			currency: "EUR",
+			wantErr:  ErrTooManyDecimals,
+		},
+		"rejects decimals on zero decimal currencies": {
+			amount:   MustParse("1.5"),
+			currency: "JPY",
+			wantErr:  ErrTooManyDecimals,
+		},
+		"rejects unknown currencies": {
+			amount:   MustParse("1"),
+			currency: "XXX",
+			wantErr:  ErrUnknownCurrency,
+		},
+		"rejects a different currency": {
+			amount:   Money{Units: 100, Scale: 2, Currency: "GBP"},
+			currency: "EUR",
+			wantErr:  ErrCurrencyMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := test.amount.In(test.currency)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMoney_WithCurrency(t *testing.T) {
+	for name, test := range map[string]struct {
+		amount   Money
+		currency string
+
+		want    Money
+		wantErr error
+	}{
+		"tags a unitless amount": {
+			amount:   MustParse("10.5"),
+			currency: "usd",
+			want:     Money{Units: 105, Scale: 1, Currency: "USD"},
+		},
+		"leaves the amount alone without a currency": {
+			amount: MustParse("10.5"),
+			want:   MustParse("10.5"),
+		},
+		"accepts the amount's own currency": {
+			amount:   Money{Units: 100, Scale: 2, Currency: "GBP"},
+			currency: "GBP",
+			want:     Money{Units: 100, Scale: 2, Currency: "GBP"},
+		},
+		"rejects unknown currencies": {
+			amount:   MustParse("1"),
+			currency: "EURO",
+			wantErr:  ErrUnknownCurrency,
+		},
+		"rejects a different currency": {
+			amount:   Money{Units: 100, Scale: 2, Currency: "GBP"},
+			currency: "EUR",
+			wantErr:  ErrCurrencyMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := test.amount.WithCurrency(test.currency)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	balance, err := MustParse("100.25").In("EUR")
+	require.NoError(t, err)
+	for _, withdrawal := range []string{"0.1", "0.2", "33.33", "66.62"} {
+		balance, err = balance.Sub(MustParse(withdrawal))
+		require.NoError(t, err)
+	}
+	require.True(t, balance.IsZero())
+	require.Equal(t, "0.00", balance.String())
+
+	balance, err = balance.Add(MustParse("0.3"))
+	require.NoError(t, err)
+	cmp, err := balance.Cmp(MustParse("0.30"))
+	require.NoError(t, err)
+	require.Equal(t, 0, cmp)
+
+	_, err = balance.Add(Money{Units: 1, Currency: "GBP"})
+	require.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	_, err = Money{Units: 1 << 62}.Add(Money{Units: 1 << 62})
+	require.ErrorIs(t, err, ErrOverflow)
+}
+
+func TestMoney_String(t *testing.T) {
+	for name, test := range map[string]struct {
+		amount Money
+		want   string
+	}{
+		"formats minor units": {
+			amount: Money{Units: 10025, Scale: 2},
+			want:   "100.25",
+		},
+		"pads small amounts": {
+			amount: Money{Units: 5, Scale: 2},
+			want:   "0.05",
+		},
+		"formats negatives": {
+			amount: Money{Units: -5, Scale: 3},
+			want:   "-0.005",
+		},
+		"formats whole amounts": {
+			amount: Money{Units: 42},
+			want:   "42",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, test.amount.String())
+		})
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	for name, test := range map[string]struct {
+		input string
+
+		want    Money
+		wantErr bool
+	}{
+		"reads a number": {
+			input: `{"Amount": 100.25}`,
+			want:  Money{Units: 10025, Scale: 2},
+		},
+		"reads a string": {
+			input: `{"Amount": "100.25"}`,
+			want:  Money{Units: 10025, Scale: 2},
+		},
+		"rejects more precision than it can hold": {
+			input:   `{"Amount": 0.1000000000000000055511151231257827}`,
+			wantErr: true,
+		},
+		"fails on a bad string": {
+			input:   `{"Amount": "abc"}`,
+			wantErr: true,
+		},
+		"fails on a boolean": {
+			input:   `{"Amount": true}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got struct{ Amount Money }
+			err := json.Unmarshal([]byte(test.input), &got)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got.Amount)
+
+			encoded, err := json.Marshal(got)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"Amount": "100.25"}`, string(encoded))
+		})
+	}
+}
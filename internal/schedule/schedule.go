@@ -0,0 +1,204 @@
+// Package schedule keeps standing orders: payments a user asks to be made on
+// a future date, or again and again on a recurring one, and the history of
+// every attempt to make them.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// How often a schedule pays. Once pays on StartAt only; the others pay on
+// StartAt and then every day, week or month after it. A monthly schedule
+// starting on a day some months do not have pays on their last day instead.
+const (
+	Once    = "once"
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// The states of a schedule. Only active schedules run. A schedule is
+// completed once it has no dates left, and cancelled schedules stay that way.
+const (
+	StatusActive    = "active"
+	StatusPaused    = "paused"
+	StatusCancelled = "cancelled"
+	StatusCompleted = "completed"
+)
+
+// The outcomes of a run. A run that failed for lack of funds is retrying
+// while the retry policy allows another attempt at the same date.
+const (
+	RunSucceeded = "succeeded"
+	RunRetrying  = "retrying"
+	RunFailed    = "failed"
+)
+
+const idSize = 16
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+	// ErrInvalidStatus is returned for changes the schedule's status does
+	// not allow, such as resuming an active schedule.
+	ErrInvalidStatus = errors.New("schedule cannot make that change")
+)
+
+// Schedule pays Amount, in the currency of wallet WalletId, into Creditor on
+// each of its dates.
+type Schedule struct {
+	Id        string      `json:"Id"`
+	UserId    string      `json:"-"`
+	WalletId  string      `json:"WalletId"`
+	Creditor  string      `json:"Creditor"`
+	Amount    money.Money `json:"Amount"`
+	Frequency string      `json:"Frequency"`
+	StartAt   time.Time   `json:"StartAt"`
+	EndAt     *time.Time  `json:"EndAt,omitempty"`
+	Status    string      `json:"Status"`
+	// NextRunAt is when an active schedule runs next: its next date, or a
+	// retry of the date before.
+	NextRunAt *time.Time `json:"NextRunAt,omitempty"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	// Due counts the dates that have passed, so it is the index of the date
+	// being paid, and Attempts the failed attempts at paying it.
+	Due      int `json:"-"`
+	Attempts int `json:"-"`
+}
+
+// Run is one attempt at paying one of a schedule's dates.
+type Run struct {
+	Id            string    `json:"Id"`
+	ScheduleId    string    `json:"ScheduleId"`
+	DueAt         time.Time `json:"DueAt"`
+	Attempt       int       `json:"Attempt"`
+	Status        string    `json:"Status"`
+	TransactionId string    `json:"TransactionId,omitempty"`
+	Error         string    `json:"Error,omitempty"`
+	RanAt         time.Time `json:"RanAt"`
+}
+
+// Request creates a schedule. The currency works as it does for a
+// wallet.PaymentRequest.
+type Request struct {
+	TargetWallet string      `json:"Creditor"`
+	Amount       money.Money `json:"Amount"`
+	Currency     string      `json:"Currency,omitempty"`
+	Frequency    string      `json:"Frequency"`
+	StartAt      time.Time   `json:"StartAt"`
+	EndAt        *time.Time  `json:"EndAt,omitempty"`
+}
+
+// Store persists schedules and their runs.
+type Store interface {
+	GetWallet(id string) (*wallet.Wallet, error)
+	CreateSchedule(s *Schedule) error
+	// GetSchedule returns ErrScheduleNotFound for unknown schedules.
+	GetSchedule(id string) (*Schedule, error)
+	// ListSchedules returns the schedules paying out of a wallet, oldest
+	// first.
+	ListSchedules(walletId string) ([]*Schedule, error)
+	// UpdateSchedule loads a schedule, applies update to it and saves the
+	// result in one step, saving nothing if update fails.
+	UpdateSchedule(id string, update func(s *Schedule) error) error
+	// DueSchedules returns the active schedules whose NextRunAt is at or
+	// before the given time, earliest first.
+	DueSchedules(at time.Time) ([]*Schedule, error)
+	CreateRun(run *Run) error
+	// ListRuns returns a schedule's runs, oldest first.
+	ListRuns(scheduleId string) ([]*Run, error)
+}
+
+func validFrequency(frequency string) bool {
+	switch frequency {
+	case Once, Daily, Weekly, Monthly:
+		return true
+	}
+	return false
+}
+
+// date returns the schedule's nth date, counting StartAt as the first, and
+// whether it has one.
+func (s *Schedule) date(n int) (time.Time, bool) {
+	var date time.Time
+	switch s.Frequency {
+	case Once:
+		if n > 0 {
+			return time.Time{}, false
+		}
+		date = s.StartAt
+	case Daily:
+		date = s.StartAt.AddDate(0, 0, n)
+	case Weekly:
+		date = s.StartAt.AddDate(0, 0, 7*n)
+	case Monthly:
+		// Go normalises 31 April to 1 May, so pick the day within the month
+		// by hand.
+		year, month, day := s.StartAt.Date()
+		first := time.Date(year, month+time.Month(n), 1, s.StartAt.Hour(), s.StartAt.Minute(),
+			s.StartAt.Second(), s.StartAt.Nanosecond(), s.StartAt.Location())
+		if last := first.AddDate(0, 1, -1).Day(); day > last {
+			day = last
+		}
+		date = first.AddDate(0, 0, day-1)
+	default:
+		return time.Time{}, false
+	}
+	if s.EndAt != nil && date.After(*s.EndAt) {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// advance moves the schedule past the date it has just paid, or given up
+// on, and past any other date already gone by at now, which are skipped
+// rather than paid late. A schedule with no dates left is completed.
+func (s *Schedule) advance(now time.Time) {
+	s.Attempts = 0
+	for {
+		s.Due++
+		next, ok := s.date(s.Due)
+		if !ok {
+			s.Status, s.NextRunAt = StatusCompleted, nil
+			return
+		}
+		if next.After(now) {
+			s.NextRunAt = &next
+			return
+		}
+	}
+}
+
+// Occurrence identifies the date the schedule is paying. It stays the same
+// across retries of that date, so a payment can be made once per date.
+func (s *Schedule) Occurrence() string {
+	return s.Id + ":" + strconv.Itoa(s.Due)
+}
+
+// dueAt is the date the schedule is paying.
+func (s *Schedule) dueAt() time.Time {
+	date, _ := s.date(s.Due)
+	return date
+}
+
+func (r Request) validate(now time.Time) error {
+	switch {
+	case !validFrequency(r.Frequency):
+		return fmt.Errorf("%w: frequency must be %q, %q, %q or %q", ErrInvalidSchedule, Once, Daily, Weekly, Monthly)
+	case r.StartAt.IsZero():
+		return fmt.Errorf("%w: StartAt is required", ErrInvalidSchedule)
+	case !r.StartAt.After(now):
+		return fmt.Errorf("%w: StartAt must be in the future", ErrInvalidSchedule)
+	case r.EndAt != nil && r.EndAt.Before(r.StartAt):
+		return fmt.Errorf("%w: EndAt must not be before StartAt", ErrInvalidSchedule)
+	case r.TargetWallet == "":
+		return fmt.Errorf("%w: Creditor is required", ErrInvalidSchedule)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// RetryPolicy decides how a date whose payment failed for lack of funds is
+// retried: up to MaxRetries more times, Interval apart. Payments failing for
+// any other reason are not retried.
+type RetryPolicy struct {
+	MaxRetries int
+	Interval   time.Duration
+}
+
+// DefaultRetryPolicy retries a payment three times, an hour apart.
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, Interval: time.Hour}
+
+// PayFunc makes one of a schedule's payments on behalf of its user. It is
+// called again for the same Occurrence when the run that paid it could not
+// be recorded, and must not pay it twice.
+type PayFunc func(s *Schedule) (wallet.Payment, error)
+
+// Scheduler creates and changes schedules, and runs the ones that are due.
+// Only one Scheduler should run a Store's schedules at a time.
+type Scheduler struct {
+	store Store
+	pay   PayFunc
+	now   func() time.Time
+	retry RetryPolicy
+
+	// mu serialises runs with changes to schedules, so a schedule cannot be
+	// paused or cancelled halfway through a run.
+	mu sync.Mutex
+}
+
+// Option configures optional parts of a Scheduler.
+type Option func(*Scheduler)
+
+// WithClock makes the scheduler tell the time with now rather than the
+// system clock.
+func WithClock(now func() time.Time) Option {
+	return func(s *Scheduler) {
+		s.now = now
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(s *Scheduler) {
+		s.retry = policy
+	}
+}
+
+func NewScheduler(store Store, pay PayFunc, options ...Option) *Scheduler {
+	s := &Scheduler{store: store, pay: pay, now: time.Now, retry: DefaultRetryPolicy}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Create schedules payments out of one of the user's wallets.
+func (s *Scheduler) Create(userId, walletId string, request Request) (*Schedule, error) {
+	now := s.now().UTC()
+	if err := request.validate(now); err != nil {
+		return nil, err
+	}
+	source, err := s.store.GetWallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	if source.UserId != userId {
+		return nil, fmt.Errorf("%w: wallet %s", user.ErrUnauthorized, walletId)
+	}
+	if request.TargetWallet == walletId {
+		return nil, wallet.ErrSameWallet
+	}
+	if _, err := s.store.GetWallet(request.TargetWallet); err != nil {
+		return nil, err
+	}
+	amount, err := request.Amount.WithCurrency(request.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if amount, err = amount.In(source.Currency()); err != nil {
+		return nil, fmt.Errorf("%w: %w", wallet.ErrInvalidAmount, err)
+	}
+	if !amount.IsPositive() {
+		return nil, fmt.Errorf("%w: amount must be positive", wallet.ErrInvalidAmount)
+	}
+	startAt := request.StartAt.UTC()
+	schedule := &Schedule{
+		Id:        manager.GenerateId(idSize),
+		UserId:    userId,
+		WalletId:  walletId,
+		Creditor:  request.TargetWallet,
+		Amount:    amount,
+		Frequency: request.Frequency,
+		StartAt:   startAt,
+		Status:    StatusActive,
+		NextRunAt: &startAt,
+		CreatedAt: now,
+	}
+	if request.EndAt != nil {
+		endAt := request.EndAt.UTC()
+		schedule.EndAt = &endAt
+	}
+	if err := s.store.CreateSchedule(schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// Get returns one of the schedules paying out of one of the user's wallets.
+func (s *Scheduler) Get(userId, walletId, id string) (*Schedule, error) {
+	schedule, err := s.store.GetSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.UserId != userId || schedule.WalletId != walletId {
+		return nil, fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	return schedule, nil
+}
+
+// List returns the schedules paying out of one of the user's wallets, oldest
+// first.
+func (s *Scheduler) List(userId, walletId string) ([]*Schedule, error) {
+	source, err := s.store.GetWallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	if source.UserId != userId {
+		return nil, fmt.Errorf("%w: wallet %s", user.ErrUnauthorized, walletId)
+	}
+	return s.store.ListSchedules(walletId)
+}
+
+// Runs returns every attempt at paying one of the user's schedules, oldest
+// first.
+func (s *Scheduler) Runs(userId, walletId, id string) ([]*Run, error) {
+	if _, err := s.Get(userId, walletId, id); err != nil {
+		return nil, err
+	}
+	return s.store.ListRuns(id)
+}
+
+// Pause stops an active schedule from running until it is resumed.
+func (s *Scheduler) Pause(userId, walletId, id string) (*Schedule, error) {
+	return s.change(userId, walletId, id, func(schedule *Schedule, now time.Time) error {
+		if schedule.Status != StatusActive {
+			return fmt.Errorf("%w: %s is %s", ErrInvalidStatus, id, schedule.Status)
+		}
+		schedule.Status, schedule.NextRunAt = StatusPaused, nil
+		return nil
+	})
+}
+
+// Resume restarts a paused schedule from its next date. Dates that passed
+// while it was paused are skipped.
+func (s *Scheduler) Resume(userId, walletId, id string) (*Schedule, error) {
+	return s.change(userId, walletId, id, func(schedule *Schedule, now time.Time) error {
+		if schedule.Status != StatusPaused {
+			return fmt.Errorf("%w: %s is %s", ErrInvalidStatus, id, schedule.Status)
+		}
+		schedule.Status = StatusActive
+		if due := schedule.dueAt(); due.After(now) {
+			schedule.Attempts, schedule.NextRunAt = 0, &due
+			return nil
+		}
+		schedule.advance(now)
+		return nil
+	})
+}
+
+// Cancel stops a schedule for good.
+func (s *Scheduler) Cancel(userId, walletId, id string) (*Schedule, error) {
+	return s.change(userId, walletId, id, func(schedule *Schedule, now time.Time) error {
+		if schedule.Status != StatusActive && schedule.Status != StatusPaused {
+			return fmt.Errorf("%w: %s is %s", ErrInvalidStatus, id, schedule.Status)
+		}
+		schedule.Status, schedule.NextRunAt = StatusCancelled, nil
+		return nil
+	})
+}
+
+func (s *Scheduler) change(userId, walletId, id string, update func(schedule *Schedule, now time.Time) error) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.Get(userId, walletId, id); err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	var changed Schedule
+	err := s.store.UpdateSchedule(id, func(schedule *Schedule) error {
+		if err := update(schedule, now); err != nil {
+			return err
+		}
+		changed = *schedule
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &changed, nil
+}
+
+// RunDue makes the payment of every schedule that is due, and returns how
+// many it ran.
+func (s *Scheduler) RunDue() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	due, err := s.store.DueSchedules(now)
+	if err != nil {
+		return 0, err
+	}
+	for i, schedule := range due {
+		if err := s.run(schedule, now); err != nil {
+			return i, err
+		}
+	}
+	return len(due), nil
+}
+
+// Run calls RunDue every interval until ctx is done. Failures are logged
+// and retried on the next tick.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RunDue(); err != nil {
+			slog.Error("running scheduled payments", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run pays one due schedule, records the attempt and moves the schedule on
+// to its next run.
+func (s *Scheduler) run(schedule *Schedule, now time.Time) error {
+	payment, payErr := s.pay(schedule)
+	run := &Run{
+		Id:         manager.GenerateId(idSize),
+		ScheduleId: schedule.Id,
+		DueAt:      schedule.dueAt(),
+		Attempt:    schedule.Attempts + 1,
+		Status:     RunSucceeded,
+		RanAt:      now,
+	}
+	retry := false
+	switch {
+	case payErr == nil:
+		run.TransactionId = payment.TransactionId
+	case errors.Is(payErr, wallet.ErrInsufficientFunds) && schedule.Attempts < s.retry.MaxRetries:
+		run.Status, run.Error, retry = RunRetrying, payErr.Error(), true
+	default:
+		run.Status, run.Error = RunFailed, payErr.Error()
+	}
+	if err := s.store.CreateRun(run); err != nil {
+		return err
+	}
+	return s.store.UpdateSchedule(schedule.Id, func(current *Schedule) error {
+		if !retry {
+			current.advance(now)
+			return nil
+		}
+		current.Attempts++
+		retryAt := now.Add(s.retry.Interval)
+		current.NextRunAt = &retryAt
+		return nil
+	})
+}
@@ -0,0 +1,368 @@
+package schedule_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func eur(amount string) money.Money {
+	m, err := money.MustParse(amount).In("EUR")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// clock is a time that only moves when a test moves it.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+// start is when every test begins: the last day of January.
+var start = time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)
+
+type fixture struct {
+	store     *memory.Store
+	clock     *clock
+	scheduler *schedule.Scheduler
+	payer     *wallet.Wallet
+	payee     *wallet.Wallet
+}
+
+// newFixture makes a scheduler paying from user1's wallet, holding balance,
+// by calling the wallet directly.
+func newFixture(t *testing.T, balance string, options ...schedule.Option) *fixture {
+	t.Helper()
+	store := memory.New()
+	f := &fixture{store: store, clock: &clock{now: start}}
+	var err error
+	f.payer, err = wallet.New(context.Background(), store, "user1", "EUR", "")
+	require.NoError(t, err)
+	if balance != "0" {
+		_, err = f.payer.Deposit(context.Background(), money.MustParse(balance))
+		require.NoError(t, err)
+	}
+	f.payee, err = wallet.New(context.Background(), store, "user2", "EUR", "")
+	require.NoError(t, err)
+	pay := func(s *schedule.Schedule) (wallet.Payment, error) {
+		payer, err := wallet.Get(store, s.WalletId)
+		if err != nil {
+			return wallet.Payment{}, err
+		}
+		return payer.InitiatePayment(context.Background(), s.Creditor, s.Amount, nil)
+	}
+	options = append([]schedule.Option{schedule.WithClock(f.clock.Now)}, options...)
+	f.scheduler = schedule.NewScheduler(store, pay, options...)
+	return f
+}
+
+func (f *fixture) create(t *testing.T, frequency, amount string, startAt time.Time, endAt *time.Time) *schedule.Schedule {
+	t.Helper()
+	created, err := f.scheduler.Create("user1", f.payer.Id, schedule.Request{
+		TargetWallet: f.payee.Id,
+		Amount:       money.MustParse(amount),
+		Frequency:    frequency,
+		StartAt:      startAt,
+		EndAt:        endAt,
+	})
+	require.NoError(t, err)
+	return created
+}
+
+// runAt moves the clock to at and runs whatever is due.
+func (f *fixture) runAt(t *testing.T, at time.Time) int {
+	t.Helper()
+	f.clock.now = at
+	ran, err := f.scheduler.RunDue()
+	require.NoError(t, err)
+	return ran
+}
+
+func (f *fixture) balance(t *testing.T, w *wallet.Wallet) money.Money {
+	t.Helper()
+	got, err := wallet.Get(f.store, w.Id)
+	require.NoError(t, err)
+	return got.Balance
+}
+
+func TestScheduler_Create(t *testing.T) {
+	hour := start.Add(time.Hour)
+	before := start.Add(-time.Hour)
+	never := time.Time{}
+	for name, test := range map[string]struct {
+		userId    string
+		creditor  string
+		amount    string
+		currency  string
+		frequency string
+		startAt   *time.Time
+		endAt     *time.Time
+
+		wantErr error
+	}{
+		"schedules a payment": {},
+		"schedules a payment in the wallet's currency": {
+			currency: "EUR",
+		},
+		"unknown frequency": {
+			frequency: "yearly",
+			wantErr:   schedule.ErrInvalidSchedule,
+		},
+		"no start": {
+			startAt: &never,
+			wantErr: schedule.ErrInvalidSchedule,
+		},
+		"starts in the past": {
+			startAt: &before,
+			wantErr: schedule.ErrInvalidSchedule,
+		},
+		"ends before it starts": {
+			endAt:   &start,
+			wantErr: schedule.ErrInvalidSchedule,
+		},
+		"no creditor": {
+			creditor: "-",
+			wantErr:  schedule.ErrInvalidSchedule,
+		},
+		"unknown creditor": {
+			creditor: "missing",
+			wantErr:  wallet.ErrWalletNotFound,
+		},
+		"pays itself": {
+			creditor: "self",
+			wantErr:  wallet.ErrSameWallet,
+		},
+		"someone else's wallet": {
+			userId:  "user2",
+			wantErr: user.ErrUnauthorized,
+		},
+		"nothing to pay": {
+			amount:  "0",
+			wantErr: wallet.ErrInvalidAmount,
+		},
+		"another currency": {
+			currency: "USD",
+			wantErr:  money.ErrCurrencyMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t, "100")
+			request := schedule.Request{
+				TargetWallet: f.payee.Id,
+				Amount:       money.MustParse("10"),
+				Currency:     test.currency,
+				Frequency:    schedule.Monthly,
+				StartAt:      hour,
+				EndAt:        test.endAt,
+			}
+			switch test.creditor {
+			case "":
+			case "-":
+				request.TargetWallet = ""
+			case "self":
+				request.TargetWallet = f.payer.Id
+			default:
+				request.TargetWallet = test.creditor
+			}
+			if test.amount != "" {
+				request.Amount = money.MustParse(test.amount)
+			}
+			if test.frequency != "" {
+				request.Frequency = test.frequency
+			}
+			if test.startAt != nil {
+				request.StartAt = *test.startAt
+			}
+			userId := "user1"
+			if test.userId != "" {
+				userId = test.userId
+			}
+
+			created, err := f.scheduler.Create(userId, f.payer.Id, request)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, schedule.StatusActive, created.Status)
+			require.Equal(t, eur("10"), created.Amount)
+			require.Equal(t, hour, *created.NextRunAt)
+
+			got, err := f.scheduler.Get("user1", f.payer.Id, created.Id)
+			require.NoError(t, err)
+			require.Equal(t, created, got)
+		})
+	}
+}
+
+func TestScheduler_RunsMonthly(t *testing.T) {
+	f := newFixture(t, "100")
+	end := time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC)
+	created := f.create(t, schedule.Monthly, "20", start.Add(time.Minute), &end)
+
+	require.Zero(t, f.runAt(t, start), "nothing is due before the first date")
+	require.Equal(t, 1, f.runAt(t, start.Add(time.Minute)))
+	require.Zero(t, f.runAt(t, start.Add(2*time.Minute)), "a date is paid once")
+
+	// January 31st falls on the last day of shorter months.
+	got, err := f.scheduler.Get("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 2, 29, 9, 1, 0, 0, time.UTC), *got.NextRunAt)
+	require.Equal(t, 1, f.runAt(t, *got.NextRunAt))
+	got, err = f.scheduler.Get("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 3, 31, 9, 1, 0, 0, time.UTC), *got.NextRunAt)
+	require.Equal(t, 1, f.runAt(t, *got.NextRunAt))
+
+	// The April date, the 30th at 09:01, is after the end.
+	got, err = f.scheduler.Get("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, schedule.StatusCompleted, got.Status)
+	require.Nil(t, got.NextRunAt)
+	require.Zero(t, f.runAt(t, end.AddDate(1, 0, 0)))
+
+	require.Equal(t, eur("40"), f.balance(t, f.payer))
+	require.Equal(t, eur("60"), f.balance(t, f.payee))
+	runs, err := f.scheduler.Runs("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Len(t, runs, 3)
+	for _, run := range runs {
+		require.Equal(t, schedule.RunSucceeded, run.Status)
+		require.Equal(t, 1, run.Attempt)
+		require.NotEmpty(t, run.TransactionId)
+	}
+	require.Equal(t, time.Date(2024, 2, 29, 9, 1, 0, 0, time.UTC), runs[1].DueAt)
+}
+
+func TestScheduler_RunsOnce(t *testing.T) {
+	f := newFixture(t, "100")
+	created := f.create(t, schedule.Once, "25", start.Add(time.Hour), nil)
+
+	// A run that comes late still pays, just the once.
+	require.Equal(t, 1, f.runAt(t, start.Add(48*time.Hour)))
+	require.Zero(t, f.runAt(t, start.Add(72*time.Hour)))
+	got, err := f.scheduler.Get("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, schedule.StatusCompleted, got.Status)
+	require.Equal(t, eur("75"), f.balance(t, f.payer))
+}
+
+func TestScheduler_RetriesInsufficientFunds(t *testing.T) {
+	for name, test := range map[string]struct {
+		topUpAfter int
+
+		wantStatuses []string
+		wantBalance  string
+	}{
+		"gives up after the retries": {
+			wantStatuses: []string{schedule.RunRetrying, schedule.RunRetrying, schedule.RunFailed},
+			wantBalance:  "10",
+		},
+		"pays once funds arrive": {
+			topUpAfter:   2,
+			wantStatuses: []string{schedule.RunRetrying, schedule.RunRetrying, schedule.RunSucceeded},
+			wantBalance:  "20",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t, "10", schedule.WithRetryPolicy(schedule.RetryPolicy{MaxRetries: 2, Interval: time.Hour}))
+			created := f.create(t, schedule.Daily, "30", start.Add(time.Minute), nil)
+
+			at := start.Add(time.Minute)
+			for i := range test.wantStatuses {
+				if test.topUpAfter != 0 && i == test.topUpAfter {
+					_, err := f.payer.Deposit(context.Background(), money.MustParse("40"))
+					require.NoError(t, err)
+				}
+				require.Equal(t, 1, f.runAt(t, at))
+				require.Zero(t, f.runAt(t, at.Add(time.Hour-time.Second)), "retries wait for the interval")
+				at = at.Add(time.Hour)
+			}
+
+			runs, err := f.scheduler.Runs("user1", f.payer.Id, created.Id)
+			require.NoError(t, err)
+			require.Len(t, runs, len(test.wantStatuses))
+			for i, run := range runs {
+				require.Equal(t, test.wantStatuses[i], run.Status)
+				require.Equal(t, i+1, run.Attempt)
+				require.Equal(t, start.Add(time.Minute), run.DueAt, "retries pay the same date")
+			}
+			require.Contains(t, runs[0].Error, wallet.ErrInsufficientFunds.Error())
+			require.Equal(t, eur(test.wantBalance), f.balance(t, f.payer))
+
+			got, err := f.scheduler.Get("user1", f.payer.Id, created.Id)
+			require.NoError(t, err)
+			require.Equal(t, schedule.StatusActive, got.Status)
+			require.Equal(t, start.Add(24*time.Hour+time.Minute), *got.NextRunAt, "the next date starts afresh")
+		})
+	}
+}
+
+func TestScheduler_PauseResumeCancel(t *testing.T) {
+	f := newFixture(t, "100")
+	created := f.create(t, schedule.Weekly, "10", start.Add(time.Minute), nil)
+	week := 7 * 24 * time.Hour
+
+	paused, err := f.scheduler.Pause("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, schedule.StatusPaused, paused.Status)
+	require.Nil(t, paused.NextRunAt)
+	_, err = f.scheduler.Pause("user1", f.payer.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrInvalidStatus)
+	require.Zero(t, f.runAt(t, start.Add(week)), "paused schedules do not run")
+
+	// Two dates passed while the schedule was paused, and are skipped.
+	f.clock.now = start.Add(week + time.Hour)
+	resumed, err := f.scheduler.Resume("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, schedule.StatusActive, resumed.Status)
+	require.Equal(t, start.Add(2*week+time.Minute), *resumed.NextRunAt)
+	_, err = f.scheduler.Resume("user1", f.payer.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrInvalidStatus)
+	require.Equal(t, 1, f.runAt(t, start.Add(2*week+time.Minute)))
+
+	cancelled, err := f.scheduler.Cancel("user1", f.payer.Id, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, schedule.StatusCancelled, cancelled.Status)
+	_, err = f.scheduler.Cancel("user1", f.payer.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrInvalidStatus)
+	_, err = f.scheduler.Resume("user1", f.payer.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrInvalidStatus)
+	require.Zero(t, f.runAt(t, start.Add(10*week)), "cancelled schedules do not run")
+	require.Equal(t, eur("90"), f.balance(t, f.payer))
+
+	_, err = f.scheduler.Pause("user2", f.payer.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrScheduleNotFound, "schedules belong to their user")
+	_, err = f.scheduler.Get("user1", f.payee.Id, created.Id)
+	require.ErrorIs(t, err, schedule.ErrScheduleNotFound, "and to their wallet")
+	_, err = f.scheduler.Runs("user1", f.payer.Id, "missing")
+	require.ErrorIs(t, err, schedule.ErrScheduleNotFound)
+}
+
+func TestScheduler_List(t *testing.T) {
+	f := newFixture(t, "100")
+	first := f.create(t, schedule.Daily, "1", start.Add(time.Hour), nil)
+	f.clock.now = start.Add(time.Second)
+	second := f.create(t, schedule.Weekly, "2", start.Add(time.Hour), nil)
+
+	listed, err := f.scheduler.List("user1", f.payer.Id)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	require.Equal(t, first.Id, listed[0].Id)
+	require.Equal(t, second.Id, listed[1].Id)
+
+	_, err = f.scheduler.List("user2", f.payer.Id)
+	require.ErrorIs(t, err, user.ErrUnauthorized)
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+)
+
+const (
+	DefaultAdminLimit = 50
+	MaxAdminLimit     = 100
+)
+
+var errAdminOnly = fmt.Errorf("%w: the admin role is required", auth.ErrForbidden)
+
+type operatorContextKey struct{}
+
+// AdminWallet is a wallet as operators see it, including its owner.
+type AdminWallet struct {
+	Id        string      `json:"Id"`
+	UserId    string      `json:"UserId"`
+	Name      string      `json:"Name,omitempty"`
+	Balance   money.Money `json:"Balance"`
+	Available money.Money `json:"Available"`
+	Currency  string      `json:"Currency"`
+	Status    string      `json:"Status"`
+	CreatedAt time.Time   `json:"CreatedAt"`
+	// Limits are the wallet's own limits, overriding its owner's tier.
+	Limits wallet.Limits `json:"Limits,omitempty"`
+}
+
+type AdminUser struct {
+	*user.User
+	Wallets []AdminWallet `json:"Wallets"`
+}
+
+type UserPage struct {
+	Users      []*user.User `json:"Users"`
+	NextCursor string       `json:"NextCursor,omitempty"`
+}
+
+type WalletPage struct {
+	Wallets    []AdminWallet `json:"Wallets"`
+	NextCursor string        `json:"NextCursor,omitempty"`
+}
+
+type Ledger struct {
+	WalletId string         `json:"WalletId"`
+	Balance  money.Money    `json:"Balance"`
+	Entries  []wallet.Entry `json:"Entries"`
+}
+
+// AdjustmentRequest corrects a wallet's balance. A positive Amount credits
+// the wallet and a negative one debits it.
+type AdjustmentRequest struct {
+	Amount   money.Money `json:"Amount"`
+	Currency string      `json:"Currency,omitempty"`
+	Reason   string      `json:"Reason"`
+}
+
+type AdjustmentResponse struct {
+	TransactionId string      `json:"TransactionId"`
+	WalletId      string      `json:"WalletId"`
+	Amount        money.Money `json:"Amount"`
+	Balance       money.Money `json:"Balance"`
+	Currency      string      `json:"Currency"`
+	OperatorId    string      `json:"OperatorId"`
+	Reason        string      `json:"Reason"`
+	Timestamp     time.Time   `json:"Timestamp"`
+}
+
+// RequireAdmin only lets requests through when they carry the API key of an
+// operator, whose ID handlers can then read with operatorFrom.
+func (s *Server) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := auth.FromHeader(r.Header.Get("Authorization"))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", auth.Scheme)
+			writeError(w, r, auth.ErrUnauthenticated)
+			return
+		}
+		key, err := auth.Authenticate(s.store, apiKey)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", auth.Scheme)
+			writeError(w, r, err)
+			return
+		}
+		auditActor(r, key.UserId)
+		operator, err := user.Get(s.store, key.UserId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !operator.IsAdmin() {
+			writeError(w, r, errAdminOnly)
+			return
+		}
+		ctx := logging.With(r.Context(), "operator_id", operator.Id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, operatorContextKey{}, operator.Id)))
+	})
+}
+
+// operatorFrom returns the operator RequireAdmin let through.
+func operatorFrom(ctx context.Context) string {
+	operatorId, _ := ctx.Value(operatorContextKey{}).(string)
+	return operatorId
+}
+
+// HandleAdminCreateOperator creates another operator and issues its API key.
+func (s *Server) HandleAdminCreateOperator(w http.ResponseWriter, r *http.Request) {
+	operator, err := user.NewAdmin(r.Context(), s.store)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditUser(r, operator.Id)
+	credential, err := auth.Issue(s.store, operator.Id, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(CreateUserResponse{User: operator, Credential: credential})
+}
+
+// HandleAdminListUsers lists users in order of ID. The query string may
+// narrow them down by q, a prefix of the ID, role and kyc, a KYC status.
+func (s *Server) HandleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	after, limit, err := parsePage(values)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	users, err := s.store.ListUsers(user.Query{
+		IdPrefix:  values.Get("q"),
+		Role:      values.Get("role"),
+		KycStatus: values.Get("kyc"),
+		After:     after,
+		Limit:     limit + 1,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	page := UserPage{Users: users}
+	if len(users) > limit {
+		page.Users, page.NextCursor = users[:limit], users[limit-1].Id
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func (s *Server) HandleAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	userRequested := mux.Vars(r)["user"]
+	userData, ok := s.lookupUser(w, r, userRequested)
+	if !ok {
+		return
+	}
+	wallets, err := s.store.ListWallets(wallet.WalletQuery{UserId: userData.Id})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(AdminUser{User: userData, Wallets: adminWallets(wallets)})
+}
+
+// HandleAdminReviewKyc verifies or rejects a user waiting to be verified.
+func (s *Server) HandleAdminReviewKyc(w http.ResponseWriter, r *http.Request) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return
+	}
+	var input user.KycReview
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := userData.ReviewKyc(r.Context(), input, operatorFrom(r.Context())); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(userData.Kyc)
+}
+
+// HandleAdminListWallets lists wallets in order of ID. The query string may
+// narrow them down by q, a prefix of the ID, user, currency and status.
+func (s *Server) HandleAdminListWallets(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	after, limit, err := parsePage(values)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := wallet.WalletQuery{
+		UserId:   values.Get("user"),
+		Status:   values.Get("status"),
+		IdPrefix: values.Get("q"),
+		After:    after,
+		Limit:    limit + 1,
+	}
+	if currency := values.Get("currency"); currency != "" {
+		if query.Currency, err = money.ParseCurrency(currency); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	wallets, err := s.store.ListWallets(query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	page := WalletPage{Wallets: adminWallets(wallets)}
+	if len(wallets) > limit {
+		page.Wallets, page.NextCursor = page.Wallets[:limit], wallets[limit-1].Id
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func (s *Server) HandleAdminGetWallet(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(adminWallet(found))
+}
+
+// HandleAdminLedger returns every ledger entry posted to a wallet, oldest
+// first.
+func (s *Server) HandleAdminLedger(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	entries, err := found.Entries()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Ledger{WalletId: found.Id, Balance: found.Balance, Entries: entries})
+}
+
+// HandleAdminChangeStatus moves any wallet to any status, on behalf of the
+// operator.
+func (s *Server) HandleAdminChangeStatus(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	var input wallet.StatusRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	change, err := found.ChangeStatus(r.Context(), input.Status, input.Reason, operatorFrom(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(change)
+}
+
+func (s *Server) HandleAdminStatusChanges(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	changes, err := found.StatusChanges(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(changes)
+}
+
+// HandleAdminAdjust corrects a wallet's balance on behalf of the operator.
+func (s *Server) HandleAdminAdjust(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	var input AdjustmentRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	operatorId := operatorFrom(r.Context())
+	var transaction *wallet.Transaction
+	amount, err := input.Amount.WithCurrency(input.Currency)
+	if err == nil {
+		transaction, err = found.Adjust(r.Context(), amount, operatorId, input.Reason)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(AdjustmentResponse{
+		TransactionId: transaction.Id,
+		WalletId:      found.Id,
+		Amount:        amount,
+		Balance:       found.Balance,
+		Currency:      found.Currency(),
+		OperatorId:    operatorId,
+		Reason:        transaction.Adjustment.Reason,
+		Timestamp:     transaction.Timestamp,
+	})
+}
+
+// HandleAdminSetLimits replaces a wallet's own limits. Amounts left out fall
+// back to the limits of the owner's tier.
+func (s *Server) HandleAdminSetLimits(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.lookupWallet(w, r, mux.Vars(r)["wallet"])
+	if !ok {
+		return
+	}
+	var input wallet.Limits
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := found.SetLimits(r.Context(), input); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(adminWallet(found))
+}
+
+// lookupWallet loads any wallet, whoever owns it.
+func (s *Server) lookupWallet(w http.ResponseWriter, r *http.Request, walletRequested string) (*wallet.Wallet, bool) {
+	found, err := wallet.Get(s.store, walletRequested)
+	if errors.Is(err, wallet.ErrWalletNotFound) {
+		err = fmt.Errorf("%w: %s", wallet.ErrWalletNotFound, walletRequested)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return found, true
+}
+
+func adminWallet(w *wallet.Wallet) AdminWallet {
+	return AdminWallet{
+		Id:        w.Id,
+		UserId:    w.UserId,
+		Name:      w.Name,
+		Balance:   w.Balance,
+		Available: w.Available(),
+		Currency:  w.Currency(),
+		Status:    w.Status,
+		CreatedAt: w.CreatedAt,
+		Limits:    w.Limits,
+	}
+}
+
+func adminWallets(wallets []*wallet.Wallet) []AdminWallet {
+	converted := make([]AdminWallet, 0, len(wallets))
+	for _, w := range wallets {
+		converted = append(converted, adminWallet(w))
+	}
+	return converted
+}
+
+// parsePage reads cursor, the NextCursor of the previous page, and limit.
+func parsePage(values url.Values) (string, int, error) {
+	limit := DefaultAdminLimit
+	if raw := values.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > MaxAdminLimit {
+			return "", 0, fmt.Errorf("%w: limit must be between 1 and %d", wallet.ErrInvalidQuery, MaxAdminLimit)
+		}
+		limit = parsed
+	}
+	return values.Get("cursor"), limit, nil
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// newAdminRouter routes the admin endpoints the way main does, behind
+// RequireAdmin, along with deposits, withdrawals and limits for customers.
+// operator1 is an admin and user1 a customer owning wallet1 and wallet2, each
+// holding 100 EUR.
+func newAdminRouter(t *testing.T) (*mux.Router, *memory.Store, map[string]*auth.Credential) {
+	t.Helper()
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Balance: eur("0")},
+	})
+	for _, id := range []string{"wallet1", "wallet2"} {
+		found, err := wallet.Get(store, id)
+		require.NoError(t, err)
+		_, err = found.Deposit(context.Background(), money.MustParse("100"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.CreateUser(&user.User{Id: "operator1", Role: user.RoleAdmin}))
+	credentials := map[string]*auth.Credential{}
+	for _, id := range []string{"user1", "operator1"} {
+		credential, err := auth.Issue(store, id, time.Now())
+		require.NoError(t, err)
+		credentials[id] = credential
+	}
+
+	srv := New(store)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.Use(srv.Authenticate)
+	u.HandleFunc("/wallet/{wallet}/deposit", srv.HandleDeposit).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/withdraw", srv.HandleWithdrawal).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/limits", srv.HandleWalletLimits).Methods(http.MethodGet)
+	a := r.PathPrefix("/admin/v1").Subrouter()
+	a.Use(srv.RequireAdmin)
+	a.HandleFunc("/operators", srv.HandleAdminCreateOperator).Methods(http.MethodPost)
+	a.HandleFunc("/users", srv.HandleAdminListUsers).Methods(http.MethodGet)
+	a.HandleFunc("/users/{user}", srv.HandleAdminGetUser).Methods(http.MethodGet)
+	a.HandleFunc("/wallets", srv.HandleAdminListWallets).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet}", srv.HandleAdminGetWallet).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet}/ledger", srv.HandleAdminLedger).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet}/status", srv.HandleAdminChangeStatus).Methods(http.MethodPost)
+	a.HandleFunc("/wallets/{wallet}/status-changes", srv.HandleAdminStatusChanges).Methods(http.MethodGet)
+	a.HandleFunc("/wallets/{wallet}/adjustments", srv.HandleAdminAdjust).Methods(http.MethodPost)
+	a.HandleFunc("/wallets/{wallet}/limits", srv.HandleAdminSetLimits).Methods(http.MethodPut)
+	return r, store, credentials
+}
+
+func serveBody(r http.Handler, method, path, apiKey, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer_RequireAdmin(t *testing.T) {
+	r, _, credentials := newAdminRouter(t)
+	for name, test := range map[string]struct {
+		apiKey string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		"operator": {
+			apiKey:   credentials["operator1"].ApiKey,
+			wantCode: 200,
+		},
+		"no key": {
+			wantCode:    401,
+			wantErrCode: "unauthenticated",
+		},
+		"customer": {
+			apiKey:      credentials["user1"].ApiKey,
+			wantCode:    403,
+			wantErrCode: "forbidden",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/admin/v1/users", test.apiKey)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantErrCode != "" {
+				var got ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				require.Equal(t, test.wantErrCode, got.Code)
+			}
+		})
+	}
+}
+
+func TestServer_HandleAdminListUsers(t *testing.T) {
+	r, _, credentials := newAdminRouter(t)
+	apiKey := credentials["operator1"].ApiKey
+	for name, test := range map[string]struct {
+		query string
+
+		wantCode   int
+		wantIds    []string
+		wantCursor string
+	}{
+		"everyone": {
+			wantCode: 200,
+			wantIds:  []string{"operator1", "user1"},
+		},
+		"first page": {
+			query:      "?limit=1",
+			wantCode:   200,
+			wantIds:    []string{"operator1"},
+			wantCursor: "operator1",
+		},
+		"next page": {
+			query:    "?limit=1&cursor=operator1",
+			wantCode: 200,
+			wantIds:  []string{"user1"},
+		},
+		"by role": {
+			query:    "?role=customer",
+			wantCode: 200,
+			wantIds:  []string{"user1"},
+		},
+		"by prefix": {
+			query:    "?q=op",
+			wantCode: 200,
+			wantIds:  []string{"operator1"},
+		},
+		"limit too large": {
+			query:    "?limit=1000",
+			wantCode: 400,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/admin/v1/users"+test.query, apiKey)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantCode != 200 {
+				return
+			}
+			var got UserPage
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			ids := []string{}
+			for _, u := range got.Users {
+				ids = append(ids, u.Id)
+			}
+			require.Equal(t, test.wantIds, ids)
+			require.Equal(t, test.wantCursor, got.NextCursor)
+		})
+	}
+}
+
+func TestServer_HandleAdminGetUser(t *testing.T) {
+	r, _, credentials := newAdminRouter(t)
+	w := serve(r, http.MethodGet, "/admin/v1/users/user1", credentials["operator1"].ApiKey)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got AdminUser
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "user1", got.Id)
+	require.Equal(t, user.RoleCustomer, got.Role)
+	require.Len(t, got.Wallets, 2)
+	require.Equal(t, "100", got.Wallets[0].Balance.String())
+
+	w = serve(r, http.MethodGet, "/admin/v1/users/missing", credentials["operator1"].ApiKey)
+	require.Equal(t, 404, w.Code)
+}
+
+func TestServer_HandleAdminListWallets(t *testing.T) {
+	r, store, credentials := newAdminRouter(t)
+	apiKey := credentials["operator1"].ApiKey
+	frozen, err := wallet.Get(store, "wallet2")
+	require.NoError(t, err)
+	_, err = frozen.ChangeStatus(context.Background(), wallet.StatusFrozen, "suspected fraud", "operator1")
+	require.NoError(t, err)
+	for name, test := range map[string]struct {
+		query string
+
+		wantCode   int
+		wantIds    []string
+		wantCursor string
+	}{
+		"every wallet": {
+			wantCode: 200,
+			wantIds:  []string{"wallet1", "wallet2"},
+		},
+		"paged": {
+			query:      "?limit=1",
+			wantCode:   200,
+			wantIds:    []string{"wallet1"},
+			wantCursor: "wallet1",
+		},
+		"by status": {
+			query:    "?status=frozen",
+			wantCode: 200,
+			wantIds:  []string{"wallet2"},
+		},
+		"by currency": {
+			query:    "?currency=USD",
+			wantCode: 200,
+			wantIds:  []string{},
+		},
+		"by user": {
+			query:    "?user=operator1",
+			wantCode: 200,
+			wantIds:  []string{},
+		},
+		"unknown currency": {
+			query:    "?currency=XXY",
+			wantCode: 400,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/admin/v1/wallets"+test.query, apiKey)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantCode != 200 {
+				return
+			}
+			var got WalletPage
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			ids := []string{}
+			for _, found := range got.Wallets {
+				ids = append(ids, found.Id)
+			}
+			require.Equal(t, test.wantIds, ids)
+			require.Equal(t, test.wantCursor, got.NextCursor)
+		})
+	}
+}
+
+func TestServer_HandleAdminChangeStatus(t *testing.T) {
+	r, _, credentials := newAdminRouter(t)
+	operatorKey, customerKey := credentials["operator1"].ApiKey, credentials["user1"].ApiKey
+	deposit := `{"Amount": "10"}`
+
+	w := serveBody(r, http.MethodPost, "/admin/v1/wallets/wallet1/status", operatorKey, `{"Status": "frozen", "Reason": "suspected fraud"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got wallet.StatusChange
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, wallet.StatusActive, got.From)
+	require.Equal(t, wallet.StatusFrozen, got.To)
+	require.Equal(t, "operator1", got.ChangedBy)
+
+	w = serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", customerKey, deposit)
+	require.Equal(t, 409, w.Code, w.Body.String())
+	var errResponse ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResponse))
+	require.Equal(t, "wallet_frozen", errResponse.Code)
+
+	w = serveBody(r, http.MethodPost, "/admin/v1/wallets/wallet1/status", operatorKey, `{"Status": "active", "Reason": "cleared"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	w = serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", customerKey, deposit)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	w = serve(r, http.MethodGet, "/admin/v1/wallets/wallet1/status-changes", operatorKey)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var changes []wallet.StatusChange
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&changes))
+	require.Len(t, changes, 2)
+	require.Equal(t, "cleared", changes[1].Reason)
+
+	for name, test := range map[string]struct {
+		path, body string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		"unknown wallet": {
+			path:        "/admin/v1/wallets/missing/status",
+			body:        `{"Status": "frozen", "Reason": "suspected fraud"}`,
+			wantCode:    404,
+			wantErrCode: "wallet_not_found",
+		},
+		"no reason": {
+			path:        "/admin/v1/wallets/wallet1/status",
+			body:        `{"Status": "frozen"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_status",
+		},
+		"already active": {
+			path:        "/admin/v1/wallets/wallet1/status",
+			body:        `{"Status": "active", "Reason": "cleared"}`,
+			wantCode:    409,
+			wantErrCode: "status_unchanged",
+		},
+		"closing a wallet holding money": {
+			path:        "/admin/v1/wallets/wallet1/status",
+			body:        `{"Status": "closed", "Reason": "customer request"}`,
+			wantCode:    409,
+			wantErrCode: "balance_not_zero",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serveBody(r, http.MethodPost, test.path, operatorKey, test.body)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, test.wantErrCode, got.Code)
+		})
+	}
+}
+
+func TestServer_HandleAdminAdjust(t *testing.T) {
+	for name, test := range map[string]struct {
+		body string
+
+		wantCode    int
+		wantBalance string
+	}{
+		"credit": {
+			body:        `{"Amount": "12.50", "Reason": "goodwill credit"}`,
+			wantCode:    201,
+			wantBalance: "112.5",
+		},
+		"debit": {
+			body:        `{"Amount": "-12.50", "Currency": "EUR", "Reason": "duplicate deposit"}`,
+			wantCode:    201,
+			wantBalance: "87.5",
+		},
+		"no reason": {
+			body:     `{"Amount": "12.50"}`,
+			wantCode: 400,
+		},
+		"currency mismatch": {
+			body:     `{"Amount": "12.50", "Currency": "USD", "Reason": "goodwill credit"}`,
+			wantCode: 400,
+		},
+		"more than the balance": {
+			body:     `{"Amount": "-100.01", "Reason": "duplicate deposit"}`,
+			wantCode: 403,
+		},
+		"bad request": {
+			body:     `i'm not json`,
+			wantCode: 400,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, store, credentials := newAdminRouter(t)
+			w := serveBody(r, http.MethodPost, "/admin/v1/wallets/wallet1/adjustments", credentials["operator1"].ApiKey, test.body)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantCode != 201 {
+				return
+			}
+			var got AdjustmentResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, "operator1", got.OperatorId)
+			require.Equal(t, test.wantBalance, got.Balance.String())
+
+			found, err := wallet.Get(store, "wallet1")
+			require.NoError(t, err)
+			require.NoError(t, found.Reconcile())
+		})
+	}
+}
+
+func TestServer_HandleAdminSetLimits(t *testing.T) {
+	for name, test := range map[string]struct {
+		body string
+
+		wantCode int
+	}{
+		"sets limits": {
+			body:     `{"withdrawal": {"PerTransaction": "30", "Daily": "50"}}`,
+			wantCode: 200,
+		},
+		"limits on adjustments": {
+			body:     `{"adjustment": {"Daily": "50"}}`,
+			wantCode: 400,
+		},
+		"negative limit": {
+			body:     `{"withdrawal": {"Daily": "-50"}}`,
+			wantCode: 400,
+		},
+		"bad request": {
+			body:     `i'm not json`,
+			wantCode: 400,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, _, credentials := newAdminRouter(t)
+			w := serveBody(r, http.MethodPut, "/admin/v1/wallets/wallet1/limits", credentials["operator1"].ApiKey, test.body)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantCode != 200 {
+				return
+			}
+			var got AdminWallet
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, "30", got.Limits[wallet.TypeWithdrawal].PerTransaction.String())
+
+			apiKey := credentials["user1"].ApiKey
+			w = serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/limits", apiKey)
+			require.Equal(t, 200, w.Code, w.Body.String())
+			var limits wallet.Limits
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&limits))
+			require.Equal(t, "50", limits[wallet.TypeWithdrawal].Daily.String())
+
+			w = serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/withdraw", apiKey, `{"Amount": "30"}`)
+			require.Equal(t, 200, w.Code, w.Body.String())
+			w = serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/withdraw", apiKey, `{"Amount": "25"}`)
+			require.Equal(t, 403, w.Code, w.Body.String())
+			var errResponse ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&errResponse))
+			require.Equal(t, "limit_exceeded", errResponse.Code)
+			require.Equal(t, wallet.PeriodDaily, errResponse.Limit.Period)
+			require.Equal(t, "20", errResponse.Limit.Remaining.String())
+		})
+	}
+}
+
+func TestServer_HandleAdminLedger(t *testing.T) {
+	r, _, credentials := newAdminRouter(t)
+	apiKey := credentials["operator1"].ApiKey
+	w := serveBody(r, http.MethodPost, "/admin/v1/wallets/wallet1/adjustments", apiKey, `{"Amount": "5", "Reason": "goodwill credit"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+
+	w = serve(r, http.MethodGet, "/admin/v1/wallets/wallet1/ledger", apiKey)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got Ledger
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "wallet1", got.WalletId)
+	require.Equal(t, "105", got.Balance.String())
+	require.Len(t, got.Entries, 2)
+}
+
+func TestServer_HandleAdminCreateOperator(t *testing.T) {
+	r, store, credentials := newAdminRouter(t)
+	w := serve(r, http.MethodPost, "/admin/v1/operators", credentials["operator1"].ApiKey)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var got CreateUserResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, user.RoleAdmin, got.Role)
+
+	w = serve(r, http.MethodGet, "/admin/v1/users", got.ApiKey)
+	require.Equal(t, 200, w.Code, "the new operator's key works straight away")
+	created, err := store.GetUser(got.Id)
+	require.NoError(t, err)
+	require.True(t, created.IsAdmin())
+}
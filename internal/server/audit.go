@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+)
+
+type auditContextKey struct{}
+
+// auditTrail is what Audit learns about a call while it is handled: who
+// made it, the user it was about and the balances of the wallets its
+// transactions moved money through.
+type auditTrail struct {
+	actorId  string
+	userId   string
+	balances []audit.Balance
+}
+
+// Audit records every call that may change state, whether or not it
+// succeeds, in the audit log. It runs before Authenticate or RequireAdmin,
+// so calls they refuse are recorded too; they name who made the call with
+// auditActor once the key checks out, and calls without a valid key have no
+// actor. The balances recorded are the ones each transaction the call
+// applied left behind, and what they were just before it, as the store
+// applied it, so calls running alongside it cannot creep in between. Handlers
+// name a wallet they create or user they create with auditCreatedWallet and
+// auditUser.
+func (s *Server) Audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		trail := &auditTrail{userId: mux.Vars(r)["user"]}
+		ctx := context.WithValue(r.Context(), auditContextKey{}, trail)
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(wallet.OnApplied(ctx, trail.addTransaction)))
+
+		entry := &audit.Entry{
+			Action:    r.Method + " " + routeOf(r),
+			Path:      r.URL.Path,
+			Status:    recorder.statusCode,
+			ActorId:   trail.actorId,
+			UserId:    trail.userId,
+			SourceIP:  r.RemoteAddr,
+			RequestId: r.Header.Get(RequestIDHeader),
+			Balances:  trail.balances,
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.SourceIP = host
+		}
+		if err := s.audit.Append(entry); err != nil {
+			logging.FromContext(r.Context()).Error("auditing request", "error", err)
+		}
+	})
+}
+
+// addTransaction notes the balances of the wallets an applied transaction
+// debited and credited, working out what each held before it from what it
+// left behind.
+func (t *auditTrail) addTransaction(applied *wallet.Transaction) {
+	if walletId := applied.SourceWalletId; walletId != "" {
+		after := applied.SourceBalance
+		balance := audit.Balance{WalletId: walletId, Currency: after.Currency, After: after.String()}
+		if before, err := after.Add(applied.AmountFor(walletId)); err == nil {
+			balance.Before = before.String()
+		}
+		t.note(balance)
+	}
+	if walletId := applied.TargetWalletId; walletId != "" {
+		after := applied.TargetBalance
+		balance := audit.Balance{WalletId: walletId, Currency: after.Currency, After: after.String()}
+		if before, err := after.Sub(applied.AmountFor(walletId)); err == nil {
+			balance.Before = before.String()
+		}
+		t.note(balance)
+	}
+}
+
+// note records a wallet's balance. A wallet noted already keeps the balance
+// it had before the call's first transaction, and takes the one after its
+// latest.
+func (t *auditTrail) note(balance audit.Balance) {
+	for i := range t.balances {
+		if t.balances[i].WalletId == balance.WalletId {
+			t.balances[i].After = balance.After
+			return
+		}
+	}
+	t.balances = append(t.balances, balance)
+}
+
+// auditCreatedWallet has Audit record the balance of a wallet a call
+// created, which had none before it.
+func auditCreatedWallet(r *http.Request, created *wallet.Wallet) {
+	if trail, ok := r.Context().Value(auditContextKey{}).(*auditTrail); ok {
+		trail.note(audit.Balance{WalletId: created.Id, Currency: created.Currency(), After: created.Balance.String()})
+	}
+}
+
+// auditActor has Audit record who made a call, once their key is checked.
+func auditActor(r *http.Request, actorId string) {
+	if trail, ok := r.Context().Value(auditContextKey{}).(*auditTrail); ok {
+		trail.actorId = actorId
+	}
+}
+
+// auditUser has Audit record the user a call was about, for calls with no
+// user in their path.
+func auditUser(r *http.Request, userId string) {
+	if trail, ok := r.Context().Value(auditContextKey{}).(*auditTrail); ok {
+		trail.userId = userId
+	}
+}
+
+// HandleAdminExportAudit streams the audit log as one JSON entry per line,
+// starting after the Seq in after, for audit.VerifyExport to check.
+func (s *Server) HandleAdminExportAudit(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if value := r.URL.Query().Get("after"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			writeError(w, r, fmt.Errorf("%w: after must be an entry's Seq", wallet.ErrInvalidQuery))
+			return
+		}
+		after = parsed
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	written, err := audit.Export(s.store, after, w)
+	switch {
+	case err != nil && written == 0:
+		writeError(w, r, err)
+	case err != nil:
+		// The status went out with the first entry, so all that is left is
+		// to cut the export short.
+		logging.FromContext(r.Context()).Error("exporting the audit log", "error", err, "written", written)
+	}
+}
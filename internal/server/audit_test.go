@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Audit(t *testing.T) {
+	r, store, credentials := newAdminRouter(t)
+	srv := New(store)
+	r.Handle("/v1/user", srv.Audit(http.HandlerFunc(srv.HandleCreateUser))).Methods(http.MethodPost)
+	u := r.PathPrefix("/v1/user/{user}/audited").Subrouter()
+	u.Use(srv.Audit, srv.Authenticate)
+	u.HandleFunc("/wallet", srv.HandleCreateWallet).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/balance", srv.HandleBalanceCheck).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/payment", srv.HandlePayment).Methods(http.MethodPost)
+	a := r.PathPrefix("/admin/v1/audited").Subrouter()
+	a.Use(srv.Audit, srv.RequireAdmin)
+	a.HandleFunc("/wallets/{wallet}/adjustments", srv.HandleAdminAdjust).Methods(http.MethodPost)
+	a.HandleFunc("/audit/export", srv.HandleAdminExportAudit).Methods(http.MethodGet)
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name, method, path, apiKey, body string
+
+		wantCode  int
+		wantEntry *audit.Entry
+	}{
+		{
+			name: "user creation", method: http.MethodPost, path: "/v1/user",
+			wantCode:  201,
+			wantEntry: &audit.Entry{Action: "POST /v1/user", Status: 201},
+		},
+		{
+			name: "payment", method: http.MethodPost, path: "/v1/user/user1/audited/wallet/wallet1/payment",
+			apiKey: credentials["user1"].ApiKey, body: `{"Creditor": "wallet2", "Amount": "30"}`,
+			wantCode: 200,
+			wantEntry: &audit.Entry{Action: "POST /v1/user/{user}/audited/wallet/{wallet}/payment", Status: 200,
+				ActorId: "user1", UserId: "user1", Balances: []audit.Balance{
+					{WalletId: "wallet1", Currency: "EUR", Before: "100.00", After: "70.00"},
+					{WalletId: "wallet2", Currency: "EUR", Before: "100.00", After: "130.00"},
+				}},
+		},
+		{
+			// A refused call moved no money, so it has no balances to record.
+			name: "failed payment", method: http.MethodPost, path: "/v1/user/user1/audited/wallet/wallet1/payment",
+			apiKey: credentials["user1"].ApiKey, body: `{"Creditor": "wallet2", "Amount": "300"}`,
+			wantCode: 403,
+			wantEntry: &audit.Entry{Action: "POST /v1/user/{user}/audited/wallet/{wallet}/payment", Status: 403,
+				ActorId: "user1", UserId: "user1"},
+		},
+		{
+			name: "payment without an API key", method: http.MethodPost, path: "/v1/user/user1/audited/wallet/wallet1/payment",
+			body:     `{"Creditor": "wallet2", "Amount": "30"}`,
+			wantCode: 401,
+			wantEntry: &audit.Entry{Action: "POST /v1/user/{user}/audited/wallet/{wallet}/payment", Status: 401,
+				UserId: "user1"},
+		},
+		{
+			name: "payment with another user's API key", method: http.MethodPost, path: "/v1/user/user1/audited/wallet/wallet1/payment",
+			apiKey: credentials["operator1"].ApiKey, body: `{"Creditor": "wallet2", "Amount": "30"}`,
+			wantCode: 403,
+			wantEntry: &audit.Entry{Action: "POST /v1/user/{user}/audited/wallet/{wallet}/payment", Status: 403,
+				ActorId: "operator1", UserId: "user1"},
+		},
+		{
+			name: "balance check is not audited", method: http.MethodGet, path: "/v1/user/user1/audited/wallet/wallet1/balance",
+			apiKey:   credentials["user1"].ApiKey,
+			wantCode: 200,
+		},
+		{
+			name: "adjustment by an operator", method: http.MethodPost, path: "/admin/v1/audited/wallets/wallet2/adjustments",
+			apiKey: credentials["operator1"].ApiKey, body: `{"Amount": "-10", "Reason": "fee"}`,
+			wantCode: 201,
+			wantEntry: &audit.Entry{Action: "POST /admin/v1/audited/wallets/{wallet}/adjustments", Status: 201,
+				ActorId: "operator1", Balances: []audit.Balance{
+					{WalletId: "wallet2", Currency: "EUR", Before: "130.00", After: "120.00"},
+				}},
+		},
+	} {
+		before, err := store.LastAuditEntry()
+		require.NoError(t, err, step.name)
+		w := serveBody(r, step.method, step.path, step.apiKey, step.body)
+		require.Equal(t, step.wantCode, w.Code, step.name)
+
+		last, err := store.LastAuditEntry()
+		require.NoError(t, err, step.name)
+		if step.wantEntry == nil {
+			require.Equal(t, before, last, step.name)
+			continue
+		}
+		require.Equal(t, step.wantEntry.Action, last.Action, step.name)
+		require.Equal(t, step.wantEntry.Status, last.Status, step.name)
+		require.Equal(t, step.wantEntry.ActorId, last.ActorId, step.name)
+		require.Equal(t, step.wantEntry.Balances, last.Balances, step.name)
+		require.Equal(t, "192.0.2.1", last.SourceIP, step.name)
+		if step.wantEntry.UserId != "" {
+			require.Equal(t, step.wantEntry.UserId, last.UserId, step.name)
+		} else if step.path == "/v1/user" {
+			require.NotEmpty(t, last.UserId, "the new user")
+		}
+	}
+
+	w := serveBody(r, http.MethodPost, "/v1/user/user1/audited/wallet", credentials["user1"].ApiKey, `{"Currency": "USD"}`)
+	require.Equal(t, 201, w.Code)
+	last, err := store.LastAuditEntry()
+	require.NoError(t, err)
+	require.Len(t, last.Balances, 1)
+	require.Empty(t, last.Balances[0].Before, "a new wallet had no balance before")
+	require.Equal(t, "0.00", last.Balances[0].After)
+
+	w = serve(r, http.MethodGet, "/admin/v1/audited/audit/export?after=1", credentials["operator1"].ApiKey)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	chain, err := audit.VerifyExport(strings.NewReader(w.Body.String()))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), chain.First().Seq)
+	require.Equal(t, last.Hash, chain.Last().Hash)
+
+	w = serve(r, http.MethodGet, "/admin/v1/audited/audit/export?after=first", credentials["operator1"].ApiKey)
+	require.Equal(t, 400, w.Code)
+}
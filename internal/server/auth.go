@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// Authenticate only lets requests through when they carry an API key
+// belonging to the {user} in the path. It runs before the user is looked up,
+// so callers without a key cannot tell which users exist.
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := auth.FromHeader(r.Header.Get("Authorization"))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", auth.Scheme)
+			writeError(w, r, auth.ErrUnauthenticated)
+			return
+		}
+		key, err := auth.Authenticate(s.store, apiKey)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", auth.Scheme)
+			writeError(w, r, err)
+			return
+		}
+		auditActor(r, key.UserId)
+		if key.UserId != mux.Vars(r)["user"] {
+			writeError(w, r, auth.ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(logging.With(r.Context(), "user_id", key.UserId)))
+	})
+}
+
+func (s *Server) HandleListKeys(w http.ResponseWriter, r *http.Request) {
+	userRequested := mux.Vars(r)["user"]
+	if _, ok := s.lookupUser(w, r, userRequested); !ok {
+		return
+	}
+	keys, err := s.store.ListAPIKeys(userRequested)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+// HandleRotateKey issues a new API key in place of the one in the path, which
+// stops working straight away.
+func (s *Server) HandleRotateKey(w http.ResponseWriter, r *http.Request) {
+	userRequested, keyRequested := mux.Vars(r)["user"], mux.Vars(r)["key"]
+	if _, ok := s.lookupUser(w, r, userRequested); !ok {
+		return
+	}
+	credential, err := auth.Rotate(s.store, userRequested, keyRequested, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(credential)
+}
+
+func (s *Server) HandleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	userRequested, keyRequested := mux.Vars(r)["user"], mux.Vars(r)["key"]
+	if _, ok := s.lookupUser(w, r, userRequested); !ok {
+		return
+	}
+	if err := s.store.RevokeAPIKey(userRequested, keyRequested, time.Now()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// newAuthRouter routes the key endpoints the way main does, behind
+// Authenticate, for user1 and user2 who each hold one key.
+func newAuthRouter(t *testing.T) (*mux.Router, *memory.Store, map[string]*auth.Credential) {
+	t.Helper()
+	store := memory.New()
+	credentials := map[string]*auth.Credential{}
+	for _, id := range []string{"user1", "user2"} {
+		require.NoError(t, store.CreateUser(&user.User{Id: id}))
+		credential, err := auth.Issue(store, id, time.Now())
+		require.NoError(t, err)
+		credentials[id] = credential
+	}
+	srv := New(store)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.Use(srv.Authenticate)
+	u.HandleFunc("/keys", srv.HandleListKeys).Methods(http.MethodGet)
+	u.HandleFunc("/keys/{key}/rotate", srv.HandleRotateKey).Methods(http.MethodPost)
+	u.HandleFunc("/keys/{key}", srv.HandleRevokeKey).Methods(http.MethodDelete)
+	return r, store, credentials
+}
+
+func serve(r http.Handler, method, path, apiKey string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer_Authenticate(t *testing.T) {
+	r, _, credentials := newAuthRouter(t)
+	for name, test := range map[string]struct {
+		path, apiKey string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		"own key": {
+			path:     "/v1/user/user1/keys",
+			apiKey:   credentials["user1"].ApiKey,
+			wantCode: 200,
+		},
+		"no key": {
+			path:        "/v1/user/user1/keys",
+			wantCode:    401,
+			wantErrCode: "unauthenticated",
+		},
+		"wrong secret": {
+			path:        "/v1/user/user1/keys",
+			apiKey:      credentials["user1"].KeyId + ".wrong",
+			wantCode:    401,
+			wantErrCode: "unauthenticated",
+		},
+		"someone else's key": {
+			path:        "/v1/user/user1/keys",
+			apiKey:      credentials["user2"].ApiKey,
+			wantCode:    403,
+			wantErrCode: "forbidden",
+		},
+		"unknown users look the same as others'": {
+			path:        "/v1/user/missing/keys",
+			apiKey:      credentials["user1"].ApiKey,
+			wantCode:    403,
+			wantErrCode: "forbidden",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, test.path, test.apiKey)
+			require.Equal(t, test.wantCode, w.Code)
+			if test.wantErrCode == "" {
+				return
+			}
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, test.wantErrCode, got.Code)
+		})
+	}
+}
+
+func TestServer_RotateAndRevokeKeys(t *testing.T) {
+	r, store, credentials := newAuthRouter(t)
+	old := credentials["user1"]
+
+	w := serve(r, http.MethodPost, "/v1/user/user1/keys/"+credentials["user2"].KeyId+"/rotate", old.ApiKey)
+	require.Equal(t, 404, w.Code, "user2's key cannot be rotated by user1")
+
+	w = serve(r, http.MethodPost, "/v1/user/user1/keys/"+old.KeyId+"/rotate", old.ApiKey)
+	require.Equal(t, 201, w.Code)
+	var rotated auth.Credential
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rotated))
+	require.NotEqual(t, old.KeyId, rotated.KeyId)
+
+	require.Equal(t, 401, serve(r, http.MethodGet, "/v1/user/user1/keys", old.ApiKey).Code)
+	w = serve(r, http.MethodGet, "/v1/user/user1/keys", rotated.ApiKey)
+	require.Equal(t, 200, w.Code)
+	var keys []auth.Key
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	require.Len(t, keys, 2)
+	require.NotNil(t, keys[0].RevokedAt)
+	require.Nil(t, keys[1].RevokedAt)
+
+	w = serve(r, http.MethodDelete, "/v1/user/user1/keys/"+credentials["user2"].KeyId, rotated.ApiKey)
+	require.Equal(t, 404, w.Code)
+	_, err := auth.Authenticate(store, credentials["user2"].ApiKey)
+	require.NoError(t, err)
+
+	require.Equal(t, 204, serve(r, http.MethodDelete, "/v1/user/user1/keys/"+rotated.KeyId, rotated.ApiKey).Code)
+	require.Equal(t, 401, serve(r, http.MethodGet, "/v1/user/user1/keys", rotated.ApiKey).Code)
+}
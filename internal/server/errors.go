@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+)
+
+// RequestIDHeader carries the ID of a request, sent by the client or
+// generated by RequestID.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	requestIdSize         = 16
+	maxRequestIdLength    = 128
+	codeInternal          = "internal_error"
+	internalErrorResponse = "internal server error"
+)
+
+var errInvalidJSON = errors.New("invalid json")
+
+// ErrorResponse is the body of every error the server returns. Limit
+// describes the limit a transaction broke.
+type ErrorResponse struct {
+	Code      string             `json:"Code"`
+	Message   string             `json:"Message"`
+	RequestId string             `json:"RequestId,omitempty"`
+	Limit     *wallet.LimitError `json:"Limit,omitempty"`
+}
+
+// errorKind is how an error is reported to clients.
+type errorKind struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorKinds maps errors to statuses and codes. It is checked in order, so
+// errors that wrap others, such as a currency mismatch wrapping an invalid
+// amount, come first.
+var errorKinds = []errorKind{
+	{errInvalidJSON, http.StatusBadRequest, "invalid_json"},
+	{auth.ErrUnauthenticated, http.StatusUnauthorized, "unauthenticated"},
+	{auth.ErrForbidden, http.StatusForbidden, "forbidden"},
+	{auth.ErrKeyNotFound, http.StatusNotFound, "api_key_not_found"},
+	{user.ErrUserNotFound, http.StatusNotFound, "user_not_found"},
+	{wallet.ErrWalletNotFound, http.StatusNotFound, "wallet_not_found"},
+	{user.ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{user.ErrOperatorOnly, http.StatusForbidden, "operator_only"},
+	{user.ErrVerificationRequired, http.StatusForbidden, "verification_required"},
+	{user.ErrInvalidProfile, http.StatusBadRequest, "invalid_profile"},
+	{user.ErrProfileLocked, http.StatusConflict, "profile_locked"},
+	{user.ErrProfileIncomplete, http.StatusUnprocessableEntity, "profile_incomplete"},
+	{user.ErrInvalidKyc, http.StatusBadRequest, "invalid_kyc"},
+	{user.ErrKycStatus, http.StatusConflict, "invalid_kyc_status"},
+	{wallet.ErrInsufficientFunds, http.StatusForbidden, "insufficient_funds"},
+	{wallet.ErrLimitExceeded, http.StatusForbidden, "limit_exceeded"},
+	{wallet.ErrInvalidLimits, http.StatusBadRequest, "invalid_limits"},
+	{wallet.ErrAuthorizationNotFound, http.StatusNotFound, "authorization_not_found"},
+	{wallet.ErrAuthorizationClosed, http.StatusConflict, "authorization_closed"},
+	{wallet.ErrTransactionNotFound, http.StatusNotFound, "transaction_not_found"},
+	{wallet.ErrPaymentRefunded, http.StatusConflict, "payment_refunded"},
+	{schedule.ErrScheduleNotFound, http.StatusNotFound, "schedule_not_found"},
+	{schedule.ErrInvalidSchedule, http.StatusBadRequest, "invalid_schedule"},
+	{schedule.ErrInvalidStatus, http.StatusConflict, "invalid_schedule_status"},
+	{webhook.ErrEndpointNotFound, http.StatusNotFound, "webhook_not_found"},
+	{webhook.ErrDeliveryNotFound, http.StatusNotFound, "delivery_not_found"},
+	{webhook.ErrInvalidEndpoint, http.StatusBadRequest, "invalid_webhook"},
+	{webhook.ErrInvalidQuery, http.StatusBadRequest, "invalid_query"},
+	{webhook.ErrDeliveryPending, http.StatusConflict, "delivery_pending"},
+	{wallet.ErrWalletFrozen, http.StatusConflict, "wallet_frozen"},
+	{wallet.ErrWalletClosed, http.StatusConflict, "wallet_closed"},
+	{wallet.ErrStatusUnchanged, http.StatusConflict, "status_unchanged"},
+	{wallet.ErrBalanceNotZero, http.StatusConflict, "balance_not_zero"},
+	{wallet.ErrInvalidStatus, http.StatusBadRequest, "invalid_status"},
+	{wallet.ErrSameWallet, http.StatusBadRequest, "same_wallet"},
+	{wallet.ErrInvalidName, http.StatusBadRequest, "invalid_wallet_name"},
+	{wallet.ErrInvalidAdjustment, http.StatusBadRequest, "invalid_adjustment"},
+	{wallet.ErrInvalidQuery, http.StatusBadRequest, "invalid_query"},
+	{wallet.ErrInvalidDetails, http.StatusBadRequest, "invalid_details"},
+	{money.ErrUnknownCurrency, http.StatusBadRequest, "unknown_currency"},
+	{money.ErrCurrencyMismatch, http.StatusBadRequest, "currency_mismatch"},
+	{wallet.ErrInvalidAmount, http.StatusBadRequest, "invalid_amount"},
+	{money.ErrTooManyDecimals, http.StatusBadRequest, "invalid_amount"},
+	{money.ErrOverflow, http.StatusBadRequest, "invalid_amount"},
+	{exchange.ErrRateUnavailable, http.StatusUnprocessableEntity, "rate_unavailable"},
+	{exchange.ErrQuoteNotFound, http.StatusUnprocessableEntity, "quote_not_found"},
+	{exchange.ErrQuoteExpired, http.StatusUnprocessableEntity, "quote_expired"},
+	{exchange.ErrQuoteMismatch, http.StatusUnprocessableEntity, "quote_mismatch"},
+	{idempotency.ErrInvalidKey, http.StatusBadRequest, "invalid_idempotency_key"},
+	{idempotency.ErrKeyReused, http.StatusUnprocessableEntity, "idempotency_key_reused"},
+	{idempotency.ErrInProgress, http.StatusConflict, "idempotency_key_in_progress"},
+}
+
+// errorStatus returns the status and code err is reported with. Errors not
+// in errorKinds are internal errors.
+func errorStatus(err error) (int, string) {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.status, kind.code
+		}
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// writeError replies to r with err as an ErrorResponse. The details of
+// internal errors are logged rather than sent to the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	response := ErrorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		RequestId: r.Header.Get(RequestIDHeader),
+	}
+	var limitErr *wallet.LimitError
+	if errors.As(err, &limitErr) {
+		response.Limit = limitErr
+	}
+	noteErrorCode(r.Context(), code)
+	logger := logging.FromContext(r.Context())
+	if status == http.StatusInternalServerError {
+		logger.Error("request failed", "error", err)
+		response.Message = internalErrorResponse
+	} else {
+		logger.Debug("request refused", "code", code, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// RequestID makes sure every request carries an X-Request-ID, keeping the
+// client's own when it sends a usable one, and echoes it on the response.
+// Everything logged through the request's context carries the ID.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIdLength {
+			id = manager.GenerateId(requestIdSize)
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.With(r.Context(), "request_id", id)))
+	})
+}
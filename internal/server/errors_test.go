@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteError(t *testing.T) {
+	for name, test := range map[string]struct {
+		err error
+
+		wantCode    int
+		wantErrCode string
+		wantMessage string
+	}{
+		"unknown user": {
+			err:         fmt.Errorf("%w: user1", user.ErrUserNotFound),
+			wantCode:    404,
+			wantErrCode: "user_not_found",
+		},
+		"unknown wallet": {
+			err:         fmt.Errorf("paying: %w", wallet.ErrWalletNotFound),
+			wantCode:    404,
+			wantErrCode: "wallet_not_found",
+		},
+		"someone else's wallet": {
+			err:         user.ErrUnauthorized,
+			wantCode:    401,
+			wantErrCode: "unauthorized",
+		},
+		"insufficient funds": {
+			err:         wallet.ErrInsufficientFunds,
+			wantCode:    403,
+			wantErrCode: "insufficient_funds",
+		},
+		"invalid amount": {
+			err:         fmt.Errorf("%w: %w", wallet.ErrInvalidAmount, money.ErrTooManyDecimals),
+			wantCode:    400,
+			wantErrCode: "invalid_amount",
+		},
+		"currency mismatch wrapped in an invalid amount": {
+			err:         fmt.Errorf("%w: %w", wallet.ErrInvalidAmount, money.ErrCurrencyMismatch),
+			wantCode:    400,
+			wantErrCode: "currency_mismatch",
+		},
+		"reference too long": {
+			err:         fmt.Errorf("%w: reference must be at most 140 characters", wallet.ErrInvalidDetails),
+			wantCode:    400,
+			wantErrCode: "invalid_details",
+		},
+		"over a limit": {
+			err:         fmt.Errorf("withdrawing: %w", wallet.ErrLimitExceeded),
+			wantCode:    403,
+			wantErrCode: "limit_exceeded",
+		},
+		"closed authorization": {
+			err:         fmt.Errorf("capturing: %w", wallet.ErrAuthorizationClosed),
+			wantCode:    409,
+			wantErrCode: "authorization_closed",
+		},
+		"refunded payment": {
+			err:         fmt.Errorf("refunding: %w", wallet.ErrPaymentRefunded),
+			wantCode:    409,
+			wantErrCode: "payment_refunded",
+		},
+		"cancelled schedule": {
+			err:         fmt.Errorf("%w: schedule1 is cancelled", schedule.ErrInvalidStatus),
+			wantCode:    409,
+			wantErrCode: "invalid_schedule_status",
+		},
+		"replaying a pending delivery": {
+			err:         fmt.Errorf("%w: delivery1", webhook.ErrDeliveryPending),
+			wantCode:    409,
+			wantErrCode: "delivery_pending",
+		},
+		"expired quote": {
+			err:         exchange.ErrQuoteExpired,
+			wantCode:    422,
+			wantErrCode: "quote_expired",
+		},
+		"request still in progress": {
+			err:         idempotency.ErrInProgress,
+			wantCode:    409,
+			wantErrCode: "idempotency_key_in_progress",
+		},
+		"anything else": {
+			err:         errors.New("database is locked"),
+			wantCode:    500,
+			wantErrCode: "internal_error",
+			wantMessage: "internal server error",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(RequestIDHeader, "request1")
+			writeError(w, r, test.err)
+
+			require.Equal(t, test.wantCode, w.Code)
+			require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			wantMessage := test.wantMessage
+			if wantMessage == "" {
+				wantMessage = test.err.Error()
+			}
+			require.Equal(t, ErrorResponse{Code: test.wantErrCode, Message: wantMessage, RequestId: "request1"}, got)
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for name, test := range map[string]struct {
+		sent string
+
+		wantGenerated bool
+	}{
+		"keeps the client's ID": {
+			sent: "client-id",
+		},
+		"generates a missing ID": {
+			wantGenerated: true,
+		},
+		"replaces an ID that is too long": {
+			sent:          string(make([]byte, maxRequestIdLength+1)),
+			wantGenerated: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var seen string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = r.Header.Get(RequestIDHeader)
+			}))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.sent != "" {
+				r.Header.Set(RequestIDHeader, test.sent)
+			}
+			handler.ServeHTTP(w, r)
+
+			require.NotEmpty(t, seen)
+			require.Equal(t, seen, w.Header().Get(RequestIDHeader))
+			if !test.wantGenerated {
+				require.Equal(t, test.sent, seen)
+			} else {
+				require.NotEqual(t, test.sent, seen)
+			}
+		})
+	}
+}
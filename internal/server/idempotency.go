@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// Idempotent makes next safe to retry. A request carrying an Idempotency-Key
+// is handled once; retries with the same key and body get the stored
+// response back, and reusing the key for a different request is rejected.
+// Requests without the header are passed straight through.
+func (s *Server) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency.Header)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			writeError(w, r, fmt.Errorf("%w: must be at most %d characters", idempotency.ErrInvalidKey, idempotency.MaxKeyLength))
+			return
+		}
+		if strings.HasPrefix(key, scheduleKeyPrefix) {
+			writeError(w, r, fmt.Errorf("%w: must not start with %q", idempotency.ErrInvalidKey, scheduleKeyPrefix))
+			return
+		}
+		userRequested := mux.Vars(r)["user"]
+		if _, ok := s.lookupUser(w, r, userRequested); !ok {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, r, errInvalidJSON)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		record := idempotency.NewRecord(userRequested, key, idempotency.Fingerprint(r.Method, r.URL.Path, body), time.Now())
+		found, err := s.store.ReserveIdempotencyKey(record)
+		switch {
+		case err != nil:
+			writeError(w, r, err)
+			return
+		case found == nil:
+		case found.Fingerprint != record.Fingerprint:
+			writeError(w, r, idempotency.ErrKeyReused)
+			return
+		case !found.Completed():
+			writeError(w, r, idempotency.ErrInProgress)
+			return
+		default:
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(found.StatusCode)
+			_, _ = w.Write(found.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.statusCode >= http.StatusInternalServerError {
+			// Nothing was done, so let the client retry with the same key.
+			if err := s.store.ReleaseIdempotencyKey(userRequested, key); err != nil {
+				logging.FromContext(r.Context()).Error("releasing idempotency key", "idempotency_key", key, "error", err)
+			}
+			return
+		}
+		record.StatusCode, record.Body = recorder.statusCode, recorder.body.Bytes()
+		if err := s.store.CompleteIdempotencyKey(record); err != nil {
+			logging.FromContext(r.Context()).Error("storing response for idempotency key", "idempotency_key", key, "error", err)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Idempotent(t *testing.T) {
+	type request struct {
+		key, body string
+
+		wantCode     int
+		wantReplayed bool
+	}
+	for name, test := range map[string]struct {
+		pending     bool
+		requests    []request
+		wantBalance string
+	}{
+		"without a key every request is processed": {
+			requests: []request{
+				{body: `{"Amount": "10"}`, wantCode: 200},
+				{body: `{"Amount": "10"}`, wantCode: 200},
+			},
+			wantBalance: "20.00",
+		},
+		"replays the original response": {
+			requests: []request{
+				{key: "key1", body: `{"Amount": "10"}`, wantCode: 200},
+				{key: "key1", body: `{"Amount": "10"}`, wantCode: 200, wantReplayed: true},
+			},
+			wantBalance: "10.00",
+		},
+		"replays a rejected request": {
+			requests: []request{
+				{key: "key1", body: `{"Amount": "-10"}`, wantCode: 400},
+				{key: "key1", body: `{"Amount": "-10"}`, wantCode: 400, wantReplayed: true},
+			},
+			wantBalance: "0.00",
+		},
+		"keys are independent": {
+			requests: []request{
+				{key: "key1", body: `{"Amount": "10"}`, wantCode: 200},
+				{key: "key2", body: `{"Amount": "10"}`, wantCode: 200},
+			},
+			wantBalance: "20.00",
+		},
+		"rejects a key reused with a different body": {
+			requests: []request{
+				{key: "key1", body: `{"Amount": "10"}`, wantCode: 200},
+				{key: "key1", body: `{"Amount": "20"}`, wantCode: 422},
+			},
+			wantBalance: "10.00",
+		},
+		"rejects a key still being processed": {
+			pending: true,
+			requests: []request{
+				{key: "key1", body: `{"Amount": "10"}`, wantCode: 409},
+			},
+			wantBalance: "0.00",
+		},
+		"rejects a key kept for scheduled payments": {
+			requests: []request{
+				{key: "schedule:schedule1:0", body: `{"Amount": "10"}`, wantCode: 400},
+			},
+			wantBalance: "0.00",
+		},
+		"rejects a key that is too long": {
+			requests: []request{
+				{key: strings.Repeat("k", idempotency.MaxKeyLength+1), body: `{"Amount": "10"}`, wantCode: 400},
+			},
+			wantBalance: "0.00",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore(t, true, map[string]*wallet.Wallet{
+				"wallet1": {UserId: "user1", Balance: eur("0")},
+			})
+			if test.pending {
+				path := "/v1/user/user1/wallet/wallet1/deposit"
+				fingerprint := idempotency.Fingerprint(http.MethodPost, path, []byte(test.requests[0].body))
+				_, err := store.ReserveIdempotencyKey(idempotency.NewRecord("user1", "key1", fingerprint, time.Now()))
+				require.NoError(t, err)
+			}
+			srv := New(store)
+			var first string
+			for i, req := range test.requests {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set(idempotency.Header, req.key)
+				}
+				r = mux.SetURLVars(r, map[string]string{"user": "user1", "wallet": "wallet1"})
+				srv.Idempotent(srv.HandleDeposit)(w, r)
+				require.Equal(t, req.wantCode, w.Code)
+				require.Equal(t, req.wantReplayed, w.Header().Get("Idempotent-Replayed") == "true")
+				if i == 0 {
+					first = w.Body.String()
+				} else if req.wantReplayed {
+					require.Equal(t, first, w.Body.String())
+				}
+			}
+			got, err := store.GetWallet("wallet1")
+			require.NoError(t, err)
+			require.Equal(t, test.wantBalance, got.Balance.String())
+		})
+	}
+}
+
+func TestServer_IdempotentUnknownUser(t *testing.T) {
+	store := newTestStore(t, false, nil)
+	srv := New(store)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", strings.NewReader(`{"Amount": "10"}`))
+	r.Header.Set(idempotency.Header, "key1")
+	r = mux.SetURLVars(r, map[string]string{"user": "user1", "wallet": "wallet1"})
+	srv.Idempotent(srv.HandleDeposit)(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
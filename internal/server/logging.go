@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/gorilla/mux"
+)
+
+// LogRequests logs every request once it has been handled, with its route,
+// status and how long it took: at info level when it succeeded, warn when
+// the client's request was refused and error when the server failed. It runs
+// after RequestID, so the line carries the request's ID.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelInfo
+		switch {
+		case recorder.statusCode >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case recorder.statusCode >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		logging.FromContext(r.Context()).Log(r.Context(), level, "request handled",
+			"method", r.Method,
+			"route", routeOf(r),
+			"path", r.URL.Path,
+			"status", recorder.statusCode,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// routeOf returns the template of the route r matched, such as
+// /v1/user/{user}, or its path when it matched none. Variables are named
+// without the patterns they must match.
+func routeOf(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return r.URL.Path
+	}
+	var b strings.Builder
+	depth, inPattern := 0, false
+	for _, c := range template {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				inPattern = false
+			}
+		case c == ':' && depth == 1:
+			inPattern = true
+		}
+		if !inPattern {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// statusRecorder passes a response through while keeping its status.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode, r.wroteHeader = statusCode, true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRequests(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(RequestID, LogRequests)
+	r.HandleFunc("/v1/user/{user:[a-z0-9]{1,64}}/wallet/{wallet}/deposit", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errInvalidJSON)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		logging.FromContext(r.Context()).Info("checking health")
+	}).Methods(http.MethodGet)
+
+	for name, test := range map[string]struct {
+		method, path, requestId string
+
+		wantLines int
+		wantLevel string
+		wantRoute string
+	}{
+		"refused request": {
+			method:    http.MethodPost,
+			path:      "/v1/user/user1/wallet/wallet1/deposit",
+			requestId: "request1",
+			wantLines: 1,
+			wantLevel: "WARN",
+			wantRoute: "/v1/user/{user}/wallet/{wallet}/deposit",
+		},
+		"handler logs carry the request ID too": {
+			method:    http.MethodGet,
+			path:      "/v1/health",
+			requestId: "request2",
+			wantLines: 2,
+			wantLevel: "INFO",
+			wantRoute: "/v1/health",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			req := httptest.NewRequest(test.method, test.path, nil)
+			req.Header.Set(RequestIDHeader, test.requestId)
+			req = req.WithContext(logging.WithLogger(context.Background(), logging.New(&out, slog.LevelInfo)))
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+			require.Len(t, lines, test.wantLines)
+			for _, line := range lines {
+				var entry map[string]any
+				require.NoError(t, json.Unmarshal(line, &entry))
+				require.Equal(t, test.requestId, entry["request_id"])
+			}
+			var last map[string]any
+			require.NoError(t, json.Unmarshal(lines[len(lines)-1], &last))
+			require.Equal(t, "request handled", last["msg"])
+			require.Equal(t, test.wantLevel, last["level"])
+			require.Equal(t, test.wantRoute, last["route"])
+			require.Equal(t, test.path, last["path"])
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/metrics"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// operations names the calls counted as wallet operations, by method and
+// the end of their route.
+var operations = []struct {
+	method, suffix, name string
+}{
+	{http.MethodPost, "/wallet", "create_wallet"},
+	{http.MethodPost, "/deposit", "deposit"},
+	{http.MethodPost, "/withdraw", "withdrawal"},
+	{http.MethodPost, "/payment", "payment"},
+	{http.MethodPost, "/refund", "refund"},
+	{http.MethodPost, "/authorizations", "authorization"},
+	{http.MethodPost, "/capture", "capture"},
+	{http.MethodPost, "/void", "void"},
+	{http.MethodPost, "/status", "status_change"},
+	{http.MethodPost, "/adjustments", "adjustment"},
+	{http.MethodPut, "/limits", "set_limits"},
+}
+
+// operationOf returns the name of the wallet operation a call to route
+// makes, or "" when it makes none.
+func operationOf(method, route string) string {
+	for _, operation := range operations {
+		if method == operation.method && strings.HasSuffix(route, operation.suffix) {
+			return operation.name
+		}
+	}
+	return ""
+}
+
+// serverMetrics are what the server counts about the calls it handles and
+// the money they move.
+type serverMetrics struct {
+	registry   *metrics.Registry
+	requests   *metrics.Counter
+	durations  *metrics.Histogram
+	operations *metrics.Counter
+	volume     *metrics.Counter
+}
+
+func newServerMetrics(store Store) *serverMetrics {
+	registry := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: registry,
+		requests: registry.Counter("wallet_manager_http_requests_total",
+			"HTTP requests handled, by method, route and status.", "method", "route", "status"),
+		durations: registry.Histogram("wallet_manager_http_request_duration_seconds",
+			"How long HTTP requests took to handle, by method, route and status.", metrics.DefaultBuckets,
+			"method", "route", "status"),
+		operations: registry.Counter("wallet_manager_operations_total",
+			`Wallet operations attempted, by operation and result: "ok", or the code of the error that refused them.`,
+			"operation", "result"),
+		volume: registry.Counter("wallet_manager_transferred_amount_total",
+			"Money moved by transactions, by transaction type and the currency it left in.", "type", "currency"),
+	}
+	registry.GaugeFunc("wallet_manager_users", "Users, by role.", []string{"role"}, func() ([]metrics.Sample, error) {
+		counts, err := store.CountUsers()
+		if err != nil {
+			return nil, err
+		}
+		samples := []metrics.Sample{}
+		for role, users := range counts {
+			samples = append(samples, metrics.Sample{LabelValues: []string{role}, Value: float64(users)})
+		}
+		return samples, nil
+	})
+	registry.GaugeFunc("wallet_manager_wallets", "Wallets, by currency and status.", []string{"currency", "status"},
+		func() ([]metrics.Sample, error) {
+			counts, err := store.CountWallets()
+			if err != nil {
+				return nil, err
+			}
+			samples := []metrics.Sample{}
+			for _, count := range counts {
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{count.Currency, count.Status},
+					Value:       float64(count.Wallets),
+				})
+			}
+			return samples, nil
+		})
+	return m
+}
+
+// countTransaction adds an applied transaction to the volume moved. Every
+// transaction is counted once: by the wallet it debited, or by the wallet
+// it credited when it debited none, as deposits do.
+func (m *serverMetrics) countTransaction(e *event.Event) error {
+	if e.Type != wallet.EventDebited && e.Type != wallet.EventCredited {
+		return nil
+	}
+	var movement wallet.Movement
+	if err := json.Unmarshal(e.Data, &movement); err != nil {
+		return err
+	}
+	if e.Type == wallet.EventCredited && movement.Counterparty != "" {
+		return nil
+	}
+	amount, err := strconv.ParseFloat(movement.Amount.String(), 64)
+	if err != nil {
+		return err
+	}
+	m.volume.Add(amount, movement.Type, movement.Currency)
+	return nil
+}
+
+type metricsContextKey struct{}
+
+// requestOutcome is what Metrics learns about a call while it is handled:
+// the code of the error that refused it, if any.
+type requestOutcome struct {
+	errorCode string
+}
+
+// noteErrorCode tells Metrics why a call was refused. It does nothing when
+// the call is not measured.
+func noteErrorCode(ctx context.Context, code string) {
+	if outcome, ok := ctx.Value(metricsContextKey{}).(*requestOutcome); ok {
+		outcome.errorCode = code
+	}
+}
+
+// Metrics counts every request with its route and status and how long it
+// took, and every wallet operation with its result. It runs outside
+// Authenticate and RequireAdmin, so it counts the calls they refuse too.
+func (s *Server) Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		outcome := &requestOutcome{}
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), metricsContextKey{}, outcome)))
+
+		route, status := routeOf(r), strconv.Itoa(recorder.statusCode)
+		s.metrics.requests.Inc(r.Method, route, status)
+		s.metrics.durations.Observe(time.Since(start).Seconds(), r.Method, route, status)
+		if operation := operationOf(r.Method, route); operation != "" {
+			result := "ok"
+			switch {
+			case outcome.errorCode != "":
+				result = outcome.errorCode
+			case recorder.statusCode >= http.StatusBadRequest:
+				// Replays of a refused call carry no code, since writeError
+				// does not run again.
+				result = "error"
+			}
+			s.metrics.operations.Inc(operation, result)
+		}
+	})
+}
+
+// HandleMetrics serves the server's metrics in the Prometheus text format,
+// along with how many users and wallets there are at the time.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	r, store, credentials := newAdminRouter(t)
+	srv := New(store)
+	m := r.PathPrefix("/measured").Subrouter()
+	m.Use(srv.Metrics)
+	m.HandleFunc("/metrics", srv.HandleMetrics).Methods(http.MethodGet)
+	u := m.PathPrefix("/v1/user/{user}").Subrouter()
+	u.Use(srv.Authenticate)
+	u.HandleFunc("/wallet/{wallet}/balance", srv.HandleBalanceCheck).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/payment", srv.HandlePayment).Methods(http.MethodPost)
+
+	for _, call := range []struct {
+		method, path, apiKey, body string
+
+		wantCode int
+	}{
+		{http.MethodPost, "/measured/v1/user/user1/wallet/wallet1/payment", credentials["user1"].ApiKey,
+			`{"Creditor": "wallet2", "Amount": "30"}`, 200},
+		{http.MethodPost, "/measured/v1/user/user1/wallet/wallet1/payment", credentials["user1"].ApiKey,
+			`{"Creditor": "wallet2", "Amount": "300"}`, 403},
+		{http.MethodPost, "/measured/v1/user/user1/wallet/wallet1/payment", "",
+			`{"Creditor": "wallet2", "Amount": "30"}`, 401},
+		{http.MethodPost, "/measured/v1/user/user1/wallet/missing/payment", credentials["user1"].ApiKey,
+			`{"Creditor": "wallet2", "Amount": "30"}`, 404},
+		{http.MethodGet, "/measured/v1/user/user1/wallet/missing/balance", credentials["user1"].ApiKey, "", 404},
+		{http.MethodGet, "/measured/v1/user/user1/wallet/wallet1/balance", credentials["user1"].ApiKey, "", 200},
+	} {
+		require.Equal(t, call.wantCode, serveBody(r, call.method, call.path, call.apiKey, call.body).Code, call.path)
+	}
+	_, err := srv.Events().Dispatch()
+	require.NoError(t, err)
+
+	w := serve(r, http.MethodGet, "/measured/metrics", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+	for _, line := range []string{
+		`wallet_manager_http_requests_total{method="POST",route="/measured/v1/user/{user}/wallet/{wallet}/payment",status="200"} 1`,
+		`wallet_manager_http_requests_total{method="POST",route="/measured/v1/user/{user}/wallet/{wallet}/payment",status="401"} 1`,
+		`wallet_manager_http_requests_total{method="GET",route="/measured/v1/user/{user}/wallet/{wallet}/balance",status="404"} 1`,
+		`wallet_manager_http_request_duration_seconds_count{method="GET",route="/measured/v1/user/{user}/wallet/{wallet}/balance",status="200"} 1`,
+		`wallet_manager_operations_total{operation="payment",result="ok"} 1`,
+		`wallet_manager_operations_total{operation="payment",result="insufficient_funds"} 1`,
+		`wallet_manager_operations_total{operation="payment",result="unauthenticated"} 1`,
+		`wallet_manager_operations_total{operation="payment",result="wallet_not_found"} 1`,
+		`wallet_manager_transferred_amount_total{type="deposit",currency="EUR"} 200`,
+		`wallet_manager_transferred_amount_total{type="payment",currency="EUR"} 30`,
+		`wallet_manager_users{role="admin"} 1`,
+		`wallet_manager_users{role="customer"} 1`,
+		`wallet_manager_wallets{currency="EUR",status="active"} 2`,
+	} {
+		require.Contains(t, w.Body.String(), line+"\n")
+	}
+	require.NotContains(t, w.Body.String(), `operation="balance`, "balance checks are not wallet operations")
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+)
+
+// scheduleKeyPrefix starts the idempotency keys scheduled payments are made
+// under. Idempotent refuses client keys starting with it, so a client cannot
+// take a scheduled payment's key.
+const scheduleKeyPrefix = "schedule:"
+
+// errMaybePaid refuses a scheduled payment that an earlier run started but
+// did not finish, since it may have been made.
+var errMaybePaid = errors.New("an earlier run may already have made this payment")
+
+// payScheduled makes one of a schedule's payments the way HandlePayment
+// would for its user, held to the user's tier as it is when the payment is
+// made. Its logs name the schedule in place of a request.
+//
+// Each date is paid under an idempotency key of its own, as if the user had
+// sent one, so when the scheduler stops between paying and recording the
+// run, the next run gets the same payment back rather than paying again.
+func (s *Server) payScheduled(sch *schedule.Schedule) (wallet.Payment, error) {
+	payer, err := user.Get(s.store, sch.UserId, user.WithTiers(s.tiers), user.WithConverter(s.quoter.Value))
+	if err != nil {
+		return wallet.Payment{}, err
+	}
+	ctx := logging.With(context.Background(), "schedule_id", sch.Id)
+	key := scheduleKeyPrefix + sch.Occurrence()
+	record := idempotency.NewRecord(sch.UserId, key, idempotency.Fingerprint("SCHEDULE", key, nil), time.Now())
+	found, err := s.store.ReserveIdempotencyKey(record)
+	switch {
+	case err != nil:
+		return wallet.Payment{}, err
+	case found == nil:
+	case found.Fingerprint != record.Fingerprint:
+		return wallet.Payment{}, fmt.Errorf("%w: %s", idempotency.ErrKeyReused, key)
+	case !found.Completed():
+		return wallet.Payment{}, errMaybePaid
+	default:
+		var payment wallet.Payment
+		err := json.Unmarshal(found.Body, &payment)
+		return payment, err
+	}
+
+	payment, err := s.pay(ctx, payer, sch.WalletId, wallet.PaymentRequest{
+		TargetWallet: sch.Creditor,
+		Amount:       sch.Amount,
+	})
+	if err != nil {
+		// Nothing was paid, so let a retry pay the date.
+		if err := s.store.ReleaseIdempotencyKey(sch.UserId, key); err != nil {
+			logging.FromContext(ctx).Error("releasing idempotency key", "idempotency_key", key, "error", err)
+		}
+		return wallet.Payment{}, err
+	}
+	record.StatusCode = http.StatusOK
+	if record.Body, err = json.Marshal(payment); err == nil {
+		err = s.store.CompleteIdempotencyKey(record)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("storing scheduled payment", "idempotency_key", key, "error", err)
+	}
+	return payment, nil
+}
+
+// HandleCreateSchedule schedules payments out of a wallet.
+func (s *Server) HandleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	if _, ok := s.lookupUserWallet(w, r, userRequested, walletRequested); !ok {
+		return
+	}
+	var input schedule.Request
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	created, err := s.scheduler.Create(userRequested, walletRequested, input)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(created)
+}
+
+// HandleListSchedules lists the schedules paying out of a wallet, oldest
+// first.
+func (s *Server) HandleListSchedules(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	if _, ok := s.lookupUserWallet(w, r, userRequested, walletRequested); !ok {
+		return
+	}
+	schedules, err := s.scheduler.List(userRequested, walletRequested)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(schedules)
+}
+
+// HandleGetSchedule returns one of a wallet's schedules.
+func (s *Server) HandleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	s.handleSchedule(w, r, s.scheduler.Get)
+}
+
+// HandleScheduleRuns lists every attempt at paying a schedule, oldest first.
+func (s *Server) HandleScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	if _, ok := s.lookupUserWallet(w, r, userRequested, walletRequested); !ok {
+		return
+	}
+	runs, err := s.scheduler.Runs(userRequested, walletRequested, mux.Vars(r)["schedule"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(runs)
+}
+
+// HandlePauseSchedule stops a schedule until it is resumed.
+func (s *Server) HandlePauseSchedule(w http.ResponseWriter, r *http.Request) {
+	s.handleSchedule(w, r, s.scheduler.Pause)
+}
+
+// HandleResumeSchedule restarts a paused schedule from its next date.
+func (s *Server) HandleResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	s.handleSchedule(w, r, s.scheduler.Resume)
+}
+
+// HandleCancelSchedule stops a schedule for good.
+func (s *Server) HandleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+	s.handleSchedule(w, r, s.scheduler.Cancel)
+}
+
+// handleSchedule replies with the schedule named in the path after passing it
+// to action.
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request,
+	action func(userId, walletId, id string) (*schedule.Schedule, error)) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	if _, ok := s.lookupUserWallet(w, r, userRequested, walletRequested); !ok {
+		return
+	}
+	found, err := action(userRequested, walletRequested, mux.Vars(r)["schedule"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(found)
+}
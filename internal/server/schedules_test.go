@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// newScheduleServer serves the schedule endpoints of a server whose clock
+// reads *now, with wallet1 holding balance and wallet2 empty.
+func newScheduleServer(t *testing.T, now *time.Time, balance string, options ...Option) (*Server, *mux.Router) {
+	t.Helper()
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Balance: eur("0")},
+	})
+	source, err := wallet.Get(store, "wallet1")
+	require.NoError(t, err)
+	_, err = source.Deposit(context.Background(), money.MustParse(balance))
+	require.NoError(t, err)
+	options = append(options, WithScheduleOptions(
+		schedule.WithClock(func() time.Time { return *now }),
+		schedule.WithRetryPolicy(schedule.RetryPolicy{MaxRetries: 1, Interval: time.Hour}),
+	))
+	srv := New(store, options...)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("/wallet/{wallet}/balance", srv.HandleBalanceCheck).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/schedules", srv.HandleCreateSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/schedules", srv.HandleListSchedules).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/schedules/{schedule}", srv.HandleGetSchedule).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/schedules/{schedule}/runs", srv.HandleScheduleRuns).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/schedules/{schedule}/pause", srv.HandlePauseSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/schedules/{schedule}/resume", srv.HandleResumeSchedule).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/schedules/{schedule}/cancel", srv.HandleCancelSchedule).Methods(http.MethodPost)
+	return srv, r
+}
+
+func createSchedule(t *testing.T, r *mux.Router, body string) schedule.Schedule {
+	t.Helper()
+	w := serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/schedules", "", body)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var created schedule.Schedule
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	return created
+}
+
+func TestServer_Schedules(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	srv, r := newScheduleServer(t, &now, "100")
+	created := createSchedule(t, r,
+		`{"Creditor": "wallet2", "Amount": "30", "Frequency": "daily", "StartAt": "2024-03-01T09:00:00Z"}`)
+	require.Equal(t, schedule.StatusActive, created.Status)
+	require.Equal(t, "30", created.Amount.String())
+	path := "/v1/user/user1/wallet/wallet1/schedules/" + created.Id
+
+	// Three days pay, the fourth runs out of money and is retried an hour
+	// later.
+	runAt := func(at time.Time) {
+		now = at
+		_, err := srv.Scheduler().RunDue()
+		require.NoError(t, err)
+	}
+	for day := 0; day < 4; day++ {
+		runAt(time.Date(2024, 3, 1+day, 9, 0, 0, 0, time.UTC))
+	}
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name         string
+		method, path string
+		body         string
+
+		wantCode    int
+		wantErrCode string
+		wantBody    string
+	}{
+		{
+			name:   "unknown frequency",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/schedules",
+			body:        `{"Creditor": "wallet2", "Amount": "30", "Frequency": "hourly", "StartAt": "2024-04-01T09:00:00Z"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_schedule",
+		},
+		{
+			name:   "starts in the past",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/schedules",
+			body:        `{"Creditor": "wallet2", "Amount": "30", "Frequency": "once", "StartAt": "2024-03-01T09:00:00Z"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_schedule",
+		},
+		{
+			name:   "pays another currency",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/schedules",
+			body:        `{"Creditor": "wallet2", "Amount": "30", "Currency": "USD", "Frequency": "once", "StartAt": "2024-04-01T09:00:00Z"}`,
+			wantCode:    400,
+			wantErrCode: "currency_mismatch",
+		},
+		{
+			name:   "scheduled payments are paid",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet1/balance",
+			wantCode: 200,
+			wantBody: `{"Balance":"10.00","Available":"10.00","Currency":"EUR"}`,
+		},
+		{
+			name:   "waits to retry",
+			method: http.MethodGet, path: path,
+			wantCode: 200,
+			wantBody: fmt.Sprintf(`{"Id":%q,"WalletId":"wallet1","Creditor":"wallet2","Amount":"30.00","Frequency":"daily",
+				"StartAt":"2024-03-01T09:00:00Z","Status":"active","NextRunAt":"2024-03-04T10:00:00Z",
+				"CreatedAt":"2024-03-01T08:00:00Z"}`, created.Id),
+		},
+		{
+			name:   "pauses",
+			method: http.MethodPost, path: path + "/pause",
+			wantCode: 200,
+		},
+		{
+			name:   "pauses only active schedules",
+			method: http.MethodPost, path: path + "/pause",
+			wantCode:    409,
+			wantErrCode: "invalid_schedule_status",
+		},
+		{
+			name:   "resumes",
+			method: http.MethodPost, path: path + "/resume",
+			wantCode: 200,
+		},
+		{
+			name:   "cancels",
+			method: http.MethodPost, path: path + "/cancel",
+			wantCode: 200,
+		},
+		{
+			name:   "resumes only paused schedules",
+			method: http.MethodPost, path: path + "/resume",
+			wantCode:    409,
+			wantErrCode: "invalid_schedule_status",
+		},
+		{
+			name:   "schedules belong to their wallet",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet2/schedules/" + created.Id,
+			wantCode:    404,
+			wantErrCode: "schedule_not_found",
+		},
+		{
+			name:   "unknown schedule",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet1/schedules/missing/runs",
+			wantCode:    404,
+			wantErrCode: "schedule_not_found",
+		},
+	} {
+		w := serveBody(r, step.method, step.path, "", step.body)
+		require.Equal(t, step.wantCode, w.Code, "%s: %s", step.name, w.Body.String())
+		if step.wantErrCode != "" {
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, step.wantErrCode, got.Code, step.name)
+		}
+		if step.wantBody != "" {
+			require.JSONEq(t, step.wantBody, w.Body.String(), step.name)
+		}
+	}
+
+	w := serve(r, http.MethodGet, path+"/runs", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var runs []schedule.Run
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&runs))
+	require.Len(t, runs, 4)
+	require.Equal(t, schedule.RunSucceeded, runs[0].Status)
+	require.NotEmpty(t, runs[0].TransactionId)
+	require.Equal(t, schedule.RunRetrying, runs[3].Status)
+	require.Contains(t, runs[3].Error, wallet.ErrInsufficientFunds.Error())
+
+	w = serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/schedules", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var listed []schedule.Schedule
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listed))
+	require.Len(t, listed, 1)
+	require.Equal(t, schedule.StatusCancelled, listed[0].Status)
+}
+
+func TestServer_SchedulesPayLikePayments(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	srv, r := newScheduleServer(t, &now, "100", WithTiers(user.DefaultTiers))
+	created := createSchedule(t, r,
+		`{"Creditor": "wallet2", "Amount": "30", "Frequency": "once", "StartAt": "2024-03-01T09:00:00Z"}`)
+
+	// Unverified users cannot make payments, scheduled or not, and such
+	// failures are not retried.
+	now = created.StartAt
+	_, err := srv.Scheduler().RunDue()
+	require.NoError(t, err)
+
+	w := serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/schedules/"+created.Id+"/runs", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var runs []schedule.Run
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&runs))
+	require.Len(t, runs, 1)
+	require.Equal(t, schedule.RunFailed, runs[0].Status)
+	require.Contains(t, runs[0].Error, user.ErrVerificationRequired.Error())
+
+	w = serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/schedules/"+created.Id, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got schedule.Schedule
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, schedule.StatusCompleted, got.Status)
+}
+
+func TestServer_SchedulesPayEachDateOnce(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	srv, r := newScheduleServer(t, &now, "50")
+	sch := &schedule.Schedule{Id: "schedule1", UserId: "user1", WalletId: "wallet1", Creditor: "wallet2",
+		Amount: eur("30"), Frequency: schedule.Daily, StartAt: now}
+
+	// Clients cannot take a scheduled payment's key for requests of their own.
+	r.HandleFunc("/v1/user/{user}/wallet/{wallet}/deposit", srv.Idempotent(srv.HandleDeposit)).Methods(http.MethodPost)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", strings.NewReader(`{"Amount": "10"}`))
+	req.Header.Set(idempotency.Header, "schedule:"+sch.Occurrence())
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	// As if the scheduler stopped after paying, before recording the run.
+	paid, err := srv.payScheduled(sch)
+	require.NoError(t, err)
+	again, err := srv.payScheduled(sch)
+	require.NoError(t, err)
+	require.Equal(t, paid.TransactionId, again.TransactionId, "the date is not paid twice")
+	w = serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/balance", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"Balance":"20.00"`)
+
+	// A failed payment can be retried.
+	sch.Due = 1
+	_, err = srv.payScheduled(sch)
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+	_, err = srv.payScheduled(sch)
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+
+	// A payment an earlier run started but did not finish may have been made.
+	sch.Due = 2
+	found, err := srv.store.ReserveIdempotencyKey(idempotency.NewRecord("user1", "schedule:"+sch.Occurrence(),
+		idempotency.Fingerprint("SCHEDULE", "schedule:"+sch.Occurrence(), nil), time.Now()))
+	require.NoError(t, err)
+	require.Nil(t, found)
+	_, err = srv.payScheduled(sch)
+	require.ErrorIs(t, err, errMaybePaid)
+
+	// Nor is one whose key was kept for a different request, as clients could
+	// before such keys were refused.
+	sch.Due = 3
+	taken := idempotency.NewRecord("user1", "schedule:"+sch.Occurrence(),
+		idempotency.Fingerprint(http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", []byte(`{"Amount": "10"}`)),
+		time.Now())
+	_, err = srv.store.ReserveIdempotencyKey(taken)
+	require.NoError(t, err)
+	taken.StatusCode, taken.Body = http.StatusOK, []byte(`{"TransactionId": "deposit1"}`)
+	require.NoError(t, srv.store.CompleteIdempotencyKey(taken))
+	_, err = srv.payScheduled(sch)
+	require.ErrorIs(t, err, idempotency.ErrKeyReused)
+}
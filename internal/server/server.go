@@ -1,134 +1,715 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
 	"github.com/adrianos93/wallet-manager/internal/user"
 	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
 	"github.com/gorilla/mux"
 )
 
-func HandleCreateUser(w http.ResponseWriter, r *http.Request) {
-	createdUser := user.New()
+// Store is everything the server keeps its state in.
+type Store interface {
+	user.Store
+	auth.Store
+	idempotency.Store
+	schedule.Store
+	webhook.Store
+	event.Store
+	audit.Store
+}
+
+type Server struct {
+	store           Store
+	quoter          *exchange.Quoter
+	tiers           user.Tiers
+	holdDuration    time.Duration
+	scheduler       *schedule.Scheduler
+	scheduleOptions []schedule.Option
+	webhooks        *webhook.Dispatcher
+	webhookOptions  []webhook.Option
+	events          *event.Bus
+	eventOptions    []event.Option
+	audit           *audit.Log
+	auditOptions    []audit.Option
+	metrics         *serverMetrics
+}
+
+// Option configures optional parts of a Server.
+type Option func(*Server)
+
+// WithQuoter prices payments between wallets in different currencies. By
+// default no exchange rates are known, so such payments are refused.
+func WithQuoter(quoter *exchange.Quoter) Option {
+	return func(s *Server) {
+		s.quoter = quoter
+	}
+}
+
+// WithTiers limits what users may do until they are verified. By default
+// every user may do everything.
+func WithTiers(tiers user.Tiers) Option {
+	return func(s *Server) {
+		s.tiers = tiers
+	}
+}
+
+// WithHoldDuration sets how long authorizations hold funds for. By default
+// they hold them for wallet.DefaultHoldDuration.
+func WithHoldDuration(d time.Duration) Option {
+	return func(s *Server) {
+		s.holdDuration = d
+	}
+}
+
+// WithScheduleOptions configures the scheduler that makes scheduled
+// payments, such as its clock and retry policy.
+func WithScheduleOptions(options ...schedule.Option) Option {
+	return func(s *Server) {
+		s.scheduleOptions = append(s.scheduleOptions, options...)
+	}
+}
+
+// WithWebhookOptions configures the dispatcher that delivers webhooks, such
+// as its clock, HTTP client and retry policy.
+func WithWebhookOptions(options ...webhook.Option) Option {
+	return func(s *Server) {
+		s.webhookOptions = append(s.webhookOptions, options...)
+	}
+}
+
+// WithEventOptions configures the bus that hands the store's events to the
+// server's subscribers.
+func WithEventOptions(options ...event.Option) Option {
+	return func(s *Server) {
+		s.eventOptions = append(s.eventOptions, options...)
+	}
+}
+
+// WithAuditOptions configures the log the server audits calls in, such as
+// its clock.
+func WithAuditOptions(options ...audit.Option) Option {
+	return func(s *Server) {
+		s.auditOptions = append(s.auditOptions, options...)
+	}
+}
+
+func New(store Store, options ...Option) *Server {
+	s := &Server{store: store}
+	for _, option := range options {
+		option(s)
+	}
+	if s.quoter == nil {
+		s.quoter, _ = exchange.NewQuoter(exchange.StaticRates{}, money.Money{}, exchange.DefaultQuoteTTL)
+	}
+	s.scheduler = schedule.NewScheduler(store, s.payScheduled, s.scheduleOptions...)
+	s.webhooks = webhook.NewDispatcher(store, s.webhookOptions...)
+	s.events = event.NewBus(store, s.eventOptions...)
+	s.metrics = newServerMetrics(store)
+	s.events.Subscribe("webhooks", s.webhooks.Handle)
+	s.events.Subscribe("metrics", s.metrics.countTransaction)
+	s.audit = audit.NewLog(store, s.auditOptions...)
+	return s
+}
+
+// Scheduler makes the server's scheduled payments. Nothing runs them until
+// its Run or RunDue is called.
+func (s *Server) Scheduler() *schedule.Scheduler {
+	return s.scheduler
+}
+
+// Events hands the events the store records to the server's subscribers,
+// such as its webhooks, and takes further subscribers. Nothing is handed
+// out until its Run or Dispatch is called.
+func (s *Server) Events() *event.Bus {
+	return s.events
+}
+
+// Webhooks delivers the webhook events the server's events stand for.
+// Nothing is delivered until its Run or DeliverDue is called.
+func (s *Server) Webhooks() *webhook.Dispatcher {
+	return s.webhooks
+}
+
+// CreateUserResponse is a new user along with the API key it authenticates
+// with.
+type CreateUserResponse struct {
+	*user.User
+	*auth.Credential
+}
+
+// HandleCreateUser creates a customer. The body is optional, and may hold
+// any of the user's details.
+func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var input user.Details
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	createdUser, err := user.New(r.Context(), s.store, input, user.WithTiers(s.tiers), user.WithConverter(s.quoter.Value))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditUser(r, createdUser.Id)
+	credential, err := auth.Issue(s.store, createdUser.Id, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(createdUser)
+	_ = json.NewEncoder(w).Encode(CreateUserResponse{User: createdUser, Credential: credential})
 }
 
-func HandleCreateWallet(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleCreateWallet(w http.ResponseWriter, r *http.Request) {
 	userRequested := mux.Vars(r)["user"]
-	userData, found := user.Users[userRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("user %s not found", userRequested).Error(), http.StatusNotFound)
+	userData, ok := s.lookupUser(w, r, userRequested)
+	if !ok {
 		return
 	}
-	walletToReturn := userData.CreateWallet()
+	var input wallet.CreateWalletRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	walletToReturn, err := userData.CreateWallet(r.Context(), input.Currency, input.Name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditCreatedWallet(r, walletToReturn)
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(walletToReturn)
 }
 
-func HandleDeposit(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleDeposit(w http.ResponseWriter, r *http.Request) {
 	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
-	userData, found := user.Users[userRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("user %s not found", userRequested).Error(), http.StatusNotFound)
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
 		return
 	}
-	_, found = wallet.Wallets[walletRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("wallet %s not found", walletRequested).Error(), http.StatusNotFound)
+	var (
+		input           wallet.Deposit
+		balanceToReturn wallet.Balance
+	)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
 		return
 	}
-	var input wallet.Deposit
+	amount, err := input.Amount.WithCurrency(input.Currency)
+	if err == nil {
+		balanceToReturn, err = userData.Deposit(r.Context(), walletRequested, amount, wallet.WithDetails(input.TransactionDetails))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(balanceToReturn)
+}
+
+func (s *Server) HandleWithdrawal(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	var (
+		input           wallet.Withdraw
+		balanceToReturn wallet.Balance
+	)
 	defer r.Body.Close()
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, errors.New("invalid json").Error(), http.StatusBadRequest)
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	amount, err := input.Amount.WithCurrency(input.Currency)
+	if err == nil {
+		balanceToReturn, err = userData.Withdraw(r.Context(), walletRequested, amount, wallet.WithDetails(input.TransactionDetails))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(balanceToReturn)
+}
+
+func (s *Server) HandleBalanceCheck(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
 		return
 	}
-	balanceToReturn, err := userData.Deposit(walletRequested, input.Amount)
+	balanceToReturn, err := userData.CheckBalance(r.Context(), walletRequested)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, r, err)
 		return
 	}
 	_ = json.NewEncoder(w).Encode(balanceToReturn)
 }
 
-func HandleWithdrawal(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandlePayment(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	var paymentRequest wallet.PaymentRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&paymentRequest); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	payment, err := s.pay(r.Context(), userData, walletRequested, paymentRequest)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(payment)
+}
+
+// pay makes a payment out of one of the payer's wallets. Payments asked for
+// over HTTP and scheduled ones both go through it.
+func (s *Server) pay(ctx context.Context, payer *user.User, walletId string, paymentRequest wallet.PaymentRequest) (wallet.Payment, error) {
+	price := s.quoter.Quote
+	if paymentRequest.QuoteId != "" {
+		// Check the quote up front: payments within one currency never ask
+		// for a price, but a quote for another payment must still fail.
+		quote, err := s.quoter.Locked(paymentRequest.QuoteId,
+			quoteScope(payer.Id, walletId, paymentRequest.TargetWallet))
+		if err != nil {
+			return wallet.Payment{}, err
+		}
+		price = func(from, to string) (*exchange.Quote, error) {
+			return quote, nil
+		}
+	}
+	amount, err := paymentRequest.Amount.WithCurrency(paymentRequest.Currency)
+	if err != nil {
+		return wallet.Payment{}, err
+	}
+	return payer.InitiatePayment(ctx, walletId, paymentRequest.TargetWallet, amount, price,
+		wallet.WithDetails(paymentRequest.TransactionDetails))
+}
+
+func (s *Server) HandleQuote(w http.ResponseWriter, r *http.Request) {
 	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
-	userData, found := user.Users[userRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("user %s not found", userRequested).Error(), http.StatusNotFound)
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	var quoteRequest wallet.PaymentRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&quoteRequest); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	scope := quoteScope(userRequested, walletRequested, quoteRequest.TargetWallet)
+	lock := func(from, to string) (*exchange.Quote, error) {
+		return s.quoter.Lock(from, to, scope)
+	}
+	var quote wallet.PaymentQuote
+	amount, err := quoteRequest.Amount.WithCurrency(quoteRequest.Currency)
+	if err == nil {
+		quote, err = userData.QuotePayment(r.Context(), walletRequested, quoteRequest.TargetWallet, amount, lock)
+	}
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	_, found = wallet.Wallets[walletRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("wallet %s not found", walletRequested).Error(), http.StatusNotFound)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(quote)
+}
+
+// HandleAuthorize holds funds in a wallet for a payment captured later.
+func (s *Server) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
 		return
 	}
-	var input wallet.Withdraw
+	var input wallet.AuthorizationRequest
 	defer r.Body.Close()
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, errors.New("invalid json").Error(), http.StatusBadRequest)
+		writeError(w, r, errInvalidJSON)
 		return
 	}
-	balanceToReturn, err := userData.Withdraw(walletRequested, input.Amount)
+	var authorization *wallet.Authorization
+	amount, err := input.Amount.WithCurrency(input.Currency)
+	if err == nil {
+		authorization, err = userData.Authorize(r.Context(), walletRequested, input.TargetWallet, amount, s.holdDuration)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, r, err)
 		return
 	}
-	_ = json.NewEncoder(w).Encode(balanceToReturn)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(authorization)
 }
 
-func HandleBalanceCheck(w http.ResponseWriter, r *http.Request) {
+// HandleListAuthorizations lists a wallet's authorizations, oldest first.
+func (s *Server) HandleListAuthorizations(w http.ResponseWriter, r *http.Request) {
 	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
-	userData, found := user.Users[userRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("user %s not found", userRequested).Error(), http.StatusNotFound)
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	authorizations, err := userData.Authorizations(r.Context(), walletRequested)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	_, found = wallet.Wallets[walletRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("wallet %s not found", walletRequested).Error(), http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(authorizations)
+}
+
+// HandleGetAuthorization returns one of a wallet's authorizations.
+func (s *Server) HandleGetAuthorization(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
 		return
 	}
-	balanceToReturn, err := userData.CheckBalance(walletRequested)
+	authorization, err := userData.Authorization(r.Context(), walletRequested, mux.Vars(r)["authorization"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, r, err)
 		return
 	}
-	_ = json.NewEncoder(w).Encode(balanceToReturn)
+	_ = json.NewEncoder(w).Encode(authorization)
 }
 
-func HandlePayment(w http.ResponseWriter, r *http.Request) {
+// HandleCapture pays out part or all of an authorization. An empty body
+// captures everything it still holds.
+func (s *Server) HandleCapture(w http.ResponseWriter, r *http.Request) {
 	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
-	userData, found := user.Users[userRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("user %s not found", userRequested).Error(), http.StatusNotFound)
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
 		return
 	}
-	_, found = wallet.Wallets[walletRequested]
-	if !found {
-		http.Error(w, fmt.Errorf("wallet %s not found", walletRequested).Error(), http.StatusNotFound)
+	var input wallet.CaptureRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errInvalidJSON)
 		return
 	}
-	var paymentRequest wallet.PaymentRequest
-	if err := json.NewDecoder(r.Body).Decode(&paymentRequest); err != nil {
-		http.Error(w, errors.New("invalid json").Error(), http.StatusBadRequest)
+	amount := input.Amount
+	if amount != nil {
+		withCurrency, err := amount.WithCurrency(input.Currency)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		amount = &withCurrency
+	}
+	capture, err := userData.Capture(r.Context(), walletRequested, mux.Vars(r)["authorization"], amount)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	payment, err := userData.InitiatePayment(walletRequested, paymentRequest.TargetWallet, paymentRequest.Amount)
+	_ = json.NewEncoder(w).Encode(capture)
+}
+
+// HandleVoid releases what an authorization still holds.
+func (s *Server) HandleVoid(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	authorization, err := userData.Void(r.Context(), walletRequested, mux.Vars(r)["authorization"])
 	if err != nil {
-		switch {
-		case strings.Contains(err.Error(), "unauthorized"):
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(authorization)
+}
+
+// HandleRefund returns part or all of a payment the wallet received to the
+// wallet that made it. An empty body refunds everything not refunded yet.
+func (s *Server) HandleRefund(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	var input wallet.RefundRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	amount := input.Amount
+	if amount != nil {
+		withCurrency, err := amount.WithCurrency(input.Currency)
+		if err != nil {
+			writeError(w, r, err)
 			return
-		case strings.Contains(err.Error(), "insufficient funds"):
-			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+		amount = &withCurrency
+	}
+	refund, err := userData.Refund(r.Context(), walletRequested, mux.Vars(r)["transaction"], amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(refund)
+}
+
+func (s *Server) HandleTransactions(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	query, err := parseTransactionQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	history, err := userData.History(r.Context(), walletRequested, query, r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(history)
+}
+
+// HandleGetUser returns the user along with the total it holds in each
+// currency.
+func (s *Server) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return
+	}
+	profile, err := userData.Profile(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(profile)
+}
+
+// HandleUpdateProfile changes the details set in the body, leaving the rest
+// as they are.
+func (s *Server) HandleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return
+	}
+	var input user.Details
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := userData.UpdateDetails(r.Context(), input); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	profile, err := userData.Profile(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(profile)
+}
+
+// HandleSubmitKyc asks for the user to be verified.
+func (s *Server) HandleSubmitKyc(w http.ResponseWriter, r *http.Request) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return
+	}
+	var input user.KycSubmission
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	if err := userData.SubmitKyc(r.Context(), input.Documents); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(userData.Kyc)
+}
+
+// HandleListWallets returns a page of the user's wallets, ordered by the
+// sort query parameter, with the totals of all of them.
+func (s *Server) HandleListWallets(w http.ResponseWriter, r *http.Request) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return
+	}
+	values := r.URL.Query()
+	query := user.WalletsQuery{Sort: values.Get("sort")}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			writeError(w, r, fmt.Errorf("%w: limit must be a positive number", wallet.ErrInvalidQuery))
 			return
 		}
+		query.Limit = limit
 	}
-	_ = json.NewEncoder(w).Encode(payment)
+	list, err := userData.Wallets(r.Context(), query, values.Get("cursor"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// HandleChangeStatus freezes or closes one of the user's wallets.
+func (s *Server) HandleChangeStatus(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	var input wallet.StatusRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	change, err := userData.ChangeWalletStatus(r.Context(), walletRequested, input.Status, input.Reason)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(change)
+}
+
+// HandleWalletLimits returns the limits on one of the user's wallets.
+func (s *Server) HandleWalletLimits(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	limits, err := userData.WalletLimits(r.Context(), walletRequested)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(limits)
+}
+
+// HandleStatusChanges lists every change of a wallet's status, oldest first.
+func (s *Server) HandleStatusChanges(w http.ResponseWriter, r *http.Request) {
+	userRequested, walletRequested := mux.Vars(r)["user"], mux.Vars(r)["wallet"]
+	userData, ok := s.lookupUserWallet(w, r, userRequested, walletRequested)
+	if !ok {
+		return
+	}
+	changes, err := userData.WalletStatusChanges(r.Context(), walletRequested)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(changes)
+}
+
+func (s *Server) lookupUser(w http.ResponseWriter, r *http.Request, userRequested string) (*user.User, bool) {
+	userData, err := user.Get(s.store, userRequested, user.WithTiers(s.tiers), user.WithConverter(s.quoter.Value))
+	if errors.Is(err, user.ErrUserNotFound) {
+		err = fmt.Errorf("%w: %s", user.ErrUserNotFound, userRequested)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return userData, true
+}
+
+func (s *Server) lookupUserWallet(w http.ResponseWriter, r *http.Request, userRequested, walletRequested string) (*user.User, bool) {
+	userData, ok := s.lookupUser(w, r, userRequested)
+	if !ok {
+		return nil, false
+	}
+	_, err := s.store.GetWallet(walletRequested)
+	if errors.Is(err, wallet.ErrWalletNotFound) {
+		err = fmt.Errorf("%w: %s", wallet.ErrWalletNotFound, walletRequested)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return userData, true
+}
+
+// quoteScope ties a locked quote to the user and wallets it was asked for.
+func quoteScope(userId, sourceWalletId, targetWalletId string) string {
+	return userId + "/" + sourceWalletId + "/" + targetWalletId
+}
+
+// parseTransactionQuery reads the history filters from the query string:
+// from and to as RFC 3339 times, direction as "in" or "out", counterparty as
+// a wallet ID, min_amount and max_amount as decimals, and limit.
+func parseTransactionQuery(values url.Values) (wallet.TransactionQuery, error) {
+	query := wallet.TransactionQuery{
+		Direction:      values.Get("direction"),
+		CounterpartyId: values.Get("counterparty"),
+		Reference:      values.Get("reference"),
+	}
+	// Metadata filters read as metadata[key]=value.
+	for param := range values {
+		key, ok := strings.CutPrefix(param, "metadata[")
+		if !ok {
+			continue
+		}
+		key, ok = strings.CutSuffix(key, "]")
+		if !ok {
+			return wallet.TransactionQuery{}, fmt.Errorf("%w: %s must read metadata[key]", wallet.ErrInvalidQuery, param)
+		}
+		if query.Metadata == nil {
+			query.Metadata = map[string]string{}
+		}
+		query.Metadata[key] = values.Get(param)
+	}
+	for param, field := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if raw := values.Get(param); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return wallet.TransactionQuery{}, fmt.Errorf("%w: %s must be an RFC 3339 time", wallet.ErrInvalidQuery, param)
+			}
+			*field = parsed
+		}
+	}
+	for param, field := range map[string]**money.Money{"min_amount": &query.MinAmount, "max_amount": &query.MaxAmount} {
+		if raw := values.Get(param); raw != "" {
+			parsed, err := money.Parse(raw)
+			if err != nil {
+				return wallet.TransactionQuery{}, fmt.Errorf("%w: %s must be a decimal amount", wallet.ErrInvalidQuery, param)
+			}
+			*field = &parsed
+		}
+	}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return wallet.TransactionQuery{}, fmt.Errorf("%w: limit must be a positive number", wallet.ErrInvalidQuery)
+		}
+		query.Limit = limit
+	}
+	return query, nil
 }
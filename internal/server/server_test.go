@@ -1,42 +1,130 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
 	"github.com/adrianos93/wallet-manager/internal/user"
 	"github.com/adrianos93/wallet-manager/internal/wallet"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
 )
 
+func eur(amount string) money.Money {
+	m, err := money.MustParse(amount).In("EUR")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// newTestStore seeds user1 when asked to, along with every non-nil wallet
+// under its map key.
+func newTestStore(t *testing.T, withUser bool, wallets map[string]*wallet.Wallet) *memory.Store {
+	t.Helper()
+	store := memory.New()
+	if withUser {
+		require.NoError(t, store.CreateUser(&user.User{Id: "user1"}))
+	}
+	for id, w := range wallets {
+		if w == nil {
+			continue
+		}
+		w.Id = id
+		require.NoError(t, store.CreateWallet(w))
+	}
+	return store
+}
+
 func TestServer_HandleCreateUser(t *testing.T) {
 	for name, test := range map[string]struct {
-		wantCode int
+		body string
+
+		wantCode    int
+		wantErrCode string
+		wantName    string
 	}{
 		"golden path": {
 			wantCode: 201,
 		},
+		"with details": {
+			body:     `{"Name": "Ada Lovelace", "Country": "gb"}`,
+			wantCode: 201,
+			wantName: "Ada Lovelace",
+		},
+		"invalid details": {
+			body:        `{"Email": "not an email"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_profile",
+		},
+		"bad request": {
+			body:        `i'm not json`,
+			wantCode:    400,
+			wantErrCode: "invalid_json",
+		},
 	} {
 		t.Run(name, func(t *testing.T) {
+			store := memory.New()
 			w := httptest.NewRecorder()
-			r := httptest.NewRequest(http.MethodPost, "/v1/user", nil)
-			HandleCreateUser(w, r)
-			require.Equal(t, test.wantCode, w.Code)
+			r := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(test.body))
+			New(store).HandleCreateUser(w, r)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantErrCode != "" {
+				var got ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				require.Equal(t, test.wantErrCode, got.Code)
+				return
+			}
+
+			var created struct {
+				Id, KeyId, ApiKey, Name string
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+			require.Equal(t, test.wantName, created.Name)
+			stored, err := store.GetUser(created.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantName, stored.Name)
+			key, err := auth.Authenticate(store, created.ApiKey)
+			require.NoError(t, err)
+			require.Equal(t, created.Id, key.UserId)
+			require.Equal(t, created.KeyId, key.Id)
 		})
 	}
 }
 
 func TestServer_HandleCreateWallet(t *testing.T) {
 	for name, test := range map[string]struct {
-		wantCode int
-		wantErr  bool
+		body string
+
+		wantCode     int
+		wantCurrency string
+		wantErr      bool
 	}{
 		"golden path": {
-			wantCode: 201,
+			wantCode:     201,
+			wantCurrency: "EUR",
+		},
+		"with a currency": {
+			body:         `{"Currency": "JPY"}`,
+			wantCode:     201,
+			wantCurrency: "JPY",
+		},
+		"unknown currency": {
+			body:     `{"Currency": "ABC"}`,
+			wantCode: 400,
+		},
+		"bad request": {
+			body:     `i'm not json`,
+			wantCode: 400,
 		},
 		"user not found": {
 			wantCode: 404,
@@ -44,27 +132,29 @@ func TestServer_HandleCreateWallet(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user.Users["user1"] = &user.User{
-				Id:      "user1",
-				Wallets: map[string]*wallet.Wallet{},
-			}
+			store := newTestStore(t, !test.wantErr, nil)
 			vars := map[string]string{
 				"user": "user1",
 			}
-			if test.wantErr {
-				delete(user.Users, "user1")
-			}
 			w := httptest.NewRecorder()
-			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet", nil)
+			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet", strings.NewReader(test.body))
 			r = mux.SetURLVars(r, vars)
-			HandleCreateWallet(w, r)
+			New(store).HandleCreateWallet(w, r)
 			require.Equal(t, test.wantCode, w.Code)
+			if test.wantCurrency != "" {
+				var created struct{ Id, Balance, Currency string }
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+				require.Equal(t, test.wantCurrency, created.Currency)
+				stored, err := store.GetWallet(created.Id)
+				require.NoError(t, err)
+				require.Equal(t, test.wantCurrency, stored.Balance.Currency)
+			}
 		})
 	}
 }
 
 func TestServer_HandleDeposit(t *testing.T) {
-	input := wallet.Deposit{Amount: 100}
+	input := wallet.Deposit{Amount: money.MustParse("100")}
 	for name, test := range map[string]struct {
 		wantCode                                   int
 		body                                       []byte
@@ -86,6 +176,26 @@ func TestServer_HandleDeposit(t *testing.T) {
 			wantCode: 400,
 			body:     []byte(`i'm not json`),
 		},
+		"too many decimal places": {
+			wantCode: 400,
+			body:     []byte(`{"Amount": "100.255"}`),
+		},
+		"matching currency": {
+			wantCode: 200,
+			body:     []byte(`{"Amount": "100", "Currency": "EUR"}`),
+		},
+		"currency mismatch": {
+			wantCode: 400,
+			body:     []byte(`{"Amount": "100", "Currency": "USD"}`),
+		},
+		"with details": {
+			wantCode: 200,
+			body:     []byte(`{"Amount": "100", "Reference": "INV-1", "Description": "Top-up", "Metadata": {"order": "1"}}`),
+		},
+		"invalid details": {
+			wantCode: 400,
+			body:     []byte(`{"Amount": "100", "Metadata": {"order id": "1"}}`),
+		},
 		"not your wallet": {
 			wantCode:       401,
 			body:           func() (b []byte) { b, _ = json.Marshal(input); return }(),
@@ -93,41 +203,32 @@ func TestServer_HandleDeposit(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user.Users["user1"] = &user.User{
-				Id: "user1",
-				Wallets: map[string]*wallet.Wallet{
-					"wallet1": {Id: "wallet1", Balance: 0},
-				},
+			owner := "user1"
+			if test.wantDepositErr {
+				owner = "user2"
 			}
-			wallet.Wallets["wallet1"] = &wallet.Wallet{
-				Id:      "wallet1",
-				Balance: 0,
+			wallets := map[string]*wallet.Wallet{
+				"wallet1": {UserId: owner, Balance: eur("0")},
+			}
+			if test.wantWalletErr {
+				wallets["wallet1"] = nil
 			}
+			store := newTestStore(t, !test.wantUserErr, wallets)
 			vars := map[string]string{
 				"user":   "user1",
 				"wallet": "wallet1",
 			}
-			if test.wantUserErr {
-				delete(user.Users, "user1")
-			}
-			if test.wantWalletErr {
-				delete(wallet.Wallets, "wallet1")
-			}
-			if test.wantDepositErr {
-				walletToDelete := user.Users["user1"]
-				delete(walletToDelete.Wallets, "wallet1")
-			}
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/deposit", strings.NewReader(string(test.body)))
 			r = mux.SetURLVars(r, vars)
-			HandleDeposit(w, r)
+			New(store).HandleDeposit(w, r)
 			require.Equal(t, test.wantCode, w.Code)
 		})
 	}
 }
 
 func TestServer_HandleWithdrawal(t *testing.T) {
-	input := wallet.Withdraw{Amount: 100}
+	input := wallet.Withdraw{Amount: money.MustParse("100")}
 	for name, test := range map[string]struct {
 		wantCode                                    int
 		body                                        []byte
@@ -156,34 +257,25 @@ func TestServer_HandleWithdrawal(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user.Users["user1"] = &user.User{
-				Id: "user1",
-				Wallets: map[string]*wallet.Wallet{
-					"wallet1": {Id: "wallet1", Balance: 100},
-				},
+			owner := "user1"
+			if test.wantWithdrawErr {
+				owner = "user2"
 			}
-			wallet.Wallets["wallet1"] = &wallet.Wallet{
-				Id:      "wallet1",
-				Balance: 0,
+			wallets := map[string]*wallet.Wallet{
+				"wallet1": {UserId: owner, Balance: eur("100")},
 			}
+			if test.wantWalletErr {
+				wallets["wallet1"] = nil
+			}
+			store := newTestStore(t, !test.wantUserErr, wallets)
 			vars := map[string]string{
 				"user":   "user1",
 				"wallet": "wallet1",
 			}
-			if test.wantUserErr {
-				delete(user.Users, "user1")
-			}
-			if test.wantWalletErr {
-				delete(wallet.Wallets, "wallet1")
-			}
-			if test.wantWithdrawErr {
-				walletToDelete := user.Users["user1"]
-				delete(walletToDelete.Wallets, "wallet1")
-			}
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/withdraw", strings.NewReader(string(test.body)))
 			r = mux.SetURLVars(r, vars)
-			HandleWithdrawal(w, r)
+			New(store).HandleWithdrawal(w, r)
 			require.Equal(t, test.wantCode, w.Code)
 		})
 	}
@@ -211,35 +303,29 @@ func TestServer_HandleBalanceCheck(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user.Users["user1"] = &user.User{
-				Id: "user1",
-				Wallets: map[string]*wallet.Wallet{
-					"wallet1": {Id: "wallet1", Balance: 0},
-				},
+			owner := "user1"
+			if test.wantBalanceErr {
+				owner = "user2"
+			}
+			wallets := map[string]*wallet.Wallet{
+				"wallet1": {UserId: owner, Balance: eur("0")},
 			}
-			wallet.Wallets["wallet1"] = &wallet.Wallet{
-				Id:      "wallet1",
-				Balance: 0,
+			if test.wantWalletErr {
+				wallets["wallet1"] = nil
 			}
+			store := newTestStore(t, !test.wantUserErr, wallets)
 			vars := map[string]string{
 				"user":   "user1",
 				"wallet": "wallet1",
 			}
-			if test.wantUserErr {
-				delete(user.Users, "user1")
-			}
-			if test.wantWalletErr {
-				delete(wallet.Wallets, "wallet1")
-			}
-			if test.wantBalanceErr {
-				walletToDelete := user.Users["user1"]
-				delete(walletToDelete.Wallets, "wallet1")
-			}
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest(http.MethodGet, "/v1/user/user1/wallet/wallet1/balance", nil)
 			r = mux.SetURLVars(r, vars)
-			HandleBalanceCheck(w, r)
+			New(store).HandleBalanceCheck(w, r)
 			require.Equal(t, test.wantCode, w.Code)
+			if test.wantCode == 200 {
+				require.JSONEq(t, `{"Balance":"0.00","Available":"0.00","Currency":"EUR"}`, w.Body.String())
+			}
 		})
 	}
 }
@@ -247,11 +333,11 @@ func TestServer_HandleBalanceCheck(t *testing.T) {
 func TestServer_HandlePayment(t *testing.T) {
 	input := wallet.PaymentRequest{
 		TargetWallet: "wallet2",
-		Amount:       50,
+		Amount:       money.MustParse("50"),
 	}
 	inputInsufficient := wallet.PaymentRequest{
 		TargetWallet: "wallet2",
-		Amount:       150,
+		Amount:       money.MustParse("150"),
 	}
 	for name, test := range map[string]struct {
 		wantCode                                   int
@@ -274,6 +360,10 @@ func TestServer_HandlePayment(t *testing.T) {
 			wantCode: 400,
 			body:     []byte(`i'm not json`),
 		},
+		"negative amount": {
+			wantCode: 400,
+			body:     []byte(`{"Creditor": "wallet2", "Amount": -50}`),
+		},
 		"not your wallet": {
 			wantCode:       401,
 			body:           func() (b []byte) { b, _ = json.Marshal(input); return }(),
@@ -283,41 +373,786 @@ func TestServer_HandlePayment(t *testing.T) {
 			wantCode: 403,
 			body:     func() (b []byte) { b, _ = json.Marshal(inputInsufficient); return }(),
 		},
+		"currency mismatch": {
+			wantCode: 400,
+			body:     []byte(`{"Creditor": "wallet2", "Amount": "50", "Currency": "USD"}`),
+		},
+		"no rate to the creditor's currency": {
+			wantCode: 422,
+			body:     []byte(`{"Creditor": "wallet3", "Amount": "50"}`),
+		},
+		"unknown creditor": {
+			wantCode: 404,
+			body:     []byte(`{"Creditor": "missing", "Amount": "50"}`),
+		},
+		"paying itself": {
+			wantCode: 400,
+			body:     []byte(`{"Creditor": "wallet1", "Amount": "50"}`),
+		},
+		"with details": {
+			wantCode: 200,
+			body:     []byte(`{"Creditor": "wallet2", "Amount": "50", "Reference": "INV-1", "Metadata": {"order": "1"}}`),
+		},
+		"description too long": {
+			wantCode: 400,
+			body:     []byte(`{"Creditor": "wallet2", "Amount": "50", "Description": "` + strings.Repeat("d", 501) + `"}`),
+		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user.Users["user1"] = &user.User{
-				Id: "user1",
-				Wallets: map[string]*wallet.Wallet{
-					"wallet1": {Id: "wallet1", Balance: 100},
-				},
+			owner := "user1"
+			if test.wantPaymentErr {
+				owner = "user2"
 			}
-			wallet.Wallets["wallet1"] = &wallet.Wallet{
-				Id:      "wallet1",
-				Balance: 100,
+			wallets := map[string]*wallet.Wallet{
+				"wallet1": {UserId: owner, Balance: eur("100")},
+				"wallet2": {UserId: "user2", Balance: eur("0")},
+				"wallet3": {UserId: "user2", Balance: money.Money{Scale: 2, Currency: "USD"}},
 			}
-			wallet.Wallets["wallet2"] = &wallet.Wallet{
-				Id:      "wallet2",
-				Balance: 0,
+			if test.wantWalletErr {
+				wallets["wallet1"] = nil
 			}
+			store := newTestStore(t, !test.wantUserErr, wallets)
 			vars := map[string]string{
 				"user":   "user1",
 				"wallet": "wallet1",
 			}
-			if test.wantUserErr {
-				delete(user.Users, "user1")
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/payment", strings.NewReader(string(test.body)))
+			r = mux.SetURLVars(r, vars)
+			New(store).HandlePayment(w, r)
+			require.Equal(t, test.wantCode, w.Code)
+		})
+	}
+}
+
+func TestServer_HandleQuote(t *testing.T) {
+	for name, test := range map[string]struct {
+		body string
+
+		wantCode      int
+		wantConverted string
+	}{
+		"quotes a payment in another currency": {
+			body:          `{"Creditor": "wallet3", "Amount": "40"}`,
+			wantCode:      201,
+			wantConverted: "49.5",
+		},
+		"quotes a payment in the same currency": {
+			body:          `{"Creditor": "wallet2", "Amount": "40"}`,
+			wantCode:      201,
+			wantConverted: "40",
+		},
+		"unknown creditor": {
+			body:     `{"Creditor": "missing", "Amount": "40"}`,
+			wantCode: 404,
+		},
+		"no rate": {
+			body:     `{"Creditor": "wallet4", "Amount": "40"}`,
+			wantCode: 422,
+		},
+		"negative amount": {
+			body:     `{"Creditor": "wallet3", "Amount": "-40"}`,
+			wantCode: 400,
+		},
+		"bad request": {
+			body:     `i'm not json`,
+			wantCode: 400,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, store := newQuoteServer(t)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/quote", strings.NewReader(test.body))
+			r = mux.SetURLVars(r, map[string]string{"user": "user1", "wallet": "wallet1"})
+			srv.HandleQuote(w, r)
+			require.Equal(t, test.wantCode, w.Code)
+			if test.wantCode != 201 {
+				return
+			}
+			var got wallet.PaymentQuote
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.NotEmpty(t, got.QuoteId)
+			require.Equal(t, test.wantConverted, got.ConvertedAmount.String())
+
+			source, err := store.GetWallet("wallet1")
+			require.NoError(t, err)
+			require.Equal(t, eur("100"), source.Balance, "quoting moves no money")
+		})
+	}
+}
+
+func TestServer_HandlePaymentWithQuote(t *testing.T) {
+	srv, store := newQuoteServer(t)
+	quote := func(creditor string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/quote",
+			strings.NewReader(`{"Creditor": "`+creditor+`", "Amount": "40"}`))
+		r = mux.SetURLVars(r, map[string]string{"user": "user1", "wallet": "wallet1"})
+		srv.HandleQuote(w, r)
+		require.Equal(t, 201, w.Code)
+		var got wallet.PaymentQuote
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+		return got.QuoteId
+	}
+	pay := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/payment", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"user": "user1", "wallet": "wallet1"})
+		srv.HandlePayment(w, r)
+		return w
+	}
+
+	quoteId := quote("wallet3")
+	w := pay(`{"Creditor": "wallet2", "Amount": "40", "QuoteId": "` + quoteId + `"}`)
+	require.Equal(t, 422, w.Code, "a quote only pays the creditor it was asked for")
+	w = pay(`{"Creditor": "wallet3", "Amount": "40", "QuoteId": "unknown"}`)
+	require.Equal(t, 422, w.Code)
+
+	w = pay(`{"Creditor": "wallet3", "Amount": "40", "QuoteId": "` + quoteId + `"}`)
+	require.Equal(t, 200, w.Code)
+	var got wallet.Payment
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "60", got.Balance.String())
+	require.NotNil(t, got.Conversion)
+	require.Equal(t, quoteId, got.Conversion.QuoteId)
+	require.Equal(t, "1.2375", got.Conversion.Rate.String())
+	require.Equal(t, "49.5", got.Conversion.ConvertedAmount.String())
+
+	target, err := store.GetWallet("wallet3")
+	require.NoError(t, err)
+	require.Equal(t, "49.50", target.Balance.String())
+
+	// Without a quote the payment is priced at the current rate.
+	w = pay(`{"Creditor": "wallet3", "Amount": "10"}`)
+	require.Equal(t, 200, w.Code)
+}
+
+// newQuoteServer serves user1's EUR wallet1 with 100 in it, and user2's
+// wallet2 in EUR, wallet3 in USD and wallet4 in GBP, with rates for EUR/USD
+// only.
+func newQuoteServer(t *testing.T) (*Server, *memory.Store) {
+	t.Helper()
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user2", Balance: eur("0")},
+		"wallet3": {UserId: "user2", Balance: money.Money{Scale: 2, Currency: "USD"}},
+		"wallet4": {UserId: "user2", Balance: money.Money{Scale: 2, Currency: "GBP"}},
+	})
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id: "seed", Type: wallet.TypeDeposit, TargetWalletId: "wallet1", Amount: eur("100"), Timestamp: time.Now(),
+	}))
+	quoter, err := exchange.NewQuoter(exchange.StaticRates{"EUR/USD": money.MustParse("1.25")}, money.MustParse("0.01"), time.Minute)
+	require.NoError(t, err)
+	return New(store, WithQuoter(quoter)), store
+}
+
+func TestServer_HandleTransactions(t *testing.T) {
+	for name, test := range map[string]struct {
+		query string
+
+		wantCode                                   int
+		wantTransactions                           int
+		wantUserErr, wantWalletErr, wantHistoryErr bool
+	}{
+		"golden path": {
+			wantCode:         200,
+			wantTransactions: 2,
+		},
+		"filters by direction": {
+			query:            "?direction=out",
+			wantCode:         200,
+			wantTransactions: 1,
+		},
+		"filters by amount": {
+			query:            "?min_amount=20",
+			wantCode:         200,
+			wantTransactions: 1,
+		},
+		"limits the page": {
+			query:            "?limit=1",
+			wantCode:         200,
+			wantTransactions: 1,
+		},
+		"filters by reference": {
+			query:            "?reference=INV-1",
+			wantCode:         200,
+			wantTransactions: 1,
+		},
+		"filters by metadata": {
+			query:            "?metadata[order]=1&metadata[channel]=web",
+			wantCode:         200,
+			wantTransactions: 1,
+		},
+		"filters by other metadata": {
+			query:            "?metadata[order]=2",
+			wantCode:         200,
+			wantTransactions: 0,
+		},
+		"invalid metadata filter": {
+			query:    "?metadata[order=1",
+			wantCode: 400,
+		},
+		"invalid metadata key": {
+			query:    "?metadata[order%20id]=1",
+			wantCode: 400,
+		},
+		"invalid time": {
+			query:    "?from=yesterday",
+			wantCode: 400,
+		},
+		"invalid direction": {
+			query:    "?direction=sideways",
+			wantCode: 400,
+		},
+		"invalid limit": {
+			query:    "?limit=0",
+			wantCode: 400,
+		},
+		"invalid cursor": {
+			query:    "?cursor=nope",
+			wantCode: 400,
+		},
+		"user not found": {
+			wantCode:    404,
+			wantUserErr: true,
+		},
+		"wallet not found": {
+			wantCode:      404,
+			wantWalletErr: true,
+		},
+		"not your wallet": {
+			wantCode:       401,
+			wantHistoryErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			owner := "user1"
+			if test.wantHistoryErr {
+				owner = "user2"
+			}
+			wallets := map[string]*wallet.Wallet{
+				"wallet1": {UserId: owner, Balance: eur("0")},
 			}
 			if test.wantWalletErr {
-				delete(wallet.Wallets, "wallet1")
+				wallets["wallet1"] = nil
 			}
-			if test.wantPaymentErr {
-				walletToDelete := user.Users["user1"]
-				delete(walletToDelete.Wallets, "wallet1")
+			store := newTestStore(t, !test.wantUserErr, wallets)
+			if !test.wantUserErr && !test.wantWalletErr {
+				require.NoError(t, store.ApplyTransaction(&wallet.Transaction{Id: "tx1", Type: wallet.TypeDeposit, TargetWalletId: "wallet1", Amount: eur("30"), Timestamp: time.Now(),
+					Reference: "INV-1", Metadata: map[string]string{"order": "1", "channel": "web"}}))
+				require.NoError(t, store.ApplyTransaction(&wallet.Transaction{Id: "tx2", Type: wallet.TypeWithdrawal, SourceWalletId: "wallet1", Amount: eur("10"), Timestamp: time.Now()}))
+			}
+			vars := map[string]string{
+				"user":   "user1",
+				"wallet": "wallet1",
 			}
 			w := httptest.NewRecorder()
-			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/payment", strings.NewReader(string(test.body)))
+			r := httptest.NewRequest(http.MethodGet, "/v1/user/user1/wallet/wallet1/transactions"+test.query, nil)
 			r = mux.SetURLVars(r, vars)
-			HandlePayment(w, r)
+			New(store).HandleTransactions(w, r)
 			require.Equal(t, test.wantCode, w.Code)
+			if test.wantCode == 200 {
+				var got wallet.History
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				require.Len(t, got.Transactions, test.wantTransactions)
+			}
 		})
 	}
 }
+
+func TestServer_HandleChangeStatus(t *testing.T) {
+	for name, test := range map[string]struct {
+		body    string
+		balance string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		"freezes": {
+			body:     `{"Status": "frozen", "Reason": "lost my phone"}`,
+			balance:  "10",
+			wantCode: 200,
+		},
+		"closes an empty wallet": {
+			body:     `{"Status": "closed", "Reason": "no longer needed"}`,
+			balance:  "0",
+			wantCode: 200,
+		},
+		"cannot close a wallet holding money": {
+			body:        `{"Status": "closed", "Reason": "no longer needed"}`,
+			balance:     "10",
+			wantCode:    409,
+			wantErrCode: "balance_not_zero",
+		},
+		"cannot reactivate": {
+			body:        `{"Status": "active", "Reason": "found my phone"}`,
+			balance:     "10",
+			wantCode:    403,
+			wantErrCode: "operator_only",
+		},
+		"unknown status": {
+			body:        `{"Status": "paused", "Reason": "holiday"}`,
+			balance:     "10",
+			wantCode:    400,
+			wantErrCode: "invalid_status",
+		},
+		"bad request": {
+			body:        `i'm not json`,
+			balance:     "10",
+			wantCode:    400,
+			wantErrCode: "invalid_json",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore(t, true, map[string]*wallet.Wallet{
+				"wallet1": {UserId: "user1", Balance: eur("0")},
+			})
+			if test.balance != "0" {
+				found, err := wallet.Get(store, "wallet1")
+				require.NoError(t, err)
+				_, err = found.Deposit(context.Background(), money.MustParse(test.balance))
+				require.NoError(t, err)
+			}
+			vars := map[string]string{
+				"user":   "user1",
+				"wallet": "wallet1",
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/user/user1/wallet/wallet1/status", strings.NewReader(test.body))
+			r = mux.SetURLVars(r, vars)
+			New(store).HandleChangeStatus(w, r)
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantErrCode != "" {
+				var got ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				require.Equal(t, test.wantErrCode, got.Code)
+				return
+			}
+
+			w = httptest.NewRecorder()
+			r = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/user/user1/wallet/wallet1/status-changes", nil), vars)
+			New(store).HandleStatusChanges(w, r)
+			require.Equal(t, 200, w.Code)
+			var changes []wallet.StatusChange
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&changes))
+			require.Len(t, changes, 1)
+			require.Equal(t, "user1", changes[0].ChangedBy)
+		})
+	}
+}
+
+func TestServer_HandleListWallets(t *testing.T) {
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Name: "Savings", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Name: "Bills", Balance: eur("0")},
+		"wallet3": {UserId: "user2", Balance: eur("0")},
+	})
+	found, err := wallet.Get(store, "wallet1")
+	require.NoError(t, err)
+	_, err = found.Deposit(context.Background(), money.MustParse("10.50"))
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("", New(store).HandleGetUser).Methods(http.MethodGet)
+	u.HandleFunc("/wallets", New(store).HandleListWallets).Methods(http.MethodGet)
+
+	for name, test := range map[string]struct {
+		path string
+
+		wantCode   int
+		wantIds    []string
+		wantCursor string
+	}{
+		"every wallet": {
+			path:     "/v1/user/user1/wallets?sort=name",
+			wantCode: 200,
+			wantIds:  []string{"wallet2", "wallet1"},
+		},
+		"paged": {
+			path:       "/v1/user/user1/wallets?sort=-balance&limit=1",
+			wantCode:   200,
+			wantIds:    []string{"wallet1"},
+			wantCursor: "wallet1",
+		},
+		"next page": {
+			path:     "/v1/user/user1/wallets?sort=-balance&limit=1&cursor=wallet1",
+			wantCode: 200,
+			wantIds:  []string{"wallet2"},
+		},
+		"unknown sort": {
+			path:     "/v1/user/user1/wallets?sort=colour",
+			wantCode: 400,
+		},
+		"invalid limit": {
+			path:     "/v1/user/user1/wallets?limit=none",
+			wantCode: 400,
+		},
+		"user not found": {
+			path:     "/v1/user/missing/wallets",
+			wantCode: 404,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, test.path, "")
+			require.Equal(t, test.wantCode, w.Code, w.Body.String())
+			if test.wantCode != 200 {
+				return
+			}
+			var got user.WalletList
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			ids := []string{}
+			for _, found := range got.Wallets {
+				ids = append(ids, found.Id)
+			}
+			require.Equal(t, test.wantIds, ids)
+			require.Equal(t, test.wantCursor, got.NextCursor)
+			require.Len(t, got.Totals, 1)
+			require.Equal(t, "10.5", got.Totals[0].Balance.String())
+			require.Equal(t, 2, got.Totals[0].Wallets)
+		})
+	}
+
+	w := serve(r, http.MethodGet, "/v1/user/user1", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got user.Profile
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "user1", got.Id)
+	require.Len(t, got.Totals, 1)
+}
+
+func TestServer_Kyc(t *testing.T) {
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Balance: eur("0")},
+	})
+	require.NoError(t, store.CreateUser(&user.User{Id: "operator1", Role: user.RoleAdmin}))
+	operator, err := auth.Issue(store, "operator1", time.Now())
+	require.NoError(t, err)
+	srv := New(store, WithTiers(user.DefaultTiers))
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("", srv.HandleGetUser).Methods(http.MethodGet)
+	u.HandleFunc("", srv.HandleUpdateProfile).Methods(http.MethodPatch)
+	u.HandleFunc("/kyc", srv.HandleSubmitKyc).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/deposit", srv.HandleDeposit).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/payment", srv.HandlePayment).Methods(http.MethodPost)
+	a := r.PathPrefix("/admin/v1").Subrouter()
+	a.Use(srv.RequireAdmin)
+	a.HandleFunc("/users", srv.HandleAdminListUsers).Methods(http.MethodGet)
+	a.HandleFunc("/users/{user}/kyc", srv.HandleAdminReviewKyc).Methods(http.MethodPost)
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name         string
+		method, path string
+		body         string
+		apiKey       string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		{
+			name:   "unverified deposits are capped",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/deposit",
+			body:        `{"Amount": "1000.01"}`,
+			wantCode:    403,
+			wantErrCode: "limit_exceeded",
+		},
+		{
+			name:   "unverified deposits up to the cap",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/deposit",
+			body:     `{"Amount": "1000"}`,
+			wantCode: 200,
+		},
+		{
+			name:   "the cap covers every wallet of the user",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet2/deposit",
+			body:        `{"Amount": "0.01"}`,
+			wantCode:    403,
+			wantErrCode: "limit_exceeded",
+		},
+		{
+			name:   "unverified users cannot pay",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/payment",
+			body:        `{"Creditor": "wallet2", "Amount": "10"}`,
+			wantCode:    403,
+			wantErrCode: "verification_required",
+		},
+		{
+			name:   "verification needs a complete profile",
+			method: http.MethodPost, path: "/v1/user/user1/kyc",
+			body:        `{"Documents": [{"Type": "passport", "Reference": "scan-123"}]}`,
+			wantCode:    422,
+			wantErrCode: "profile_incomplete",
+		},
+		{
+			name:   "completes the profile",
+			method: http.MethodPatch, path: "/v1/user/user1",
+			body:     `{"Name": "Ada Lovelace", "DateOfBirth": "1990-12-10", "Country": "GB"}`,
+			wantCode: 200,
+		},
+		{
+			name:   "submits documents",
+			method: http.MethodPost, path: "/v1/user/user1/kyc",
+			body:     `{"Documents": [{"Type": "passport", "Reference": "scan-123"}]}`,
+			wantCode: 202,
+		},
+		{
+			name:   "identity is locked while pending",
+			method: http.MethodPatch, path: "/v1/user/user1",
+			body:        `{"Name": "Somebody Else"}`,
+			wantCode:    409,
+			wantErrCode: "profile_locked",
+		},
+		{
+			name:   "operators find pending users",
+			method: http.MethodGet, path: "/admin/v1/users?kyc=pending",
+			apiKey:   operator.ApiKey,
+			wantCode: 200,
+		},
+		{
+			name:   "operators verify",
+			method: http.MethodPost, path: "/admin/v1/users/user1/kyc",
+			body:     `{"Status": "verified"}`,
+			apiKey:   operator.ApiKey,
+			wantCode: 200,
+		},
+		{
+			name:   "verified users can pay",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/payment",
+			body:     `{"Creditor": "wallet2", "Amount": "10"}`,
+			wantCode: 200,
+		},
+		{
+			name:   "verified deposits are not capped",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/deposit",
+			body:     `{"Amount": "5000"}`,
+			wantCode: 200,
+		},
+		{
+			name:   "reviews happen once",
+			method: http.MethodPost, path: "/admin/v1/users/user1/kyc",
+			body:        `{"Status": "rejected", "Reason": "changed our mind"}`,
+			apiKey:      operator.ApiKey,
+			wantCode:    409,
+			wantErrCode: "invalid_kyc_status",
+		},
+	} {
+		w := serveBody(r, step.method, step.path, step.apiKey, step.body)
+		require.Equal(t, step.wantCode, w.Code, "%s: %s", step.name, w.Body.String())
+		if step.wantErrCode != "" {
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, step.wantErrCode, got.Code, step.name)
+		}
+	}
+
+	w := serve(r, http.MethodGet, "/v1/user/user1", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var got user.Profile
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "Ada Lovelace", got.Name)
+	require.Equal(t, user.TierVerified, got.Tier)
+	require.Equal(t, user.KycVerified, got.Kyc.Status)
+	require.Equal(t, "operator1", got.Kyc.ReviewedBy)
+}
+
+func TestServer_Authorizations(t *testing.T) {
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Balance: eur("0")},
+	})
+	source, err := wallet.Get(store, "wallet1")
+	require.NoError(t, err)
+	_, err = source.Deposit(context.Background(), money.MustParse("100"))
+	require.NoError(t, err)
+	srv := New(store, WithHoldDuration(time.Hour))
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("/wallet/{wallet}/balance", srv.HandleBalanceCheck).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/withdraw", srv.HandleWithdrawal).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/authorizations", srv.HandleAuthorize).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/authorizations", srv.HandleListAuthorizations).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/authorizations/{authorization}", srv.HandleGetAuthorization).Methods(http.MethodGet)
+	u.HandleFunc("/wallet/{wallet}/authorizations/{authorization}/capture", srv.HandleCapture).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/authorizations/{authorization}/void", srv.HandleVoid).Methods(http.MethodPost)
+
+	w := serveBody(r, http.MethodPost, "/v1/user/user1/wallet/wallet1/authorizations", "", `{"Creditor": "wallet2", "Amount": "60"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var authorization wallet.Authorization
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&authorization))
+	require.Equal(t, wallet.HoldPending, authorization.Status)
+	require.WithinDuration(t, time.Now().Add(time.Hour), authorization.ExpiresAt, time.Minute)
+	path := "/v1/user/user1/wallet/wallet1/authorizations/" + authorization.Id
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name         string
+		method, path string
+		body         string
+
+		wantCode    int
+		wantErrCode string
+		wantBody    string
+	}{
+		{
+			name:   "holds more than is available",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/authorizations",
+			body:        `{"Creditor": "wallet2", "Amount": "40.01"}`,
+			wantCode:    403,
+			wantErrCode: "insufficient_funds",
+		},
+		{
+			name:   "balance shows what is available",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet1/balance",
+			wantCode: 200,
+			wantBody: `{"Balance":"100.00","Available":"40.00","Currency":"EUR"}`,
+		},
+		{
+			name:   "withdrawals leave held funds alone",
+			method: http.MethodPost, path: "/v1/user/user1/wallet/wallet1/withdraw",
+			body:        `{"Amount": "40.01"}`,
+			wantCode:    403,
+			wantErrCode: "insufficient_funds",
+		},
+		{
+			name:   "captures part",
+			method: http.MethodPost, path: path + "/capture",
+			body:     `{"Amount": "25"}`,
+			wantCode: 200,
+		},
+		{
+			name:   "captures no more than is left",
+			method: http.MethodPost, path: path + "/capture",
+			body:        `{"Amount": "35.01"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_amount",
+		},
+		{
+			name:   "voids the rest",
+			method: http.MethodPost, path: path + "/void",
+			wantCode: 200,
+		},
+		{
+			name:   "captures only pending authorizations",
+			method: http.MethodPost, path: path + "/capture",
+			wantCode:    409,
+			wantErrCode: "authorization_closed",
+		},
+		{
+			name:   "balance is released",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet1/balance",
+			wantCode: 200,
+			wantBody: `{"Balance":"75.00","Available":"75.00","Currency":"EUR"}`,
+		},
+		{
+			name:   "authorizations belong to their wallet",
+			method: http.MethodGet, path: "/v1/user/user1/wallet/wallet2/authorizations/" + authorization.Id,
+			wantCode:    404,
+			wantErrCode: "authorization_not_found",
+		},
+	} {
+		w := serveBody(r, step.method, step.path, "", step.body)
+		require.Equal(t, step.wantCode, w.Code, "%s: %s", step.name, w.Body.String())
+		if step.wantErrCode != "" {
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, step.wantErrCode, got.Code, step.name)
+		}
+		if step.wantBody != "" {
+			require.JSONEq(t, step.wantBody, w.Body.String(), step.name)
+		}
+	}
+
+	w = serve(r, http.MethodGet, "/v1/user/user1/wallet/wallet1/authorizations", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var listed []wallet.Authorization
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listed))
+	require.Len(t, listed, 1)
+	require.Equal(t, wallet.HoldVoided, listed[0].Status)
+	require.Equal(t, "25", listed[0].Captured.String())
+}
+
+func TestServer_HandleRefund(t *testing.T) {
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user1", Balance: eur("0")},
+	})
+	payer, err := wallet.Get(store, "wallet1")
+	require.NoError(t, err)
+	_, err = payer.Deposit(context.Background(), money.MustParse("100"))
+	require.NoError(t, err)
+	paid, err := payer.InitiatePayment(context.Background(), "wallet2", money.MustParse("40"), nil)
+	require.NoError(t, err)
+	srv := New(store)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("/wallet/{wallet}/payment/{transaction}/refund", srv.HandleRefund).Methods(http.MethodPost)
+	path := "/v1/user/user1/wallet/wallet2/payment/" + paid.TransactionId + "/refund"
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name string
+		path string
+		body string
+
+		wantCode    int
+		wantErrCode string
+		wantBody    string
+	}{
+		{
+			name:        "payers cannot refund themselves",
+			path:        "/v1/user/user1/wallet/wallet1/payment/" + paid.TransactionId + "/refund",
+			wantCode:    404,
+			wantErrCode: "transaction_not_found",
+		},
+		{
+			name:        "refunds in the payment's currency",
+			path:        path,
+			body:        `{"Amount": "10", "Currency": "USD"}`,
+			wantCode:    400,
+			wantErrCode: "currency_mismatch",
+		},
+		{
+			name:     "refunds part",
+			path:     path,
+			body:     `{"Amount": "15"}`,
+			wantCode: 201,
+			wantBody: `"RefundOf":{"TransactionId":"` + paid.TransactionId + `","Amount":"40.00","Refunded":"15.00","Currency":"EUR","Status":"partially_refunded"}`,
+		},
+		{
+			name:        "refunds no more than is left",
+			path:        path,
+			body:        `{"Amount": "25.01"}`,
+			wantCode:    400,
+			wantErrCode: "invalid_amount",
+		},
+		{
+			name:     "refunds the rest",
+			path:     path,
+			wantCode: 201,
+			wantBody: `"Refunded":"40.00","Currency":"EUR","Status":"refunded"`,
+		},
+		{
+			name:        "refunds once",
+			path:        path,
+			wantCode:    409,
+			wantErrCode: "payment_refunded",
+		},
+	} {
+		w := serveBody(r, http.MethodPost, step.path, "", step.body)
+		require.Equal(t, step.wantCode, w.Code, "%s: %s", step.name, w.Body.String())
+		if step.wantErrCode != "" {
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, step.wantErrCode, got.Code, step.name)
+		}
+		if step.wantBody != "" {
+			require.Contains(t, w.Body.String(), step.wantBody, step.name)
+		}
+	}
+
+	payer, err = wallet.Get(store, "wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), payer.Balance)
+}
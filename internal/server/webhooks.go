@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	"github.com/gorilla/mux"
+)
+
+// HandleCreateWebhook registers an endpoint for the user's events.
+func (s *Server) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.createWebhook(w, r, owner)
+	}
+}
+
+// HandleListWebhooks lists the user's endpoints, oldest first.
+func (s *Server) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.listWebhooks(w, r, owner)
+	}
+}
+
+// HandleDeleteWebhook removes one of the user's endpoints.
+func (s *Server) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.deleteWebhook(w, r, owner)
+	}
+}
+
+// HandleListDeliveries lists the deliveries to the user's endpoints, newest
+// first.
+func (s *Server) HandleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.listDeliveries(w, r, owner)
+	}
+}
+
+// HandleGetDelivery returns one of the deliveries to the user's endpoints.
+func (s *Server) HandleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.handleDelivery(w, r, owner, http.StatusOK, s.webhooks.Delivery)
+	}
+}
+
+// HandleReplayDelivery sends a delivery to the user's endpoint again.
+func (s *Server) HandleReplayDelivery(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.webhookOwner(w, r); ok {
+		s.handleDelivery(w, r, owner, http.StatusCreated, s.webhooks.Replay)
+	}
+}
+
+// HandleAdminCreateWebhook registers a global endpoint, which receives every
+// user's events.
+func (s *Server) HandleAdminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	s.createWebhook(w, r, "")
+}
+
+func (s *Server) HandleAdminListWebhooks(w http.ResponseWriter, r *http.Request) {
+	s.listWebhooks(w, r, "")
+}
+
+func (s *Server) HandleAdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	s.deleteWebhook(w, r, "")
+}
+
+func (s *Server) HandleAdminListDeliveries(w http.ResponseWriter, r *http.Request) {
+	s.listDeliveries(w, r, "")
+}
+
+func (s *Server) HandleAdminGetDelivery(w http.ResponseWriter, r *http.Request) {
+	s.handleDelivery(w, r, "", http.StatusOK, s.webhooks.Delivery)
+}
+
+func (s *Server) HandleAdminReplayDelivery(w http.ResponseWriter, r *http.Request) {
+	s.handleDelivery(w, r, "", http.StatusCreated, s.webhooks.Replay)
+}
+
+// webhookOwner returns the user in the path, whose webhooks the request is
+// about.
+func (s *Server) webhookOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userData, ok := s.lookupUser(w, r, mux.Vars(r)["user"])
+	if !ok {
+		return "", false
+	}
+	return userData.Id, true
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request, owner string) {
+	var input webhook.EndpointRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+	registration, err := s.webhooks.Register(owner, input)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(registration)
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request, owner string) {
+	endpoints, err := s.webhooks.Endpoints(owner)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(endpoints)
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request, owner string) {
+	if err := s.webhooks.Remove(owner, mux.Vars(r)["endpoint"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveries reads the endpoint, status and limit filters from the query
+// string.
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request, owner string) {
+	values := r.URL.Query()
+	query := webhook.DeliveryQuery{EndpointId: values.Get("endpoint"), Status: values.Get("status")}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			writeError(w, r, fmt.Errorf("%w: limit must be a positive number", webhook.ErrInvalidQuery))
+			return
+		}
+		query.Limit = limit
+	}
+	deliveries, err := s.webhooks.Deliveries(owner, query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(deliveries)
+}
+
+// handleDelivery replies with status and what action returns for the
+// delivery named in the path.
+func (s *Server) handleDelivery(w http.ResponseWriter, r *http.Request, owner string, status int,
+	action func(userId, id string) (*webhook.Delivery, error)) {
+	delivery, err := action(owner, mux.Vars(r)["delivery"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(delivery)
+}
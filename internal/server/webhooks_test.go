@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// receivedEvents collects the events posted to a test server, by path.
+type receivedEvents struct {
+	mu     sync.Mutex
+	events map[string][]webhook.Event
+}
+
+func newEventReceiver(t *testing.T) (*receivedEvents, *httptest.Server) {
+	t.Helper()
+	received := &receivedEvents{events: map[string][]webhook.Event{}}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received.mu.Lock()
+		defer received.mu.Unlock()
+		received.events[r.URL.Path] = append(received.events[r.URL.Path], event)
+	}))
+	t.Cleanup(receiver.Close)
+	return received, receiver
+}
+
+func (r *receivedEvents) types(path string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := []string{}
+	for _, event := range r.events[path] {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestServer_Webhooks(t *testing.T) {
+	store := newTestStore(t, true, map[string]*wallet.Wallet{
+		"wallet1": {UserId: "user1", Balance: eur("0")},
+		"wallet2": {UserId: "user2", Balance: eur("0")},
+	})
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	received, receiver := newEventReceiver(t)
+	srv := New(store, WithWebhookOptions(webhook.WithPrivateNetworks()))
+	// The seeded wallets' events are handled before any endpoint exists.
+	_, err := srv.Events().Dispatch()
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	u := r.PathPrefix("/v1/user/{user}").Subrouter()
+	u.HandleFunc("/wallet", srv.HandleCreateWallet).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/deposit", srv.HandleDeposit).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/payment", srv.HandlePayment).Methods(http.MethodPost)
+	u.HandleFunc("/wallet/{wallet}/status", srv.HandleChangeStatus).Methods(http.MethodPost)
+	u.HandleFunc("/webhooks", srv.HandleCreateWebhook).Methods(http.MethodPost)
+	u.HandleFunc("/webhooks", srv.HandleListWebhooks).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries", srv.HandleListDeliveries).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries/{delivery}", srv.HandleGetDelivery).Methods(http.MethodGet)
+	u.HandleFunc("/webhooks/deliveries/{delivery}/replay", srv.HandleReplayDelivery).Methods(http.MethodPost)
+	u.HandleFunc("/webhooks/{endpoint}", srv.HandleDeleteWebhook).Methods(http.MethodDelete)
+	a := r.PathPrefix("/admin/v1").Subrouter()
+	a.HandleFunc("/webhooks", srv.HandleAdminCreateWebhook).Methods(http.MethodPost)
+	a.HandleFunc("/webhooks/deliveries", srv.HandleAdminListDeliveries).Methods(http.MethodGet)
+
+	register := func(path, body string) webhook.Registration {
+		t.Helper()
+		w := serveBody(r, http.MethodPost, path, "", body)
+		require.Equal(t, 201, w.Code, w.Body.String())
+		var registration webhook.Registration
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&registration))
+		require.NotEmpty(t, registration.Secret)
+		return registration
+	}
+	mine := register("/v1/user/user1/webhooks", fmt.Sprintf(`{"URL": %q}`, receiver.URL+"/user1"))
+	register("/v1/user/user2/webhooks", fmt.Sprintf(`{"URL": %q, "Events": ["payment.received"]}`, receiver.URL+"/user2"))
+	register("/admin/v1/webhooks", fmt.Sprintf(`{"URL": %q, "Events": ["wallet.frozen"]}`, receiver.URL+"/ops"))
+
+	for _, request := range []struct{ path, body string }{
+		{"/v1/user/user1/wallet", `{"Currency": "EUR"}`},
+		{"/v1/user/user1/wallet/wallet1/deposit", `{"Amount": "100", "Reference": "top-up"}`},
+		{"/v1/user/user1/wallet/wallet1/payment", `{"Creditor": "wallet2", "Amount": "30", "Reference": "INV-1"}`},
+		{"/v1/user/user1/wallet/wallet1/status", `{"Status": "frozen", "Reason": "lost card"}`},
+	} {
+		w := serveBody(r, http.MethodPost, request.path, "", request.body)
+		require.Less(t, w.Code, 300, "%s: %s", request.path, w.Body.String())
+	}
+	_, err = srv.Events().Dispatch()
+	require.NoError(t, err)
+	delivered, err := srv.Webhooks().DeliverDue()
+	require.NoError(t, err)
+	require.Equal(t, 6, delivered)
+
+	require.Equal(t, []string{webhook.EventWalletCreated, webhook.EventDepositCompleted, webhook.EventPaymentSent,
+		webhook.EventWalletFrozen}, received.types("/user1"))
+	require.Equal(t, []string{webhook.EventPaymentReceived}, received.types("/user2"))
+	require.Equal(t, []string{webhook.EventWalletFrozen}, received.types("/ops"))
+	var sent webhook.TransactionData
+	require.NoError(t, json.Unmarshal(received.events["/user1"][2].Data, &sent))
+	require.Equal(t, "70", sent.Balance.String(), "the payer's balance after paying")
+	paid := received.events["/user2"][0]
+	require.Equal(t, "user2", paid.UserId)
+	require.JSONEq(t, fmt.Sprintf(`{"TransactionId": %q, "WalletId": "wallet2", "Counterparty": "wallet1",
+		"Amount": "30.00", "Currency": "EUR", "Balance": "30.00", "Reference": "INV-1"}`, sent.TransactionId),
+		string(paid.Data))
+
+	w := serve(r, http.MethodGet, "/v1/user/user1/webhooks/deliveries?status=succeeded", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var deliveries []webhook.Delivery
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&deliveries))
+	require.Len(t, deliveries, 4)
+	require.Equal(t, webhook.EventWalletFrozen, deliveries[0].EventType, "deliveries are newest first")
+	replayPath := "/v1/user/user1/webhooks/deliveries/" + deliveries[0].Id + "/replay"
+
+	// Each step runs against the state the steps before it left behind.
+	for _, step := range []struct {
+		name         string
+		method, path string
+		body         string
+
+		wantCode    int
+		wantErrCode string
+	}{
+		{
+			name:   "unknown event",
+			method: http.MethodPost, path: "/v1/user/user1/webhooks",
+			body:        `{"URL": "https://example.com", "Events": ["wallet.deleted"]}`,
+			wantCode:    400,
+			wantErrCode: "invalid_webhook",
+		},
+		{
+			name:   "unknown delivery status",
+			method: http.MethodGet, path: "/v1/user/user1/webhooks/deliveries?status=lost",
+			wantCode:    400,
+			wantErrCode: "invalid_query",
+		},
+		{
+			name:   "no dead letters",
+			method: http.MethodGet, path: "/admin/v1/webhooks/deliveries?status=dead",
+			wantCode: 200,
+		},
+		{
+			name:   "someone else's delivery",
+			method: http.MethodGet, path: "/v1/user/user2/webhooks/deliveries/" + deliveries[0].Id,
+			wantCode:    404,
+			wantErrCode: "delivery_not_found",
+		},
+		{
+			name:   "replays",
+			method: http.MethodPost, path: replayPath,
+			wantCode: 201,
+		},
+		{
+			name:   "shows a delivery",
+			method: http.MethodGet, path: "/v1/user/user1/webhooks/deliveries/" + deliveries[0].Id,
+			wantCode: 200,
+		},
+		{
+			name:   "removes an endpoint",
+			method: http.MethodDelete, path: "/v1/user/user1/webhooks/" + mine.Id,
+			wantCode: 204,
+		},
+		{
+			name:   "removes an endpoint once",
+			method: http.MethodDelete, path: "/v1/user/user1/webhooks/" + mine.Id,
+			wantCode:    404,
+			wantErrCode: "webhook_not_found",
+		},
+		{
+			name:   "replays to removed endpoints",
+			method: http.MethodPost, path: replayPath,
+			wantCode:    404,
+			wantErrCode: "webhook_not_found",
+		},
+		{
+			name:   "lists endpoints",
+			method: http.MethodGet, path: "/v1/user/user1/webhooks",
+			wantCode: 200,
+		},
+	} {
+		w := serveBody(r, step.method, step.path, "", step.body)
+		require.Equal(t, step.wantCode, w.Code, "%s: %s", step.name, w.Body.String())
+		if step.wantErrCode != "" {
+			var got ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, step.wantErrCode, got.Code, step.name)
+		}
+	}
+
+	w = serve(r, http.MethodGet, "/v1/user/user1/webhooks/deliveries", "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&deliveries))
+	require.Len(t, deliveries, 5)
+	require.Equal(t, webhook.DeliveryPending, deliveries[0].Status)
+	require.NotEmpty(t, deliveries[0].ReplayOf)
+}
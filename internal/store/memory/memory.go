@@ -0,0 +1,1270 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+)
+
+// Store keeps every user, API key, wallet, transaction, ledger entry,
+// authorization, schedule, webhook, event, audit and idempotency record in
+// maps. Records are copied on the way in and out so callers can only change
+// state through the Store.
+//
+// The registries of users, API keys, schedules, webhooks, events, the audit
+// log and accounts are guarded by mu, while each account has its own lock
+// guarding its balance and history. A transaction locks every account it
+// touches in order of account ID, so transactions on unrelated wallets run
+// in parallel and two transfers between the same wallets in opposite
+// directions cannot deadlock. A change to a wallet records its events while
+// it still holds the wallet's lock, so a wallet's events are in the order of
+// its changes.
+type Store struct {
+	mu          sync.RWMutex
+	users       map[string]user.User
+	apiKeys     map[string]auth.Key
+	accounts    map[string]*account
+	idempotency map[idempotencyKey]idempotency.Record
+	// authorizations finds the wallet whose account holds an authorization,
+	// and transactions a wallet whose account holds a transaction.
+	authorizations map[string]string
+	transactions   map[string]string
+	schedules      map[string]schedule.Schedule
+	scheduleRuns   map[string][]schedule.Run
+	endpoints      map[string]webhook.Endpoint
+	// deliveries are kept in the order they were created, and
+	// deliveryIndex finds one by ID. deliveredEvents holds the events each
+	// endpoint has a delivery of, other than a replay.
+	deliveries      []webhook.Delivery
+	deliveryIndex   map[string]int
+	deliveredEvents map[deliveredEvent]bool
+	// events is the outbox, in order of Seq from 1.
+	events       []event.Event
+	eventCursors map[string]int64
+	// auditLog is in order of Seq from 1.
+	auditLog []audit.Entry
+}
+
+// account is a wallet, or a system account when wallet is nil, together with
+// its history and the authorizations it made.
+type account struct {
+	mu             sync.Mutex
+	wallet         *wallet.Wallet
+	transactions   []wallet.Transaction
+	entries        []wallet.Entry
+	statusChanges  []wallet.StatusChange
+	authorizations []wallet.Authorization
+}
+
+type idempotencyKey struct {
+	userId, key string
+}
+
+type deliveredEvent struct {
+	endpointId, eventId string
+}
+
+func New() *Store {
+	return &Store{
+		users:           map[string]user.User{},
+		apiKeys:         map[string]auth.Key{},
+		accounts:        map[string]*account{},
+		idempotency:     map[idempotencyKey]idempotency.Record{},
+		authorizations:  map[string]string{},
+		transactions:    map[string]string{},
+		schedules:       map[string]schedule.Schedule{},
+		scheduleRuns:    map[string][]schedule.Run{},
+		endpoints:       map[string]webhook.Endpoint{},
+		deliveryIndex:   map[string]int{},
+		deliveredEvents: map[deliveredEvent]bool{},
+		eventCursors:    map[string]int64{},
+	}
+}
+
+func (s *Store) CreateUser(u *user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[u.Id]; found {
+		return fmt.Errorf("user %s already exists", u.Id)
+	}
+	created := copyUser(*u)
+	if created.Role == "" {
+		created.Role = user.RoleCustomer
+	}
+	if created.Kyc.Status == "" {
+		created.Kyc.Status = user.KycUnverified
+	}
+	s.users[u.Id] = created
+	return nil
+}
+
+func (s *Store) GetUser(id string) (*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found, ok := s.users[id]
+	if !ok {
+		return nil, user.ErrUserNotFound
+	}
+	copied := copyUser(found)
+	return &copied, nil
+}
+
+func (s *Store) UpdateUser(id string, update func(u *user.User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.users[id]
+	if !ok {
+		return user.ErrUserNotFound
+	}
+	updated := copyUser(found)
+	if err := update(&updated); err != nil {
+		return err
+	}
+	updated.Id, updated.Role = found.Id, found.Role
+	s.users[id] = copyUser(updated)
+	return nil
+}
+
+func (s *Store) ListUsers(query user.Query) ([]*user.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []*user.User{}
+	for _, found := range s.users {
+		if !strings.HasPrefix(found.Id, query.IdPrefix) || found.Id <= query.After ||
+			(query.Role != "" && found.Role != query.Role) ||
+			(query.KycStatus != "" && found.Kyc.Status != query.KycStatus) {
+			continue
+		}
+		copied := copyUser(found)
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	if query.Limit > 0 && len(users) > query.Limit {
+		users = users[:query.Limit]
+	}
+	return users, nil
+}
+
+func (s *Store) CountUsers() (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := map[string]int{}
+	for _, found := range s.users {
+		counts[found.Role]++
+	}
+	return counts, nil
+}
+
+func (s *Store) CreateAPIKey(k *auth.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[k.UserId]; !found {
+		return user.ErrUserNotFound
+	}
+	if _, found := s.apiKeys[k.Id]; found {
+		return fmt.Errorf("API key %s already exists", k.Id)
+	}
+	s.apiKeys[k.Id] = copyAPIKey(*k)
+	return nil
+}
+
+func (s *Store) GetAPIKey(id string) (*auth.Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found, ok := s.apiKeys[id]
+	if !ok {
+		return nil, auth.ErrKeyNotFound
+	}
+	copied := copyAPIKey(found)
+	return &copied, nil
+}
+
+func (s *Store) ListAPIKeys(userId string) ([]*auth.Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []*auth.Key{}
+	for _, found := range s.apiKeys {
+		if found.UserId == userId {
+			copied := copyAPIKey(found)
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].Id < keys[j].Id
+	})
+	return keys, nil
+}
+
+func (s *Store) RevokeAPIKey(userId, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.apiKeys[id]
+	if !ok || found.UserId != userId {
+		return auth.ErrKeyNotFound
+	}
+	if !found.Revoked() {
+		found.RevokedAt = &at
+		s.apiKeys[id] = found
+	}
+	return nil
+}
+
+// copyUser copies a user along with its documents and review time.
+func copyUser(u user.User) user.User {
+	u.Kyc.Documents = append([]user.Document(nil), u.Kyc.Documents...)
+	if u.Kyc.UpdatedAt != nil {
+		at := *u.Kyc.UpdatedAt
+		u.Kyc.UpdatedAt = &at
+	}
+	return u
+}
+
+// copyAPIKey copies a key along with its revocation time.
+func copyAPIKey(k auth.Key) auth.Key {
+	if k.RevokedAt != nil {
+		at := *k.RevokedAt
+		k.RevokedAt = &at
+	}
+	return k
+}
+
+func (s *Store) CreateWallet(w *wallet.Wallet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.accounts[w.Id]; found {
+		return fmt.Errorf("wallet %s already exists", w.Id)
+	}
+	created := *w
+	if created.Status == "" {
+		created.Status = wallet.StatusActive
+	}
+	if created.CreatedAt.IsZero() {
+		created.CreatedAt = time.Now().UTC()
+	}
+	e, err := wallet.CreatedEvent(&created)
+	if err != nil {
+		return err
+	}
+	s.accounts[w.Id] = &account{wallet: &created}
+	s.recordEvents(e)
+	return nil
+}
+
+func (s *Store) GetWallet(id string) (*wallet.Wallet, error) {
+	found, err := s.walletAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	return found.copyWallet(time.Now())
+}
+
+func (s *Store) ListWallets(query wallet.WalletQuery) ([]*wallet.Wallet, error) {
+	s.mu.RLock()
+	candidates := []*account{}
+	for id, found := range s.accounts {
+		if found.wallet != nil && strings.HasPrefix(id, query.IdPrefix) && id > query.After {
+			candidates = append(candidates, found)
+		}
+	}
+	s.mu.RUnlock()
+
+	wallets := []*wallet.Wallet{}
+	now := time.Now()
+	for _, found := range candidates {
+		found.mu.Lock()
+		copied, err := found.copyWallet(now)
+		found.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if (query.UserId != "" && copied.UserId != query.UserId) ||
+			(query.Currency != "" && copied.Currency() != query.Currency) ||
+			(query.Status != "" && copied.Status != query.Status) {
+			continue
+		}
+		wallets = append(wallets, copied)
+	}
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].Id < wallets[j].Id })
+	if query.Limit > 0 && len(wallets) > query.Limit {
+		wallets = wallets[:query.Limit]
+	}
+	return wallets, nil
+}
+
+func (s *Store) CountWallets() ([]wallet.WalletCount, error) {
+	s.mu.RLock()
+	candidates := []*account{}
+	for _, found := range s.accounts {
+		if found.wallet != nil {
+			candidates = append(candidates, found)
+		}
+	}
+	s.mu.RUnlock()
+
+	type group struct{ currency, status string }
+	groups := map[group]int{}
+	for _, found := range candidates {
+		found.mu.Lock()
+		groups[group{found.wallet.Currency(), found.wallet.Status}]++
+		found.mu.Unlock()
+	}
+	counts := []wallet.WalletCount{}
+	for g, wallets := range groups {
+		counts = append(counts, wallet.WalletCount{Currency: g.currency, Status: g.status, Wallets: wallets})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Currency != counts[j].Currency {
+			return counts[i].Currency < counts[j].Currency
+		}
+		return counts[i].Status < counts[j].Status
+	})
+	return counts, nil
+}
+
+func (s *Store) ChangeWalletStatus(change *wallet.StatusChange) error {
+	found, err := s.walletAccount(change.WalletId)
+	if err != nil {
+		return err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	if err := wallet.CheckStatusChange(found.wallet.Status, change.To, found.wallet.Balance); err != nil {
+		return err
+	}
+	change.From = found.wallet.Status
+	e, err := change.Event(found.wallet.UserId)
+	if err != nil {
+		return err
+	}
+	found.wallet.Status = change.To
+	found.statusChanges = append(found.statusChanges, *change)
+	s.mu.Lock()
+	s.recordEvents(e)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) SetWalletLimits(walletId string, limits wallet.Limits) error {
+	found, err := s.walletAccount(walletId)
+	if err != nil {
+		return err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	found.wallet.Limits = wallet.Limits{}.Merge(limits)
+	return nil
+}
+
+func (s *Store) ListStatusChanges(walletId string) ([]*wallet.StatusChange, error) {
+	found, err := s.walletAccount(walletId)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	changes := make([]*wallet.StatusChange, 0, len(found.statusChanges))
+	for _, change := range found.statusChanges {
+		copied := change
+		changes = append(changes, &copied)
+	}
+	return changes, nil
+}
+
+func (s *Store) ApplyTransaction(t *wallet.Transaction) error {
+	if t.SourceWalletId == "" && t.TargetWalletId == "" {
+		return errors.New("transaction has no wallets")
+	}
+	if t.SourceWalletId == t.TargetWalletId {
+		return errors.New("transaction cannot move money within one wallet")
+	}
+	entries := t.Entries()
+	if err := wallet.CheckBalanced(entries); err != nil {
+		return err
+	}
+	accountIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		accountIds = append(accountIds, entry.AccountId)
+	}
+	// A user limit counts the transactions of every wallet the owner has,
+	// so their accounts are locked along with those the entries touch.
+	var owned []string
+	if t.UserLimit != nil {
+		var err error
+		if owned, err = s.ownedWalletIds(t.LimitedWalletId()); err != nil {
+			return err
+		}
+		accountIds = append(accountIds, owned...)
+	}
+	accounts, err := s.lockAccounts(accountIds)
+	if err != nil {
+		return err
+	}
+	defer unlockAccounts(accounts)
+
+	var captured *wallet.Authorization
+	if t.AuthorizationId != "" {
+		if t.SourceWalletId == "" {
+			return fmt.Errorf("%w: %s", wallet.ErrAuthorizationNotFound, t.AuthorizationId)
+		}
+		if captured, err = accounts[t.SourceWalletId].authorization(t.AuthorizationId); err != nil {
+			return err
+		}
+		if err := captured.Capture(t); err != nil {
+			return err
+		}
+	}
+	var refunded *wallet.Transaction
+	if t.RefundOf != "" {
+		if t.SourceWalletId == "" {
+			return fmt.Errorf("%w: payment %s", wallet.ErrTransactionNotFound, t.RefundOf)
+		}
+		if refunded, err = accounts[t.SourceWalletId].transaction(t.RefundOf); err != nil {
+			return err
+		}
+		if err := refunded.Refund(t); err != nil {
+			return err
+		}
+	}
+	for i := range entries {
+		if posted := accounts[entries[i].AccountId]; posted.wallet != nil {
+			if err := posted.wallet.Allows(t, entries[i].Direction); err != nil {
+				return err
+			}
+		}
+		balance, err := balanceOf(accounts[entries[i].AccountId], entries[i].Amount.Currency)
+		if err != nil {
+			return err
+		}
+		if entries[i].Balance, err = entries[i].Post(balance); err != nil {
+			return err
+		}
+	}
+	if err := wallet.CheckLimit(t, func(since time.Time) (money.Money, error) {
+		return spentSince(accounts[t.LimitedWalletId()], t, since)
+	}); err != nil {
+		return err
+	}
+	if err := wallet.CheckUserLimit(t, func(since time.Time) ([]money.Money, error) {
+		byCurrency := map[string]money.Money{}
+		for _, id := range owned {
+			spent, err := spentSince(accounts[id], t, since)
+			if err != nil {
+				return nil, err
+			}
+			total, found := byCurrency[spent.Currency]
+			if !found {
+				byCurrency[spent.Currency] = spent
+			} else if byCurrency[spent.Currency], err = total.Add(spent); err != nil {
+				return nil, err
+			}
+		}
+		totals := make([]money.Money, 0, len(byCurrency))
+		for _, total := range byCurrency {
+			totals = append(totals, total)
+		}
+		return totals, nil
+	}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		debited := accounts[entry.AccountId]
+		if entry.Direction != wallet.Debit || debited.wallet == nil {
+			continue
+		}
+		held, err := debited.heldAt(t.Timestamp, captured)
+		if err != nil {
+			return err
+		}
+		if err := wallet.CheckAvailable(entry, held); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if accounts[entry.AccountId].wallet == nil {
+			continue
+		}
+		if entry.Direction == wallet.Debit {
+			t.SourceBalance = entry.Balance
+		} else {
+			t.TargetBalance = entry.Balance
+		}
+	}
+	events, err := t.Events(func(walletId string) string { return accounts[walletId].wallet.UserId })
+	if err != nil {
+		return err
+	}
+
+	if captured != nil {
+		accounts[t.SourceWalletId].saveAuthorization(captured)
+	}
+	if refunded != nil {
+		// The payment is kept by both of its wallets, which the refund moves
+		// money between.
+		accounts[t.SourceWalletId].saveRefunded(refunded)
+		accounts[t.TargetWalletId].saveRefunded(refunded)
+	}
+	for _, entry := range entries {
+		posted := accounts[entry.AccountId]
+		posted.entries = append(posted.entries, entry)
+		if posted.wallet == nil {
+			continue
+		}
+		posted.wallet.Balance = entry.Balance
+	}
+	for _, walletId := range []string{t.SourceWalletId, t.TargetWalletId} {
+		if walletId != "" {
+			accounts[walletId].transactions = append(accounts[walletId].transactions, copyTransaction(t))
+		}
+	}
+	kept := t.SourceWalletId
+	if kept == "" {
+		kept = t.TargetWalletId
+	}
+	s.mu.Lock()
+	s.transactions[t.Id] = kept
+	s.recordEvents(events...)
+	s.mu.Unlock()
+	return nil
+}
+
+// spentSince adds up the amounts of the account's transactions after since
+// that are of the same type as t and count against the account's wallet.
+func spentSince(limited *account, t *wallet.Transaction, since time.Time) (money.Money, error) {
+	total, err := money.Zero(limited.wallet.Currency())
+	if err != nil {
+		return money.Money{}, err
+	}
+	for i := range limited.transactions {
+		counted := &limited.transactions[i]
+		if counted.Type != t.Type || counted.LimitedWalletId() != limited.wallet.Id || !counted.Timestamp.After(since) {
+			continue
+		}
+		if total, err = total.Add(counted.Amount); err != nil {
+			return money.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// ownedWalletIds returns the IDs of every wallet belonging to the user who
+// owns walletId, walletId among them.
+func (s *Store) ownedWalletIds(walletId string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	limited, ok := s.accounts[walletId]
+	if !ok || limited.wallet == nil {
+		return nil, wallet.ErrWalletNotFound
+	}
+	ids := []string{}
+	for id, found := range s.accounts {
+		if found.wallet != nil && found.wallet.UserId == limited.wallet.UserId {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *Store) CreateAuthorization(a *wallet.Authorization) error {
+	if a.SourceWalletId == a.TargetWalletId {
+		return errors.New("authorization cannot pay a wallet into itself")
+	}
+	accounts, err := s.lockAccounts([]string{a.SourceWalletId, a.TargetWalletId})
+	if err != nil {
+		return err
+	}
+	defer unlockAccounts(accounts)
+	source, target := accounts[a.SourceWalletId], accounts[a.TargetWalletId]
+	if source.wallet == nil || target.wallet == nil {
+		return wallet.ErrWalletNotFound
+	}
+	held, err := source.heldAt(a.CreatedAt, nil)
+	if err != nil {
+		return err
+	}
+	if err := wallet.CheckAuthorization(a, source.wallet, target.wallet, held); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.authorizations[a.Id]; found {
+		return fmt.Errorf("authorization %s already exists", a.Id)
+	}
+	s.authorizations[a.Id] = a.SourceWalletId
+	source.authorizations = append(source.authorizations, *a)
+	return nil
+}
+
+func (s *Store) GetAuthorization(id string) (*wallet.Authorization, error) {
+	found, err := s.authorizationAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	return found.authorization(id)
+}
+
+func (s *Store) ListAuthorizations(walletId string) ([]*wallet.Authorization, error) {
+	found, err := s.walletAccount(walletId)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	authorizations := make([]*wallet.Authorization, 0, len(found.authorizations))
+	for _, authorization := range found.authorizations {
+		copied := authorization
+		authorizations = append(authorizations, &copied)
+	}
+	return authorizations, nil
+}
+
+func (s *Store) UpdateAuthorization(id string, update func(a *wallet.Authorization) error) error {
+	found, err := s.authorizationAccount(id)
+	if err != nil {
+		return err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	updated, err := found.authorization(id)
+	if err != nil {
+		return err
+	}
+	if err := update(updated); err != nil {
+		return err
+	}
+	found.saveAuthorization(updated)
+	return nil
+}
+
+// transaction returns a copy of one of the account's transactions.
+func (a *account) transaction(id string) (*wallet.Transaction, error) {
+	for i := len(a.transactions) - 1; i >= 0; i-- {
+		if a.transactions[i].Id == id {
+			copied := copyTransaction(&a.transactions[i])
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", wallet.ErrTransactionNotFound, id)
+}
+
+// saveRefunded records how much of one of the account's payments has been
+// refunded, the only part of a transaction that ever changes.
+func (a *account) saveRefunded(payment *wallet.Transaction) {
+	for i := range a.transactions {
+		if a.transactions[i].Id == payment.Id {
+			a.transactions[i].Refunded = payment.Refunded
+		}
+	}
+}
+
+// authorizationAccount returns the account of the wallet that made an
+// authorization, without locking it.
+func (s *Store) authorizationAccount(id string) (*account, error) {
+	s.mu.RLock()
+	walletId, ok := s.authorizations[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, wallet.ErrAuthorizationNotFound
+	}
+	return s.walletAccount(walletId)
+}
+
+// authorization returns a copy of one of the account's authorizations.
+func (a *account) authorization(id string) (*wallet.Authorization, error) {
+	for _, authorization := range a.authorizations {
+		if authorization.Id == id {
+			copied := authorization
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", wallet.ErrAuthorizationNotFound, id)
+}
+
+// saveAuthorization replaces the account's authorization with the same ID.
+// Only the status and captured amount of an authorization ever change.
+func (a *account) saveAuthorization(updated *wallet.Authorization) {
+	for i := range a.authorizations {
+		if a.authorizations[i].Id == updated.Id {
+			a.authorizations[i].Status = updated.Status
+			a.authorizations[i].Captured = updated.Captured
+		}
+	}
+}
+
+// heldAt adds up what the account's authorizations hold at the given time,
+// counting pending, when given, in place of the stored authorization it
+// updates.
+func (a *account) heldAt(at time.Time, pending *wallet.Authorization) (money.Money, error) {
+	authorizations := a.authorizations
+	if pending != nil {
+		authorizations = append([]wallet.Authorization{}, authorizations...)
+		for i := range authorizations {
+			if authorizations[i].Id == pending.Id {
+				authorizations[i] = *pending
+			}
+		}
+	}
+	return wallet.SumHeld(authorizations, a.wallet.Currency(), at)
+}
+
+// copyWallet copies the account's wallet, along with what it has held at
+// the given time.
+func (a *account) copyWallet(at time.Time) (*wallet.Wallet, error) {
+	copied := *a.wallet
+	held, err := a.heldAt(at, nil)
+	if err != nil {
+		return nil, err
+	}
+	copied.Held = held
+	return &copied, nil
+}
+
+// lockAccounts looks up the given accounts, creating system accounts on first
+// use, and locks them in order of ID. The caller must unlockAccounts them.
+func (s *Store) lockAccounts(ids []string) (map[string]*account, error) {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+
+	accounts := make(map[string]*account, len(sorted))
+	s.mu.Lock()
+	for _, id := range sorted {
+		found, ok := s.accounts[id]
+		switch {
+		case !ok && wallet.IsSystemAccount(id):
+			found = &account{}
+			s.accounts[id] = found
+		case !ok:
+			s.mu.Unlock()
+			return nil, wallet.ErrWalletNotFound
+		}
+		accounts[id] = found
+	}
+	s.mu.Unlock()
+
+	for i, id := range sorted {
+		if i > 0 && sorted[i-1] == id {
+			continue
+		}
+		accounts[id].mu.Lock()
+	}
+	return accounts, nil
+}
+
+func unlockAccounts(accounts map[string]*account) {
+	for _, locked := range accounts {
+		locked.mu.Unlock()
+	}
+}
+
+// copyTransaction copies a transaction along with its metadata, conversion
+// and adjustment.
+func copyTransaction(t *wallet.Transaction) wallet.Transaction {
+	copied := *t
+	if t.Metadata != nil {
+		copied.Metadata = make(map[string]string, len(t.Metadata))
+		for key, value := range t.Metadata {
+			copied.Metadata[key] = value
+		}
+	}
+	if t.Conversion != nil {
+		conversion := *t.Conversion
+		copied.Conversion = &conversion
+	}
+	if t.Adjustment != nil {
+		adjustment := *t.Adjustment
+		copied.Adjustment = &adjustment
+	}
+	return copied
+}
+
+// balanceOf returns an account's current balance: a wallet's stored balance,
+// or the running balance of a system account's latest entry.
+func balanceOf(a *account, currency string) (money.Money, error) {
+	if a.wallet != nil {
+		return a.wallet.Balance, nil
+	}
+	if len(a.entries) > 0 {
+		return a.entries[len(a.entries)-1].Balance, nil
+	}
+	return money.Zero(currency)
+}
+
+// walletAccount returns the account holding a wallet, without locking it.
+func (s *Store) walletAccount(id string) (*account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found, ok := s.accounts[id]
+	if !ok || found.wallet == nil {
+		return nil, wallet.ErrWalletNotFound
+	}
+	return found, nil
+}
+
+func (s *Store) GetTransaction(id string) (*wallet.Transaction, error) {
+	s.mu.RLock()
+	walletId, ok := s.transactions[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrTransactionNotFound, id)
+	}
+	found, err := s.walletAccount(walletId)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	return found.transaction(id)
+}
+
+func (s *Store) ListTransactions(walletId string, query wallet.TransactionQuery) ([]*wallet.Transaction, error) {
+	found, err := s.walletAccount(walletId)
+	if err != nil {
+		return nil, err
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	history := found.transactions
+	end := len(history)
+	if query.Before != "" {
+		end = -1
+		for i := range history {
+			if history[i].Id == query.Before {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("%w: unknown cursor", wallet.ErrInvalidQuery)
+		}
+	}
+	transactions := []*wallet.Transaction{}
+	for i := end - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(transactions) == query.Limit {
+			break
+		}
+		transaction := copyTransaction(&history[i])
+		if query.Matches(walletId, &transaction) {
+			transactions = append(transactions, &transaction)
+		}
+	}
+	return transactions, nil
+}
+
+func (s *Store) ListEntries(accountId string) ([]wallet.Entry, error) {
+	s.mu.RLock()
+	found, ok := s.accounts[accountId]
+	s.mu.RUnlock()
+	switch {
+	case !ok && wallet.IsSystemAccount(accountId):
+		return []wallet.Entry{}, nil
+	case !ok:
+		return nil, wallet.ErrWalletNotFound
+	}
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	return append([]wallet.Entry{}, found.entries...), nil
+}
+
+func (s *Store) CreateSchedule(sch *schedule.Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.schedules[sch.Id]; found {
+		return fmt.Errorf("schedule %s already exists", sch.Id)
+	}
+	s.schedules[sch.Id] = copySchedule(*sch)
+	return nil
+}
+
+func (s *Store) GetSchedule(id string) (*schedule.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found, ok := s.schedules[id]
+	if !ok {
+		return nil, schedule.ErrScheduleNotFound
+	}
+	copied := copySchedule(found)
+	return &copied, nil
+}
+
+func (s *Store) ListSchedules(walletId string) ([]*schedule.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schedules := []*schedule.Schedule{}
+	for _, found := range s.schedules {
+		if found.WalletId != walletId {
+			continue
+		}
+		copied := copySchedule(found)
+		schedules = append(schedules, &copied)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if !schedules[i].CreatedAt.Equal(schedules[j].CreatedAt) {
+			return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+		}
+		return schedules[i].Id < schedules[j].Id
+	})
+	return schedules, nil
+}
+
+func (s *Store) UpdateSchedule(id string, update func(sch *schedule.Schedule) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.schedules[id]
+	if !ok {
+		return schedule.ErrScheduleNotFound
+	}
+	updated := copySchedule(found)
+	if err := update(&updated); err != nil {
+		return err
+	}
+	updated.Id, updated.UserId, updated.WalletId = found.Id, found.UserId, found.WalletId
+	s.schedules[id] = copySchedule(updated)
+	return nil
+}
+
+func (s *Store) DueSchedules(at time.Time) ([]*schedule.Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	due := []*schedule.Schedule{}
+	for _, found := range s.schedules {
+		if found.Status != schedule.StatusActive || found.NextRunAt == nil || found.NextRunAt.After(at) {
+			continue
+		}
+		copied := copySchedule(found)
+		due = append(due, &copied)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextRunAt.Equal(*due[j].NextRunAt) {
+			return due[i].NextRunAt.Before(*due[j].NextRunAt)
+		}
+		return due[i].Id < due[j].Id
+	})
+	return due, nil
+}
+
+func (s *Store) CreateRun(run *schedule.Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.schedules[run.ScheduleId]; !found {
+		return schedule.ErrScheduleNotFound
+	}
+	s.scheduleRuns[run.ScheduleId] = append(s.scheduleRuns[run.ScheduleId], *run)
+	return nil
+}
+
+func (s *Store) ListRuns(scheduleId string) ([]*schedule.Run, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, found := s.schedules[scheduleId]; !found {
+		return nil, schedule.ErrScheduleNotFound
+	}
+	runs := make([]*schedule.Run, 0, len(s.scheduleRuns[scheduleId]))
+	for _, run := range s.scheduleRuns[scheduleId] {
+		copied := run
+		runs = append(runs, &copied)
+	}
+	return runs, nil
+}
+
+// copySchedule copies a schedule along with its end and next run times.
+func copySchedule(sch schedule.Schedule) schedule.Schedule {
+	if sch.EndAt != nil {
+		at := *sch.EndAt
+		sch.EndAt = &at
+	}
+	if sch.NextRunAt != nil {
+		at := *sch.NextRunAt
+		sch.NextRunAt = &at
+	}
+	return sch
+}
+
+func (s *Store) CreateEndpoint(e *webhook.Endpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.endpoints[e.Id]; found {
+		return fmt.Errorf("webhook endpoint %s already exists", e.Id)
+	}
+	s.endpoints[e.Id] = copyEndpoint(*e)
+	return nil
+}
+
+func (s *Store) GetEndpoint(id string) (*webhook.Endpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found, ok := s.endpoints[id]
+	if !ok {
+		return nil, webhook.ErrEndpointNotFound
+	}
+	copied := copyEndpoint(found)
+	return &copied, nil
+}
+
+func (s *Store) ListEndpoints(userId string) ([]*webhook.Endpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	endpoints := []*webhook.Endpoint{}
+	for _, found := range s.endpoints {
+		if found.UserId != userId {
+			continue
+		}
+		copied := copyEndpoint(found)
+		endpoints = append(endpoints, &copied)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if !endpoints[i].CreatedAt.Equal(endpoints[j].CreatedAt) {
+			return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+		}
+		return endpoints[i].Id < endpoints[j].Id
+	})
+	return endpoints, nil
+}
+
+func (s *Store) DeleteEndpoint(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.endpoints[id]; !found {
+		return webhook.ErrEndpointNotFound
+	}
+	delete(s.endpoints, id)
+	return nil
+}
+
+func (s *Store) CreateDelivery(d *webhook.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.deliveryIndex[d.Id]; found {
+		return fmt.Errorf("webhook delivery %s already exists", d.Id)
+	}
+	if d.ReplayOf == "" {
+		delivered := deliveredEvent{d.EndpointId, d.EventId}
+		if s.deliveredEvents[delivered] {
+			return fmt.Errorf("%w: event %s to endpoint %s", webhook.ErrDuplicateDelivery, d.EventId, d.EndpointId)
+		}
+		s.deliveredEvents[delivered] = true
+	}
+	s.deliveryIndex[d.Id] = len(s.deliveries)
+	s.deliveries = append(s.deliveries, copyDelivery(*d))
+	return nil
+}
+
+func (s *Store) GetDelivery(id string) (*webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.deliveryIndex[id]
+	if !ok {
+		return nil, webhook.ErrDeliveryNotFound
+	}
+	copied := copyDelivery(s.deliveries[i])
+	return &copied, nil
+}
+
+func (s *Store) ListDeliveries(query webhook.DeliveryQuery) ([]*webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deliveries := []*webhook.Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		found := s.deliveries[i]
+		switch {
+		case found.UserId != query.UserId:
+			continue
+		case query.EndpointId != "" && found.EndpointId != query.EndpointId:
+			continue
+		case query.Status != "" && found.Status != query.Status:
+			continue
+		}
+		copied := copyDelivery(found)
+		deliveries = append(deliveries, &copied)
+		if len(deliveries) == query.Limit {
+			break
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *Store) UpdateDelivery(id string, update func(d *webhook.Delivery) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.deliveryIndex[id]
+	if !ok {
+		return webhook.ErrDeliveryNotFound
+	}
+	found := s.deliveries[i]
+	updated := copyDelivery(found)
+	if err := update(&updated); err != nil {
+		return err
+	}
+	updated.Id, updated.EndpointId, updated.UserId = found.Id, found.EndpointId, found.UserId
+	s.deliveries[i] = copyDelivery(updated)
+	return nil
+}
+
+func (s *Store) DueDeliveries(at time.Time) ([]*webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	due := []*webhook.Delivery{}
+	for _, found := range s.deliveries {
+		if found.Status != webhook.DeliveryPending || found.NextAttemptAt == nil || found.NextAttemptAt.After(at) {
+			continue
+		}
+		copied := copyDelivery(found)
+		due = append(due, &copied)
+	}
+	// The stable sort keeps deliveries due at the same time in the order
+	// they were created.
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+	})
+	return due, nil
+}
+
+// copyEndpoint copies an endpoint along with its events.
+func copyEndpoint(e webhook.Endpoint) webhook.Endpoint {
+	e.Events = append([]string{}, e.Events...)
+	return e
+}
+
+// copyDelivery copies a delivery along with its payload and attempt times.
+func copyDelivery(d webhook.Delivery) webhook.Delivery {
+	d.Payload = append([]byte{}, d.Payload...)
+	if d.NextAttemptAt != nil {
+		at := *d.NextAttemptAt
+		d.NextAttemptAt = &at
+	}
+	if d.LastAttemptAt != nil {
+		at := *d.LastAttemptAt
+		d.LastAttemptAt = &at
+	}
+	return d
+}
+
+// recordEvents adds events to the outbox, numbering them as it goes. The
+// caller must hold mu.
+func (s *Store) recordEvents(events ...*event.Event) {
+	for _, e := range events {
+		e.Seq = int64(len(s.events)) + 1
+		s.events = append(s.events, copyEvent(*e))
+	}
+}
+
+func (s *Store) ListEvents(after int64, limit int) ([]*event.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	events := []*event.Event{}
+	// Seq counts from 1, so the event after after is at that index.
+	for i := after; i >= 0 && i < int64(len(s.events)) && len(events) != limit; i++ {
+		copied := copyEvent(s.events[i])
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+func (s *Store) EventCursor(subscriber string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.eventCursors[subscriber], nil
+}
+
+func (s *Store) SaveEventCursor(subscriber string, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventCursors[subscriber] = seq
+	return nil
+}
+
+func (s *Store) AppendAuditEntry(e *audit.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Seq != int64(len(s.auditLog))+1 {
+		return fmt.Errorf("audit entry %d cannot follow entry %d", e.Seq, len(s.auditLog))
+	}
+	s.auditLog = append(s.auditLog, copyAuditEntry(*e))
+	return nil
+}
+
+func (s *Store) LastAuditEntry() (*audit.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.auditLog) == 0 {
+		return nil, nil
+	}
+	copied := copyAuditEntry(s.auditLog[len(s.auditLog)-1])
+	return &copied, nil
+}
+
+func (s *Store) ListAuditEntries(after int64, limit int) ([]*audit.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []*audit.Entry{}
+	// Seq counts from 1, so the entry after after is at that index.
+	for i := after; i >= 0 && i < int64(len(s.auditLog)) && len(entries) != limit; i++ {
+		copied := copyAuditEntry(s.auditLog[i])
+		entries = append(entries, &copied)
+	}
+	return entries, nil
+}
+
+// copyAuditEntry copies an audit entry along with its balances.
+func copyAuditEntry(e audit.Entry) audit.Entry {
+	e.Balances = append([]audit.Balance(nil), e.Balances...)
+	return e
+}
+
+// copyEvent copies an event along with its data.
+func copyEvent(e event.Event) event.Event {
+	e.Data = append([]byte{}, e.Data...)
+	return e
+}
+
+func (s *Store) ReserveIdempotencyKey(record *idempotency.Record) (*idempotency.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := idempotencyKey{record.UserId, record.Key}
+	if found, ok := s.idempotency[key]; ok && !found.Expired(record.CreatedAt) {
+		found.Body = append([]byte{}, found.Body...)
+		return &found, nil
+	}
+	s.idempotency[key] = *record
+	return nil, nil
+}
+
+func (s *Store) CompleteIdempotencyKey(record *idempotency.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := idempotencyKey{record.UserId, record.Key}
+	found, ok := s.idempotency[key]
+	if !ok {
+		return idempotency.ErrRecordNotFound
+	}
+	found.StatusCode = record.StatusCode
+	found.Body = append([]byte{}, record.Body...)
+	s.idempotency[key] = found
+	return nil
+}
+
+func (s *Store) ReleaseIdempotencyKey(userId, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotency, idempotencyKey{userId, key})
+	return nil
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/store/storetest"
+)
+
+func TestMemory_Store(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Store {
+		return New()
+	})
+}
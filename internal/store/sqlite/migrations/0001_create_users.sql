@@ -0,0 +1,4 @@
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    created_at INTEGER NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE wallets (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL REFERENCES users (id),
+    balance    INTEGER NOT NULL,
+    scale      INTEGER NOT NULL,
+    currency   TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX wallets_user_id ON wallets (user_id);
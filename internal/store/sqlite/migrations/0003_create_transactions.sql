@@ -0,0 +1,17 @@
+CREATE TABLE transactions (
+    seq              INTEGER PRIMARY KEY AUTOINCREMENT,
+    id               TEXT NOT NULL UNIQUE,
+    type             TEXT NOT NULL,
+    source_wallet_id TEXT REFERENCES wallets (id),
+    target_wallet_id TEXT REFERENCES wallets (id),
+    amount           INTEGER NOT NULL,
+    scale            INTEGER NOT NULL,
+    currency         TEXT NOT NULL,
+    source_balance   INTEGER,
+    target_balance   INTEGER,
+    reference        TEXT NOT NULL DEFAULT '',
+    created_at       INTEGER NOT NULL
+);
+
+CREATE INDEX transactions_source_wallet_id ON transactions (source_wallet_id, seq);
+CREATE INDEX transactions_target_wallet_id ON transactions (target_wallet_id, seq);
@@ -0,0 +1,31 @@
+CREATE TABLE ledger_entries (
+    seq            INTEGER PRIMARY KEY AUTOINCREMENT,
+    transaction_id TEXT NOT NULL REFERENCES transactions (id),
+    account_id     TEXT NOT NULL,
+    direction      TEXT NOT NULL CHECK (direction IN ('debit', 'credit')),
+    amount         INTEGER NOT NULL,
+    scale          INTEGER NOT NULL,
+    currency       TEXT NOT NULL,
+    balance        INTEGER NOT NULL,
+    created_at     INTEGER NOT NULL
+);
+
+CREATE INDEX ledger_entries_account_id ON ledger_entries (account_id, seq);
+
+-- Post every transaction recorded before the ledger existed. Deposits came
+-- from the cash-in account and withdrawals went to the cash-out account.
+INSERT INTO ledger_entries (transaction_id, account_id, direction, amount, scale, currency, balance, created_at)
+SELECT transaction_id, account_id, direction, amount, scale, currency,
+       SUM(CASE direction WHEN 'credit' THEN amount ELSE -amount END)
+           OVER (PARTITION BY account_id ORDER BY seq, direction DESC ROWS UNBOUNDED PRECEDING),
+       created_at
+FROM (
+    SELECT seq, id AS transaction_id, COALESCE(source_wallet_id, 'system:cash-in:' || currency) AS account_id,
+           'debit' AS direction, amount, scale, currency, created_at
+    FROM transactions
+    UNION ALL
+    SELECT seq, id, COALESCE(target_wallet_id, 'system:cash-out:' || currency),
+           'credit', amount, scale, currency, created_at
+    FROM transactions
+)
+ORDER BY seq, direction DESC;
@@ -0,0 +1,10 @@
+CREATE TABLE idempotency_keys (
+    user_id     TEXT NOT NULL REFERENCES users (id),
+    key         TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    status_code INTEGER,
+    body        BLOB,
+    created_at  INTEGER NOT NULL,
+    expires_at  INTEGER NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
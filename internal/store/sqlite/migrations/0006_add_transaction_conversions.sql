@@ -0,0 +1,6 @@
+ALTER TABLE transactions ADD COLUMN fx_quote_id TEXT;
+ALTER TABLE transactions ADD COLUMN fx_rate TEXT;
+ALTER TABLE transactions ADD COLUMN fx_spread TEXT;
+ALTER TABLE transactions ADD COLUMN converted_amount INTEGER;
+ALTER TABLE transactions ADD COLUMN converted_scale INTEGER;
+ALTER TABLE transactions ADD COLUMN converted_currency TEXT;
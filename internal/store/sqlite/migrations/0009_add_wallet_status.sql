@@ -0,0 +1,3 @@
+ALTER TABLE wallets ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+
+CREATE INDEX wallets_status ON wallets (status);
@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN adjusted_by TEXT;
+ALTER TABLE transactions ADD COLUMN adjustment_reason TEXT;
@@ -0,0 +1,11 @@
+CREATE TABLE wallet_status_changes (
+    seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+    wallet_id   TEXT NOT NULL REFERENCES wallets (id),
+    from_status TEXT NOT NULL,
+    to_status   TEXT NOT NULL,
+    reason      TEXT NOT NULL,
+    changed_by  TEXT NOT NULL,
+    created_at  INTEGER NOT NULL
+);
+
+CREATE INDEX wallet_status_changes_wallet_id ON wallet_status_changes (wallet_id, seq);
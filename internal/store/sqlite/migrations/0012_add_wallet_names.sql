@@ -0,0 +1 @@
+ALTER TABLE wallets ADD COLUMN name TEXT NOT NULL DEFAULT '';
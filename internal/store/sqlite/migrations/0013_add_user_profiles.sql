@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN date_of_birth TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN country TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN kyc_status TEXT NOT NULL DEFAULT 'unverified';
+ALTER TABLE users ADD COLUMN kyc_reviewed_by TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN kyc_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN kyc_updated_at INTEGER;
+
+CREATE TABLE kyc_documents (
+    seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id      TEXT NOT NULL REFERENCES users (id),
+    type         TEXT NOT NULL,
+    reference    TEXT NOT NULL,
+    submitted_at INTEGER NOT NULL
+);
+
+CREATE INDEX kyc_documents_user_id ON kyc_documents (user_id, seq);
@@ -0,0 +1 @@
+ALTER TABLE wallets ADD COLUMN limits TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+CREATE TABLE authorizations (
+    seq              INTEGER PRIMARY KEY AUTOINCREMENT,
+    id               TEXT NOT NULL UNIQUE,
+    source_wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    target_wallet_id TEXT NOT NULL REFERENCES wallets (id),
+    amount           INTEGER NOT NULL,
+    captured         INTEGER NOT NULL,
+    scale            INTEGER NOT NULL,
+    currency         TEXT NOT NULL,
+    status           TEXT NOT NULL,
+    created_at       INTEGER NOT NULL,
+    expires_at       INTEGER NOT NULL
+);
+
+CREATE INDEX authorizations_source_wallet_id ON authorizations (source_wallet_id, status, expires_at);
+
+ALTER TABLE transactions ADD COLUMN authorization_id TEXT REFERENCES authorizations (id);
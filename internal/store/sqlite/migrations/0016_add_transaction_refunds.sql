@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN refund_of TEXT REFERENCES transactions (id);
+ALTER TABLE transactions ADD COLUMN refunded INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,35 @@
+CREATE TABLE schedules (
+    seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+    id          TEXT NOT NULL UNIQUE,
+    user_id     TEXT NOT NULL REFERENCES users (id),
+    wallet_id   TEXT NOT NULL REFERENCES wallets (id),
+    creditor_id TEXT NOT NULL REFERENCES wallets (id),
+    amount      INTEGER NOT NULL,
+    scale       INTEGER NOT NULL,
+    currency    TEXT NOT NULL,
+    frequency   TEXT NOT NULL,
+    start_at    INTEGER NOT NULL,
+    end_at      INTEGER,
+    status      TEXT NOT NULL,
+    next_run_at INTEGER,
+    due         INTEGER NOT NULL,
+    attempts    INTEGER NOT NULL,
+    created_at  INTEGER NOT NULL
+);
+
+CREATE INDEX schedules_wallet_id ON schedules (wallet_id);
+CREATE INDEX schedules_next_run_at ON schedules (status, next_run_at);
+
+CREATE TABLE schedule_runs (
+    seq            INTEGER PRIMARY KEY AUTOINCREMENT,
+    id             TEXT NOT NULL UNIQUE,
+    schedule_id    TEXT NOT NULL REFERENCES schedules (id),
+    due_at         INTEGER NOT NULL,
+    attempt        INTEGER NOT NULL,
+    status         TEXT NOT NULL,
+    transaction_id TEXT REFERENCES transactions (id),
+    error          TEXT NOT NULL,
+    ran_at         INTEGER NOT NULL
+);
+
+CREATE INDEX schedule_runs_schedule_id ON schedule_runs (schedule_id);
@@ -0,0 +1,3 @@
+ALTER TABLE transactions ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE transactions ADD COLUMN metadata TEXT;
+CREATE INDEX transactions_reference ON transactions (reference);
@@ -0,0 +1,36 @@
+CREATE TABLE webhook_endpoints (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    id         TEXT NOT NULL UNIQUE,
+    user_id    TEXT NOT NULL,
+    url        TEXT NOT NULL,
+    events     TEXT NOT NULL,
+    secret     TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_endpoints_user_id ON webhook_endpoints (user_id);
+
+-- Deliveries outlive their endpoints, so endpoint_id is not a foreign key.
+CREATE TABLE webhook_deliveries (
+    seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+    id              TEXT NOT NULL UNIQUE,
+    endpoint_id     TEXT NOT NULL,
+    user_id         TEXT NOT NULL,
+    event_id        TEXT NOT NULL,
+    event_type      TEXT NOT NULL,
+    payload         BLOB NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INTEGER NOT NULL,
+    next_attempt_at INTEGER,
+    last_attempt_at INTEGER,
+    response_code   INTEGER NOT NULL,
+    error           TEXT NOT NULL,
+    replay_of       TEXT,
+    created_at      INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_user_id ON webhook_deliveries (user_id, status);
+CREATE INDEX webhook_deliveries_next_attempt_at ON webhook_deliveries (status, next_attempt_at);
+-- An endpoint gets one delivery of each event, besides replays.
+CREATE UNIQUE INDEX webhook_deliveries_endpoint_event ON webhook_deliveries (endpoint_id, event_id)
+    WHERE replay_of IS NULL;
@@ -0,0 +1,15 @@
+-- The outbox. seq numbers events in the order their changes were committed.
+CREATE TABLE events (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    id         TEXT NOT NULL UNIQUE,
+    type       TEXT NOT NULL,
+    user_id    TEXT NOT NULL,
+    wallet_id  TEXT NOT NULL,
+    data       BLOB NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE event_cursors (
+    subscriber TEXT PRIMARY KEY,
+    seq        INTEGER NOT NULL
+);
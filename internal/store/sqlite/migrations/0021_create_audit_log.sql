@@ -0,0 +1,26 @@
+-- The audit log is append-only: the triggers refuse to change or remove an
+-- entry, and Verify catches anyone who goes around them.
+CREATE TABLE audit_log (
+    seq        INTEGER PRIMARY KEY,
+    action     TEXT NOT NULL,
+    path       TEXT NOT NULL,
+    status     INTEGER NOT NULL,
+    actor_id   TEXT NOT NULL,
+    user_id    TEXT NOT NULL,
+    source_ip  TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    balances   TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    prev_hash  TEXT NOT NULL,
+    hash       TEXT NOT NULL UNIQUE
+);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
@@ -0,0 +1,1660 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	_ "modernc.org/sqlite"
+)
+
+// Store keeps users, API keys, wallets, transactions, the ledger,
+// authorizations, schedules, webhooks, the event outbox, the audit log and
+// idempotency records in a SQLite database file.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if needed) the database at path and brings its
+// schema up to date.
+func Open(path string) (*Store, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so a single connection avoids
+	// SQLITE_BUSY errors between our own goroutines.
+	db.SetMaxOpenConns(1)
+	migrations, err := loadMigrations()
+	if err == nil {
+		_, err = migrate(db, migrations)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// OpenReadOnly opens the existing database at path without changing it: it
+// is neither created nor migrated, and every write to it fails. It is for
+// tools that inspect a database, such as audit-verify.
+func OpenReadOnly(path string) (*Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("mode", "ro")
+	params.Add("_pragma", "busy_timeout(5000)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) CreateUser(u *user.User) error {
+	role := u.Role
+	if role == "" {
+		role = user.RoleCustomer
+	}
+	kycStatus := u.Kyc.Status
+	if kycStatus == "" {
+		kycStatus = user.KycUnverified
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO users (id, role, name, email, date_of_birth, country, kyc_status, kyc_reviewed_by, kyc_reason,
+		kyc_updated_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.Id, role, u.Name, u.Email, u.DateOfBirth, u.Country, kycStatus, u.Kyc.ReviewedBy, u.Kyc.Reason,
+		nullTime(u.Kyc.UpdatedAt), time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating user %s: %w", u.Id, err)
+	}
+	if err := insertDocuments(tx, u.Id, u.Kyc.Documents); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetUser(id string) (*user.User, error) {
+	return getUser(s.db, id)
+}
+
+// UpdateUser applies the update inside a database transaction, so
+// concurrent updates to the same user are serialised.
+func (s *Store) UpdateUser(id string, update func(u *user.User) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := getUser(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := update(found); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET name = ?, email = ?, date_of_birth = ?, country = ?, kyc_status = ?,
+		kyc_reviewed_by = ?, kyc_reason = ?, kyc_updated_at = ? WHERE id = ?`,
+		found.Name, found.Email, found.DateOfBirth, found.Country, found.Kyc.Status,
+		found.Kyc.ReviewedBy, found.Kyc.Reason, nullTime(found.Kyc.UpdatedAt), id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM kyc_documents WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	if err := insertDocuments(tx, id, found.Kyc.Documents); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListUsers(query user.Query) ([]*user.User, error) {
+	where := []string{"id > ?", `id LIKE ? ESCAPE '\'`}
+	args := []interface{}{query.After, likePrefix(query.IdPrefix)}
+	for column, value := range map[string]string{"role": query.Role, "kyc_status": query.KycStatus} {
+		if value != "" {
+			where, args = append(where, column+" = ?"), append(args, value)
+		}
+	}
+	statement := `SELECT ` + userColumns + ` FROM users WHERE ` + strings.Join(where, " AND ") + ` ORDER BY id`
+	if query.Limit > 0 {
+		statement, args = statement+" LIMIT ?", append(args, query.Limit)
+	}
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	users := []*user.User{}
+	for rows.Next() {
+		found, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, found)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The documents are loaded once the rows are closed, since the store
+	// has a single connection.
+	for _, found := range users {
+		if found.Kyc.Documents, err = listDocuments(s.db, found.Id); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (s *Store) CountUsers() (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT role, COUNT(*) FROM users GROUP BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var role string
+		var users int
+		if err := rows.Scan(&role, &users); err != nil {
+			return nil, err
+		}
+		counts[role] = users
+	}
+	return counts, rows.Err()
+}
+
+// CreateWallet records the wallet and its event inside a database
+// transaction.
+func (s *Store) CreateWallet(w *wallet.Wallet) error {
+	created := *w
+	if created.Status == "" {
+		created.Status = wallet.StatusActive
+	}
+	if created.CreatedAt.IsZero() {
+		created.CreatedAt = time.Now().UTC()
+	}
+	limits, err := encodeLimits(w.Limits)
+	if err != nil {
+		return err
+	}
+	e, err := wallet.CreatedEvent(&created)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO wallets (id, user_id, name, balance, scale, currency, status, limits, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		w.Id, w.UserId, w.Name, w.Balance.Units, w.Balance.Scale, w.Balance.Currency, created.Status, limits,
+		created.CreatedAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating wallet %s: %w", w.Id, err)
+	}
+	if err := recordEvents(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetWallet(id string) (*wallet.Wallet, error) {
+	return getWallet(s.db, id)
+}
+
+func (s *Store) ListWallets(query wallet.WalletQuery) ([]*wallet.Wallet, error) {
+	where := []string{"id > ?", `id LIKE ? ESCAPE '\'`}
+	args := []interface{}{query.After, likePrefix(query.IdPrefix)}
+	for column, value := range map[string]string{"user_id": query.UserId, "currency": query.Currency, "status": query.Status} {
+		if value != "" {
+			where, args = append(where, column+" = ?"), append(args, value)
+		}
+	}
+	statement := `SELECT ` + walletColumns + ` FROM wallets WHERE ` + strings.Join(where, " AND ") + ` ORDER BY id`
+	if query.Limit > 0 {
+		statement, args = statement+" LIMIT ?", append(args, query.Limit)
+	}
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	wallets := []*wallet.Wallet{}
+	for rows.Next() {
+		found, err := scanWallet(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		wallets = append(wallets, found)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// What each wallet holds is loaded once the rows are closed, since the
+	// store has a single connection.
+	now := time.Now()
+	for _, found := range wallets {
+		if found.Held, err = heldBy(s.db, found.Id, found.Currency(), now); err != nil {
+			return nil, err
+		}
+	}
+	return wallets, nil
+}
+
+func (s *Store) CountWallets() ([]wallet.WalletCount, error) {
+	rows, err := s.db.Query(`SELECT currency, status, COUNT(*) FROM wallets GROUP BY currency, status ORDER BY currency, status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []wallet.WalletCount{}
+	for rows.Next() {
+		var count wallet.WalletCount
+		if err := rows.Scan(&count.Currency, &count.Status, &count.Wallets); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// ChangeWalletStatus checks and records the change inside a database
+// transaction, so the wallet cannot be funded between the check and the
+// update.
+func (s *Store) ChangeWalletStatus(change *wallet.StatusChange) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := getWallet(tx, change.WalletId)
+	if err != nil {
+		return err
+	}
+	if err := wallet.CheckStatusChange(found.Status, change.To, found.Balance); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE wallets SET status = ? WHERE id = ?`, change.To, change.WalletId); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO wallet_status_changes (wallet_id, from_status, to_status, reason, changed_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		change.WalletId, found.Status, change.To, change.Reason, change.ChangedBy, change.Timestamp.UnixNano())
+	if err != nil {
+		return err
+	}
+	recorded := *change
+	recorded.From = found.Status
+	e, err := recorded.Event(found.UserId)
+	if err != nil {
+		return err
+	}
+	if err := recordEvents(tx, e); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	change.From = found.Status
+	return nil
+}
+
+func (s *Store) SetWalletLimits(walletId string, limits wallet.Limits) error {
+	encoded, err := encodeLimits(limits)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`UPDATE wallets SET limits = ? WHERE id = ?`, encoded, walletId)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return wallet.ErrWalletNotFound
+	}
+	return nil
+}
+
+func (s *Store) ListStatusChanges(walletId string) ([]*wallet.StatusChange, error) {
+	if _, err := getWallet(s.db, walletId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT from_status, to_status, reason, changed_by, created_at
+		FROM wallet_status_changes WHERE wallet_id = ? ORDER BY seq`, walletId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []*wallet.StatusChange{}
+	for rows.Next() {
+		change := &wallet.StatusChange{WalletId: walletId}
+		var createdAt int64
+		if err := rows.Scan(&change.From, &change.To, &change.Reason, &change.ChangedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		change.Timestamp = time.Unix(0, createdAt).UTC()
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// ApplyTransaction posts the transaction's ledger entries and updates the
+// wallets they touch inside a single database transaction, so a transfer
+// either happens in full or not at all.
+func (s *Store) ApplyTransaction(t *wallet.Transaction) error {
+	if t.SourceWalletId == "" && t.TargetWalletId == "" {
+		return errors.New("transaction has no wallets")
+	}
+	if t.SourceWalletId == t.TargetWalletId {
+		return errors.New("transaction cannot move money within one wallet")
+	}
+	entries := t.Entries()
+	if err := wallet.CheckBalanced(entries); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if t.AuthorizationId != "" {
+		captured, err := getAuthorization(tx, t.AuthorizationId)
+		if err != nil {
+			return err
+		}
+		if err := captured.Capture(t); err != nil {
+			return err
+		}
+		if err := saveAuthorization(tx, captured); err != nil {
+			return err
+		}
+	}
+	if t.RefundOf != "" {
+		refunded, err := getTransaction(tx, t.RefundOf)
+		if err != nil {
+			return err
+		}
+		if err := refunded.Refund(t); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE transactions SET refunded = ? WHERE id = ?`, refunded.Refunded.Units, refunded.Id); err != nil {
+			return err
+		}
+	}
+	owners := map[string]string{}
+	for i := range entries {
+		if !wallet.IsSystemAccount(entries[i].AccountId) {
+			found, err := getWallet(tx, entries[i].AccountId)
+			if err != nil {
+				return err
+			}
+			if err := found.Allows(t, entries[i].Direction); err != nil {
+				return err
+			}
+			owners[found.Id] = found.UserId
+		}
+		balance, err := balanceOf(tx, entries[i].AccountId, entries[i].Amount.Currency)
+		if err != nil {
+			return err
+		}
+		if entries[i].Balance, err = entries[i].Post(balance); err != nil {
+			return err
+		}
+	}
+	if err := wallet.CheckLimit(t, func(since time.Time) (money.Money, error) {
+		return spentSince(tx, t, since)
+	}); err != nil {
+		return err
+	}
+	if err := wallet.CheckUserLimit(t, func(since time.Time) ([]money.Money, error) {
+		return ownerSpentSince(tx, t, since)
+	}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Direction != wallet.Debit || wallet.IsSystemAccount(entry.AccountId) {
+			continue
+		}
+		held, err := heldBy(tx, entry.AccountId, entry.Amount.Currency, t.Timestamp)
+		if err != nil {
+			return err
+		}
+		if err := wallet.CheckAvailable(entry, held); err != nil {
+			return err
+		}
+	}
+
+	var sourceBalance, targetBalance sql.NullInt64
+	for _, entry := range entries {
+		if wallet.IsSystemAccount(entry.AccountId) {
+			continue
+		}
+		if err := setBalance(tx, entry.AccountId, entry.Balance); err != nil {
+			return err
+		}
+		if entry.Direction == wallet.Debit {
+			t.SourceBalance = entry.Balance
+			sourceBalance = sql.NullInt64{Int64: entry.Balance.Units, Valid: true}
+		} else {
+			t.TargetBalance = entry.Balance
+			targetBalance = sql.NullInt64{Int64: entry.Balance.Units, Valid: true}
+		}
+	}
+
+	var (
+		quoteId, rate, spread, convertedCurrency sql.NullString
+		convertedAmount, convertedScale          sql.NullInt64
+		adjustedBy, adjustmentReason             sql.NullString
+	)
+	if a := t.Adjustment; a != nil {
+		adjustedBy, adjustmentReason = nullString(a.OperatorId), nullString(a.Reason)
+	}
+	if c := t.Conversion; c != nil {
+		quoteId, rate, spread = nullString(c.QuoteId), nullString(c.Rate.String()), nullString(c.Spread.String())
+		convertedAmount = sql.NullInt64{Int64: c.ConvertedAmount.Units, Valid: true}
+		convertedScale = sql.NullInt64{Int64: int64(c.ConvertedAmount.Scale), Valid: true}
+		convertedCurrency = nullString(c.ConvertedAmount.Currency)
+	}
+	metadata, err := encodeMetadata(t.Metadata)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO transactions
+		(id, type, source_wallet_id, target_wallet_id, amount, scale, currency, source_balance, target_balance, reference, created_at,
+		fx_quote_id, fx_rate, fx_spread, converted_amount, converted_scale, converted_currency,
+		adjusted_by, adjustment_reason, authorization_id, refund_of, description, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Id, t.Type, nullString(t.SourceWalletId), nullString(t.TargetWalletId),
+		t.Amount.Units, t.Amount.Scale, t.Amount.Currency, sourceBalance, targetBalance,
+		t.Reference, t.Timestamp.UnixNano(),
+		quoteId, rate, spread, convertedAmount, convertedScale, convertedCurrency,
+		adjustedBy, adjustmentReason, nullString(t.AuthorizationId), nullString(t.RefundOf), t.Description, metadata)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		_, err := tx.Exec(`INSERT INTO ledger_entries
+			(transaction_id, account_id, direction, amount, scale, currency, balance, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			entry.TransactionId, entry.AccountId, entry.Direction, entry.Amount.Units, entry.Amount.Scale,
+			entry.Amount.Currency, entry.Balance.Units, entry.Timestamp.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	events, err := t.Events(func(walletId string) string { return owners[walletId] })
+	if err != nil {
+		return err
+	}
+	if err := recordEvents(tx, events...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetTransaction(id string) (*wallet.Transaction, error) {
+	return getTransaction(s.db, id)
+}
+
+func (s *Store) ListTransactions(walletId string, query wallet.TransactionQuery) ([]*wallet.Transaction, error) {
+	if _, err := getWallet(s.db, walletId); err != nil {
+		return nil, err
+	}
+	where := []string{"(source_wallet_id = ? OR target_wallet_id = ?)"}
+	args := []interface{}{walletId, walletId}
+	if query.Before != "" {
+		var before int64
+		err := s.db.QueryRow(`SELECT seq FROM transactions WHERE id = ? AND (source_wallet_id = ? OR target_wallet_id = ?)`,
+			query.Before, walletId, walletId).Scan(&before)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: unknown cursor", wallet.ErrInvalidQuery)
+		}
+		if err != nil {
+			return nil, err
+		}
+		where, args = append(where, "seq < ?"), append(args, before)
+	}
+	if !query.From.IsZero() {
+		where, args = append(where, "created_at >= ?"), append(args, query.From.UnixNano())
+	}
+	if !query.To.IsZero() {
+		where, args = append(where, "created_at < ?"), append(args, query.To.UnixNano())
+	}
+	switch query.Direction {
+	case wallet.Incoming:
+		where, args = append(where, "target_wallet_id = ?"), append(args, walletId)
+	case wallet.Outgoing:
+		where, args = append(where, "source_wallet_id = ?"), append(args, walletId)
+	}
+	if query.CounterpartyId != "" {
+		where = append(where, "((source_wallet_id = ? AND target_wallet_id = ?) OR (target_wallet_id = ? AND source_wallet_id = ?))")
+		args = append(args, walletId, query.CounterpartyId, walletId, query.CounterpartyId)
+	}
+	if query.Reference != "" {
+		where, args = append(where, "reference = ?"), append(args, query.Reference)
+	}
+	for key, value := range query.Metadata {
+		where = append(where, "EXISTS (SELECT 1 FROM json_each(metadata) WHERE json_each.key = ? AND json_each.value = ?)")
+		args = append(args, key, value)
+	}
+	// Converted payments arrive in the target wallet as converted_amount.
+	walletAmount := "CASE WHEN target_wallet_id = ? AND converted_amount IS NOT NULL THEN converted_amount ELSE amount END"
+	if query.MinAmount != nil {
+		where, args = append(where, walletAmount+" >= ?"), append(args, walletId, query.MinAmount.Units)
+	}
+	if query.MaxAmount != nil {
+		where, args = append(where, walletAmount+" <= ?"), append(args, walletId, query.MaxAmount.Units)
+	}
+	statement := `SELECT ` + transactionColumns + ` FROM transactions WHERE ` + strings.Join(where, " AND ") + ` ORDER BY seq DESC`
+	if query.Limit > 0 {
+		statement, args = statement+" LIMIT ?", append(args, query.Limit)
+	}
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transactions := []*wallet.Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+func (s *Store) ListEntries(accountId string) ([]wallet.Entry, error) {
+	if !wallet.IsSystemAccount(accountId) {
+		if _, err := getWallet(s.db, accountId); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := s.db.Query(`SELECT transaction_id, account_id, direction, amount, scale, currency, balance, created_at
+		FROM ledger_entries WHERE account_id = ? ORDER BY seq`, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []wallet.Entry{}
+	for rows.Next() {
+		var (
+			entry                      wallet.Entry
+			amount, balance, createdAt int64
+			scale                      int
+			currency                   string
+		)
+		if err := rows.Scan(&entry.TransactionId, &entry.AccountId, &entry.Direction, &amount, &scale, &currency,
+			&balance, &createdAt); err != nil {
+			return nil, err
+		}
+		entry.Amount = money.Money{Units: amount, Scale: scale, Currency: currency}
+		entry.Balance = money.Money{Units: balance, Scale: scale, Currency: currency}
+		entry.Timestamp = time.Unix(0, createdAt).UTC()
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CreateAuthorization checks and saves the authorization inside a database
+// transaction, so the source wallet cannot be drained between the two.
+func (s *Store) CreateAuthorization(a *wallet.Authorization) error {
+	if a.SourceWalletId == a.TargetWalletId {
+		return errors.New("authorization cannot pay a wallet into itself")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	source, err := getWallet(tx, a.SourceWalletId)
+	if err != nil {
+		return err
+	}
+	target, err := getWallet(tx, a.TargetWalletId)
+	if err != nil {
+		return err
+	}
+	held, err := heldBy(tx, source.Id, source.Currency(), a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := wallet.CheckAuthorization(a, source, target, held); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO authorizations
+		(id, source_wallet_id, target_wallet_id, amount, captured, scale, currency, status, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Id, a.SourceWalletId, a.TargetWalletId, a.Amount.Units, a.Captured.Units, a.Amount.Scale, a.Amount.Currency,
+		a.Status, a.CreatedAt.UnixNano(), a.ExpiresAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating authorization %s: %w", a.Id, err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetAuthorization(id string) (*wallet.Authorization, error) {
+	return getAuthorization(s.db, id)
+}
+
+func (s *Store) ListAuthorizations(walletId string) ([]*wallet.Authorization, error) {
+	if _, err := getWallet(s.db, walletId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+authorizationColumns+` FROM authorizations WHERE source_wallet_id = ? ORDER BY seq`,
+		walletId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	authorizations := []*wallet.Authorization{}
+	for rows.Next() {
+		found, err := scanAuthorization(rows)
+		if err != nil {
+			return nil, err
+		}
+		authorizations = append(authorizations, found)
+	}
+	return authorizations, rows.Err()
+}
+
+// UpdateAuthorization applies the update inside a database transaction, so
+// it cannot race a capture of the same authorization.
+func (s *Store) UpdateAuthorization(id string, update func(a *wallet.Authorization) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := getAuthorization(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := update(found); err != nil {
+		return err
+	}
+	if err := saveAuthorization(tx, found); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) CreateSchedule(sch *schedule.Schedule) error {
+	_, err := s.db.Exec(`INSERT INTO schedules (id, user_id, wallet_id, creditor_id, amount, scale, currency, frequency,
+		start_at, end_at, status, next_run_at, due, attempts, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sch.Id, sch.UserId, sch.WalletId, sch.Creditor, sch.Amount.Units, sch.Amount.Scale, sch.Amount.Currency,
+		sch.Frequency, sch.StartAt.UnixNano(), nullTime(sch.EndAt), sch.Status, nullTime(sch.NextRunAt), sch.Due,
+		sch.Attempts, sch.CreatedAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating schedule %s: %w", sch.Id, err)
+	}
+	return nil
+}
+
+func (s *Store) GetSchedule(id string) (*schedule.Schedule, error) {
+	return getSchedule(s.db, id)
+}
+
+func (s *Store) ListSchedules(walletId string) ([]*schedule.Schedule, error) {
+	return querySchedules(s.db, `SELECT `+scheduleColumns+` FROM schedules WHERE wallet_id = ? ORDER BY seq`, walletId)
+}
+
+// UpdateSchedule applies the update inside a database transaction, so two
+// changes to the same schedule cannot interleave.
+func (s *Store) UpdateSchedule(id string, update func(sch *schedule.Schedule) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := getSchedule(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := update(found); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE schedules SET status = ?, next_run_at = ?, due = ?, attempts = ? WHERE id = ?`,
+		found.Status, nullTime(found.NextRunAt), found.Due, found.Attempts, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) DueSchedules(at time.Time) ([]*schedule.Schedule, error) {
+	return querySchedules(s.db, `SELECT `+scheduleColumns+` FROM schedules
+		WHERE status = ? AND next_run_at <= ? ORDER BY next_run_at, id`, schedule.StatusActive, at.UnixNano())
+}
+
+func (s *Store) CreateRun(run *schedule.Run) error {
+	_, err := s.db.Exec(`INSERT INTO schedule_runs (id, schedule_id, due_at, attempt, status, transaction_id, error, ran_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Id, run.ScheduleId, run.DueAt.UnixNano(), run.Attempt, run.Status, nullString(run.TransactionId), run.Error,
+		run.RanAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating run %s: %w", run.Id, err)
+	}
+	return nil
+}
+
+func (s *Store) ListRuns(scheduleId string) ([]*schedule.Run, error) {
+	if _, err := getSchedule(s.db, scheduleId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT id, schedule_id, due_at, attempt, status, transaction_id, error, ran_at
+		FROM schedule_runs WHERE schedule_id = ? ORDER BY seq`, scheduleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []*schedule.Run{}
+	for rows.Next() {
+		run := &schedule.Run{}
+		var (
+			dueAt, ranAt  int64
+			transactionId sql.NullString
+		)
+		err := rows.Scan(&run.Id, &run.ScheduleId, &dueAt, &run.Attempt, &run.Status, &transactionId, &run.Error, &ranAt)
+		if err != nil {
+			return nil, err
+		}
+		run.TransactionId = transactionId.String
+		run.DueAt, run.RanAt = time.Unix(0, dueAt).UTC(), time.Unix(0, ranAt).UTC()
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *Store) CreateEndpoint(e *webhook.Endpoint) error {
+	_, err := s.db.Exec(`INSERT INTO webhook_endpoints (id, user_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Id, e.UserId, e.URL, strings.Join(e.Events, ","), e.Secret, e.CreatedAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating webhook endpoint %s: %w", e.Id, err)
+	}
+	return nil
+}
+
+func (s *Store) GetEndpoint(id string) (*webhook.Endpoint, error) {
+	found, err := scanEndpoint(s.db.QueryRow(`SELECT `+endpointColumns+` FROM webhook_endpoints WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", webhook.ErrEndpointNotFound, id)
+	}
+	return found, err
+}
+
+func (s *Store) ListEndpoints(userId string) ([]*webhook.Endpoint, error) {
+	rows, err := s.db.Query(`SELECT `+endpointColumns+` FROM webhook_endpoints WHERE user_id = ? ORDER BY seq`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	endpoints := []*webhook.Endpoint{}
+	for rows.Next() {
+		found, err := scanEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, found)
+	}
+	return endpoints, rows.Err()
+}
+
+func (s *Store) DeleteEndpoint(id string) error {
+	result, err := s.db.Exec(`DELETE FROM webhook_endpoints WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return fmt.Errorf("%w: %s", webhook.ErrEndpointNotFound, id)
+	}
+	return nil
+}
+
+func (s *Store) CreateDelivery(d *webhook.Delivery) error {
+	result, err := s.db.Exec(`INSERT INTO webhook_deliveries (id, endpoint_id, user_id, event_id, event_type, payload,
+		status, attempts, next_attempt_at, last_attempt_at, response_code, error, replay_of, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (endpoint_id, event_id) WHERE replay_of IS NULL DO NOTHING`,
+		d.Id, d.EndpointId, d.UserId, d.EventId, d.EventType, []byte(d.Payload), d.Status, d.Attempts,
+		nullTime(d.NextAttemptAt), nullTime(d.LastAttemptAt), d.ResponseCode, d.Error, nullString(d.ReplayOf),
+		d.CreatedAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating webhook delivery %s: %w", d.Id, err)
+	}
+	if created, err := result.RowsAffected(); err != nil || created == 0 {
+		return fmt.Errorf("%w: event %s to endpoint %s", webhook.ErrDuplicateDelivery, d.EventId, d.EndpointId)
+	}
+	return nil
+}
+
+func (s *Store) GetDelivery(id string) (*webhook.Delivery, error) {
+	return getDelivery(s.db, id)
+}
+
+func (s *Store) ListDeliveries(query webhook.DeliveryQuery) ([]*webhook.Delivery, error) {
+	where := []string{"user_id = ?"}
+	args := []interface{}{query.UserId}
+	if query.EndpointId != "" {
+		where, args = append(where, "endpoint_id = ?"), append(args, query.EndpointId)
+	}
+	if query.Status != "" {
+		where, args = append(where, "status = ?"), append(args, query.Status)
+	}
+	statement := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries WHERE ` + strings.Join(where, " AND ") + ` ORDER BY seq DESC`
+	if query.Limit > 0 {
+		statement, args = statement+" LIMIT ?", append(args, query.Limit)
+	}
+	return queryDeliveries(s.db, statement, args...)
+}
+
+// UpdateDelivery applies the update inside a database transaction, so two
+// changes to the same delivery cannot interleave.
+func (s *Store) UpdateDelivery(id string, update func(d *webhook.Delivery) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := getDelivery(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := update(found); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?,
+		response_code = ?, error = ? WHERE id = ?`,
+		found.Status, found.Attempts, nullTime(found.NextAttemptAt), nullTime(found.LastAttemptAt),
+		found.ResponseCode, found.Error, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) DueDeliveries(at time.Time) ([]*webhook.Delivery, error) {
+	return queryDeliveries(s.db, `SELECT `+deliveryColumns+` FROM webhook_deliveries
+		WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, seq`, webhook.DeliveryPending, at.UnixNano())
+}
+
+func (s *Store) ListEvents(after int64, limit int) ([]*event.Event, error) {
+	rows, err := s.db.Query(`SELECT seq, id, type, user_id, wallet_id, data, created_at FROM events
+		WHERE seq > ? ORDER BY seq LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*event.Event{}
+	for rows.Next() {
+		e := &event.Event{}
+		var (
+			data      []byte
+			createdAt int64
+		)
+		if err := rows.Scan(&e.Seq, &e.Id, &e.Type, &e.UserId, &e.WalletId, &data, &createdAt); err != nil {
+			return nil, err
+		}
+		e.Data, e.CreatedAt = data, time.Unix(0, createdAt).UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) EventCursor(subscriber string) (int64, error) {
+	var seq int64
+	err := s.db.QueryRow(`SELECT seq FROM event_cursors WHERE subscriber = ?`, subscriber).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func (s *Store) SaveEventCursor(subscriber string, seq int64) error {
+	_, err := s.db.Exec(`INSERT INTO event_cursors (subscriber, seq) VALUES (?, ?)
+		ON CONFLICT (subscriber) DO UPDATE SET seq = excluded.seq`, subscriber, seq)
+	return err
+}
+
+// AppendAuditEntry checks the entry's place in the log and saves it inside a
+// database transaction.
+func (s *Store) AppendAuditEntry(e *audit.Entry) error {
+	balances, err := json.Marshal(e.Balances)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM audit_log`).Scan(&last); err != nil {
+		return err
+	}
+	if e.Seq != last+1 {
+		return fmt.Errorf("audit entry %d cannot follow entry %d", e.Seq, last)
+	}
+	_, err = tx.Exec(`INSERT INTO audit_log (seq, action, path, status, actor_id, user_id, source_ip, request_id, balances,
+		created_at, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Seq, e.Action, e.Path, e.Status, e.ActorId, e.UserId, e.SourceIP, e.RequestId, string(balances),
+		e.CreatedAt.UnixNano(), e.PrevHash, e.Hash)
+	if err != nil {
+		return fmt.Errorf("appending audit entry %d: %w", e.Seq, err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) LastAuditEntry() (*audit.Entry, error) {
+	entries, err := queryAuditEntries(s.db, `SELECT `+auditColumns+` FROM audit_log ORDER BY seq DESC LIMIT 1`)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+func (s *Store) ListAuditEntries(after int64, limit int) ([]*audit.Entry, error) {
+	return queryAuditEntries(s.db, `SELECT `+auditColumns+` FROM audit_log WHERE seq > ? ORDER BY seq LIMIT ?`, after, limit)
+}
+
+func (s *Store) ReserveIdempotencyKey(record *idempotency.Record) (*idempotency.Record, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	found := &idempotency.Record{UserId: record.UserId, Key: record.Key}
+	var (
+		statusCode           sql.NullInt64
+		createdAt, expiresAt int64
+	)
+	err = tx.QueryRow(`SELECT fingerprint, status_code, body, created_at, expires_at FROM idempotency_keys
+		WHERE user_id = ? AND key = ?`, record.UserId, record.Key).
+		Scan(&found.Fingerprint, &statusCode, &found.Body, &createdAt, &expiresAt)
+	switch {
+	case err == nil:
+		found.StatusCode = int(statusCode.Int64)
+		found.CreatedAt, found.ExpiresAt = time.Unix(0, createdAt).UTC(), time.Unix(0, expiresAt).UTC()
+		if !found.Expired(record.CreatedAt) {
+			return found, nil
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO idempotency_keys (user_id, key, fingerprint, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		record.UserId, record.Key, record.Fingerprint, record.CreatedAt.UnixNano(), record.ExpiresAt.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+func (s *Store) CompleteIdempotencyKey(record *idempotency.Record) error {
+	result, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = ?, body = ? WHERE user_id = ? AND key = ?`,
+		record.StatusCode, record.Body, record.UserId, record.Key)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return idempotency.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *Store) ReleaseIdempotencyKey(userId, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`, userId, key)
+	return err
+}
+
+func (s *Store) CreateAPIKey(k *auth.Key) error {
+	_, err := s.db.Exec(`INSERT INTO api_keys (id, user_id, hash, created_at) VALUES (?, ?, ?, ?)`,
+		k.Id, k.UserId, k.Hash, k.CreatedAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("creating API key %s: %w", k.Id, err)
+	}
+	return nil
+}
+
+func (s *Store) GetAPIKey(id string) (*auth.Key, error) {
+	found, err := scanAPIKey(s.db.QueryRow(`SELECT id, user_id, hash, created_at, revoked_at FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, auth.ErrKeyNotFound
+	}
+	return found, err
+}
+
+func (s *Store) ListAPIKeys(userId string) ([]*auth.Key, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, hash, created_at, revoked_at FROM api_keys
+		WHERE user_id = ? ORDER BY created_at, id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*auth.Key{}
+	for rows.Next() {
+		found, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found)
+	}
+	return keys, rows.Err()
+}
+
+func (s *Store) RevokeAPIKey(userId, id string, at time.Time) error {
+	result, err := s.db.Exec(`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND user_id = ?`,
+		at.UnixNano(), id, userId)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return auth.ErrKeyNotFound
+	}
+	return nil
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*auth.Key, error) {
+	var (
+		found     auth.Key
+		createdAt int64
+		revokedAt sql.NullInt64
+	)
+	if err := row.Scan(&found.Id, &found.UserId, &found.Hash, &createdAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	found.CreatedAt = time.Unix(0, createdAt).UTC()
+	if revokedAt.Valid {
+		at := time.Unix(0, revokedAt.Int64).UTC()
+		found.RevokedAt = &at
+	}
+	return &found, nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+const userColumns = `id, role, name, email, date_of_birth, country, kyc_status, kyc_reviewed_by, kyc_reason, kyc_updated_at`
+
+// getUser loads a user along with its KYC documents.
+func getUser(q queryer, id string) (*user.User, error) {
+	found, err := scanUser(q.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, user.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found.Kyc.Documents, err = listDocuments(q, id); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// scanUser reads a row of userColumns, leaving out the user's documents.
+func scanUser(row interface{ Scan(...interface{}) error }) (*user.User, error) {
+	found := &user.User{}
+	var updatedAt sql.NullInt64
+	err := row.Scan(&found.Id, &found.Role, &found.Name, &found.Email, &found.DateOfBirth, &found.Country,
+		&found.Kyc.Status, &found.Kyc.ReviewedBy, &found.Kyc.Reason, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		at := time.Unix(0, updatedAt.Int64).UTC()
+		found.Kyc.UpdatedAt = &at
+	}
+	return found, nil
+}
+
+func listDocuments(q queryer, userId string) ([]user.Document, error) {
+	rows, err := q.Query(`SELECT type, reference, submitted_at FROM kyc_documents WHERE user_id = ? ORDER BY seq`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var documents []user.Document
+	for rows.Next() {
+		var (
+			document    user.Document
+			submittedAt int64
+		)
+		if err := rows.Scan(&document.Type, &document.Reference, &submittedAt); err != nil {
+			return nil, err
+		}
+		document.SubmittedAt = time.Unix(0, submittedAt).UTC()
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+func insertDocuments(q queryer, userId string, documents []user.Document) error {
+	for _, document := range documents {
+		_, err := q.Exec(`INSERT INTO kyc_documents (user_id, type, reference, submitted_at) VALUES (?, ?, ?, ?)`,
+			userId, document.Type, document.Reference, document.SubmittedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const walletColumns = `id, user_id, name, balance, scale, currency, status, limits, created_at`
+
+// getWallet loads a wallet along with what it has held now.
+func getWallet(q queryer, id string) (*wallet.Wallet, error) {
+	found, err := scanWallet(q.QueryRow(`SELECT `+walletColumns+` FROM wallets WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, wallet.ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found.Held, err = heldBy(q, id, found.Currency(), time.Now()); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// scanWallet reads a row of walletColumns.
+func scanWallet(row interface{ Scan(...interface{}) error }) (*wallet.Wallet, error) {
+	found := &wallet.Wallet{}
+	var (
+		limits    string
+		createdAt int64
+	)
+	err := row.Scan(&found.Id, &found.UserId, &found.Name, &found.Balance.Units, &found.Balance.Scale, &found.Balance.Currency,
+		&found.Status, &limits, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	found.CreatedAt = time.Unix(0, createdAt).UTC()
+	if limits != "" {
+		if err := json.Unmarshal([]byte(limits), &found.Limits); err != nil {
+			return nil, fmt.Errorf("reading the limits of wallet %s: %w", found.Id, err)
+		}
+		if found.Limits, err = found.Limits.In(found.Currency()); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// encodeLimits stores a wallet's limits as JSON, or as an empty string when
+// it has none.
+func encodeLimits(limits wallet.Limits) (string, error) {
+	if len(limits) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(limits)
+	return string(encoded), err
+}
+
+// encodeMetadata stores a transaction's metadata as a JSON object, or as NULL
+// when it has none.
+func encodeMetadata(metadata map[string]string) (sql.NullString, error) {
+	if len(metadata) == 0 {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(metadata)
+	return sql.NullString{String: string(encoded), Valid: true}, err
+}
+
+// spentSince adds up the amounts of the transactions after since that count
+// towards the same limits as t.
+func spentSince(q queryer, t *wallet.Transaction, since time.Time) (money.Money, error) {
+	column := "source_wallet_id"
+	if t.Type == wallet.TypeDeposit {
+		column = "target_wallet_id"
+	}
+	rows, err := q.Query(`SELECT amount, scale, currency FROM transactions WHERE `+column+` = ? AND type = ? AND created_at > ?`,
+		t.LimitedWalletId(), t.Type, since.UnixNano())
+	if err != nil {
+		return money.Money{}, err
+	}
+	defer rows.Close()
+	total, err := money.Zero(t.Amount.Currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	for rows.Next() {
+		var amount money.Money
+		if err := rows.Scan(&amount.Units, &amount.Scale, &amount.Currency); err != nil {
+			return money.Money{}, err
+		}
+		if total, err = total.Add(amount); err != nil {
+			return money.Money{}, err
+		}
+	}
+	return total, rows.Err()
+}
+
+// ownerSpentSince adds up, in each currency, the amounts of the
+// transactions after since of the same type as t counted against any wallet
+// of the user owning the wallet t counts against.
+func ownerSpentSince(q queryer, t *wallet.Transaction, since time.Time) ([]money.Money, error) {
+	column := "source_wallet_id"
+	if t.Type == wallet.TypeDeposit {
+		column = "target_wallet_id"
+	}
+	rows, err := q.Query(`SELECT t.amount, t.scale, t.currency FROM transactions t JOIN wallets w ON w.id = t.`+column+`
+		WHERE w.user_id = (SELECT user_id FROM wallets WHERE id = ?) AND t.type = ? AND t.created_at > ?`,
+		t.LimitedWalletId(), t.Type, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byCurrency := map[string]money.Money{}
+	for rows.Next() {
+		var amount money.Money
+		if err := rows.Scan(&amount.Units, &amount.Scale, &amount.Currency); err != nil {
+			return nil, err
+		}
+		total, found := byCurrency[amount.Currency]
+		if !found {
+			byCurrency[amount.Currency] = amount
+		} else if byCurrency[amount.Currency], err = total.Add(amount); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	totals := make([]money.Money, 0, len(byCurrency))
+	for _, total := range byCurrency {
+		totals = append(totals, total)
+	}
+	return totals, nil
+}
+
+const transactionColumns = `id, type, source_wallet_id, target_wallet_id, amount, scale, currency,
+	source_balance, target_balance, reference, created_at,
+	fx_quote_id, fx_rate, fx_spread, converted_amount, converted_scale, converted_currency,
+	adjusted_by, adjustment_reason, authorization_id, refund_of, refunded, description, metadata`
+
+func getTransaction(q queryer, id string) (*wallet.Transaction, error) {
+	found, err := scanTransaction(q.QueryRow(`SELECT `+transactionColumns+` FROM transactions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrTransactionNotFound, id)
+	}
+	return found, err
+}
+
+// scanTransaction reads a row of transactionColumns.
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*wallet.Transaction, error) {
+	var (
+		t                                        wallet.Transaction
+		source, target                           sql.NullString
+		sourceBalance, targetBalance             sql.NullInt64
+		amount, createdAt, refunded              int64
+		scale                                    int
+		currency                                 string
+		quoteId, rate, spread, convertedCurrency sql.NullString
+		convertedAmount, convertedScale          sql.NullInt64
+		adjustedBy, adjustmentReason             sql.NullString
+		authorizationId, refundOf, metadata      sql.NullString
+		err                                      error
+	)
+	if err := row.Scan(&t.Id, &t.Type, &source, &target, &amount, &scale, &currency,
+		&sourceBalance, &targetBalance, &t.Reference, &createdAt,
+		&quoteId, &rate, &spread, &convertedAmount, &convertedScale, &convertedCurrency,
+		&adjustedBy, &adjustmentReason, &authorizationId, &refundOf, &refunded, &t.Description, &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &t.Metadata); err != nil {
+			return nil, fmt.Errorf("reading the metadata of transaction %s: %w", t.Id, err)
+		}
+	}
+	t.AuthorizationId, t.RefundOf = authorizationId.String, refundOf.String
+	if adjustedBy.Valid {
+		t.Adjustment = &wallet.Adjustment{OperatorId: adjustedBy.String, Reason: adjustmentReason.String}
+	}
+	t.SourceWalletId, t.TargetWalletId = source.String, target.String
+	t.Amount = money.Money{Units: amount, Scale: scale, Currency: currency}
+	if refunded != 0 {
+		t.Refunded = money.Money{Units: refunded, Scale: scale, Currency: currency}
+	}
+	targetScale, targetCurrency := scale, currency
+	if convertedAmount.Valid {
+		targetScale, targetCurrency = int(convertedScale.Int64), convertedCurrency.String
+		conversion := &wallet.Conversion{
+			QuoteId:         quoteId.String,
+			SourceAmount:    t.Amount,
+			SourceCurrency:  currency,
+			ConvertedAmount: money.Money{Units: convertedAmount.Int64, Scale: targetScale, Currency: targetCurrency},
+			TargetCurrency:  targetCurrency,
+		}
+		if conversion.Rate, err = money.Parse(rate.String); err != nil {
+			return nil, err
+		}
+		if conversion.Spread, err = money.Parse(spread.String); err != nil {
+			return nil, err
+		}
+		t.Conversion = conversion
+	}
+	if sourceBalance.Valid {
+		t.SourceBalance = money.Money{Units: sourceBalance.Int64, Scale: scale, Currency: currency}
+	}
+	if targetBalance.Valid {
+		t.TargetBalance = money.Money{Units: targetBalance.Int64, Scale: targetScale, Currency: targetCurrency}
+	}
+	t.Timestamp = time.Unix(0, createdAt).UTC()
+	return &t, nil
+}
+
+const authorizationColumns = `id, source_wallet_id, target_wallet_id, amount, captured, scale, currency, status,
+	created_at, expires_at`
+
+func getAuthorization(q queryer, id string) (*wallet.Authorization, error) {
+	found, err := scanAuthorization(q.QueryRow(`SELECT `+authorizationColumns+` FROM authorizations WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrAuthorizationNotFound, id)
+	}
+	return found, err
+}
+
+// scanAuthorization reads a row of authorizationColumns.
+func scanAuthorization(row interface{ Scan(...interface{}) error }) (*wallet.Authorization, error) {
+	found := &wallet.Authorization{}
+	var (
+		amount, captured, createdAt, expiresAt int64
+		scale                                  int
+		currency                               string
+	)
+	err := row.Scan(&found.Id, &found.SourceWalletId, &found.TargetWalletId, &amount, &captured, &scale, &currency,
+		&found.Status, &createdAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	found.Amount = money.Money{Units: amount, Scale: scale, Currency: currency}
+	found.Captured = money.Money{Units: captured, Scale: scale, Currency: currency}
+	found.CreatedAt, found.ExpiresAt = time.Unix(0, createdAt).UTC(), time.Unix(0, expiresAt).UTC()
+	return found, nil
+}
+
+// saveAuthorization stores the status and captured amount of an
+// authorization, the only parts of it that ever change.
+func saveAuthorization(q queryer, a *wallet.Authorization) error {
+	_, err := q.Exec(`UPDATE authorizations SET status = ?, captured = ? WHERE id = ?`, a.Status, a.Captured.Units, a.Id)
+	return err
+}
+
+const scheduleColumns = `id, user_id, wallet_id, creditor_id, amount, scale, currency, frequency, start_at, end_at,
+	status, next_run_at, due, attempts, created_at`
+
+func getSchedule(q queryer, id string) (*schedule.Schedule, error) {
+	found, err := scanSchedule(q.QueryRow(`SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", schedule.ErrScheduleNotFound, id)
+	}
+	return found, err
+}
+
+func querySchedules(q queryer, query string, args ...interface{}) ([]*schedule.Schedule, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	schedules := []*schedule.Schedule{}
+	for rows.Next() {
+		found, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, found)
+	}
+	return schedules, rows.Err()
+}
+
+// scanSchedule reads a row of scheduleColumns.
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*schedule.Schedule, error) {
+	found := &schedule.Schedule{}
+	var (
+		amount, startAt, createdAt int64
+		endAt, nextRunAt           sql.NullInt64
+		scale                      int
+		currency                   string
+	)
+	err := row.Scan(&found.Id, &found.UserId, &found.WalletId, &found.Creditor, &amount, &scale, &currency,
+		&found.Frequency, &startAt, &endAt, &found.Status, &nextRunAt, &found.Due, &found.Attempts, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	found.Amount = money.Money{Units: amount, Scale: scale, Currency: currency}
+	found.StartAt, found.CreatedAt = time.Unix(0, startAt).UTC(), time.Unix(0, createdAt).UTC()
+	found.EndAt, found.NextRunAt = timeOf(endAt), timeOf(nextRunAt)
+	return found, nil
+}
+
+const endpointColumns = `id, user_id, url, events, secret, created_at`
+
+// scanEndpoint reads a row of endpointColumns.
+func scanEndpoint(row interface{ Scan(...interface{}) error }) (*webhook.Endpoint, error) {
+	found := &webhook.Endpoint{}
+	var (
+		events    string
+		createdAt int64
+	)
+	if err := row.Scan(&found.Id, &found.UserId, &found.URL, &events, &found.Secret, &createdAt); err != nil {
+		return nil, err
+	}
+	found.Events = []string{}
+	if events != "" {
+		found.Events = strings.Split(events, ",")
+	}
+	found.CreatedAt = time.Unix(0, createdAt).UTC()
+	return found, nil
+}
+
+const deliveryColumns = `id, endpoint_id, user_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_attempt_at, response_code, error, replay_of, created_at`
+
+func getDelivery(q queryer, id string) (*webhook.Delivery, error) {
+	found, err := scanDelivery(q.QueryRow(`SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", webhook.ErrDeliveryNotFound, id)
+	}
+	return found, err
+}
+
+func queryDeliveries(q queryer, query string, args ...interface{}) ([]*webhook.Delivery, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*webhook.Delivery{}
+	for rows.Next() {
+		found, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, found)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanDelivery reads a row of deliveryColumns.
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*webhook.Delivery, error) {
+	found := &webhook.Delivery{}
+	var (
+		payload                      []byte
+		nextAttemptAt, lastAttemptAt sql.NullInt64
+		replayOf                     sql.NullString
+		createdAt                    int64
+	)
+	err := row.Scan(&found.Id, &found.EndpointId, &found.UserId, &found.EventId, &found.EventType, &payload,
+		&found.Status, &found.Attempts, &nextAttemptAt, &lastAttemptAt, &found.ResponseCode, &found.Error,
+		&replayOf, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	found.Payload, found.ReplayOf = payload, replayOf.String
+	found.NextAttemptAt, found.LastAttemptAt = timeOf(nextAttemptAt), timeOf(lastAttemptAt)
+	found.CreatedAt = time.Unix(0, createdAt).UTC()
+	return found, nil
+}
+
+const auditColumns = `seq, action, path, status, actor_id, user_id, source_ip, request_id, balances, created_at, prev_hash, hash`
+
+func queryAuditEntries(q queryer, query string, args ...interface{}) ([]*audit.Entry, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*audit.Entry{}
+	for rows.Next() {
+		e := &audit.Entry{}
+		var (
+			balances  string
+			createdAt int64
+		)
+		err := rows.Scan(&e.Seq, &e.Action, &e.Path, &e.Status, &e.ActorId, &e.UserId, &e.SourceIP, &e.RequestId,
+			&balances, &createdAt, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(balances), &e.Balances); err != nil {
+			return nil, fmt.Errorf("reading balances of audit entry %d: %w", e.Seq, err)
+		}
+		e.CreatedAt = time.Unix(0, createdAt).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// recordEvents adds events to the outbox as part of q's transaction, and
+// fills in the Seq each was given.
+func recordEvents(q queryer, events ...*event.Event) error {
+	for _, e := range events {
+		result, err := q.Exec(`INSERT INTO events (id, type, user_id, wallet_id, data, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			e.Id, e.Type, e.UserId, e.WalletId, []byte(e.Data), e.CreatedAt.UnixNano())
+		if err != nil {
+			return fmt.Errorf("recording event %s: %w", e.Id, err)
+		}
+		if e.Seq, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heldBy adds up what the wallet's pending authorizations hold at the given
+// time.
+func heldBy(q queryer, walletId, currency string, at time.Time) (money.Money, error) {
+	held, err := money.Zero(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	err = q.QueryRow(`SELECT COALESCE(SUM(amount - captured), 0) FROM authorizations
+		WHERE source_wallet_id = ? AND status = ? AND expires_at > ?`,
+		walletId, wallet.HoldPending, at.UnixNano()).Scan(&held.Units)
+	return held, err
+}
+
+// balanceOf returns an account's current balance: a wallet's stored balance,
+// or the running balance of a system account's latest entry.
+func balanceOf(q queryer, accountId, currency string) (money.Money, error) {
+	if !wallet.IsSystemAccount(accountId) {
+		found, err := getWallet(q, accountId)
+		if err != nil {
+			return money.Money{}, err
+		}
+		return found.Balance, nil
+	}
+	balance, err := money.Zero(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	err = q.QueryRow(`SELECT balance, scale FROM ledger_entries WHERE account_id = ? ORDER BY seq DESC LIMIT 1`, accountId).
+		Scan(&balance.Units, &balance.Scale)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return money.Money{}, err
+	}
+	return balance, nil
+}
+
+func setBalance(q queryer, walletId string, balance money.Money) error {
+	_, err := q.Exec(`UPDATE wallets SET balance = ?, scale = ? WHERE id = ?`, balance.Units, balance.Scale, walletId)
+	return err
+}
+
+// likePrefix is a LIKE pattern matching strings that start with prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// timeOf is the inverse of nullTime.
+func timeOf(at sql.NullInt64) *time.Time {
+	if !at.Valid {
+		return nil
+	}
+	t := time.Unix(0, at.Int64).UTC()
+	return &t
+}
@@ -0,0 +1,150 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/storetest"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLite_Store(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Store {
+		return openTestStore(t, filepath.Join(t.TempDir(), "wallets.db"))
+	})
+}
+
+func TestSQLite_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	store, err := Open(path)
+	require.NoError(t, err)
+	u, err := user.New(context.Background(), store, user.Details{})
+	require.NoError(t, err)
+	w, err := u.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	_, err = w.Deposit(context.Background(), money.MustParse("100.25"))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	reopened := openTestStore(t, path)
+	_, err = user.Get(reopened, u.Id)
+	require.NoError(t, err)
+	got, err := wallet.Get(reopened, w.Id)
+	require.NoError(t, err)
+	require.Equal(t, "100.25", got.Balance.String())
+}
+
+func TestSQLite_Migrate(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "wallets.db"))
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	version, err := migrate(store.db, migrations)
+	require.NoError(t, err)
+	require.Equal(t, migrations[len(migrations)-1].version, version, "migrating twice must be a no-op")
+
+	var applied int
+	require.NoError(t, store.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied))
+	require.Equal(t, len(migrations), applied)
+}
+
+func TestSQLite_MigrateBackfillsLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	var beforeLedger []migration
+	for _, m := range migrations {
+		if m.version < 4 {
+			beforeLedger = append(beforeLedger, m)
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+path)
+	require.NoError(t, err)
+	store := &Store{db: db}
+	t.Cleanup(func() { store.Close() })
+	version, err := migrate(store.db, beforeLedger)
+	require.NoError(t, err)
+	require.Equal(t, 3, version)
+
+	// Write the history the way the schema stood before the ledger existed.
+	_, err = store.db.Exec(`
+		INSERT INTO users (id, created_at) VALUES ('user1', 0);
+		INSERT INTO wallets (id, user_id, balance, scale, currency, created_at) VALUES
+			('wallet1', 'user1', 6000, 2, 'EUR', 0),
+			('wallet2', 'user1', 2000, 2, 'EUR', 0);
+		INSERT INTO transactions (id, type, source_wallet_id, target_wallet_id, amount, scale, currency, source_balance, target_balance, created_at) VALUES
+			('t1', 'deposit', NULL, 'wallet1', 10000, 2, 'EUR', NULL, 10000, 1),
+			('t2', 'payment', 'wallet1', 'wallet2', 4000, 2, 'EUR', 6000, 4000, 2),
+			('t3', 'withdrawal', 'wallet2', NULL, 2000, 2, 'EUR', 2000, NULL, 3);
+	`)
+	require.NoError(t, err)
+
+	_, err = migrate(store.db, migrations)
+	require.NoError(t, err)
+
+	for _, walletId := range []string{"wallet1", "wallet2"} {
+		w, err := wallet.Get(store, walletId)
+		require.NoError(t, err)
+		require.NoError(t, w.Reconcile())
+	}
+	cashIn, err := store.ListEntries(wallet.CashIn("EUR"))
+	require.NoError(t, err)
+	require.Len(t, cashIn, 1)
+	require.Equal(t, "-100.00", cashIn[0].Balance.String())
+	cashOut, err := store.ListEntries(wallet.CashOut("EUR"))
+	require.NoError(t, err)
+	require.Len(t, cashOut, 1)
+	require.Equal(t, "20.00", cashOut[0].Balance.String())
+}
+
+func TestSQLite_OpenReadOnly(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	_, err := OpenReadOnly(missing)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(missing)
+	require.ErrorIs(t, err, os.ErrNotExist, "opening read-only must not create the file")
+
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	require.NoError(t, audit.NewLog(openTestStore(t, path)).Append(&audit.Entry{Action: "POST /v1/user", Status: 201}))
+	store, err := OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	chain, err := audit.Verify(store)
+	require.NoError(t, err)
+	require.Equal(t, 1, chain.Count())
+	require.Error(t, store.CreateUser(&user.User{Id: "user1"}), "writes must fail")
+}
+
+func TestSQLite_AuditLogIsAppendOnly(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "wallet.db"))
+	require.NoError(t, audit.NewLog(store).Append(&audit.Entry{Action: "POST /v1/user", Status: 201}))
+
+	for name, statement := range map[string]string{
+		"update": `UPDATE audit_log SET status = 200`,
+		"delete": `DELETE FROM audit_log`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.db.Exec(statement)
+			require.ErrorContains(t, err, "append-only")
+		})
+	}
+	chain, err := audit.Verify(store)
+	require.NoError(t, err)
+	require.Equal(t, 1, chain.Count())
+}
@@ -0,0 +1,1510 @@
+// Package storetest holds the behaviour every store implementation must
+// share, so each backend can run the same suite against itself.
+package storetest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/audit"
+	"github.com/adrianos93/wallet-manager/internal/auth"
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/idempotency"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/schedule"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+// Store is everything a backend implements.
+type Store interface {
+	user.Store
+	auth.Store
+	idempotency.Store
+	schedule.Store
+	webhook.Store
+	event.Store
+	audit.Store
+}
+
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	for name, test := range map[string]func(t *testing.T, store Store){
+		"users":                      testUsers,
+		"wallets":                    testWallets,
+		"applies transactions":       testApplyTransaction,
+		"rejects insufficient funds": testInsufficientFunds,
+		"rejects unknown wallets":    testUnknownWallets,
+		"posts a balanced ledger":    testLedger,
+		"converts currencies":        testConversion,
+		"filters transactions":       testListTransactions,
+		"reserves idempotency keys":  testIdempotency,
+		"stores API keys":            testAPIKeys,
+		"lists users":                testListUsers,
+		"updates profiles":           testUpdateUser,
+		"caps user totals":           testUserCap,
+		"enforces limits":            testLimits,
+		"enforces user limits":       testUserLimits,
+		"lists wallets":              testListWallets,
+		"enforces wallet statuses":   testWalletStatus,
+		"holds authorized funds":     testAuthorizations,
+		"refunds payments":           testRefunds,
+		"keeps schedules":            testSchedules,
+		"keeps webhooks":             testWebhooks,
+		"records events":             testEvents,
+		"keeps an audit log":         testAuditLog,
+		"concurrent transactions":    testConcurrentTransactions,
+		"concurrent registrations":   testConcurrentRegistrations,
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func eur(amount string) money.Money {
+	m, err := money.MustParse(amount).In("EUR")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// seedUser creates user1, which owns every wallet the suite creates.
+func seedUser(t *testing.T, store user.Store) {
+	t.Helper()
+	if _, err := store.GetUser("user1"); err == nil {
+		return
+	}
+	require.NoError(t, store.CreateUser(&user.User{Id: "user1"}))
+}
+
+func seedWallet(t *testing.T, store user.Store, id, balance string) {
+	t.Helper()
+	seedUser(t, store)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: id, UserId: "user1", Balance: eur("0")}))
+	if balance != "0" {
+		require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+			Id:             "seed-" + id,
+			Type:           wallet.TypeDeposit,
+			TargetWalletId: id,
+			Amount:         eur(balance),
+			Timestamp:      time.Now(),
+		}))
+	}
+}
+
+func testUsers(t *testing.T, store Store) {
+	require.NoError(t, store.CreateUser(&user.User{Id: "user1"}))
+	require.Error(t, store.CreateUser(&user.User{Id: "user1"}))
+
+	got, err := store.GetUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, "user1", got.Id)
+
+	_, err = store.GetUser("missing")
+	require.ErrorIs(t, err, user.ErrUserNotFound)
+}
+
+func testWallets(t *testing.T, store Store) {
+	seedUser(t, store)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet1", UserId: "user1", Balance: eur("0")}))
+	require.Error(t, store.CreateWallet(&wallet.Wallet{Id: "wallet1", UserId: "user1", Balance: eur("0")}))
+
+	got, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, "user1", got.UserId)
+	require.Equal(t, eur("0"), got.Balance)
+
+	got.Balance = eur("1000")
+	again, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("0"), again.Balance, "changing a returned wallet must not change the store")
+
+	yen, err := money.Zero("JPY")
+	require.NoError(t, err)
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet2", UserId: "user1", Name: "Travel", Balance: yen, CreatedAt: created}))
+	got, err = store.GetWallet("wallet2")
+	require.NoError(t, err)
+	require.Equal(t, "JPY", got.Currency())
+	require.Equal(t, "Travel", got.Name)
+	require.Equal(t, created, got.CreatedAt)
+
+	_, err = store.GetWallet("missing")
+	require.ErrorIs(t, err, wallet.ErrWalletNotFound)
+}
+
+func testApplyTransaction(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100.25")
+	seedWallet(t, store, "wallet2", "0")
+
+	payment := &wallet.Transaction{
+		Id:             "payment1",
+		Type:           wallet.TypePayment,
+		SourceWalletId: "wallet1",
+		TargetWalletId: "wallet2",
+		Amount:         eur("40.10"),
+		Timestamp:      time.Now(),
+	}
+	require.NoError(t, store.ApplyTransaction(payment))
+	require.Equal(t, eur("60.15"), payment.SourceBalance)
+	require.Equal(t, eur("40.10"), payment.TargetBalance)
+
+	source, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("60.15"), source.Balance)
+	target, err := store.GetWallet("wallet2")
+	require.NoError(t, err)
+	require.Equal(t, eur("40.10"), target.Balance)
+
+	history, err := store.ListTransactions("wallet1", wallet.TransactionQuery{})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "payment1", history[0].Id, "history is newest first")
+	require.Equal(t, eur("60.15"), history[0].SourceBalance)
+
+	history, err = store.ListTransactions("wallet2", wallet.TransactionQuery{})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "wallet1", history[0].SourceWalletId)
+}
+
+func testInsufficientFunds(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "10")
+	seedWallet(t, store, "wallet2", "0")
+
+	err := store.ApplyTransaction(&wallet.Transaction{
+		Id:             "payment1",
+		Type:           wallet.TypePayment,
+		SourceWalletId: "wallet1",
+		TargetWalletId: "wallet2",
+		Amount:         eur("10.01"),
+		Timestamp:      time.Now(),
+	})
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+
+	source, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("10"), source.Balance)
+	target, err := store.GetWallet("wallet2")
+	require.NoError(t, err)
+	require.Equal(t, eur("0"), target.Balance)
+
+	history, err := store.ListTransactions("wallet2", wallet.TransactionQuery{})
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
+
+func testUnknownWallets(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "10")
+
+	err := store.ApplyTransaction(&wallet.Transaction{
+		Id:             "payment1",
+		Type:           wallet.TypePayment,
+		SourceWalletId: "wallet1",
+		TargetWalletId: "missing",
+		Amount:         eur("5"),
+		Timestamp:      time.Now(),
+	})
+	require.ErrorIs(t, err, wallet.ErrWalletNotFound)
+
+	source, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("10"), source.Balance)
+
+	_, err = store.ListTransactions("missing", wallet.TransactionQuery{})
+	require.ErrorIs(t, err, wallet.ErrWalletNotFound)
+}
+
+func testLedger(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	for _, transaction := range []*wallet.Transaction{
+		{Id: "payment1", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2", Amount: eur("30")},
+		{Id: "withdrawal1", Type: wallet.TypeWithdrawal, SourceWalletId: "wallet2", Amount: eur("12.50")},
+		{Id: "deposit1", Type: wallet.TypeDeposit, TargetWalletId: "wallet2", Amount: eur("0.01")},
+	} {
+		transaction.Timestamp = time.Now()
+		require.NoError(t, store.ApplyTransaction(transaction))
+	}
+
+	entries, err := store.ListEntries("wallet2")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, wallet.Credit, entries[0].Direction)
+	require.Equal(t, eur("30"), entries[0].Balance)
+	require.Equal(t, wallet.Debit, entries[1].Direction)
+	require.Equal(t, eur("17.50"), entries[1].Balance)
+	require.Equal(t, eur("17.51"), entries[2].Balance)
+
+	var all []wallet.Entry
+	for accountId, want := range map[string]string{
+		"wallet1":             "70",
+		"wallet2":             "17.51",
+		wallet.CashIn("EUR"):  "-100.01",
+		wallet.CashOut("EUR"): "12.50",
+	} {
+		entries, err := store.ListEntries(accountId)
+		require.NoError(t, err)
+		balance, err := wallet.SumEntries(entries, "EUR")
+		require.NoError(t, err)
+		require.Equal(t, eur(want), balance, accountId)
+		require.Equal(t, eur(want), entries[len(entries)-1].Balance, accountId)
+		if !wallet.IsSystemAccount(accountId) {
+			stored, err := store.GetWallet(accountId)
+			require.NoError(t, err)
+			require.Equal(t, stored.Balance, balance, accountId)
+		}
+		all = append(all, entries...)
+	}
+	require.NoError(t, wallet.CheckBalanced(all))
+}
+
+func testConversion(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	usd, err := money.Zero("USD")
+	require.NoError(t, err)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet2", UserId: "user1", Balance: usd}))
+
+	converted := money.Money{Units: 4950, Scale: 2, Currency: "USD"}
+	conversion := &wallet.Conversion{
+		QuoteId:         "quote1",
+		Rate:            money.MustParse("1.2375"),
+		Spread:          money.MustParse("0.01"),
+		SourceAmount:    eur("40"),
+		SourceCurrency:  "EUR",
+		ConvertedAmount: converted,
+		TargetCurrency:  "USD",
+	}
+	payment := &wallet.Transaction{
+		Id:             "payment1",
+		Type:           wallet.TypePayment,
+		SourceWalletId: "wallet1",
+		TargetWalletId: "wallet2",
+		Amount:         eur("40"),
+		Conversion:     conversion,
+		Timestamp:      time.Now(),
+	}
+	require.NoError(t, store.ApplyTransaction(payment))
+	require.Equal(t, eur("60"), payment.SourceBalance)
+	require.Equal(t, converted, payment.TargetBalance)
+
+	target, err := store.GetWallet("wallet2")
+	require.NoError(t, err)
+	require.Equal(t, converted, target.Balance)
+
+	for _, walletId := range []string{"wallet1", "wallet2"} {
+		history, err := store.ListTransactions(walletId, wallet.TransactionQuery{})
+		require.NoError(t, err)
+		require.Equal(t, "payment1", history[0].Id, walletId)
+		require.Equal(t, conversion, history[0].Conversion, walletId)
+		require.Equal(t, converted, history[0].TargetBalance, walletId)
+	}
+
+	// Amount filters compare against what moved in or out of the wallet.
+	minimum := money.Money{Units: 45, Currency: "USD"}
+	history, err := store.ListTransactions("wallet2", wallet.TransactionQuery{MinAmount: &minimum})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	var all []wallet.Entry
+	for _, accountId := range []string{"wallet1", "wallet2", wallet.CashIn("EUR"), wallet.FX("EUR"), wallet.FX("USD")} {
+		entries, err := store.ListEntries(accountId)
+		require.NoError(t, err)
+		all = append(all, entries...)
+	}
+	require.NoError(t, wallet.CheckBalanced(all))
+}
+
+func testListTransactions(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "0")
+	seedWallet(t, store, "wallet2", "0")
+	seedWallet(t, store, "wallet3", "0")
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, transaction := range []*wallet.Transaction{
+		{Id: "t0", Type: wallet.TypeDeposit, TargetWalletId: "wallet1", Amount: eur("100")},
+		{Id: "t1", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2", Amount: eur("10"),
+			Reference: "INV-1", Description: "March rent", Metadata: map[string]string{"order": "1", "channel": "web"}},
+		{Id: "t2", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet3", Amount: eur("20"),
+			Reference: "INV-2"},
+		{Id: "t3", Type: wallet.TypePayment, SourceWalletId: "wallet2", TargetWalletId: "wallet1", Amount: eur("5"),
+			Metadata: map[string]string{"order": "2", "channel": "web"}},
+		{Id: "t4", Type: wallet.TypeWithdrawal, SourceWalletId: "wallet1", Amount: eur("1")},
+		{Id: "t5", Type: wallet.TypePayment, SourceWalletId: "wallet2", TargetWalletId: "wallet3", Amount: eur("1")},
+	} {
+		transaction.Timestamp = start.Add(time.Duration(i) * time.Hour)
+		require.NoError(t, store.ApplyTransaction(transaction))
+	}
+	amount := func(s string) *money.Money {
+		m := eur(s)
+		return &m
+	}
+	stored, err := store.GetTransaction("t1")
+	require.NoError(t, err)
+	require.Equal(t, "INV-1", stored.Reference)
+	require.Equal(t, "March rent", stored.Description)
+	require.Equal(t, map[string]string{"order": "1", "channel": "web"}, stored.Metadata)
+
+	for name, test := range map[string]struct {
+		query   wallet.TransactionQuery
+		want    []string
+		wantErr error
+	}{
+		"everything newest first": {
+			want: []string{"t4", "t3", "t2", "t1", "t0"},
+		},
+		"limited": {
+			query: wallet.TransactionQuery{Limit: 2},
+			want:  []string{"t4", "t3"},
+		},
+		"before a cursor": {
+			query: wallet.TransactionQuery{Before: "t3", Limit: 2},
+			want:  []string{"t2", "t1"},
+		},
+		"time range": {
+			query: wallet.TransactionQuery{From: start.Add(time.Hour), To: start.Add(3 * time.Hour)},
+			want:  []string{"t2", "t1"},
+		},
+		"incoming": {
+			query: wallet.TransactionQuery{Direction: wallet.Incoming},
+			want:  []string{"t3", "t0"},
+		},
+		"outgoing": {
+			query: wallet.TransactionQuery{Direction: wallet.Outgoing},
+			want:  []string{"t4", "t2", "t1"},
+		},
+		"counterparty": {
+			query: wallet.TransactionQuery{CounterpartyId: "wallet2"},
+			want:  []string{"t3", "t1"},
+		},
+		"amount range": {
+			query: wallet.TransactionQuery{MinAmount: amount("5"), MaxAmount: amount("20")},
+			want:  []string{"t3", "t2", "t1"},
+		},
+		"reference": {
+			query: wallet.TransactionQuery{Reference: "INV-2"},
+			want:  []string{"t2"},
+		},
+		"metadata": {
+			query: wallet.TransactionQuery{Metadata: map[string]string{"channel": "web"}},
+			want:  []string{"t3", "t1"},
+		},
+		"every metadata pair": {
+			query: wallet.TransactionQuery{Metadata: map[string]string{"channel": "web", "order": "2"}},
+			want:  []string{"t3"},
+		},
+		"unknown cursor": {
+			query:   wallet.TransactionQuery{Before: "t5"},
+			wantErr: wallet.ErrInvalidQuery,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := store.ListTransactions("wallet1", test.query)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			ids := []string{}
+			for _, transaction := range got {
+				ids = append(ids, transaction.Id)
+			}
+			require.Equal(t, test.want, ids)
+		})
+	}
+}
+
+func testIdempotency(t *testing.T, store Store) {
+	seedUser(t, store)
+	now := time.Now()
+	first := idempotency.NewRecord("user1", "key1", "fingerprint1", now)
+	found, err := store.ReserveIdempotencyKey(first)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	found, err = store.ReserveIdempotencyKey(idempotency.NewRecord("user1", "key1", "fingerprint2", now))
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.Equal(t, "fingerprint1", found.Fingerprint)
+	require.False(t, found.Completed())
+
+	first.StatusCode, first.Body = 200, []byte(`{"Balance":"10.00"}`)
+	require.NoError(t, store.CompleteIdempotencyKey(first))
+	found, err = store.ReserveIdempotencyKey(idempotency.NewRecord("user1", "key1", "fingerprint1", now))
+	require.NoError(t, err)
+	require.Equal(t, 200, found.StatusCode)
+	require.Equal(t, first.Body, found.Body)
+
+	// Once expired, the key can be reserved again.
+	later := idempotency.NewRecord("user1", "key1", "fingerprint3", now.Add(idempotency.Retention))
+	found, err = store.ReserveIdempotencyKey(later)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	require.NoError(t, store.ReleaseIdempotencyKey("user1", "key1"))
+	found, err = store.ReserveIdempotencyKey(idempotency.NewRecord("user1", "key1", "fingerprint4", now))
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	require.ErrorIs(t, store.CompleteIdempotencyKey(idempotency.NewRecord("user1", "missing", "", now)), idempotency.ErrRecordNotFound)
+}
+
+func testAPIKeys(t *testing.T, store Store) {
+	seedUser(t, store)
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, key := range []*auth.Key{
+		{Id: "key1", UserId: "user1", Hash: "hash1", CreatedAt: created},
+		{Id: "key2", UserId: "user1", Hash: "hash2", CreatedAt: created.Add(time.Second)},
+		{Id: "key3", UserId: "user2", Hash: "hash3", CreatedAt: created},
+	} {
+		require.NoError(t, store.CreateAPIKey(key), i)
+	}
+	require.Error(t, store.CreateAPIKey(&auth.Key{Id: "key1", UserId: "user1", Hash: "other", CreatedAt: created}))
+	require.Error(t, store.CreateAPIKey(&auth.Key{Id: "key4", UserId: "missing", Hash: "hash4", CreatedAt: created}))
+
+	got, err := store.GetAPIKey("key1")
+	require.NoError(t, err)
+	require.Equal(t, &auth.Key{Id: "key1", UserId: "user1", Hash: "hash1", CreatedAt: created}, got)
+	_, err = store.GetAPIKey("missing")
+	require.ErrorIs(t, err, auth.ErrKeyNotFound)
+
+	revoked := created.Add(time.Hour)
+	require.NoError(t, store.RevokeAPIKey("user1", "key1", revoked))
+	require.NoError(t, store.RevokeAPIKey("user1", "key1", revoked.Add(time.Hour)))
+	require.ErrorIs(t, store.RevokeAPIKey("user1", "key3", revoked), auth.ErrKeyNotFound, "key3 belongs to user2")
+	require.ErrorIs(t, store.RevokeAPIKey("user1", "missing", revoked), auth.ErrKeyNotFound)
+
+	keys, err := store.ListAPIKeys("user1")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "key1", keys[0].Id)
+	require.True(t, keys[0].Revoked())
+	require.Equal(t, revoked, *keys[0].RevokedAt, "revoking again keeps the first time")
+	require.Equal(t, "key2", keys[1].Id)
+	require.False(t, keys[1].Revoked())
+
+	keys, err = store.ListAPIKeys("nobody")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func testListUsers(t *testing.T, store Store) {
+	for _, u := range []*user.User{
+		{Id: "bob2"},
+		{Id: "alice"},
+		{Id: "bob1"},
+		{Id: "operator1", Role: user.RoleAdmin},
+	} {
+		require.NoError(t, store.CreateUser(u))
+	}
+	ids := func(users []*user.User) []string {
+		found := []string{}
+		for _, u := range users {
+			found = append(found, u.Id)
+		}
+		return found
+	}
+	for name, test := range map[string]struct {
+		query user.Query
+		want  []string
+	}{
+		"everyone in order of ID": {
+			want: []string{"alice", "bob1", "bob2", "operator1"},
+		},
+		"by prefix": {
+			query: user.Query{IdPrefix: "bob"},
+			want:  []string{"bob1", "bob2"},
+		},
+		"by role": {
+			query: user.Query{Role: user.RoleCustomer},
+			want:  []string{"alice", "bob1", "bob2"},
+		},
+		"after a cursor": {
+			query: user.Query{After: "bob1", Limit: 1},
+			want:  []string{"bob2"},
+		},
+		"prefixes are not patterns": {
+			query: user.Query{IdPrefix: "%"},
+			want:  []string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := store.ListUsers(test.query)
+			require.NoError(t, err)
+			require.Equal(t, test.want, ids(got))
+		})
+	}
+
+	got, err := store.GetUser("operator1")
+	require.NoError(t, err)
+	require.Equal(t, user.RoleAdmin, got.Role)
+	got, err = store.GetUser("alice")
+	require.NoError(t, err)
+	require.Equal(t, user.RoleCustomer, got.Role, "users are customers unless told otherwise")
+
+	counts, err := store.CountUsers()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{user.RoleCustomer: 3, user.RoleAdmin: 1}, counts)
+}
+
+func testUpdateUser(t *testing.T, store Store) {
+	submitted := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	require.NoError(t, store.CreateUser(&user.User{
+		Id:      "user1",
+		Details: user.Details{Name: "Ada Lovelace", Email: "ada@example.com"},
+	}))
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	got, err := store.GetUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, "Ada Lovelace", got.Name)
+	require.Equal(t, user.KycUnverified, got.Kyc.Status, "users start unverified")
+
+	require.NoError(t, store.UpdateUser("user1", func(u *user.User) error {
+		u.DateOfBirth, u.Country = "1990-12-10", "GB"
+		u.Kyc = user.Kyc{
+			Status:    user.KycPending,
+			Documents: []user.Document{{Type: user.DocumentPassport, Reference: "doc-1", SubmittedAt: submitted}},
+			UpdatedAt: &submitted,
+		}
+		return nil
+	}))
+	got, err = store.GetUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, user.Details{Name: "Ada Lovelace", Email: "ada@example.com", DateOfBirth: "1990-12-10", Country: "GB"},
+		got.Details)
+	require.Equal(t, user.KycPending, got.Kyc.Status)
+	require.Equal(t, []user.Document{{Type: user.DocumentPassport, Reference: "doc-1", SubmittedAt: submitted}}, got.Kyc.Documents)
+	require.True(t, submitted.Equal(*got.Kyc.UpdatedAt))
+
+	pending, err := store.ListUsers(user.Query{KycStatus: user.KycPending})
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, "user1", pending[0].Id)
+	require.Len(t, pending[0].Kyc.Documents, 1)
+
+	failed := errors.New("rejected")
+	err = store.UpdateUser("user1", func(u *user.User) error {
+		u.Name = "Somebody Else"
+		return failed
+	})
+	require.ErrorIs(t, err, failed)
+	got, err = store.GetUser("user1")
+	require.NoError(t, err)
+	require.Equal(t, "Ada Lovelace", got.Name, "a failed update saves nothing")
+
+	err = store.UpdateUser("missing", func(*user.User) error { return nil })
+	require.ErrorIs(t, err, user.ErrUserNotFound)
+}
+
+func testUserCap(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "80")
+	seedWallet(t, store, "wallet2", "0")
+	deposit := func(id, walletId, amount string) error {
+		limit := eur("100")
+		return store.ApplyTransaction(&wallet.Transaction{
+			Id:             id,
+			Type:           wallet.TypeDeposit,
+			TargetWalletId: walletId,
+			Amount:         eur(amount),
+			Timestamp:      time.Now(),
+			UserLimit:      &wallet.UserLimit{Cap: &limit, Currency: "EUR", Convert: money.Money.In},
+		})
+	}
+	err := deposit("over", "wallet2", "20.01")
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, wallet.PeriodTotal, limitErr.Period)
+	require.Equal(t, eur("20"), limitErr.Remaining, "deposits into every wallet of the owner count")
+	got, err := store.GetWallet("wallet2")
+	require.NoError(t, err)
+	require.Equal(t, eur("0"), got.Balance, "a refused deposit changes nothing")
+
+	require.NoError(t, deposit("up-to-cap", "wallet2", "20"))
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id:             "withdrawal",
+		Type:           wallet.TypeWithdrawal,
+		SourceWalletId: "wallet1",
+		Amount:         eur("50"),
+		Timestamp:      time.Now(),
+	}))
+	require.ErrorIs(t, deposit("after-withdrawal", "wallet1", "0.01"), wallet.ErrLimitExceeded,
+		"withdrawals do not make room")
+}
+
+func testLimits(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	now := time.Now()
+	pay := func(id, amount string, at time.Time, limit *wallet.Limit) error {
+		return store.ApplyTransaction(&wallet.Transaction{
+			Id:             id,
+			Type:           wallet.TypePayment,
+			SourceWalletId: "wallet1",
+			TargetWalletId: "wallet2",
+			Amount:         eur(amount),
+			Timestamp:      at,
+			Limit:          limit,
+		})
+	}
+	daily := eur("30")
+	limit := &wallet.Limit{Daily: &daily}
+	require.NoError(t, pay("yesterday", "25", now.Add(-25*time.Hour), nil))
+	require.NoError(t, pay("today", "20", now.Add(-time.Hour), nil))
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id:             "withdrawal",
+		Type:           wallet.TypeWithdrawal,
+		SourceWalletId: "wallet1",
+		Amount:         eur("20"),
+		Timestamp:      now,
+	}))
+
+	err := pay("over", "10.01", now, limit)
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, eur("10"), limitErr.Remaining, "only today's payments count")
+	require.NoError(t, pay("within", "10", now, limit))
+
+	override := eur("5")
+	require.NoError(t, store.SetWalletLimits("wallet1", wallet.Limits{wallet.TypeDeposit: {PerTransaction: &override}}))
+	got, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, wallet.Limits{wallet.TypeDeposit: {PerTransaction: &override}}, got.Limits)
+	listed, err := store.ListWallets(wallet.WalletQuery{IdPrefix: "wallet1"})
+	require.NoError(t, err)
+	require.Equal(t, got.Limits, listed[0].Limits)
+	require.NoError(t, store.SetWalletLimits("wallet1", wallet.Limits{}))
+	got, err = store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Empty(t, got.Limits)
+
+	require.ErrorIs(t, store.SetWalletLimits("missing", wallet.Limits{}), wallet.ErrWalletNotFound)
+}
+
+func testUserLimits(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "100")
+	yen, err := money.Zero("JPY")
+	require.NoError(t, err)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet3", UserId: "user1", Balance: yen}))
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet4", UserId: "user2", Balance: eur("0")}))
+	now := time.Now()
+	apply := func(id, transactionType, source, target string, amount money.Money, limit *wallet.UserLimit) error {
+		return store.ApplyTransaction(&wallet.Transaction{
+			Id:             id,
+			Type:           transactionType,
+			SourceWalletId: source,
+			TargetWalletId: target,
+			Amount:         amount,
+			Timestamp:      now,
+			UserLimit:      limit,
+		})
+	}
+	require.NoError(t, apply("yen", wallet.TypeDeposit, "", "wallet3", money.Money{Units: 5000, Currency: "JPY"}, nil))
+	require.NoError(t, apply("other-user", wallet.TypeDeposit, "", "wallet4", eur("100"), nil))
+	require.NoError(t, apply("from-wallet1", wallet.TypeWithdrawal, "wallet1", "", eur("20"), nil))
+	require.NoError(t, apply("from-wallet3", wallet.TypeWithdrawal, "wallet3", "", money.Money{Units: 2000, Currency: "JPY"}, nil))
+	require.NoError(t, apply("other-type", wallet.TypePayment, "wallet1", "wallet2", eur("30"), nil))
+	require.NoError(t, apply("other-owner", wallet.TypeWithdrawal, "wallet4", "", eur("30"), nil))
+
+	daily := eur("50")
+	limit := &wallet.UserLimit{
+		Limit:    wallet.Limit{Daily: &daily},
+		Currency: "EUR",
+		// A yen is worth a cent.
+		Convert: func(amount money.Money, currency string) (money.Money, error) {
+			if amount.Currency == "JPY" {
+				return money.Money{Units: amount.Units, Scale: 2, Currency: currency}, nil
+			}
+			return amount.In(currency)
+		},
+	}
+	err = apply("over", wallet.TypeWithdrawal, "wallet2", "", eur("10.01"), limit)
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, eur("10"), limitErr.Remaining, "withdrawals from every wallet of the owner count")
+	require.NoError(t, apply("within", wallet.TypeWithdrawal, "wallet2", "", eur("10"), limit))
+	err = apply("yen-over", wallet.TypeWithdrawal, "wallet3", "", money.Money{Units: 1, Currency: "JPY"}, limit)
+	require.ErrorIs(t, err, wallet.ErrLimitExceeded)
+}
+
+func testListWallets(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "10")
+	seedWallet(t, store, "wallet2", "20")
+	require.NoError(t, store.CreateUser(&user.User{Id: "user2"}))
+	yen, err := money.Zero("JPY")
+	require.NoError(t, err)
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet3", UserId: "user2", Balance: yen}))
+	require.NoError(t, store.ChangeWalletStatus(statusChange("wallet2", wallet.StatusFrozen)))
+
+	ids := func(wallets []*wallet.Wallet) []string {
+		found := []string{}
+		for _, w := range wallets {
+			found = append(found, w.Id)
+		}
+		return found
+	}
+	for name, test := range map[string]struct {
+		query wallet.WalletQuery
+		want  []string
+	}{
+		"every wallet in order of ID": {
+			want: []string{"wallet1", "wallet2", "wallet3"},
+		},
+		"by user": {
+			query: wallet.WalletQuery{UserId: "user1"},
+			want:  []string{"wallet1", "wallet2"},
+		},
+		"by currency": {
+			query: wallet.WalletQuery{Currency: "JPY"},
+			want:  []string{"wallet3"},
+		},
+		"by status": {
+			query: wallet.WalletQuery{Status: wallet.StatusFrozen},
+			want:  []string{"wallet2"},
+		},
+		"by prefix after a cursor": {
+			query: wallet.WalletQuery{IdPrefix: "wallet", After: "wallet1", Limit: 1},
+			want:  []string{"wallet2"},
+		},
+		"system accounts are not wallets": {
+			query: wallet.WalletQuery{IdPrefix: "system"},
+			want:  []string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := store.ListWallets(test.query)
+			require.NoError(t, err)
+			require.Equal(t, test.want, ids(got))
+		})
+	}
+
+	got, err := store.ListWallets(wallet.WalletQuery{UserId: "user1"})
+	require.NoError(t, err)
+	require.Equal(t, eur("10"), got[0].Balance)
+	require.Equal(t, wallet.StatusActive, got[0].Status)
+
+	counts, err := store.CountWallets()
+	require.NoError(t, err)
+	require.Equal(t, []wallet.WalletCount{
+		{Currency: "EUR", Status: wallet.StatusActive, Wallets: 1},
+		{Currency: "EUR", Status: wallet.StatusFrozen, Wallets: 1},
+		{Currency: "JPY", Status: wallet.StatusActive, Wallets: 1},
+	}, counts)
+}
+
+func statusChange(walletId, status string) *wallet.StatusChange {
+	return &wallet.StatusChange{
+		WalletId:  walletId,
+		To:        status,
+		Reason:    "testing",
+		ChangedBy: "operator1",
+		Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+}
+
+func testWalletStatus(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "100")
+	payment := func(id, source, target, amount string) *wallet.Transaction {
+		return &wallet.Transaction{
+			Id:             id,
+			Type:           wallet.TypePayment,
+			SourceWalletId: source,
+			TargetWalletId: target,
+			Amount:         eur(amount),
+			Timestamp:      time.Now(),
+		}
+	}
+
+	frozen := statusChange("wallet1", wallet.StatusFrozen)
+	require.NoError(t, store.ChangeWalletStatus(frozen))
+	require.Equal(t, wallet.StatusActive, frozen.From)
+	require.ErrorIs(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusFrozen)), wallet.ErrStatusUnchanged)
+	require.ErrorIs(t, store.ChangeWalletStatus(statusChange("missing", wallet.StatusFrozen)), wallet.ErrWalletNotFound)
+
+	got, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, wallet.StatusFrozen, got.Status)
+	require.ErrorIs(t, store.ApplyTransaction(payment("payment1", "wallet2", "wallet1", "10")), wallet.ErrWalletFrozen)
+
+	adjustment := &wallet.Transaction{
+		Id:             "adjustment1",
+		Type:           wallet.TypeAdjustment,
+		TargetWalletId: "wallet1",
+		Amount:         eur("5"),
+		Timestamp:      time.Now(),
+		Adjustment:     &wallet.Adjustment{OperatorId: "operator1", Reason: "goodwill credit"},
+	}
+	require.NoError(t, store.ApplyTransaction(adjustment))
+	transactions, err := store.ListTransactions("wallet1", wallet.TransactionQuery{})
+	require.NoError(t, err)
+	require.Len(t, transactions, 2)
+	require.Equal(t, "adjustment1", transactions[0].Id, "newest first")
+	require.Equal(t, adjustment.Adjustment, transactions[0].Adjustment)
+	require.Nil(t, transactions[1].Adjustment)
+	entries, err := store.ListEntries(wallet.Adjustments("EUR"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.NoError(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusInboundOnly)))
+	require.NoError(t, store.ApplyTransaction(payment("payment2", "wallet2", "wallet1", "10")), "money can still come in")
+	require.ErrorIs(t, store.ApplyTransaction(payment("payment3", "wallet1", "wallet2", "10")), wallet.ErrWalletFrozen)
+
+	for id, want := range map[string]string{"wallet1": "115", "wallet2": "90"} {
+		got, err := store.GetWallet(id)
+		require.NoError(t, err)
+		require.Equal(t, eur(want), got.Balance, id)
+	}
+
+	require.ErrorIs(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusClosed)), wallet.ErrBalanceNotZero)
+	require.NoError(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusActive)))
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id:             "withdrawal1",
+		Type:           wallet.TypeWithdrawal,
+		SourceWalletId: "wallet1",
+		Amount:         eur("115"),
+		Timestamp:      time.Now(),
+	}))
+	require.NoError(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusClosed)))
+	require.ErrorIs(t, store.ApplyTransaction(payment("payment4", "wallet2", "wallet1", "10")), wallet.ErrWalletClosed)
+	adjustment.Id = "adjustment2"
+	require.ErrorIs(t, store.ApplyTransaction(adjustment), wallet.ErrWalletClosed)
+	require.ErrorIs(t, store.ChangeWalletStatus(statusChange("wallet1", wallet.StatusActive)), wallet.ErrWalletClosed, "closing is for good")
+
+	changes, err := store.ListStatusChanges("wallet1")
+	require.NoError(t, err)
+	transitions := []string{}
+	for _, change := range changes {
+		transitions = append(transitions, change.From+">"+change.To)
+	}
+	require.Equal(t, []string{"active>frozen", "frozen>inbound_only", "inbound_only>active", "active>closed"}, transitions)
+	require.Equal(t, frozen, changes[0])
+
+	changes, err = store.ListStatusChanges("wallet2")
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	_, err = store.ListStatusChanges("missing")
+	require.ErrorIs(t, err, wallet.ErrWalletNotFound)
+}
+
+// testConcurrentTransactions runs payments in both directions between the
+// same wallets alongside deposits and withdrawals, then checks no money was
+// created or lost. Run it with -race.
+func authorization(id, source, target, amount string, created time.Time) *wallet.Authorization {
+	return &wallet.Authorization{
+		Id:             id,
+		SourceWalletId: source,
+		TargetWalletId: target,
+		Amount:         eur(amount),
+		Captured:       eur("0"),
+		Status:         wallet.HoldPending,
+		CreatedAt:      created,
+		ExpiresAt:      created.Add(time.Hour),
+	}
+}
+
+func testAuthorizations(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	now := time.Now()
+
+	require.NoError(t, store.CreateAuthorization(authorization("hold1", "wallet1", "wallet2", "60", now)))
+	require.ErrorIs(t, store.CreateAuthorization(authorization("hold2", "wallet1", "wallet2", "40.01", now)),
+		wallet.ErrInsufficientFunds)
+	require.ErrorIs(t, store.CreateAuthorization(authorization("hold2", "wallet1", "missing", "10", now)),
+		wallet.ErrWalletNotFound)
+	require.NoError(t, store.CreateAuthorization(authorization("expired", "wallet1", "wallet2", "40", now.Add(-2*time.Hour))))
+
+	got, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("60"), got.Held, "expired holds set nothing aside")
+	listed, err := store.ListWallets(wallet.WalletQuery{UserId: "user1"})
+	require.NoError(t, err)
+	require.Equal(t, eur("60"), listed[0].Held)
+	require.Equal(t, eur("0"), listed[1].Held)
+
+	err = store.ApplyTransaction(&wallet.Transaction{
+		Id:             "withdrawal1",
+		Type:           wallet.TypeWithdrawal,
+		SourceWalletId: "wallet1",
+		Amount:         eur("40.01"),
+		Timestamp:      now,
+	})
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds, "a debit may not dip into held funds")
+
+	capture := func(id, hold, amount string) error {
+		return store.ApplyTransaction(&wallet.Transaction{
+			Id:              id,
+			Type:            wallet.TypePayment,
+			SourceWalletId:  "wallet1",
+			TargetWalletId:  "wallet2",
+			Amount:          eur(amount),
+			AuthorizationId: hold,
+			Timestamp:       time.Now(),
+		})
+	}
+	require.NoError(t, capture("capture1", "hold1", "25"))
+	require.ErrorIs(t, capture("capture2", "hold1", "35.01"), wallet.ErrInvalidAmount)
+	require.ErrorIs(t, capture("capture2", "expired", "10"), wallet.ErrAuthorizationClosed)
+	require.ErrorIs(t, capture("capture2", "missing", "10"), wallet.ErrAuthorizationNotFound)
+
+	hold, err := store.GetAuthorization("hold1")
+	require.NoError(t, err)
+	require.Equal(t, eur("25"), hold.Captured)
+	require.Equal(t, wallet.HoldPending, hold.Status)
+	got, err = store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("75"), got.Balance)
+	require.Equal(t, eur("35"), got.Held)
+
+	history, err := store.ListTransactions("wallet2", wallet.TransactionQuery{})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "hold1", history[0].AuthorizationId)
+
+	require.NoError(t, store.UpdateAuthorization("hold1", func(a *wallet.Authorization) error {
+		a.Status = wallet.HoldVoided
+		return nil
+	}))
+	require.ErrorIs(t, store.UpdateAuthorization("missing", func(*wallet.Authorization) error { return nil }),
+		wallet.ErrAuthorizationNotFound)
+	require.ErrorIs(t, capture("capture2", "hold1", "10"), wallet.ErrAuthorizationClosed)
+	got, err = store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("0"), got.Held)
+
+	holds, err := store.ListAuthorizations("wallet1")
+	require.NoError(t, err)
+	require.Len(t, holds, 2)
+	require.Equal(t, "hold1", holds[0].Id, "authorizations are oldest first")
+	require.Equal(t, wallet.HoldVoided, holds[0].Status)
+	require.Equal(t, eur("40"), holds[1].Amount)
+	holds, err = store.ListAuthorizations("wallet2")
+	require.NoError(t, err)
+	require.Empty(t, holds)
+	_, err = store.GetAuthorization("missing")
+	require.ErrorIs(t, err, wallet.ErrAuthorizationNotFound)
+}
+
+func testRefunds(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id:             "payment1",
+		Type:           wallet.TypePayment,
+		SourceWalletId: "wallet1",
+		TargetWalletId: "wallet2",
+		Amount:         eur("40"),
+		Timestamp:      time.Now(),
+	}))
+
+	got, err := store.GetTransaction("payment1")
+	require.NoError(t, err)
+	require.Equal(t, "wallet2", got.TargetWalletId)
+	require.Equal(t, eur("40"), got.Amount)
+	require.Equal(t, wallet.PaymentCompleted, got.PaymentStatus())
+	_, err = store.GetTransaction("missing")
+	require.ErrorIs(t, err, wallet.ErrTransactionNotFound)
+
+	refund := func(id, of, source, target, amount string) error {
+		return store.ApplyTransaction(&wallet.Transaction{
+			Id:             id,
+			Type:           wallet.TypeRefund,
+			SourceWalletId: source,
+			TargetWalletId: target,
+			Amount:         eur(amount),
+			RefundOf:       of,
+			Timestamp:      time.Now(),
+		})
+	}
+	require.NoError(t, refund("refund1", "payment1", "wallet2", "wallet1", "15"))
+	require.ErrorIs(t, refund("refund2", "payment1", "wallet2", "wallet1", "25.01"), wallet.ErrInvalidAmount)
+	require.ErrorIs(t, refund("refund2", "payment1", "wallet1", "wallet2", "5"), wallet.ErrTransactionNotFound,
+		"only the payee refunds, and only to the payer")
+	require.ErrorIs(t, refund("refund2", "refund1", "wallet1", "wallet2", "5"), wallet.ErrTransactionNotFound,
+		"only payments are refunded")
+	require.ErrorIs(t, refund("refund2", "missing", "wallet2", "wallet1", "5"), wallet.ErrTransactionNotFound)
+
+	got, err = store.GetTransaction("payment1")
+	require.NoError(t, err)
+	require.Equal(t, eur("15"), got.Refunded)
+	require.Equal(t, wallet.PaymentPartiallyRefunded, got.PaymentStatus())
+
+	require.NoError(t, refund("refund2", "payment1", "wallet2", "wallet1", "25"))
+	require.ErrorIs(t, refund("refund3", "payment1", "wallet2", "wallet1", "1"), wallet.ErrPaymentRefunded)
+	for _, walletId := range []string{"wallet1", "wallet2"} {
+		history, err := store.ListTransactions(walletId, wallet.TransactionQuery{})
+		require.NoError(t, err)
+		payment := history[len(history)-1]
+		if walletId == "wallet1" {
+			payment = history[len(history)-2]
+		}
+		require.Equal(t, "payment1", payment.Id)
+		require.Equal(t, wallet.PaymentRefunded, payment.PaymentStatus(), "both wallets see the refunds")
+		require.Equal(t, "refund2", history[0].Id)
+		require.Equal(t, "payment1", history[0].RefundOf)
+	}
+	source, err := store.GetWallet("wallet1")
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), source.Balance)
+}
+
+func testSchedules(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	now := time.Now().UTC().Truncate(time.Second)
+	next := now.Add(time.Hour)
+	end := now.Add(30 * 24 * time.Hour)
+	for i, id := range []string{"rent", "gym"} {
+		require.NoError(t, store.CreateSchedule(&schedule.Schedule{
+			Id:        id,
+			UserId:    "user1",
+			WalletId:  "wallet1",
+			Creditor:  "wallet2",
+			Amount:    eur("12.5"),
+			Frequency: schedule.Monthly,
+			StartAt:   next,
+			EndAt:     &end,
+			Status:    schedule.StatusActive,
+			NextRunAt: &next,
+			CreatedAt: now.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	got, err := store.GetSchedule("rent")
+	require.NoError(t, err)
+	require.Equal(t, eur("12.5"), got.Amount)
+	require.Equal(t, "user1", got.UserId)
+	require.True(t, next.Equal(*got.NextRunAt))
+	require.True(t, end.Equal(*got.EndAt))
+	_, err = store.GetSchedule("missing")
+	require.ErrorIs(t, err, schedule.ErrScheduleNotFound)
+
+	listed, err := store.ListSchedules("wallet1")
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	require.Equal(t, "rent", listed[0].Id, "schedules are oldest first")
+	listed, err = store.ListSchedules("wallet2")
+	require.NoError(t, err)
+	require.Empty(t, listed)
+
+	due, err := store.DueSchedules(now)
+	require.NoError(t, err)
+	require.Empty(t, due)
+	require.NoError(t, store.UpdateSchedule("gym", func(s *schedule.Schedule) error {
+		earlier := now.Add(time.Minute)
+		s.NextRunAt, s.Due, s.Attempts = &earlier, 1, 2
+		return nil
+	}))
+	due, err = store.DueSchedules(next)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	require.Equal(t, "gym", due[0].Id, "due schedules are earliest first")
+	require.Equal(t, 1, due[0].Due)
+	require.Equal(t, 2, due[0].Attempts)
+
+	require.NoError(t, store.UpdateSchedule("gym", func(s *schedule.Schedule) error {
+		s.Status, s.NextRunAt = schedule.StatusPaused, nil
+		return nil
+	}))
+	failed := errors.New("failed")
+	require.ErrorIs(t, store.UpdateSchedule("rent", func(s *schedule.Schedule) error {
+		s.Status = schedule.StatusCancelled
+		return failed
+	}), failed)
+	require.ErrorIs(t, store.UpdateSchedule("missing", func(*schedule.Schedule) error { return nil }),
+		schedule.ErrScheduleNotFound)
+	due, err = store.DueSchedules(next)
+	require.NoError(t, err)
+	require.Len(t, due, 1, "only active schedules are due")
+	require.Equal(t, "rent", due[0].Id)
+	require.Equal(t, schedule.StatusActive, due[0].Status, "failed updates save nothing")
+	got, err = store.GetSchedule("gym")
+	require.NoError(t, err)
+	require.Nil(t, got.NextRunAt)
+
+	for i, status := range []string{schedule.RunRetrying, schedule.RunSucceeded} {
+		run := &schedule.Run{
+			Id:         fmt.Sprintf("run%d", i),
+			ScheduleId: "rent",
+			DueAt:      next,
+			Attempt:    i + 1,
+			Status:     status,
+			RanAt:      next.Add(time.Duration(i) * time.Hour),
+		}
+		if status == schedule.RunSucceeded {
+			run.TransactionId = "seed-wallet1"
+		} else {
+			run.Error = "insufficient funds"
+		}
+		require.NoError(t, store.CreateRun(run))
+	}
+	runs, err := store.ListRuns("rent")
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, "run0", runs[0].Id, "runs are oldest first")
+	require.Equal(t, "insufficient funds", runs[0].Error)
+	require.Equal(t, "seed-wallet1", runs[1].TransactionId)
+	require.True(t, next.Equal(runs[1].DueAt))
+	runs, err = store.ListRuns("gym")
+	require.NoError(t, err)
+	require.Empty(t, runs)
+	_, err = store.ListRuns("missing")
+	require.ErrorIs(t, err, schedule.ErrScheduleNotFound)
+}
+
+func testEvents(t *testing.T, store Store) {
+	seedWallet(t, store, "wallet1", "100")
+	seedWallet(t, store, "wallet2", "0")
+	require.NoError(t, store.ChangeWalletStatus(&wallet.StatusChange{
+		WalletId: "wallet2", To: wallet.StatusInboundOnly, Reason: "testing", Timestamp: time.Now(),
+	}))
+	require.ErrorIs(t, store.ApplyTransaction(&wallet.Transaction{
+		Id: "too-much", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2",
+		Amount: eur("500"), Timestamp: time.Now(),
+	}), wallet.ErrInsufficientFunds)
+	require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+		Id: "payment1", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2",
+		Amount: eur("30"), Timestamp: time.Now(), Reference: "INV-1",
+	}))
+
+	events, err := store.ListEvents(0, 100)
+	require.NoError(t, err)
+	types := []string{}
+	for i, e := range events {
+		if i > 0 {
+			require.Greater(t, e.Seq, events[i-1].Seq, "events are in order of Seq")
+		}
+		require.Equal(t, "user1", e.UserId)
+		types = append(types, e.Type+" "+e.WalletId)
+	}
+	require.Equal(t, []string{
+		wallet.EventCreated + " wallet1",
+		wallet.EventCredited + " wallet1",
+		wallet.EventCreated + " wallet2",
+		wallet.EventStatusChanged + " wallet2",
+		wallet.EventDebited + " wallet1",
+		wallet.EventCredited + " wallet2",
+	}, types, "failed transactions record nothing")
+	var change wallet.StatusChange
+	require.NoError(t, json.Unmarshal(events[3].Data, &change))
+	require.Equal(t, wallet.StatusActive, change.From)
+	var sent wallet.Movement
+	require.NoError(t, json.Unmarshal(events[4].Data, &sent))
+	require.Equal(t, "payment1", sent.TransactionId)
+	require.Equal(t, "wallet2", sent.Counterparty)
+	require.Equal(t, "INV-1", sent.Reference)
+	require.Equal(t, "70", sent.Balance.String())
+
+	page, err := store.ListEvents(events[1].Seq, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, events[2].Id, page[0].Id)
+	page, err = store.ListEvents(events[5].Seq, 2)
+	require.NoError(t, err)
+	require.Empty(t, page)
+
+	cursor, err := store.EventCursor("webhooks")
+	require.NoError(t, err)
+	require.Zero(t, cursor)
+	require.NoError(t, store.SaveEventCursor("webhooks", events[2].Seq))
+	require.NoError(t, store.SaveEventCursor("webhooks", events[3].Seq))
+	cursor, err = store.EventCursor("webhooks")
+	require.NoError(t, err)
+	require.Equal(t, events[3].Seq, cursor)
+}
+
+func testAuditLog(t *testing.T, store Store) {
+	last, err := store.LastAuditEntry()
+	require.NoError(t, err)
+	require.Nil(t, last)
+
+	log := audit.NewLog(store)
+	for _, e := range []*audit.Entry{
+		{Action: "POST /v1/user", Path: "/v1/user", Status: 201, UserId: "user1"},
+		{Action: "POST /v1/user/{user}/wallet/{wallet}/deposit", Path: "/v1/user/user1/wallet/wallet1/deposit",
+			Status: 200, ActorId: "user1", UserId: "user1", SourceIP: "192.0.2.1", RequestId: "request2",
+			Balances: []audit.Balance{{WalletId: "wallet1", Currency: "EUR", Before: "0.00", After: "10.00"}}},
+		{Action: "PUT /admin/v1/wallets/{wallet}/limits", Path: "/admin/v1/wallets/wallet1/limits",
+			Status: 400, ActorId: "operator1"},
+	} {
+		require.NoError(t, log.Append(e))
+	}
+	require.Error(t, store.AppendAuditEntry(&audit.Entry{Seq: 2, Action: "DELETE /"}), "entries cannot be replaced")
+	require.Error(t, store.AppendAuditEntry(&audit.Entry{Seq: 5, Action: "DELETE /"}), "or skip a place")
+
+	entries, err := store.ListAuditEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, int64(2), entries[1].Seq)
+	require.Equal(t, entries[0].Hash, entries[1].PrevHash)
+	require.Equal(t, []audit.Balance{{WalletId: "wallet1", Currency: "EUR", Before: "0.00", After: "10.00"}},
+		entries[1].Balances)
+	page, err := store.ListAuditEntries(1, 1)
+	require.NoError(t, err)
+	require.Equal(t, entries[1:2], page)
+	last, err = store.LastAuditEntry()
+	require.NoError(t, err)
+	require.Equal(t, entries[2], last)
+
+	chain, err := audit.Verify(store)
+	require.NoError(t, err, "entries read back match their hashes")
+	require.Equal(t, 3, chain.Count())
+}
+
+func testWebhooks(t *testing.T, store Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, endpoint := range []*webhook.Endpoint{
+		{Id: "mine", UserId: "user1", URL: "https://example.com/hook", Events: []string{webhook.EventPaymentReceived}},
+		{Id: "global", URL: "https://ops.example.com/hook", Events: []string{}},
+		{Id: "also-mine", UserId: "user1", URL: "https://example.com/other", Events: []string{}},
+	} {
+		endpoint.Secret, endpoint.CreatedAt = "secret-"+endpoint.Id, now.Add(time.Duration(i)*time.Second)
+		require.NoError(t, store.CreateEndpoint(endpoint))
+	}
+
+	got, err := store.GetEndpoint("mine")
+	require.NoError(t, err)
+	require.Equal(t, "user1", got.UserId)
+	require.Equal(t, "secret-mine", got.Secret)
+	require.Equal(t, []string{webhook.EventPaymentReceived}, got.Events)
+	require.True(t, now.Equal(got.CreatedAt))
+	_, err = store.GetEndpoint("missing")
+	require.ErrorIs(t, err, webhook.ErrEndpointNotFound)
+
+	endpoints, err := store.ListEndpoints("user1")
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+	require.Equal(t, "mine", endpoints[0].Id, "endpoints are oldest first")
+	require.Empty(t, endpoints[1].Events)
+	endpoints, err = store.ListEndpoints("")
+	require.NoError(t, err)
+	require.Len(t, endpoints, 1)
+	require.Equal(t, "global", endpoints[0].Id)
+
+	later := now.Add(time.Minute)
+	for i, delivery := range []*webhook.Delivery{
+		{Id: "d0", EndpointId: "mine", UserId: "user1", NextAttemptAt: &later},
+		{Id: "d1", EndpointId: "global", NextAttemptAt: &now},
+		{Id: "d2", EndpointId: "also-mine", UserId: "user1", NextAttemptAt: &now},
+	} {
+		delivery.EventId, delivery.EventType = "event1", webhook.EventPaymentReceived
+		delivery.Payload, delivery.Status = []byte(`{"Id":"event1"}`), webhook.DeliveryPending
+		delivery.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, store.CreateDelivery(delivery))
+	}
+
+	due, err := store.DueDeliveries(now)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	require.Equal(t, "d1", due[0].Id, "deliveries due at once are oldest first")
+	require.JSONEq(t, `{"Id":"event1"}`, string(due[0].Payload))
+	due, err = store.DueDeliveries(later)
+	require.NoError(t, err)
+	require.Len(t, due, 3)
+	require.Equal(t, "d0", due[2].Id, "due deliveries are earliest first")
+
+	require.NoError(t, store.UpdateDelivery("d2", func(d *webhook.Delivery) error {
+		d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt = webhook.DeliveryDead, 8, nil, &now
+		d.ResponseCode, d.Error = 500, "endpoint responded 500 Internal Server Error"
+		return nil
+	}))
+	failed := errors.New("failed")
+	require.ErrorIs(t, store.UpdateDelivery("d0", func(d *webhook.Delivery) error {
+		d.Status = webhook.DeliverySucceeded
+		return failed
+	}), failed)
+	require.ErrorIs(t, store.UpdateDelivery("missing", func(*webhook.Delivery) error { return nil }),
+		webhook.ErrDeliveryNotFound)
+	require.NoError(t, store.CreateDelivery(&webhook.Delivery{
+		Id: "d3", EndpointId: "also-mine", UserId: "user1", EventId: "event1", EventType: webhook.EventPaymentReceived,
+		Payload: []byte(`{"Id":"event1"}`), Status: webhook.DeliveryPending, NextAttemptAt: &later,
+		ReplayOf: "d2", CreatedAt: later,
+	}), "replays are not duplicates")
+	require.ErrorIs(t, store.CreateDelivery(&webhook.Delivery{
+		Id: "d4", EndpointId: "mine", UserId: "user1", EventId: "event1", EventType: webhook.EventPaymentReceived,
+		Payload: []byte(`{"Id":"event1"}`), Status: webhook.DeliveryPending, NextAttemptAt: &later, CreatedAt: later,
+	}), webhook.ErrDuplicateDelivery)
+	_, err = store.GetDelivery("d4")
+	require.ErrorIs(t, err, webhook.ErrDeliveryNotFound)
+
+	dead, err := store.GetDelivery("d2")
+	require.NoError(t, err)
+	require.Equal(t, webhook.DeliveryDead, dead.Status)
+	require.Equal(t, 8, dead.Attempts)
+	require.Equal(t, 500, dead.ResponseCode)
+	require.Nil(t, dead.NextAttemptAt)
+	require.True(t, now.Equal(*dead.LastAttemptAt))
+	_, err = store.GetDelivery("missing")
+	require.ErrorIs(t, err, webhook.ErrDeliveryNotFound)
+
+	ids := func(query webhook.DeliveryQuery) []string {
+		deliveries, err := store.ListDeliveries(query)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.Id)
+		}
+		return ids
+	}
+	require.Equal(t, []string{"d3", "d2", "d0"}, ids(webhook.DeliveryQuery{UserId: "user1"}), "deliveries are newest first")
+	require.Equal(t, []string{"d1"}, ids(webhook.DeliveryQuery{}))
+	require.Equal(t, []string{"d3", "d2"}, ids(webhook.DeliveryQuery{UserId: "user1", EndpointId: "also-mine"}))
+	require.Equal(t, []string{"d2"}, ids(webhook.DeliveryQuery{UserId: "user1", Status: webhook.DeliveryDead}))
+	require.Equal(t, []string{"d3"}, ids(webhook.DeliveryQuery{UserId: "user1", Limit: 1}))
+
+	// Deliveries outlive their endpoint.
+	require.NoError(t, store.DeleteEndpoint("also-mine"))
+	require.ErrorIs(t, store.DeleteEndpoint("also-mine"), webhook.ErrEndpointNotFound)
+	_, err = store.GetEndpoint("also-mine")
+	require.ErrorIs(t, err, webhook.ErrEndpointNotFound)
+	replay, err := store.GetDelivery("d3")
+	require.NoError(t, err)
+	require.Equal(t, "d2", replay.ReplayOf)
+}
+
+func testConcurrentTransactions(t *testing.T, store Store) {
+	walletIds := []string{"wallet1", "wallet2", "wallet3", "wallet4"}
+	for _, id := range walletIds {
+		seedWallet(t, store, id, "100")
+	}
+	const workers, iterations = 8, 50
+	var (
+		wg                   sync.WaitGroup
+		mu                   sync.Mutex
+		deposited, withdrawn = eur("0"), eur("0")
+		errs                 = make(chan error, workers*iterations)
+	)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				transaction := &wallet.Transaction{
+					Id:        fmt.Sprintf("tx-%d-%d", worker, i),
+					Amount:    eur("7"),
+					Timestamp: time.Now(),
+				}
+				source, target := walletIds[(worker+i)%len(walletIds)], walletIds[(worker+i+1+worker%2)%len(walletIds)]
+				switch i % 4 {
+				case 0:
+					transaction.Type, transaction.TargetWalletId = wallet.TypeDeposit, target
+				case 1:
+					transaction.Type, transaction.SourceWalletId = wallet.TypeWithdrawal, source
+				default:
+					transaction.Type = wallet.TypePayment
+					transaction.SourceWalletId, transaction.TargetWalletId = source, target
+				}
+				err := store.ApplyTransaction(transaction)
+				if errors.Is(err, wallet.ErrInsufficientFunds) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					continue
+				}
+				mu.Lock()
+				switch transaction.Type {
+				case wallet.TypeDeposit:
+					deposited, err = deposited.Add(transaction.Amount)
+				case wallet.TypeWithdrawal:
+					withdrawn, err = withdrawn.Add(transaction.Amount)
+				}
+				mu.Unlock()
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(worker)
+	}
+	// Read while the writers run, to catch unguarded reads.
+	for i := 0; i < iterations; i++ {
+		_, err := store.GetWallet(walletIds[i%len(walletIds)])
+		require.NoError(t, err)
+		_, err = store.ListTransactions(walletIds[i%len(walletIds)], wallet.TransactionQuery{Limit: 5})
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	total := eur("0")
+	var all []wallet.Entry
+	for _, id := range walletIds {
+		stored, err := store.GetWallet(id)
+		require.NoError(t, err)
+		require.False(t, stored.Balance.IsNegative(), id)
+		entries, err := store.ListEntries(id)
+		require.NoError(t, err)
+		balance, err := wallet.SumEntries(entries, "EUR")
+		require.NoError(t, err)
+		require.Equal(t, stored.Balance, balance, id)
+		total, err = total.Add(stored.Balance)
+		require.NoError(t, err)
+		all = append(all, entries...)
+	}
+	want, err := eur("400").Add(deposited)
+	require.NoError(t, err)
+	want, err = want.Sub(withdrawn)
+	require.NoError(t, err)
+	require.Equal(t, want, total)
+
+	for _, id := range []string{wallet.CashIn("EUR"), wallet.CashOut("EUR")} {
+		entries, err := store.ListEntries(id)
+		require.NoError(t, err)
+		all = append(all, entries...)
+	}
+	require.NoError(t, wallet.CheckBalanced(all))
+}
+
+// testConcurrentRegistrations creates users and wallets while other
+// goroutines look them up.
+func testConcurrentRegistrations(t *testing.T, store Store) {
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*4)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			userId, walletId := fmt.Sprintf("user-%d", worker), fmt.Sprintf("wallet-%d", worker)
+			if err := store.CreateUser(&user.User{Id: userId}); err != nil {
+				errs <- err
+				return
+			}
+			if err := store.CreateWallet(&wallet.Wallet{Id: walletId, UserId: userId, Balance: eur("0")}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := store.GetUser(userId); err != nil {
+				errs <- err
+			}
+			if _, err := store.GetWallet(walletId); err != nil {
+				errs <- err
+			}
+			if _, err := store.GetWallet(fmt.Sprintf("wallet-%d", (worker+1)%workers)); err != nil && !errors.Is(err, wallet.ErrWalletNotFound) {
+				errs <- err
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	for worker := 0; worker < workers; worker++ {
+		_, err := store.GetWallet(fmt.Sprintf("wallet-%d", worker))
+		require.NoError(t, err)
+	}
+}
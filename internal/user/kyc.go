@@ -0,0 +1,281 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// The KYC (know your customer) statuses a user moves through. Users start
+// unverified, submit documents to become pending, and an operator then
+// verifies or rejects them. Rejected users may submit again.
+const (
+	KycUnverified = "unverified"
+	KycPending    = "pending"
+	KycVerified   = "verified"
+	KycRejected   = "rejected"
+)
+
+// The kinds of document a user can submit.
+const (
+	DocumentPassport       = "passport"
+	DocumentNationalId     = "national_id"
+	DocumentDrivingLicence = "driving_licence"
+	DocumentProofOfAddress = "proof_of_address"
+)
+
+const (
+	maxDocuments          = 10
+	maxReferenceLength    = 128
+	maxReviewReasonLength = 500
+)
+
+var (
+	ErrInvalidKyc = errors.New("invalid verification request")
+	// ErrKycStatus is returned for a submission or review the user's KYC
+	// status does not allow.
+	ErrKycStatus = errors.New("verification status does not allow this")
+	// ErrProfileIncomplete is returned when a user asks to be verified
+	// before giving their name, date of birth and country.
+	ErrProfileIncomplete = errors.New("name, date of birth and country are needed for verification")
+)
+
+// Kyc is where a user stands in verifying their identity.
+type Kyc struct {
+	Status    string     `json:"Status"`
+	Documents []Document `json:"Documents,omitempty"`
+	// ReviewedBy and Reason record the operator who last verified or
+	// rejected the user, and why.
+	ReviewedBy string     `json:"ReviewedBy,omitempty"`
+	Reason     string     `json:"Reason,omitempty"`
+	UpdatedAt  *time.Time `json:"UpdatedAt,omitempty"`
+}
+
+// Document refers to a document held outside the service, such as a scan in
+// a document store, by its Reference.
+type Document struct {
+	Type        string    `json:"Type"`
+	Reference   string    `json:"Reference"`
+	SubmittedAt time.Time `json:"SubmittedAt"`
+}
+
+// KycSubmission is the body of a request to be verified.
+type KycSubmission struct {
+	Documents []Document `json:"Documents"`
+}
+
+// KycReview is an operator's decision on a pending user.
+type KycReview struct {
+	Status string `json:"Status"`
+	Reason string `json:"Reason,omitempty"`
+}
+
+// SubmitKyc asks for the user to be verified on the strength of the given
+// documents, which are added to any submitted before.
+func (u *User) SubmitKyc(ctx context.Context, documents []Document) error {
+	if len(documents) == 0 || len(documents) > maxDocuments {
+		return fmt.Errorf("%w: between 1 and %d documents are needed", ErrInvalidKyc, maxDocuments)
+	}
+	now := time.Now().UTC()
+	submitted := make([]Document, 0, len(documents))
+	for _, document := range documents {
+		document.Reference = strings.TrimSpace(document.Reference)
+		switch {
+		case !validDocumentType(document.Type):
+			return fmt.Errorf("%w: unknown document type %q", ErrInvalidKyc, document.Type)
+		case document.Reference == "" || len(document.Reference) > maxReferenceLength:
+			return fmt.Errorf("%w: document references must be between 1 and %d characters", ErrInvalidKyc, maxReferenceLength)
+		}
+		document.SubmittedAt = now
+		submitted = append(submitted, document)
+	}
+	return u.updateKyc(ctx, func(current *User) error {
+		switch {
+		case current.Kyc.Status != KycUnverified && current.Kyc.Status != KycRejected:
+			return fmt.Errorf("%w: the user is already %s", ErrKycStatus, current.Kyc.Status)
+		case !current.Details.complete():
+			return ErrProfileIncomplete
+		}
+		current.Kyc.Status = KycPending
+		current.Kyc.Documents = append(current.Kyc.Documents, submitted...)
+		current.Kyc.UpdatedAt = &now
+		return nil
+	})
+}
+
+// ReviewKyc verifies or rejects a pending user on behalf of an operator.
+// Rejections need a reason.
+func (u *User) ReviewKyc(ctx context.Context, review KycReview, operatorId string) error {
+	review.Reason = strings.TrimSpace(review.Reason)
+	switch {
+	case review.Status != KycVerified && review.Status != KycRejected:
+		return fmt.Errorf("%w: a review must be %q or %q", ErrInvalidKyc, KycVerified, KycRejected)
+	case review.Status == KycRejected && review.Reason == "":
+		return fmt.Errorf("%w: a rejection needs a reason", ErrInvalidKyc)
+	case len(review.Reason) > maxReviewReasonLength:
+		return fmt.Errorf("%w: the reason must be at most %d characters", ErrInvalidKyc, maxReviewReasonLength)
+	}
+	now := time.Now().UTC()
+	return u.updateKyc(ctx, func(current *User) error {
+		if current.Kyc.Status != KycPending {
+			return fmt.Errorf("%w: only pending users can be reviewed, and the user is %s", ErrKycStatus, current.Kyc.Status)
+		}
+		current.Kyc.Status = review.Status
+		current.Kyc.ReviewedBy = operatorId
+		current.Kyc.Reason = review.Reason
+		current.Kyc.UpdatedAt = &now
+		return nil
+	})
+}
+
+func (u *User) updateKyc(ctx context.Context, update func(current *User) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var updated User
+	err := u.store.UpdateUser(u.Id, func(current *User) error {
+		if err := update(current); err != nil {
+			return err
+		}
+		updated = *current
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Info("kyc status changed", "user_id", u.Id, "status", updated.Kyc.Status)
+	u.Details, u.Kyc = updated.Details, updated.Kyc
+	return nil
+}
+
+func validDocumentType(documentType string) bool {
+	switch documentType {
+	case DocumentPassport, DocumentNationalId, DocumentDrivingLicence, DocumentProofOfAddress:
+		return true
+	}
+	return false
+}
+
+// The tiers users are placed in. Only verified users are in TierVerified.
+const (
+	TierUnverified = "unverified"
+	TierVerified   = "verified"
+)
+
+// ErrVerificationRequired is returned for operations the user's tier does
+// not allow.
+var ErrVerificationRequired = errors.New("identity verification required")
+
+// Tier is what users in a tier may do.
+type Tier struct {
+	// DepositCap is the most the user may ever deposit, across all of its
+	// wallets, in Currency. Zero leaves deposits uncapped.
+	DepositCap money.Money
+	// Payments lets the user pay other wallets.
+	Payments bool
+	// Limits cap the deposits, withdrawals and payments the user makes
+	// across all of its wallets, in Currency. A wallet's own limits
+	// override them for that wallet alone.
+	Limits   wallet.Limits
+	Currency string
+}
+
+// Tiers holds the rules for each tier.
+type Tiers map[string]Tier
+
+// DefaultTiers caps what unverified users may deposit at 1000, limits their
+// withdrawals and keeps them from making payments. Verified users have
+// higher limits. Caps and limits are in euros.
+var DefaultTiers = Tiers{
+	TierUnverified: {
+		DepositCap: money.MustParse("1000"),
+		Limits: wallet.Limits{
+			wallet.TypeWithdrawal: limit("500", "1000", "2000"),
+		},
+		Currency: "EUR",
+	},
+	TierVerified: {
+		Payments: true,
+		Limits: wallet.Limits{
+			wallet.TypeDeposit:    limit("", "50000", "200000"),
+			wallet.TypeWithdrawal: limit("10000", "20000", "100000"),
+			wallet.TypePayment:    limit("10000", "20000", "100000"),
+		},
+		Currency: "EUR",
+	},
+}
+
+// limit builds a wallet.Limit from decimal amounts, leaving out empty ones.
+func limit(perTransaction, daily, monthly string) wallet.Limit {
+	amount := func(s string) *money.Money {
+		if s == "" {
+			return nil
+		}
+		m := money.MustParse(s)
+		return &m
+	}
+	return wallet.Limit{PerTransaction: amount(perTransaction), Daily: amount(daily), Monthly: amount(monthly)}
+}
+
+// LoadTierLimits reads a JSON file of limits by tier, such as
+// {"verified": {"payment": {"Daily": "5000"}}}.
+func LoadTierLimits(path string) (map[string]wallet.Limits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var byTier map[string]wallet.Limits
+	if err := json.Unmarshal(data, &byTier); err != nil {
+		return nil, fmt.Errorf("parsing limits in %s: %w", path, err)
+	}
+	for tier, limits := range byTier {
+		if tier != TierUnverified && tier != TierVerified {
+			return nil, fmt.Errorf("%w: unknown tier %q in %s", wallet.ErrInvalidLimits, tier, path)
+		}
+		if err := limits.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return byTier, nil
+}
+
+// Tier is the tier the user is in.
+func (u *User) Tier() string {
+	if u.Kyc.Status == KycVerified {
+		return TierVerified
+	}
+	return TierUnverified
+}
+
+// limits counts a transaction against the limits of the user's tier,
+// across all of the user's wallets.
+func (u *User) limits() wallet.TransactionOption {
+	tier := u.tier()
+	return wallet.WithUserLimits(tier.Limits, tier.Currency, u.converter())
+}
+
+// converter returns how the user's transactions are valued in its tier's
+// currency. Without WithConverter only that currency can be valued.
+func (u *User) converter() wallet.ConvertFunc {
+	if u.convert == nil {
+		return money.Money.In
+	}
+	return u.convert
+}
+
+// tier returns the rules for the user's tier. Without any tiers, as when
+// the user was loaded without WithTiers, nothing is restricted.
+func (u *User) tier() Tier {
+	if u.tiers == nil {
+		return Tier{Payments: true}
+	}
+	return u.tiers[u.Tier()]
+}
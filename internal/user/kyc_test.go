@@ -0,0 +1,459 @@
+package user_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+var ada = user.Details{Name: "Ada Lovelace", Email: "ada@example.com", DateOfBirth: "1990-12-10", Country: "GB"}
+
+var passport = []user.Document{{Type: user.DocumentPassport, Reference: "scan-123"}}
+
+func TestUser_NewDetails(t *testing.T) {
+	for name, test := range map[string]struct {
+		details user.Details
+
+		want    user.Details
+		wantErr error
+	}{
+		"no details yet": {},
+		"tidies details": {
+			details: user.Details{Name: " Ada Lovelace ", Email: "Ada@Example.com", DateOfBirth: "1990-12-10", Country: "gb"},
+			want:    ada,
+		},
+		"email with a display name": {
+			details: user.Details{Email: "Ada <ada@example.com>"},
+			wantErr: user.ErrInvalidProfile,
+		},
+		"badly written date of birth": {
+			details: user.Details{DateOfBirth: "10/12/1990"},
+			wantErr: user.ErrInvalidProfile,
+		},
+		"too young": {
+			details: user.Details{DateOfBirth: time.Now().AddDate(-user.MinimumAge, 0, 1).Format(user.DateFormat)},
+			wantErr: user.ErrInvalidProfile,
+		},
+		"unknown country format": {
+			details: user.Details{Country: "GBR"},
+			wantErr: user.ErrInvalidProfile,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			got, err := user.New(context.Background(), store, test.details)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got.Details)
+			require.Equal(t, user.KycUnverified, got.Kyc.Status)
+			stored, err := user.Get(store, got.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.want, stored.Details)
+		})
+	}
+}
+
+func TestUser_UpdateDetails(t *testing.T) {
+	for name, test := range map[string]struct {
+		kycStatus string
+		changes   user.Details
+
+		want    user.Details
+		wantErr error
+	}{
+		"changes only the given fields": {
+			changes: user.Details{Email: "ada@example.org"},
+			want:    user.Details{Name: ada.Name, Email: "ada@example.org", DateOfBirth: ada.DateOfBirth, Country: ada.Country},
+		},
+		"changes identity before verification": {
+			changes: user.Details{Country: "FR"},
+			want:    user.Details{Name: ada.Name, Email: ada.Email, DateOfBirth: ada.DateOfBirth, Country: "FR"},
+		},
+		"changes email while pending": {
+			kycStatus: user.KycPending,
+			changes:   user.Details{Email: "ada@example.org"},
+			want:      user.Details{Name: ada.Name, Email: "ada@example.org", DateOfBirth: ada.DateOfBirth, Country: ada.Country},
+		},
+		"identity is locked while pending": {
+			kycStatus: user.KycPending,
+			changes:   user.Details{Name: "Somebody Else"},
+			wantErr:   user.ErrProfileLocked,
+		},
+		"identity is locked once verified": {
+			kycStatus: user.KycVerified,
+			changes:   user.Details{DateOfBirth: "1991-01-01"},
+			wantErr:   user.ErrProfileLocked,
+		},
+		"invalid changes": {
+			changes: user.Details{Email: "not an email"},
+			wantErr: user.ErrInvalidProfile,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			u, err := user.New(context.Background(), store, ada)
+			require.NoError(t, err)
+			if test.kycStatus != "" {
+				require.NoError(t, store.UpdateUser(u.Id, func(current *user.User) error {
+					current.Kyc.Status = test.kycStatus
+					return nil
+				}))
+			}
+
+			err = u.UpdateDetails(context.Background(), test.changes)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, u.Details)
+			stored, err := user.Get(store, u.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.want, stored.Details)
+		})
+	}
+}
+
+func TestUser_SubmitKyc(t *testing.T) {
+	for name, test := range map[string]struct {
+		details   user.Details
+		kycStatus string
+		documents []user.Document
+
+		wantErr error
+	}{
+		"submits documents": {
+			details:   ada,
+			documents: passport,
+		},
+		"resubmits after a rejection": {
+			details:   ada,
+			kycStatus: user.KycRejected,
+			documents: passport,
+		},
+		"needs a complete profile": {
+			details:   user.Details{Name: ada.Name},
+			documents: passport,
+			wantErr:   user.ErrProfileIncomplete,
+		},
+		"needs documents": {
+			details: ada,
+			wantErr: user.ErrInvalidKyc,
+		},
+		"unknown document type": {
+			details:   ada,
+			documents: []user.Document{{Type: "library_card", Reference: "card-1"}},
+			wantErr:   user.ErrInvalidKyc,
+		},
+		"document without a reference": {
+			details:   ada,
+			documents: []user.Document{{Type: user.DocumentPassport, Reference: " "}},
+			wantErr:   user.ErrInvalidKyc,
+		},
+		"already pending": {
+			details:   ada,
+			kycStatus: user.KycPending,
+			documents: passport,
+			wantErr:   user.ErrKycStatus,
+		},
+		"already verified": {
+			details:   ada,
+			kycStatus: user.KycVerified,
+			documents: passport,
+			wantErr:   user.ErrKycStatus,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			u, err := user.New(context.Background(), store, test.details)
+			require.NoError(t, err)
+			if test.kycStatus != "" {
+				require.NoError(t, store.UpdateUser(u.Id, func(current *user.User) error {
+					current.Kyc.Status = test.kycStatus
+					return nil
+				}))
+			}
+
+			err = u.SubmitKyc(context.Background(), test.documents)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			stored, err := user.Get(store, u.Id)
+			require.NoError(t, err)
+			require.Equal(t, user.KycPending, stored.Kyc.Status)
+			require.Len(t, stored.Kyc.Documents, 1)
+			require.Equal(t, "scan-123", stored.Kyc.Documents[0].Reference)
+			require.False(t, stored.Kyc.Documents[0].SubmittedAt.IsZero())
+		})
+	}
+}
+
+func TestUser_ReviewKyc(t *testing.T) {
+	for name, test := range map[string]struct {
+		submit bool
+		review user.KycReview
+
+		wantStatus string
+		wantErr    error
+	}{
+		"verifies a pending user": {
+			submit:     true,
+			review:     user.KycReview{Status: user.KycVerified},
+			wantStatus: user.KycVerified,
+		},
+		"rejects a pending user": {
+			submit:     true,
+			review:     user.KycReview{Status: user.KycRejected, Reason: "passport has expired"},
+			wantStatus: user.KycRejected,
+		},
+		"rejections need a reason": {
+			submit:  true,
+			review:  user.KycReview{Status: user.KycRejected},
+			wantErr: user.ErrInvalidKyc,
+		},
+		"reviews must decide": {
+			submit:  true,
+			review:  user.KycReview{Status: user.KycPending},
+			wantErr: user.ErrInvalidKyc,
+		},
+		"only pending users are reviewed": {
+			review:  user.KycReview{Status: user.KycVerified},
+			wantErr: user.ErrKycStatus,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			u, err := user.New(context.Background(), store, ada)
+			require.NoError(t, err)
+			if test.submit {
+				require.NoError(t, u.SubmitKyc(context.Background(), passport))
+			}
+
+			err = u.ReviewKyc(context.Background(), test.review, "operator1")
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			stored, err := user.Get(store, u.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantStatus, stored.Kyc.Status)
+			require.Equal(t, "operator1", stored.Kyc.ReviewedBy)
+			require.Equal(t, test.review.Reason, stored.Kyc.Reason)
+		})
+	}
+}
+
+func TestUser_Tiers(t *testing.T) {
+	for name, test := range map[string]struct {
+		verified bool
+		tiers    user.Tiers
+		deposit  string
+
+		wantTier       string
+		wantDepositErr error
+		wantPaymentErr error
+	}{
+		"unverified users are capped": {
+			tiers:          user.DefaultTiers,
+			deposit:        "1000.01",
+			wantTier:       user.TierUnverified,
+			wantDepositErr: wallet.ErrLimitExceeded,
+			wantPaymentErr: user.ErrVerificationRequired,
+		},
+		"unverified users deposit up to the cap": {
+			tiers:          user.DefaultTiers,
+			deposit:        "1000",
+			wantTier:       user.TierUnverified,
+			wantPaymentErr: user.ErrVerificationRequired,
+		},
+		"verified users are not": {
+			verified: true,
+			tiers:    user.DefaultTiers,
+			deposit:  "5000",
+			wantTier: user.TierVerified,
+		},
+		"no tiers, no gating": {
+			deposit:  "5000",
+			wantTier: user.TierUnverified,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			created, err := user.New(context.Background(), store, ada)
+			require.NoError(t, err)
+			if test.verified {
+				require.NoError(t, created.SubmitKyc(context.Background(), passport))
+				require.NoError(t, created.ReviewKyc(context.Background(), user.KycReview{Status: user.KycVerified}, "operator1"))
+			}
+			u, err := user.Get(store, created.Id, user.WithTiers(test.tiers))
+			require.NoError(t, err)
+			require.Equal(t, test.wantTier, u.Tier())
+			source, err := u.CreateWallet(context.Background(), "EUR", "")
+			require.NoError(t, err)
+			target, err := u.CreateWallet(context.Background(), "EUR", "")
+			require.NoError(t, err)
+
+			_, err = u.Deposit(context.Background(), source.Id, money.MustParse(test.deposit))
+			if test.wantDepositErr != nil {
+				require.ErrorIs(t, err, test.wantDepositErr)
+			} else {
+				require.NoError(t, err)
+			}
+			_, err = u.InitiatePayment(context.Background(), source.Id, target.Id, money.MustParse("1"), nil)
+			if test.wantPaymentErr != nil {
+				require.ErrorIs(t, err, test.wantPaymentErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUser_Limits(t *testing.T) {
+	store := memory.New()
+	created, err := user.New(context.Background(), store, ada)
+	require.NoError(t, err)
+	u, err := user.Get(store, created.Id, user.WithTiers(user.DefaultTiers))
+	require.NoError(t, err)
+	own, err := u.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	_, err = u.Deposit(context.Background(), own.Id, money.MustParse("1000"))
+	require.NoError(t, err)
+
+	_, err = u.Withdraw(context.Background(), own.Id, money.MustParse("500.01"))
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, wallet.PeriodTransaction, limitErr.Period)
+
+	raised := money.MustParse("800")
+	require.NoError(t, own.SetLimits(context.Background(), wallet.Limits{wallet.TypeWithdrawal: {PerTransaction: &raised}}))
+	limits, err := u.WalletLimits(context.Background(), own.Id)
+	require.NoError(t, err)
+	require.Equal(t, "800.00", limits[wallet.TypeWithdrawal].PerTransaction.String())
+	require.Equal(t, "1000.00", limits[wallet.TypeWithdrawal].Daily.String(), "the tier's other limits still apply")
+	_, err = u.Withdraw(context.Background(), own.Id, money.MustParse("600"))
+	require.NoError(t, err)
+
+	_, err = u.WalletLimits(context.Background(), "somebody-elses")
+	require.ErrorIs(t, err, user.ErrUnauthorized)
+}
+
+func TestUser_LimitsAcrossWallets(t *testing.T) {
+	store := memory.New()
+	created, err := user.New(context.Background(), store, ada)
+	require.NoError(t, err)
+	quoter, err := exchange.NewQuoter(exchange.StaticRates{"EUR/USD": money.MustParse("1.25")}, money.Money{}, time.Minute)
+	require.NoError(t, err)
+	// Without a deposit cap, so both wallets can hold enough to withdraw.
+	tiers := user.Tiers{user.TierUnverified: {Limits: user.DefaultTiers[user.TierUnverified].Limits, Currency: "EUR"}}
+	u, err := user.Get(store, created.Id, user.WithTiers(tiers), user.WithConverter(quoter.Value))
+	require.NoError(t, err)
+	euros, err := u.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	dollars, err := u.CreateWallet(context.Background(), "USD", "")
+	require.NoError(t, err)
+	for _, id := range []string{euros.Id, dollars.Id} {
+		_, err = u.Deposit(context.Background(), id, money.MustParse("1000"))
+		require.NoError(t, err)
+	}
+
+	_, err = u.Withdraw(context.Background(), euros.Id, money.MustParse("500"))
+	require.NoError(t, err)
+	_, err = u.Withdraw(context.Background(), dollars.Id, money.MustParse("500"))
+	require.NoError(t, err, "500 USD is 400 EUR")
+	_, err = u.Withdraw(context.Background(), euros.Id, money.MustParse("100.01"))
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, wallet.PeriodDaily, limitErr.Period)
+	require.Equal(t, "100.00", limitErr.Remaining.String(), "both wallets count towards the daily 1000 EUR")
+	require.Equal(t, "EUR", limitErr.Currency)
+	_, err = u.Withdraw(context.Background(), euros.Id, money.MustParse("100"))
+	require.NoError(t, err)
+	_, err = u.Withdraw(context.Background(), dollars.Id, money.MustParse("1.25"))
+	require.ErrorIs(t, err, wallet.ErrLimitExceeded, "the shared daily total is spent")
+
+	limits, err := u.WalletLimits(context.Background(), dollars.Id)
+	require.NoError(t, err)
+	require.Equal(t, "1250.00", limits[wallet.TypeWithdrawal].Daily.String(), "the tier's limits are valued in the wallet's currency")
+}
+
+func TestUser_DepositCapAcrossWallets(t *testing.T) {
+	store := memory.New()
+	created, err := user.New(context.Background(), store, ada)
+	require.NoError(t, err)
+	quoter, err := exchange.NewQuoter(exchange.StaticRates{"EUR/USD": money.MustParse("1.25")}, money.Money{}, time.Minute)
+	require.NoError(t, err)
+	u, err := user.Get(store, created.Id, user.WithTiers(user.DefaultTiers), user.WithConverter(quoter.Value))
+	require.NoError(t, err)
+	euros, err := u.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	dollars, err := u.CreateWallet(context.Background(), "USD", "")
+	require.NoError(t, err)
+
+	_, err = u.Deposit(context.Background(), euros.Id, money.MustParse("600"))
+	require.NoError(t, err)
+	_, err = u.Deposit(context.Background(), dollars.Id, money.MustParse("501"))
+	var limitErr *wallet.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, wallet.PeriodTotal, limitErr.Period)
+	require.Equal(t, "400.00", limitErr.Remaining.String(), "deposits into both wallets count towards the 1000 EUR cap")
+	require.Equal(t, "EUR", limitErr.Currency)
+	_, err = u.Deposit(context.Background(), dollars.Id, money.MustParse("500"))
+	require.NoError(t, err, "500 USD is 400 EUR")
+
+	_, err = u.Withdraw(context.Background(), euros.Id, money.MustParse("100"))
+	require.NoError(t, err)
+	_, err = u.Deposit(context.Background(), euros.Id, money.MustParse("0.01"))
+	require.ErrorIs(t, err, wallet.ErrLimitExceeded, "the cap counts deposits, not what the wallets hold")
+}
+
+func TestLoadTierLimits(t *testing.T) {
+	daily := money.MustParse("5000")
+	for name, test := range map[string]struct {
+		file string
+
+		want    map[string]wallet.Limits
+		wantErr error
+	}{
+		"loads limits": {
+			file: `{"verified": {"payment": {"Daily": "5000"}}}`,
+			want: map[string]wallet.Limits{user.TierVerified: {wallet.TypePayment: {Daily: &daily}}},
+		},
+		"unknown tier": {
+			file:    `{"gold": {"payment": {"Daily": "5000"}}}`,
+			wantErr: wallet.ErrInvalidLimits,
+		},
+		"invalid limits": {
+			file:    `{"verified": {"payment": {"Daily": "-1"}}}`,
+			wantErr: wallet.ErrInvalidLimits,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limits.json")
+			require.NoError(t, os.WriteFile(path, []byte(test.file), 0o600))
+
+			got, err := user.LoadTierLimits(path)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+)
+
+const (
+	// DateFormat is how dates of birth are written.
+	DateFormat = "2006-01-02"
+	// MinimumAge is how old a user must be to hold wallets.
+	MinimumAge = 18
+
+	maxNameLength  = 100
+	maxEmailLength = 254
+	maxAge         = 130
+)
+
+var (
+	ErrInvalidProfile = errors.New("invalid profile")
+	// ErrProfileLocked is returned for changes to the identity of a user who
+	// is being, or has been, verified.
+	ErrProfileLocked = errors.New("profile is locked while verification is pending or complete")
+)
+
+// Details are the personal details a user gives about themselves. Every
+// field is optional until the user asks to be verified.
+type Details struct {
+	Name string `json:"Name,omitempty"`
+	// Email is an address on its own, without a display name.
+	Email string `json:"Email,omitempty"`
+	// DateOfBirth is written as DateFormat.
+	DateOfBirth string `json:"DateOfBirth,omitempty"`
+	// Country is an ISO 3166-1 alpha-2 code, such as "GB".
+	Country string `json:"Country,omitempty"`
+}
+
+// normalize checks the details and returns them trimmed, with the email in
+// lower case and the country in upper case.
+func (d Details) normalize(now time.Time) (Details, error) {
+	d.Name = strings.TrimSpace(d.Name)
+	d.Email = strings.ToLower(strings.TrimSpace(d.Email))
+	d.DateOfBirth = strings.TrimSpace(d.DateOfBirth)
+	d.Country = strings.ToUpper(strings.TrimSpace(d.Country))
+
+	if utf8.RuneCountInString(d.Name) > maxNameLength {
+		return Details{}, fmt.Errorf("%w: name must be at most %d characters", ErrInvalidProfile, maxNameLength)
+	}
+	if d.Email != "" {
+		address, err := mail.ParseAddress(d.Email)
+		if err != nil || address.Address != d.Email || len(d.Email) > maxEmailLength {
+			return Details{}, fmt.Errorf("%w: %q is not an email address", ErrInvalidProfile, d.Email)
+		}
+	}
+	if d.DateOfBirth != "" {
+		born, err := time.Parse(DateFormat, d.DateOfBirth)
+		if err != nil {
+			return Details{}, fmt.Errorf("%w: date of birth must be written as YYYY-MM-DD", ErrInvalidProfile)
+		}
+		switch age := ageOn(born, now); {
+		case age < MinimumAge:
+			return Details{}, fmt.Errorf("%w: users must be at least %d years old", ErrInvalidProfile, MinimumAge)
+		case age > maxAge:
+			return Details{}, fmt.Errorf("%w: %s is not a plausible date of birth", ErrInvalidProfile, d.DateOfBirth)
+		}
+	}
+	if d.Country != "" && !isCountryCode(d.Country) {
+		return Details{}, fmt.Errorf("%w: country must be an ISO 3166-1 alpha-2 code", ErrInvalidProfile)
+	}
+	return d, nil
+}
+
+// merge returns the details with every non-empty field of changes applied.
+func (d Details) merge(changes Details) Details {
+	for _, field := range []struct{ to, from *string }{
+		{&d.Name, &changes.Name},
+		{&d.Email, &changes.Email},
+		{&d.DateOfBirth, &changes.DateOfBirth},
+		{&d.Country, &changes.Country},
+	} {
+		if *field.from != "" {
+			*field.to = *field.from
+		}
+	}
+	return d
+}
+
+// complete reports whether the details identify the user well enough to be
+// verified.
+func (d Details) complete() bool {
+	return d.Name != "" && d.DateOfBirth != "" && d.Country != ""
+}
+
+// UpdateDetails changes the fields of the user's details that are set in
+// changes, leaving the rest as they are. Once the user has asked to be
+// verified only the email can change.
+func (u *User) UpdateDetails(ctx context.Context, changes Details) error {
+	changes, err := changes.normalize(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var updated User
+	err = u.store.UpdateUser(u.Id, func(current *User) error {
+		merged := current.Details.merge(changes)
+		identityChanged := merged.Name != current.Name || merged.DateOfBirth != current.DateOfBirth ||
+			merged.Country != current.Country
+		if identityChanged && (current.Kyc.Status == KycPending || current.Kyc.Status == KycVerified) {
+			return ErrProfileLocked
+		}
+		current.Details = merged
+		updated = *current
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Details are personal, so only say that they changed.
+	logging.FromContext(ctx).Info("profile updated", "user_id", u.Id)
+	u.Details, u.Kyc = updated.Details, updated.Kyc
+	return nil
+}
+
+func ageOn(born, now time.Time) int {
+	age := now.Year() - born.Year()
+	if now.Month() < born.Month() || now.Month() == born.Month() && now.Day() < born.Day() {
+		age--
+	}
+	return age
+}
+
+func isCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
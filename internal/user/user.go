@@ -1,64 +1,320 @@
 package user
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
 	"github.com/adrianos93/wallet-manager/internal/wallet"
 )
 
 type User struct {
-	Id      string                    `json:"Id"`
-	Wallets map[string]*wallet.Wallet `json:"Wallets,omitempty"`
+	Id   string `json:"Id"`
+	Role string `json:"Role"`
+	Details
+	Kyc     Kyc `json:"Kyc"`
+	store   Store
+	tiers   Tiers
+	convert wallet.ConvertFunc
 }
 
+// Option configures how a user is loaded.
+type Option func(*User)
+
+// WithTiers gates what the user may do by its tier. Users loaded without it
+// are not restricted.
+func WithTiers(tiers Tiers) Option {
+	return func(u *User) {
+		u.tiers = tiers
+	}
+}
+
+// WithConverter values the user's transactions in the currency of its tier's
+// limits. Users loaded without it can only count transactions already in
+// that currency.
+func WithConverter(convert wallet.ConvertFunc) Option {
+	return func(u *User) {
+		u.convert = convert
+	}
+}
+
+// Store persists users alongside the wallets they own. UpdateUser must load
+// the user, apply update to it and save the result in one step, saving
+// nothing if update fails. CountUsers counts users by role.
+type Store interface {
+	wallet.Store
+	CreateUser(u *User) error
+	GetUser(id string) (*User, error)
+	UpdateUser(id string, update func(u *User) error) error
+	ListUsers(query Query) ([]*User, error)
+	CountUsers() (map[string]int, error)
+}
+
+// Query narrows down a list of users. Zero values leave a filter unset.
+// Stores return matches in order of ID, starting after the user whose ID is
+// After, and stop at Limit matches unless it is zero.
+type Query struct {
+	IdPrefix  string
+	Role      string
+	KycStatus string
+	After     string
+	Limit     int
+}
+
+const (
+	// RoleCustomer users own wallets and act on them.
+	RoleCustomer = "customer"
+	// RoleAdmin users are operators, who may use the admin API.
+	RoleAdmin = "admin"
+)
+
 const userIdSize = 16
 
-var Users = map[string]*User{}
+var (
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUnauthorized is returned for wallets the user does not own.
+	ErrUnauthorized = errors.New("unauthorized transaction")
+	// ErrOperatorOnly is returned for changes only an operator may make.
+	ErrOperatorOnly = errors.New("only an operator can make this change")
+)
+
+// New creates a customer with whatever details it has given so far.
+func New(ctx context.Context, store Store, details Details, options ...Option) (*User, error) {
+	details, err := details.normalize(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return create(ctx, store, RoleCustomer, details, options)
+}
+
+// NewAdmin creates an operator.
+func NewAdmin(ctx context.Context, store Store) (*User, error) {
+	return create(ctx, store, RoleAdmin, Details{}, nil)
+}
 
-func New() *User {
+func create(ctx context.Context, store Store, role string, details Details, options []Option) (*User, error) {
 	user := &User{
 		Id:      manager.GenerateId(userIdSize),
-		Wallets: map[string]*wallet.Wallet{},
+		Role:    role,
+		Details: details,
+		Kyc:     Kyc{Status: KycUnverified},
+		store:   store,
 	}
-	Users[user.Id] = user
-	return user
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := store.CreateUser(user); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("user created", "user_id", user.Id, "role", role)
+	for _, option := range options {
+		option(user)
+	}
+	return user, nil
+}
+
+func Get(store Store, id string, options ...Option) (*User, error) {
+	user, err := store.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	user.store = store
+	for _, option := range options {
+		option(user)
+	}
+	return user, nil
 }
 
-func (u *User) CreateWallet() *wallet.Wallet {
-	wallet := wallet.New()
-	u.Wallets[wallet.Id] = wallet
-	return wallet
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
-func (u *User) Deposit(walletId string, amount float64) (wallet.Balance, error) {
-	userWallet, found := u.Wallets[walletId]
-	if !found {
-		return wallet.Balance{}, errors.New("unauthorized transaction")
+func (u *User) CreateWallet(ctx context.Context, currency, name string) (*wallet.Wallet, error) {
+	return wallet.New(ctx, u.store, u.Id, currency, name)
+}
+
+// Deposit, Withdraw and InitiatePayment pass options, such as
+// wallet.WithDetails, on to the wallet. The user's tier has the last word on
+// its limits and cap.
+func (u *User) Deposit(ctx context.Context, walletId string, amount money.Money, options ...wallet.TransactionOption) (wallet.Balance, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.Balance{}, err
+	}
+	tier := u.tier()
+	options = append(options, u.limits())
+	if !tier.DepositCap.IsZero() {
+		options = append(options, wallet.WithUserCap(tier.DepositCap, tier.Currency, u.converter()))
 	}
-	return userWallet.Deposit(amount), nil
+	return userWallet.Deposit(ctx, amount, options...)
 }
 
-func (u *User) Withdraw(walletId string, amount float64) (wallet.Balance, error) {
-	userWallet, found := u.Wallets[walletId]
-	if !found {
-		return wallet.Balance{}, errors.New("unauthorized transaction")
+func (u *User) Withdraw(ctx context.Context, walletId string, amount money.Money, options ...wallet.TransactionOption) (wallet.Balance, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.Balance{}, err
 	}
-	return userWallet.Withdraw(amount)
+	return userWallet.Withdraw(ctx, amount, append(options, u.limits())...)
 }
 
-func (u *User) CheckBalance(walletId string) (wallet.Balance, error) {
-	userWallet, found := u.Wallets[walletId]
-	if !found {
-		return wallet.Balance{}, errors.New("unauthorized transaction")
+func (u *User) CheckBalance(ctx context.Context, walletId string) (wallet.Balance, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.Balance{}, err
 	}
-	return userWallet.CheckBalance(), nil
+	return userWallet.CheckBalance(ctx), nil
 }
 
-func (u *User) InitiatePayment(sourceWalletId, targetWalletId string, amount float64) (wallet.Payment, error) {
-	intiatorWallet, found := u.Wallets[sourceWalletId]
-	if !found {
-		return wallet.Payment{}, errors.New("unauthorized transaction")
+func (u *User) InitiatePayment(ctx context.Context, sourceWalletId, targetWalletId string, amount money.Money, price wallet.PriceFunc,
+	options ...wallet.TransactionOption) (wallet.Payment, error) {
+	if err := u.checkPayments(); err != nil {
+		return wallet.Payment{}, err
+	}
+	intiatorWallet, err := u.wallet(sourceWalletId)
+	if err != nil {
+		return wallet.Payment{}, err
+	}
+	return intiatorWallet.InitiatePayment(ctx, targetWalletId, amount, price, append(options, u.limits())...)
+}
+
+func (u *User) QuotePayment(ctx context.Context, sourceWalletId, targetWalletId string, amount money.Money, lock wallet.PriceFunc) (wallet.PaymentQuote, error) {
+	if err := u.checkPayments(); err != nil {
+		return wallet.PaymentQuote{}, err
+	}
+	intiatorWallet, err := u.wallet(sourceWalletId)
+	if err != nil {
+		return wallet.PaymentQuote{}, err
+	}
+	return intiatorWallet.QuotePayment(ctx, targetWalletId, amount, lock)
+}
+
+// Authorize holds amount in one of the user's wallets for a payment into
+// another wallet, for ttl.
+func (u *User) Authorize(ctx context.Context, sourceWalletId, targetWalletId string, amount money.Money, ttl time.Duration) (*wallet.Authorization, error) {
+	if err := u.checkPayments(); err != nil {
+		return nil, err
+	}
+	userWallet, err := u.wallet(sourceWalletId)
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.Authorize(ctx, targetWalletId, amount, ttl)
+}
+
+// Capture pays amount out of an authorization on one of the user's wallets,
+// or all it holds when amount is nil. Captures are payments, held to the
+// same limits.
+func (u *User) Capture(ctx context.Context, walletId, authorizationId string, amount *money.Money) (wallet.Capture, error) {
+	if err := u.checkPayments(); err != nil {
+		return wallet.Capture{}, err
+	}
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.Capture{}, err
+	}
+	return userWallet.Capture(ctx, authorizationId, amount, u.limits())
+}
+
+func (u *User) Void(ctx context.Context, walletId, authorizationId string) (*wallet.Authorization, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.Void(ctx, authorizationId)
+}
+
+func (u *User) Authorization(ctx context.Context, walletId, authorizationId string) (*wallet.Authorization, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.Authorization(ctx, authorizationId)
+}
+
+func (u *User) Authorizations(ctx context.Context, walletId string) ([]*wallet.Authorization, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.Authorizations(ctx)
+}
+
+// Refund returns amount of a payment into one of the user's wallets, or all
+// of it not refunded yet when amount is nil.
+func (u *User) Refund(ctx context.Context, walletId, transactionId string, amount *money.Money) (wallet.Refund, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.Refund{}, err
+	}
+	return userWallet.Refund(ctx, transactionId, amount)
+}
+
+func (u *User) History(ctx context.Context, walletId string, query wallet.TransactionQuery, cursor string) (wallet.History, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return wallet.History{}, err
+	}
+	return userWallet.History(ctx, query, cursor)
+}
+
+// WalletLimits returns the limits on one of the user's wallets: those of the
+// user's tier, valued in the wallet's currency, with the wallet's own applied
+// over them.
+func (u *User) WalletLimits(ctx context.Context, walletId string) (wallet.Limits, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	tier := u.tier()
+	limits, err := tier.Limits.Convert(tier.Currency, userWallet.Currency(), u.converter())
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.EffectiveLimits(limits)
+}
+
+// ChangeWalletStatus lets users freeze or close their own wallets. Only an
+// operator can make a wallet active again, so a user cannot undo a freeze
+// an operator has put on it.
+func (u *User) ChangeWalletStatus(ctx context.Context, walletId, status, reason string) (*wallet.StatusChange, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	if status == wallet.StatusActive {
+		return nil, fmt.Errorf("%w: reactivating wallet %s", ErrOperatorOnly, walletId)
+	}
+	return userWallet.ChangeStatus(ctx, status, reason, u.Id)
+}
+
+func (u *User) WalletStatusChanges(ctx context.Context, walletId string) ([]*wallet.StatusChange, error) {
+	userWallet, err := u.wallet(walletId)
+	if err != nil {
+		return nil, err
+	}
+	return userWallet.StatusChanges(ctx)
+}
+
+func (u *User) checkPayments() error {
+	if !u.tier().Payments {
+		return fmt.Errorf("%w: %s users cannot make payments", ErrVerificationRequired, u.Tier())
+	}
+	return nil
+}
+
+// wallet loads one of the user's own wallets. Wallets belonging to someone
+// else are reported the same way as missing ones.
+func (u *User) wallet(walletId string) (*wallet.Wallet, error) {
+	userWallet, err := wallet.Get(u.store, walletId)
+	if err != nil && !errors.Is(err, wallet.ErrWalletNotFound) {
+		return nil, err
+	}
+	if err != nil || userWallet.UserId != u.Id {
+		return nil, fmt.Errorf("%w: wallet %s", ErrUnauthorized, walletId)
 	}
-	return intiatorWallet.InitiatePayment(targetWalletId, amount)
+	return userWallet, nil
 }
@@ -1,12 +1,35 @@
-package user
+package user_test
 
 import (
+	"context"
 	"testing"
 
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
 	"github.com/adrianos93/wallet-manager/internal/wallet"
 	"github.com/stretchr/testify/require"
 )
 
+// setup returns a user owning a wallet holding 100, and a wallet owned by
+// somebody else.
+func setup(t *testing.T) (*memory.Store, *user.User, *wallet.Wallet, *wallet.Wallet) {
+	t.Helper()
+	store := memory.New()
+	owner, err := user.New(context.Background(), store, user.Details{})
+	require.NoError(t, err)
+	ownWallet, err := owner.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	_, err = owner.Deposit(context.Background(), ownWallet.Id, money.MustParse("100"))
+	require.NoError(t, err)
+
+	other, err := user.New(context.Background(), store, user.Details{})
+	require.NoError(t, err)
+	otherWallet, err := other.CreateWallet(context.Background(), "EUR", "")
+	require.NoError(t, err)
+	return store, owner, ownWallet, otherWallet
+}
+
 func TestUser_New(t *testing.T) {
 	for name, test := range map[string]struct {
 		wantUsers int
@@ -19,17 +42,38 @@ func TestUser_New(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
+			store := memory.New()
 			loops := 0
 			for loops < test.wantUsers {
-				New()
+				created, err := user.New(context.Background(), store, user.Details{})
+				require.NoError(t, err)
+				got, err := user.Get(store, created.Id)
+				require.NoError(t, err)
+				require.Equal(t, created.Id, got.Id)
 				loops++
 			}
-			require.Equal(t, test.wantUsers, len(Users))
-			Users = map[string]*User{}
 		})
 	}
 }
 
+func TestUser_NewAdmin(t *testing.T) {
+	store := memory.New()
+	customer, err := user.New(context.Background(), store, user.Details{})
+	require.NoError(t, err)
+	require.False(t, customer.IsAdmin())
+
+	operator, err := user.NewAdmin(context.Background(), store)
+	require.NoError(t, err)
+	got, err := user.Get(store, operator.Id)
+	require.NoError(t, err)
+	require.True(t, got.IsAdmin())
+}
+
+func TestUser_Get(t *testing.T) {
+	_, err := user.Get(memory.New(), "missing")
+	require.ErrorIs(t, err, user.ErrUserNotFound)
+}
+
 func TestUser_CreateWallet(t *testing.T) {
 	for name, test := range map[string]struct {
 		wallets int
@@ -39,95 +83,86 @@ func TestUser_CreateWallet(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user := &User{
-				Wallets: map[string]*wallet.Wallet{},
+			store := memory.New()
+			u, err := user.New(context.Background(), store, user.Details{})
+			require.NoError(t, err)
+			for i := 0; i < test.wallets; i++ {
+				got, err := u.CreateWallet(context.Background(), "EUR", "")
+				require.NoError(t, err)
+				stored, err := store.GetWallet(got.Id)
+				require.NoError(t, err)
+				require.Equal(t, u.Id, stored.UserId)
 			}
-			got := user.CreateWallet()
-			require.Equal(t, test.wallets, len(wallet.Wallets))
-			require.Equal(t, wallet.Wallets[got.Id], got)
 		})
 	}
 }
 
 func TestUser_Deposit(t *testing.T) {
 	for name, test := range map[string]struct {
-		walletId string
-		amount   float64
+		otherWallet bool
+		amount      money.Money
 
 		wantResult wallet.Balance
 		wantErr    bool
 	}{
 		"process a deposit": {
-			walletId:   "somerandomID",
-			amount:     100,
-			wantResult: wallet.Balance{},
+			amount:     money.MustParse("100"),
+			wantResult: wallet.Balance{Balance: money.Money{Units: 20000, Scale: 2, Currency: "EUR"}, Available: money.Money{Units: 20000, Scale: 2, Currency: "EUR"}, Currency: "EUR"},
 		},
 		"fail to process a deposit": {
-			walletId:   "somerandomID",
-			amount:     100,
-			wantResult: wallet.Balance{},
-			wantErr:    true,
+			otherWallet: true,
+			amount:      money.MustParse("100"),
+			wantResult:  wallet.Balance{},
+			wantErr:     true,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user := &User{
-				Wallets: map[string]*wallet.Wallet{
-					test.walletId: {
-						Id: test.walletId,
-					},
-				},
-			}
-			if test.wantErr {
-				delete(user.Wallets, test.walletId)
+			_, u, ownWallet, otherWallet := setup(t)
+			walletId := ownWallet.Id
+			if test.otherWallet {
+				walletId = otherWallet.Id
 			}
 
-			got, err := user.Deposit(test.walletId, test.amount)
+			got, err := u.Deposit(context.Background(), walletId, test.amount)
 			if test.wantErr {
-				require.Error(t, err)
+				require.ErrorIs(t, err, user.ErrUnauthorized)
 			}
-			require.IsType(t, test.wantResult, got)
+			require.Equal(t, test.wantResult, got)
 		})
 	}
 }
 
 func TestUser_Withdraw(t *testing.T) {
 	for name, test := range map[string]struct {
-		walletId string
-		amount   float64
+		otherWallet bool
+		amount      money.Money
 
 		wantResult wallet.Balance
 		wantErr    bool
 	}{
 		"process a withdrawal": {
-			walletId:   "somerandomID",
-			amount:     100,
-			wantResult: wallet.Balance{},
+			amount:     money.MustParse("100"),
+			wantResult: wallet.Balance{Balance: money.Money{Scale: 2, Currency: "EUR"}, Available: money.Money{Scale: 2, Currency: "EUR"}, Currency: "EUR"},
 		},
 		"fail to process a withdrawal": {
-			walletId:   "somerandomID",
-			amount:     100,
-			wantResult: wallet.Balance{},
-			wantErr:    true,
+			otherWallet: true,
+			amount:      money.MustParse("100"),
+			wantResult:  wallet.Balance{},
+			wantErr:     true,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user := &User{
-				Wallets: map[string]*wallet.Wallet{
-					test.walletId: {
-						Id:      test.walletId,
-						Balance: 100,
-					},
-				},
-			}
-			if test.wantErr {
-				delete(user.Wallets, test.walletId)
+			_, u, ownWallet, otherWallet := setup(t)
+			walletId := ownWallet.Id
+			if test.otherWallet {
+				walletId = otherWallet.Id
 			}
 
-			got, err := user.Withdraw(test.walletId, test.amount)
+			got, err := u.Withdraw(context.Background(), walletId, test.amount)
 			if test.wantErr {
-				require.Error(t, err)
+				require.ErrorIs(t, err, user.ErrUnauthorized)
 			}
-			require.IsType(t, test.wantResult, got)
+			require.Equal(t, test.wantResult, got)
 		})
 	}
 }
@@ -140,8 +175,7 @@ func TestUser_CheckBalance(t *testing.T) {
 		wantErr    bool
 	}{
 		"get balance": {
-			walletId:   "somerandomID",
-			wantResult: wallet.Balance{},
+			wantResult: wallet.Balance{Balance: money.Money{Units: 10000, Scale: 2, Currency: "EUR"}, Available: money.Money{Units: 10000, Scale: 2, Currency: "EUR"}, Currency: "EUR"},
 		},
 		"fail to get balance": {
 			walletId:   "somerandomID",
@@ -150,67 +184,129 @@ func TestUser_CheckBalance(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user := &User{
-				Wallets: map[string]*wallet.Wallet{
-					test.walletId: {
-						Id:      test.walletId,
-						Balance: 100,
-					},
-				},
-			}
-			if test.wantErr {
-				delete(user.Wallets, test.walletId)
+			_, u, ownWallet, _ := setup(t)
+			walletId := ownWallet.Id
+			if test.walletId != "" {
+				walletId = test.walletId
 			}
 
-			got, err := user.CheckBalance(test.walletId)
+			got, err := u.CheckBalance(context.Background(), walletId)
 			if test.wantErr {
-				require.Error(t, err)
+				require.ErrorIs(t, err, user.ErrUnauthorized)
 			}
-			require.IsType(t, test.wantResult, got)
+			require.Equal(t, test.wantResult, got)
 		})
 	}
 }
 
 func TestUser_InitiatePayment(t *testing.T) {
 	for name, test := range map[string]struct {
-		sourceWalletId, targetWalletId string
-		amount                         float64
+		fromOtherWallet bool
+		amount          money.Money
 
-		wantResult wallet.Payment
+		wantResult wallet.Balance
 		wantErr    bool
 	}{
 		"successfully initiate payment": {
-			sourceWalletId: "somerandomID",
-			targetWalletId: "someotherID",
-			amount:         100,
-			wantResult:     wallet.Payment{},
+			amount:     money.MustParse("100"),
+			wantResult: wallet.Balance{Balance: money.Money{Scale: 2, Currency: "EUR"}, Available: money.Money{Scale: 2, Currency: "EUR"}, Currency: "EUR"},
 		},
 		"fail to initiate payment": {
-			sourceWalletId: "somerandomID",
-			targetWalletId: "someotherID",
-			amount:         100,
-			wantResult:     wallet.Payment{},
-			wantErr:        true,
+			fromOtherWallet: true,
+			amount:          money.MustParse("100"),
+			wantResult:      wallet.Balance{},
+			wantErr:         true,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			user := &User{
-				Wallets: map[string]*wallet.Wallet{
-					test.sourceWalletId: {
-						Id:      test.sourceWalletId,
-						Balance: 100,
-					},
-				},
+			_, u, ownWallet, otherWallet := setup(t)
+			sourceWalletId, targetWalletId := ownWallet.Id, otherWallet.Id
+			if test.fromOtherWallet {
+				sourceWalletId, targetWalletId = otherWallet.Id, ownWallet.Id
 			}
+
+			got, err := u.InitiatePayment(context.Background(), sourceWalletId, targetWalletId, test.amount, nil)
 			if test.wantErr {
-				delete(user.Wallets, test.sourceWalletId)
+				require.ErrorIs(t, err, user.ErrUnauthorized)
 			}
+			require.Equal(t, test.wantResult.Balance, got.Balance)
+		})
+	}
+}
 
-			got, err := user.InitiatePayment(test.sourceWalletId, test.targetWalletId, test.amount)
+func TestUser_History(t *testing.T) {
+	for name, test := range map[string]struct {
+		otherWallet bool
+
+		wantTransactions int
+		wantErr          bool
+	}{
+		"lists own transactions": {
+			wantTransactions: 1,
+		},
+		"fail to list someone else's transactions": {
+			otherWallet: true,
+			wantErr:     true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, u, ownWallet, otherWallet := setup(t)
+			walletId := ownWallet.Id
+			if test.otherWallet {
+				walletId = otherWallet.Id
+			}
+
+			got, err := u.History(context.Background(), walletId, wallet.TransactionQuery{}, "")
 			if test.wantErr {
-				require.Error(t, err)
+				require.ErrorIs(t, err, user.ErrUnauthorized)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, got.Transactions, test.wantTransactions)
+		})
+	}
+}
+
+func TestUser_ChangeWalletStatus(t *testing.T) {
+	for name, test := range map[string]struct {
+		otherWallet bool
+		status      string
+
+		wantErr error
+	}{
+		"freezes own wallet": {
+			status: wallet.StatusFrozen,
+		},
+		"makes own wallet inbound only": {
+			status: wallet.StatusInboundOnly,
+		},
+		"cannot reactivate a wallet": {
+			status:  wallet.StatusActive,
+			wantErr: user.ErrOperatorOnly,
+		},
+		"cannot change someone else's wallet": {
+			otherWallet: true,
+			status:      wallet.StatusFrozen,
+			wantErr:     user.ErrUnauthorized,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, u, ownWallet, otherWallet := setup(t)
+			walletId := ownWallet.Id
+			if test.otherWallet {
+				walletId = otherWallet.Id
+			}
+
+			got, err := u.ChangeWalletStatus(context.Background(), walletId, test.status, "lost my phone")
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
 			}
-			require.IsType(t, test.wantResult, got)
+			require.NoError(t, err)
+			require.Equal(t, u.Id, got.ChangedBy)
+			changes, err := u.WalletStatusChanges(context.Background(), walletId)
+			require.NoError(t, err)
+			require.Equal(t, []*wallet.StatusChange{got}, changes)
 		})
 	}
 }
@@ -0,0 +1,204 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// The orders a user's wallets can be listed in. Prefixing one with "-"
+// reverses it.
+const (
+	SortCreated  = "created"
+	SortName     = "name"
+	SortCurrency = "currency"
+	// SortBalance orders wallets by currency first, since balances in
+	// different currencies cannot be compared.
+	SortBalance = "balance"
+)
+
+const (
+	DefaultWalletLimit = 50
+	MaxWalletLimit     = 100
+)
+
+// WalletsQuery sorts and pages a user's wallets. Sort defaults to
+// SortCreated, and Limit to DefaultWalletLimit.
+type WalletsQuery struct {
+	Sort  string
+	Limit int
+}
+
+// WalletSummary is one of a user's wallets as the user sees it.
+type WalletSummary struct {
+	Id        string      `json:"Id"`
+	Name      string      `json:"Name,omitempty"`
+	Balance   money.Money `json:"Balance"`
+	Currency  string      `json:"Currency"`
+	Status    string      `json:"Status"`
+	CreatedAt time.Time   `json:"CreatedAt"`
+}
+
+// CurrencyTotal adds up the balances of a user's wallets in one currency.
+type CurrencyTotal struct {
+	Currency string      `json:"Currency"`
+	Balance  money.Money `json:"Balance"`
+	Wallets  int         `json:"Wallets"`
+}
+
+// WalletList is one page of a user's wallets. Totals cover every wallet the
+// user owns, not just the ones on the page.
+type WalletList struct {
+	Wallets    []WalletSummary `json:"Wallets"`
+	Totals     []CurrencyTotal `json:"Totals"`
+	NextCursor string          `json:"NextCursor,omitempty"`
+}
+
+// Profile is a user together with its tier and the totals of its wallets.
+type Profile struct {
+	*User
+	Tier   string          `json:"Tier"`
+	Totals []CurrencyTotal `json:"Totals"`
+}
+
+// Profile returns the user along with the total balance it holds in each
+// currency.
+func (u *User) Profile(ctx context.Context) (Profile, error) {
+	wallets, err := u.store.ListWallets(wallet.WalletQuery{UserId: u.Id})
+	if err != nil {
+		return Profile{}, err
+	}
+	totals, err := currencyTotals(wallets)
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{User: u, Tier: u.Tier(), Totals: totals}, nil
+}
+
+// Wallets returns one page of the user's wallets. The cursor is the
+// NextCursor of the previous page, or empty for the first page.
+func (u *User) Wallets(ctx context.Context, query WalletsQuery, cursor string) (WalletList, error) {
+	less, err := walletOrder(query.Sort)
+	if err != nil {
+		return WalletList{}, err
+	}
+	limit := query.Limit
+	switch {
+	case limit == 0:
+		limit = DefaultWalletLimit
+	case limit < 0 || limit > MaxWalletLimit:
+		return WalletList{}, fmt.Errorf("%w: limit must be between 1 and %d", wallet.ErrInvalidQuery, MaxWalletLimit)
+	}
+
+	wallets, err := u.store.ListWallets(wallet.WalletQuery{UserId: u.Id})
+	if err != nil {
+		return WalletList{}, err
+	}
+	totals, err := currencyTotals(wallets)
+	if err != nil {
+		return WalletList{}, err
+	}
+	sort.SliceStable(wallets, func(i, j int) bool { return less(wallets[i], wallets[j]) })
+
+	start := 0
+	if cursor != "" {
+		start = -1
+		for i, found := range wallets {
+			if found.Id == cursor {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return WalletList{}, fmt.Errorf("%w: unknown cursor", wallet.ErrInvalidQuery)
+		}
+	}
+	page := WalletList{Wallets: []WalletSummary{}, Totals: totals}
+	for _, found := range wallets[start:] {
+		if len(page.Wallets) == limit {
+			page.NextCursor = page.Wallets[limit-1].Id
+			break
+		}
+		page.Wallets = append(page.Wallets, WalletSummary{
+			Id:        found.Id,
+			Name:      found.Name,
+			Balance:   found.Balance,
+			Currency:  found.Currency(),
+			Status:    found.Status,
+			CreatedAt: found.CreatedAt,
+		})
+	}
+	return page, nil
+}
+
+// walletOrder returns how to order wallets for a sort. Ties are broken by
+// ID, so every order is total and pages do not overlap.
+func walletOrder(sortBy string) (func(a, b *wallet.Wallet) bool, error) {
+	field, descending := strings.CutPrefix(sortBy, "-")
+	var compare func(a, b *wallet.Wallet) int
+	switch field {
+	case "", SortCreated:
+		compare = func(a, b *wallet.Wallet) int { return a.CreatedAt.Compare(b.CreatedAt) }
+	case SortName:
+		compare = func(a, b *wallet.Wallet) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		}
+	case SortCurrency:
+		compare = func(a, b *wallet.Wallet) int { return strings.Compare(a.Currency(), b.Currency()) }
+	case SortBalance:
+		compare = func(a, b *wallet.Wallet) int {
+			if cmp := strings.Compare(a.Currency(), b.Currency()); cmp != 0 {
+				return cmp
+			}
+			cmp, _ := a.Balance.Cmp(b.Balance)
+			return cmp
+		}
+	default:
+		return nil, fmt.Errorf("%w: cannot sort by %q", wallet.ErrInvalidQuery, sortBy)
+	}
+	return func(a, b *wallet.Wallet) bool {
+		cmp := compare(a, b)
+		if cmp == 0 {
+			cmp = strings.Compare(a.Id, b.Id)
+		}
+		if descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	}, nil
+}
+
+// currencyTotals adds up the wallets' balances per currency, in order of
+// currency code.
+func currencyTotals(wallets []*wallet.Wallet) ([]CurrencyTotal, error) {
+	byCurrency := map[string]*CurrencyTotal{}
+	for _, found := range wallets {
+		currency := found.Currency()
+		total, ok := byCurrency[currency]
+		if !ok {
+			zero, err := money.Zero(currency)
+			if err != nil {
+				return nil, err
+			}
+			total = &CurrencyTotal{Currency: currency, Balance: zero}
+			byCurrency[currency] = total
+		}
+		balance, err := total.Balance.Add(found.Balance)
+		if err != nil {
+			return nil, err
+		}
+		total.Balance = balance
+		total.Wallets++
+	}
+	totals := make([]CurrencyTotal, 0, len(byCurrency))
+	for _, total := range byCurrency {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Currency < totals[j].Currency })
+	return totals, nil
+}
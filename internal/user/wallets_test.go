@@ -0,0 +1,133 @@
+package user_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/user"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+// setupWallets gives a user four wallets, created a minute apart:
+// "Savings" holding 50 EUR, "bills" holding 20 USD, "Travel" holding 5 EUR
+// and an unnamed one holding 15 EUR.
+func setupWallets(t *testing.T) *user.User {
+	t.Helper()
+	store := memory.New()
+	u, err := user.New(context.Background(), store, user.Details{})
+	require.NoError(t, err)
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, w := range []struct{ id, name, balance, currency string }{
+		{"wallet1", "Savings", "50", "EUR"},
+		{"wallet2", "bills", "20", "USD"},
+		{"wallet3", "Travel", "5", "EUR"},
+		{"wallet4", "", "15", "EUR"},
+	} {
+		zero, err := money.Zero(w.currency)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateWallet(&wallet.Wallet{
+			Id:        w.id,
+			UserId:    u.Id,
+			Name:      w.name,
+			Balance:   zero,
+			CreatedAt: created.Add(time.Duration(i) * time.Minute),
+		}))
+		_, err = u.Deposit(context.Background(), w.id, money.MustParse(w.balance))
+		require.NoError(t, err)
+	}
+	return u
+}
+
+func TestUser_Wallets(t *testing.T) {
+	u := setupWallets(t)
+	for name, test := range map[string]struct {
+		query  user.WalletsQuery
+		cursor string
+
+		wantIds    []string
+		wantCursor string
+		wantErr    error
+	}{
+		"oldest first by default": {
+			wantIds: []string{"wallet1", "wallet2", "wallet3", "wallet4"},
+		},
+		"newest first": {
+			query:   user.WalletsQuery{Sort: "-created"},
+			wantIds: []string{"wallet4", "wallet3", "wallet2", "wallet1"},
+		},
+		"by name, ignoring case": {
+			query:   user.WalletsQuery{Sort: user.SortName},
+			wantIds: []string{"wallet4", "wallet2", "wallet1", "wallet3"},
+		},
+		"by balance within each currency": {
+			query:   user.WalletsQuery{Sort: user.SortBalance},
+			wantIds: []string{"wallet3", "wallet4", "wallet1", "wallet2"},
+		},
+		"by currency, then ID": {
+			query:   user.WalletsQuery{Sort: "-currency"},
+			wantIds: []string{"wallet2", "wallet4", "wallet3", "wallet1"},
+		},
+		"first page": {
+			query:      user.WalletsQuery{Sort: user.SortBalance, Limit: 2},
+			wantIds:    []string{"wallet3", "wallet4"},
+			wantCursor: "wallet4",
+		},
+		"next page": {
+			query:   user.WalletsQuery{Sort: user.SortBalance, Limit: 2},
+			cursor:  "wallet4",
+			wantIds: []string{"wallet1", "wallet2"},
+		},
+		"unknown sort": {
+			query:   user.WalletsQuery{Sort: "colour"},
+			wantErr: wallet.ErrInvalidQuery,
+		},
+		"limit too large": {
+			query:   user.WalletsQuery{Limit: user.MaxWalletLimit + 1},
+			wantErr: wallet.ErrInvalidQuery,
+		},
+		"unknown cursor": {
+			cursor:  "missing",
+			wantErr: wallet.ErrInvalidQuery,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := u.Wallets(context.Background(), test.query, test.cursor)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			ids := []string{}
+			for _, w := range got.Wallets {
+				ids = append(ids, w.Id)
+			}
+			require.Equal(t, test.wantIds, ids)
+			require.Equal(t, test.wantCursor, got.NextCursor)
+			require.Len(t, got.Totals, 2, "totals cover every wallet, not just the page")
+		})
+	}
+}
+
+func TestUser_Profile(t *testing.T) {
+	u := setupWallets(t)
+	got, err := u.Profile(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, u.Id, got.Id)
+	require.Len(t, got.Totals, 2)
+	require.Equal(t, "EUR", got.Totals[0].Currency)
+	require.Equal(t, "70.00", got.Totals[0].Balance.String())
+	require.Equal(t, 3, got.Totals[0].Wallets)
+	require.Equal(t, "USD", got.Totals[1].Currency)
+	require.Equal(t, "20.00", got.Totals[1].Balance.String())
+	require.Equal(t, 1, got.Totals[1].Wallets)
+
+	empty, err := user.New(context.Background(), memory.New(), user.Details{})
+	require.NoError(t, err)
+	got, err = empty.Profile(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, got.Totals)
+}
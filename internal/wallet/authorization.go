@@ -0,0 +1,341 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// The states of an authorization. A pending authorization holds what it has
+// not captured until it is voided, fully captured or it expires; stores keep
+// an expired authorization as pending, and it is reported as HoldExpired.
+const (
+	HoldPending  = "pending"
+	HoldCaptured = "captured"
+	HoldVoided   = "voided"
+	HoldExpired  = "expired"
+)
+
+// DefaultHoldDuration is how long an authorization holds its funds unless
+// told otherwise.
+const DefaultHoldDuration = 7 * Day
+
+var (
+	ErrAuthorizationNotFound = errors.New("authorization not found")
+	ErrAuthorizationClosed   = errors.New("authorization is no longer pending")
+)
+
+// Authorization holds Amount in the source wallet for a payment into the
+// target wallet. It is captured in one or more payments, which add up in
+// Captured, and holds the rest until it is voided or ExpiresAt.
+type Authorization struct {
+	Id             string      `json:"Id"`
+	SourceWalletId string      `json:"WalletId"`
+	TargetWalletId string      `json:"Creditor"`
+	Amount         money.Money `json:"Amount"`
+	Captured       money.Money `json:"Captured"`
+	Status         string      `json:"Status"`
+	CreatedAt      time.Time   `json:"CreatedAt"`
+	ExpiresAt      time.Time   `json:"ExpiresAt"`
+}
+
+// AuthorizationRequest holds Amount for a payment into Creditor. The
+// currency works as it does for a PaymentRequest.
+type AuthorizationRequest struct {
+	TargetWallet string      `json:"Creditor"`
+	Amount       money.Money `json:"Amount"`
+	Currency     string      `json:"Currency,omitempty"`
+}
+
+// CaptureRequest pays Amount out of an authorization, or everything it still
+// holds when Amount is left out.
+type CaptureRequest struct {
+	Amount   *money.Money `json:"Amount,omitempty"`
+	Currency string       `json:"Currency,omitempty"`
+}
+
+// Capture is the payment made by capturing an authorization, along with
+// the authorization as it stands afterwards.
+type Capture struct {
+	Payment
+	Authorization *Authorization `json:"Authorization"`
+}
+
+// MarshalJSON adds what the authorization still holds, and its currency.
+func (a Authorization) MarshalJSON() ([]byte, error) {
+	type plain Authorization
+	return json.Marshal(struct {
+		plain
+		Remaining money.Money `json:"Remaining"`
+		Currency  string      `json:"Currency"`
+	}{plain(a), a.Remaining(), a.Amount.Currency})
+}
+
+// Remaining is the part of the authorization not captured yet.
+func (a *Authorization) Remaining() money.Money {
+	remaining, err := a.Amount.Sub(a.Captured)
+	if err != nil {
+		return a.Amount
+	}
+	return remaining
+}
+
+func (a *Authorization) Expired(at time.Time) bool {
+	return !at.Before(a.ExpiresAt)
+}
+
+// Holds reports whether the authorization sets funds aside at the given
+// time.
+func (a *Authorization) Holds(at time.Time) bool {
+	return a.Status == HoldPending && !a.Expired(at)
+}
+
+// Capture records t, a payment, as capturing part of the authorization.
+// Stores call it on the authorization t names, when they apply t.
+func (a *Authorization) Capture(t *Transaction) error {
+	if err := a.checkOpen(t.Timestamp); err != nil {
+		return err
+	}
+	if t.Type != TypePayment || t.SourceWalletId != a.SourceWalletId || t.TargetWalletId != a.TargetWalletId {
+		return fmt.Errorf("%w: %s", ErrAuthorizationNotFound, a.Id)
+	}
+	remaining := a.Remaining()
+	if cmp, err := t.Amount.Cmp(remaining); err != nil || cmp > 0 {
+		return fmt.Errorf("%w: only %s %s is left to capture", ErrInvalidAmount, remaining, remaining.Currency)
+	}
+	captured, err := a.Captured.Add(t.Amount)
+	if err != nil {
+		return err
+	}
+	a.Captured = captured
+	if a.Remaining().IsZero() {
+		a.Status = HoldCaptured
+	}
+	return nil
+}
+
+func (a *Authorization) checkOpen(at time.Time) error {
+	switch {
+	case a.Status != HoldPending:
+		return fmt.Errorf("%w: %s is %s", ErrAuthorizationClosed, a.Id, a.Status)
+	case a.Expired(at):
+		return fmt.Errorf("%w: %s expired at %s", ErrAuthorizationClosed, a.Id, a.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CheckAuthorization verifies that the source wallet, which already has held
+// set aside, can hold the authorization's amount for a payment into the
+// target wallet.
+func CheckAuthorization(a *Authorization, source, target *Wallet, held money.Money) error {
+	payment := &Transaction{Type: TypePayment, SourceWalletId: source.Id, TargetWalletId: target.Id, Amount: a.Amount}
+	if err := source.Allows(payment, Debit); err != nil {
+		return err
+	}
+	if err := target.Allows(payment, Credit); err != nil {
+		return err
+	}
+	available, err := source.Balance.Sub(held)
+	if err != nil {
+		return err
+	}
+	if cmp, err := a.Amount.Cmp(available); err != nil || cmp > 0 {
+		return fmt.Errorf("%w: %s %s is available", ErrInsufficientFunds, available, available.Currency)
+	}
+	return nil
+}
+
+// CheckAvailable verifies that a posted debit leaves the wallet it debits
+// with at least held, the amount its authorizations set aside.
+func CheckAvailable(entry Entry, held money.Money) error {
+	if entry.Direction != Debit || IsSystemAccount(entry.AccountId) {
+		return nil
+	}
+	if cmp, err := entry.Balance.Cmp(held); err != nil || cmp < 0 {
+		return fmt.Errorf("%w: %s %s is on hold", ErrInsufficientFunds, held, held.Currency)
+	}
+	return nil
+}
+
+// SumHeld adds up what the authorizations hold at the given time.
+func SumHeld(authorizations []Authorization, currency string, at time.Time) (money.Money, error) {
+	held, err := money.Zero(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	for i := range authorizations {
+		if !authorizations[i].Holds(at) {
+			continue
+		}
+		if held, err = held.Add(authorizations[i].Remaining()); err != nil {
+			return money.Money{}, err
+		}
+	}
+	return held, nil
+}
+
+// Available is the part of the balance that authorizations do not hold.
+func (w *Wallet) Available() money.Money {
+	available, err := w.Balance.Sub(w.Held)
+	if err != nil {
+		return w.Balance
+	}
+	return available
+}
+
+// Authorize holds amount, in the wallet's currency, for a payment into the
+// wallet with the given ID. The hold lasts until it is captured or voided,
+// or for ttl, or DefaultHoldDuration when ttl is not positive.
+func (w *Wallet) Authorize(ctx context.Context, walletId string, amount money.Money, ttl time.Duration) (*Authorization, error) {
+	payment, err := w.payment(walletId, amount, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultHoldDuration
+	}
+	captured, err := money.Zero(w.Currency())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	authorization := &Authorization{
+		Id:             manager.GenerateId(transactionIdSize),
+		SourceWalletId: w.Id,
+		TargetWalletId: payment.TargetWalletId,
+		Amount:         payment.Amount,
+		Captured:       captured,
+		Status:         HoldPending,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(ttl),
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.store.CreateAuthorization(authorization); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("funds held", "authorization_id", authorization.Id, "wallet_id", w.Id,
+		"counterparty", authorization.TargetWalletId, "amount", authorization.Amount.String(), "currency", w.Currency())
+	w.hold(authorization.Amount)
+	return authorization, nil
+}
+
+// Capture pays amount out of one of the wallet's authorizations, or all it
+// still holds when amount is nil.
+func (w *Wallet) Capture(ctx context.Context, authorizationId string, amount *money.Money, options ...TransactionOption) (Capture, error) {
+	authorization, err := w.Authorization(ctx, authorizationId)
+	if err != nil {
+		return Capture{}, err
+	}
+	if err := authorization.checkOpen(time.Now()); err != nil {
+		return Capture{}, err
+	}
+	captured := authorization.Remaining()
+	if amount != nil {
+		if captured, err = w.toWalletAmount(*amount); err != nil {
+			return Capture{}, err
+		}
+	}
+	transaction := newTransaction(TypePayment, captured)
+	transaction.SourceWalletId = w.Id
+	transaction.TargetWalletId = authorization.TargetWalletId
+	transaction.AuthorizationId = authorization.Id
+	if err := w.applyOptions(transaction, options); err != nil {
+		return Capture{}, err
+	}
+	if err := w.apply(ctx, transaction); err != nil {
+		return Capture{}, err
+	}
+	w.Balance = transaction.SourceBalance
+	w.release(captured)
+	if authorization, err = w.Authorization(ctx, authorizationId); err != nil {
+		return Capture{}, err
+	}
+	return Capture{
+		Payment: Payment{
+			TransactionId: transaction.Id,
+			Balance:       w.Balance,
+			Available:     w.Available(),
+			Currency:      w.Currency(),
+		},
+		Authorization: authorization,
+	}, nil
+}
+
+// Void releases what one of the wallet's authorizations still holds.
+func (w *Wallet) Void(ctx context.Context, authorizationId string) (*Authorization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var voided Authorization
+	err := w.store.UpdateAuthorization(authorizationId, func(a *Authorization) error {
+		if a.SourceWalletId != w.Id {
+			return fmt.Errorf("%w: %s", ErrAuthorizationNotFound, authorizationId)
+		}
+		if err := a.checkOpen(time.Now()); err != nil {
+			return err
+		}
+		a.Status = HoldVoided
+		voided = *a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("hold voided", "authorization_id", voided.Id, "wallet_id", w.Id)
+	w.release(voided.Remaining())
+	return &voided, nil
+}
+
+// Authorization returns one of the wallet's authorizations.
+func (w *Wallet) Authorization(ctx context.Context, id string) (*Authorization, error) {
+	authorization, err := w.store.GetAuthorization(id)
+	if err != nil {
+		return nil, err
+	}
+	if authorization.SourceWalletId != w.Id {
+		return nil, fmt.Errorf("%w: %s", ErrAuthorizationNotFound, id)
+	}
+	authorization.report(time.Now())
+	return authorization, nil
+}
+
+// Authorizations lists the wallet's authorizations, oldest first.
+func (w *Wallet) Authorizations(ctx context.Context) ([]*Authorization, error) {
+	authorizations, err := w.store.ListAuthorizations(w.Id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, authorization := range authorizations {
+		authorization.report(now)
+	}
+	return authorizations, nil
+}
+
+// report marks a pending authorization that has run out as expired.
+func (a *Authorization) report(at time.Time) {
+	if a.Status == HoldPending && a.Expired(at) {
+		a.Status = HoldExpired
+	}
+}
+
+// hold and release change what the wallet's snapshot has on hold.
+func (w *Wallet) hold(amount money.Money) {
+	if held, err := w.Held.Add(amount); err == nil {
+		w.Held = held
+	}
+}
+
+func (w *Wallet) release(amount money.Money) {
+	if held, err := w.Held.Sub(amount); err == nil {
+		w.Held = held
+	}
+}
@@ -0,0 +1,236 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet_Authorize(t *testing.T) {
+	for name, test := range map[string]struct {
+		held          string
+		amount        string
+		targetStatus  string
+		otherCurrency bool
+
+		wantErr error
+	}{
+		"holds funds": {
+			amount: "100",
+		},
+		"holds what is left": {
+			held:   "60",
+			amount: "40",
+		},
+		"more than is available": {
+			held:    "60",
+			amount:  "40.01",
+			wantErr: wallet.ErrInsufficientFunds,
+		},
+		"target wallet is frozen": {
+			amount:       "10",
+			targetStatus: wallet.StatusFrozen,
+			wantErr:      wallet.ErrWalletFrozen,
+		},
+		"target wallet holds another currency": {
+			amount:        "10",
+			otherCurrency: true,
+			wantErr:       money.ErrCurrencyMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			source := newWallet(t, store, "100")
+			currency := "EUR"
+			if test.otherCurrency {
+				currency = "USD"
+			}
+			target, err := wallet.New(context.Background(), store, "user2", currency, "")
+			require.NoError(t, err)
+			if test.targetStatus != "" {
+				_, err = target.ChangeStatus(context.Background(), test.targetStatus, "investigating", "operator1")
+				require.NoError(t, err)
+			}
+			if test.held != "" {
+				_, err = source.Authorize(context.Background(), target.Id, money.MustParse(test.held), 0)
+				require.NoError(t, err)
+			}
+
+			got, err := source.Authorize(context.Background(), target.Id, money.MustParse(test.amount), time.Hour)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, wallet.HoldPending, got.Status)
+			require.Equal(t, eur(test.amount), got.Remaining())
+			require.WithinDuration(t, time.Now().Add(time.Hour), got.ExpiresAt, time.Minute)
+
+			stored, err := wallet.Get(store, source.Id)
+			require.NoError(t, err)
+			require.Equal(t, eur("100"), stored.CheckBalance(context.Background()).Balance, "holds leave the ledger balance alone")
+			require.Equal(t, source.Available(), stored.Available())
+		})
+	}
+}
+
+func TestWallet_Capture(t *testing.T) {
+	for name, test := range map[string]struct {
+		captures []string
+		void     bool
+
+		wantErr       error
+		wantStatus    string
+		wantBalance   string
+		wantAvailable string
+	}{
+		"captures everything": {
+			captures:      []string{""},
+			wantStatus:    wallet.HoldCaptured,
+			wantBalance:   "40",
+			wantAvailable: "40",
+		},
+		"captures in parts": {
+			captures:      []string{"20", "15"},
+			wantStatus:    wallet.HoldPending,
+			wantBalance:   "65",
+			wantAvailable: "40",
+		},
+		"captures the rest": {
+			captures:      []string{"20", ""},
+			wantStatus:    wallet.HoldCaptured,
+			wantBalance:   "40",
+			wantAvailable: "40",
+		},
+		"captures more than is held": {
+			captures: []string{"50", "10.01"},
+			wantErr:  wallet.ErrInvalidAmount,
+		},
+		"captures after a void": {
+			void:     true,
+			captures: []string{"10"},
+			wantErr:  wallet.ErrAuthorizationClosed,
+		},
+		"voids what is left": {
+			captures:      []string{"20"},
+			void:          true,
+			wantStatus:    wallet.HoldVoided,
+			wantBalance:   "80",
+			wantAvailable: "80",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			source := newWallet(t, store, "100")
+			target := newWallet(t, store, "0")
+			authorization, err := source.Authorize(context.Background(), target.Id, money.MustParse("60"), 0)
+			require.NoError(t, err)
+
+			if test.void && test.wantErr != nil {
+				_, err = source.Void(context.Background(), authorization.Id)
+				require.NoError(t, err)
+			}
+			for i, captured := range test.captures {
+				var amount *money.Money
+				if captured != "" {
+					parsed := money.MustParse(captured)
+					amount = &parsed
+				}
+				_, err = source.Capture(context.Background(), authorization.Id, amount)
+				if test.wantErr != nil && i == len(test.captures)-1 {
+					require.ErrorIs(t, err, test.wantErr)
+					return
+				}
+				require.NoError(t, err)
+			}
+			if test.void {
+				_, err = source.Void(context.Background(), authorization.Id)
+				require.NoError(t, err)
+			}
+
+			got, err := source.Authorization(context.Background(), authorization.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantStatus, got.Status)
+			stored, err := wallet.Get(store, source.Id)
+			require.NoError(t, err)
+			require.Equal(t, wallet.Balance{Balance: eur(test.wantBalance), Available: eur(test.wantAvailable), Currency: "EUR"},
+				stored.CheckBalance(context.Background()))
+			require.Equal(t, stored.CheckBalance(context.Background()), source.CheckBalance(context.Background()))
+			require.NoError(t, stored.Reconcile())
+		})
+	}
+}
+
+func TestWallet_HoldsLimitWithdrawals(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	_, err := source.Authorize(context.Background(), target.Id, money.MustParse("70"), 0)
+	require.NoError(t, err)
+
+	_, err = source.Withdraw(context.Background(), money.MustParse("30.01"))
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+	_, err = source.InitiatePayment(context.Background(), target.Id, money.MustParse("30.01"), nil)
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+	got, err := source.Withdraw(context.Background(), money.MustParse("30"))
+	require.NoError(t, err)
+	require.Equal(t, wallet.Balance{Balance: eur("70"), Available: eur("0"), Currency: "EUR"}, got)
+}
+
+func TestWallet_HoldsExpire(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	created := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, store.CreateAuthorization(&wallet.Authorization{
+		Id:             "expired",
+		SourceWalletId: source.Id,
+		TargetWalletId: target.Id,
+		Amount:         eur("100"),
+		Captured:       eur("0"),
+		Status:         wallet.HoldPending,
+		CreatedAt:      created,
+		ExpiresAt:      created.Add(time.Hour),
+	}))
+
+	got, err := source.Authorization(context.Background(), "expired")
+	require.NoError(t, err)
+	require.Equal(t, wallet.HoldExpired, got.Status)
+	_, err = source.Capture(context.Background(), "expired", nil)
+	require.ErrorIs(t, err, wallet.ErrAuthorizationClosed)
+	_, err = source.Void(context.Background(), "expired")
+	require.ErrorIs(t, err, wallet.ErrAuthorizationClosed)
+
+	stored, err := wallet.Get(store, source.Id)
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), stored.Available(), "expired holds release their funds")
+	_, err = stored.Withdraw(context.Background(), money.MustParse("100"))
+	require.NoError(t, err)
+}
+
+func TestWallet_AuthorizationsAreTheWallets(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	authorization, err := source.Authorize(context.Background(), target.Id, money.MustParse("10"), 0)
+	require.NoError(t, err)
+
+	_, err = target.Authorization(context.Background(), authorization.Id)
+	require.ErrorIs(t, err, wallet.ErrAuthorizationNotFound)
+	_, err = target.Capture(context.Background(), authorization.Id, nil)
+	require.ErrorIs(t, err, wallet.ErrAuthorizationNotFound)
+	_, err = target.Void(context.Background(), authorization.Id)
+	require.ErrorIs(t, err, wallet.ErrAuthorizationNotFound)
+
+	listed, err := source.Authorizations(context.Background())
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	listed, err = target.Authorizations(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, listed)
+}
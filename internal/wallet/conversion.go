@@ -0,0 +1,61 @@
+package wallet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// Conversion records how a payment between wallets in different currencies
+// was priced. SourceAmount, which is also the transaction's Amount, leaves
+// the source wallet and ConvertedAmount arrives in the target wallet.
+type Conversion struct {
+	QuoteId         string      `json:"QuoteId,omitempty"`
+	Rate            money.Money `json:"Rate"`
+	Spread          money.Money `json:"Spread"`
+	SourceAmount    money.Money `json:"SourceAmount"`
+	SourceCurrency  string      `json:"SourceCurrency"`
+	ConvertedAmount money.Money `json:"ConvertedAmount"`
+	TargetCurrency  string      `json:"TargetCurrency"`
+}
+
+// PaymentQuote is what a payment would cost at a locked rate.
+type PaymentQuote struct {
+	Conversion
+	Creditor  string    `json:"Creditor"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+}
+
+// PriceFunc returns the quote to convert from one currency into another.
+// Payments only ask for one when the two wallets hold different currencies.
+type PriceFunc func(from, to string) (*exchange.Quote, error)
+
+func newConversion(quote *exchange.Quote, amount money.Money) (*Conversion, error) {
+	if quote.From != amount.Currency {
+		return nil, fmt.Errorf("%w: quote converts %s, not %s", exchange.ErrQuoteMismatch, quote.From, amount.Currency)
+	}
+	converted, err := quote.Convert(amount)
+	if err != nil {
+		return nil, err
+	}
+	return &Conversion{
+		QuoteId:         quote.Id,
+		Rate:            quote.Rate,
+		Spread:          quote.Spread,
+		SourceAmount:    amount,
+		SourceCurrency:  amount.Currency,
+		ConvertedAmount: converted,
+		TargetCurrency:  converted.Currency,
+	}, nil
+}
+
+// AmountFor is the amount the transaction moved in or out of the given
+// wallet, in that wallet's currency.
+func (t *Transaction) AmountFor(walletId string) money.Money {
+	if t.Conversion != nil && walletId == t.TargetWalletId {
+		return t.Conversion.ConvertedAmount
+	}
+	return t.Amount
+}
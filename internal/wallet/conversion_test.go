@@ -0,0 +1,144 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func newQuoter(t *testing.T) *exchange.Quoter {
+	t.Helper()
+	quoter, err := exchange.NewQuoter(exchange.StaticRates{"EUR/USD": money.MustParse("1.25")}, money.MustParse("0.01"), time.Minute)
+	require.NoError(t, err)
+	return quoter
+}
+
+func TestWallet_InitiatePaymentConversion(t *testing.T) {
+	for name, test := range map[string]struct {
+		targetCurrency string
+		amountToPay    money.Money
+
+		wantConversion    *wallet.Conversion
+		wantTargetBalance string
+		wantErr           error
+	}{
+		"converts into the creditor's currency": {
+			targetCurrency: "USD",
+			amountToPay:    money.MustParse("40"),
+			wantConversion: &wallet.Conversion{
+				Rate:            money.MustParse("1.2375"),
+				Spread:          money.MustParse("0.01"),
+				SourceAmount:    eur("40"),
+				SourceCurrency:  "EUR",
+				ConvertedAmount: money.Money{Units: 4950, Scale: 2, Currency: "USD"},
+				TargetCurrency:  "USD",
+			},
+			wantTargetBalance: "49.50",
+		},
+		"does not convert within one currency": {
+			targetCurrency:    "EUR",
+			amountToPay:       money.MustParse("40"),
+			wantTargetBalance: "40.00",
+		},
+		"fails without a rate": {
+			targetCurrency: "GBP",
+			amountToPay:    money.MustParse("40"),
+			wantErr:        exchange.ErrRateUnavailable,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			quoter := newQuoter(t)
+			target, err := wallet.New(context.Background(), store, "user2", test.targetCurrency, "")
+			require.NoError(t, err)
+			source := newWallet(t, store, "100")
+
+			got, err := source.InitiatePayment(context.Background(), target.Id, test.amountToPay, quoter.Quote)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, eur("60"), got.Balance)
+			require.Equal(t, test.wantConversion, got.Conversion)
+
+			target, err = wallet.Get(store, target.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantTargetBalance, target.Balance.String())
+			require.NoError(t, source.Reconcile())
+			require.NoError(t, target.Reconcile())
+		})
+	}
+}
+
+func TestWallet_ConversionLedger(t *testing.T) {
+	store := memory.New()
+	target, err := wallet.New(context.Background(), store, "user2", "USD", "")
+	require.NoError(t, err)
+	source := newWallet(t, store, "100")
+
+	_, err = source.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), newQuoter(t).Quote)
+	require.NoError(t, err)
+
+	// The FX accounts take the euros in and pay the dollars out, so each
+	// currency still balances on its own.
+	eurEntries, err := store.ListEntries(wallet.FX("EUR"))
+	require.NoError(t, err)
+	eurBalance, err := wallet.SumEntries(eurEntries, "EUR")
+	require.NoError(t, err)
+	require.Equal(t, eur("40"), eurBalance)
+
+	usdEntries, err := store.ListEntries(wallet.FX("USD"))
+	require.NoError(t, err)
+	usdBalance, err := wallet.SumEntries(usdEntries, "USD")
+	require.NoError(t, err)
+	require.Equal(t, "-49.50", usdBalance.String())
+
+	history, err := target.History(context.Background(), wallet.TransactionQuery{}, "")
+	require.NoError(t, err)
+	require.Len(t, history.Transactions, 1)
+	require.Equal(t, "49.50", history.Transactions[0].Amount.String())
+	require.Equal(t, "USD", history.Transactions[0].Currency)
+}
+
+func TestWallet_QuotePayment(t *testing.T) {
+	store := memory.New()
+	quoter := newQuoter(t)
+	usd, err := wallet.New(context.Background(), store, "user2", "USD", "")
+	require.NoError(t, err)
+	other := newWallet(t, store, "0")
+	source := newWallet(t, store, "100")
+	lock := func(from, to string) (*exchange.Quote, error) {
+		return quoter.Lock(from, to, "scope")
+	}
+
+	quote, err := source.QuotePayment(context.Background(), usd.Id, money.MustParse("40"), lock)
+	require.NoError(t, err)
+	require.NotEmpty(t, quote.QuoteId)
+	require.Equal(t, usd.Id, quote.Creditor)
+	require.Equal(t, "49.50", quote.ConvertedAmount.String())
+	require.False(t, quote.ExpiresAt.IsZero())
+
+	same, err := source.QuotePayment(context.Background(), other.Id, money.MustParse("40"), lock)
+	require.NoError(t, err)
+	require.Equal(t, "1", same.Rate.String())
+	require.Equal(t, eur("40"), same.ConvertedAmount)
+
+	// Quoting moves no money.
+	source, err = wallet.Get(store, source.Id)
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), source.Balance)
+
+	paid, err := source.InitiatePayment(context.Background(), usd.Id, money.MustParse("40"), func(from, to string) (*exchange.Quote, error) {
+		return quoter.Locked(quote.QuoteId, "scope")
+	})
+	require.NoError(t, err)
+	require.Equal(t, quote.QuoteId, paid.Conversion.QuoteId)
+	require.Equal(t, quote.ConvertedAmount, paid.Conversion.ConvertedAmount)
+}
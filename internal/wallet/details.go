@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The most a transaction's details may hold. Lengths are in characters.
+const (
+	MaxReferenceLength     = 140
+	MaxDescriptionLength   = 500
+	MaxMetadataEntries     = 20
+	MaxMetadataKeyLength   = 40
+	MaxMetadataValueLength = 500
+)
+
+var ErrInvalidDetails = errors.New("invalid transaction details")
+
+// TransactionDetails describe a deposit, withdrawal or payment to both
+// wallets it touches: a Reference, such as an invoice number, a free-text
+// Description, and Metadata the client keeps its own data in. Metadata keys
+// are letters, digits, '_', '-' and '.'.
+type TransactionDetails struct {
+	Reference   string            `json:"Reference,omitempty"`
+	Description string            `json:"Description,omitempty"`
+	Metadata    map[string]string `json:"Metadata,omitempty"`
+}
+
+// WithDetails records details on the transaction, once they pass the checks
+// described on TransactionDetails.
+func WithDetails(details TransactionDetails) TransactionOption {
+	return func(t *Transaction) {
+		t.Reference, t.Description = details.Reference, details.Description
+		t.Metadata = copyMetadata(details.Metadata)
+	}
+}
+
+// normalizeDetails trims the transaction's reference and description, and
+// checks its details fit within their limits.
+func normalizeDetails(t *Transaction) error {
+	t.Reference, t.Description = strings.TrimSpace(t.Reference), strings.TrimSpace(t.Description)
+	switch {
+	case utf8.RuneCountInString(t.Reference) > MaxReferenceLength:
+		return fmt.Errorf("%w: reference must be at most %d characters", ErrInvalidDetails, MaxReferenceLength)
+	case hasControl(t.Reference, false):
+		return fmt.Errorf("%w: reference must be a single line of text", ErrInvalidDetails)
+	case utf8.RuneCountInString(t.Description) > MaxDescriptionLength:
+		return fmt.Errorf("%w: description must be at most %d characters", ErrInvalidDetails, MaxDescriptionLength)
+	case hasControl(t.Description, true):
+		return fmt.Errorf("%w: description must be text", ErrInvalidDetails)
+	case len(t.Metadata) > MaxMetadataEntries:
+		return fmt.Errorf("%w: metadata may hold at most %d keys", ErrInvalidDetails, MaxMetadataEntries)
+	}
+	for key, value := range t.Metadata {
+		if !ValidMetadataKey(key) {
+			return fmt.Errorf("%w: metadata key %q must be 1 to %d letters, digits, '_', '-' or '.'",
+				ErrInvalidDetails, key, MaxMetadataKeyLength)
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength || hasControl(value, false) {
+			return fmt.Errorf("%w: metadata value of %q must be a single line of at most %d characters",
+				ErrInvalidDetails, key, MaxMetadataValueLength)
+		}
+	}
+	if len(t.Metadata) == 0 {
+		t.Metadata = nil
+	}
+	return nil
+}
+
+// ValidMetadataKey reports whether key may name a metadata value.
+func ValidMetadataKey(key string) bool {
+	if key == "" || len(key) > MaxMetadataKeyLength {
+		return false
+	}
+	for _, r := range key {
+		if !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasControl reports whether s holds control characters, other than line
+// breaks and tabs when multiline.
+func hasControl(s string, multiline bool) bool {
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\t') {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,127 @@
+package wallet_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet_Details(t *testing.T) {
+	tooManyKeys := map[string]string{}
+	for i := 0; i <= wallet.MaxMetadataEntries; i++ {
+		tooManyKeys[strings.Repeat("k", i+1)] = "v"
+	}
+	for name, test := range map[string]struct {
+		details wallet.TransactionDetails
+
+		want    wallet.TransactionDetails
+		wantErr error
+	}{
+		"no details": {},
+		"trimmed": {
+			details: wallet.TransactionDetails{Reference: " INV-1 ", Description: "March rent\nflat 2\n"},
+			want:    wallet.TransactionDetails{Reference: "INV-1", Description: "March rent\nflat 2"},
+		},
+		"metadata": {
+			details: wallet.TransactionDetails{Metadata: map[string]string{"order_id": "42", "client.v2-tag": ""}},
+			want:    wallet.TransactionDetails{Metadata: map[string]string{"order_id": "42", "client.v2-tag": ""}},
+		},
+		"empty metadata": {
+			details: wallet.TransactionDetails{Metadata: map[string]string{}},
+		},
+		"long reference": {
+			details: wallet.TransactionDetails{Reference: strings.Repeat("r", wallet.MaxReferenceLength+1)},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"multiline reference": {
+			details: wallet.TransactionDetails{Reference: "INV\n1"},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"long description": {
+			details: wallet.TransactionDetails{Description: strings.Repeat("é", wallet.MaxDescriptionLength+1)},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"control characters in description": {
+			details: wallet.TransactionDetails{Description: "bell\a"},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"too many metadata keys": {
+			details: wallet.TransactionDetails{Metadata: tooManyKeys},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"invalid metadata key": {
+			details: wallet.TransactionDetails{Metadata: map[string]string{"order id": "42"}},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"empty metadata key": {
+			details: wallet.TransactionDetails{Metadata: map[string]string{"": "42"}},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+		"long metadata value": {
+			details: wallet.TransactionDetails{Metadata: map[string]string{"note": strings.Repeat("v", wallet.MaxMetadataValueLength+1)}},
+			wantErr: wallet.ErrInvalidDetails,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			w := newWallet(t, store, "0")
+			_, err := w.Deposit(context.Background(), money.MustParse("10"), wallet.WithDetails(test.details))
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				require.Equal(t, eur("0"), w.Balance)
+				return
+			}
+			require.NoError(t, err)
+
+			history, err := w.History(context.Background(), wallet.TransactionQuery{}, "")
+			require.NoError(t, err)
+			require.Len(t, history.Transactions, 1)
+			got := history.Transactions[0]
+			require.Equal(t, test.want, wallet.TransactionDetails{
+				Reference: got.Reference, Description: got.Description, Metadata: got.Metadata,
+			})
+		})
+	}
+}
+
+func TestWallet_DetailsOnBothSides(t *testing.T) {
+	store := memory.New()
+	payer := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	details := wallet.TransactionDetails{
+		Reference:   "INV-7",
+		Description: "Invoice 7",
+		Metadata:    map[string]string{"order": "7"},
+	}
+	_, err := payer.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), nil, wallet.WithDetails(details))
+	require.NoError(t, err)
+	// Changing the details afterwards does not change the payment.
+	details.Metadata["order"] = "8"
+	_, err = payer.Withdraw(context.Background(), money.MustParse("10"), wallet.WithDetails(wallet.TransactionDetails{Reference: "ATM"}))
+	require.NoError(t, err)
+
+	for _, w := range []*wallet.Wallet{payer, target} {
+		history, err := w.History(context.Background(), wallet.TransactionQuery{Reference: "INV-7"}, "")
+		require.NoError(t, err)
+		require.Len(t, history.Transactions, 1)
+		require.Equal(t, "Invoice 7", history.Transactions[0].Description)
+
+		history, err = w.History(context.Background(), wallet.TransactionQuery{Metadata: map[string]string{"order": "7"}}, "")
+		require.NoError(t, err)
+		require.Len(t, history.Transactions, 1)
+		require.Equal(t, "INV-7", history.Transactions[0].Reference)
+	}
+
+	history, err := payer.History(context.Background(), wallet.TransactionQuery{Reference: "ATM"}, "")
+	require.NoError(t, err)
+	require.Len(t, history.Transactions, 1)
+	require.Equal(t, wallet.TypeWithdrawal, history.Transactions[0].Type)
+
+	_, err = payer.History(context.Background(), wallet.TransactionQuery{Metadata: map[string]string{"order id": "7"}}, "")
+	require.ErrorIs(t, err, wallet.ErrInvalidQuery)
+}
@@ -0,0 +1,82 @@
+package wallet
+
+import (
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// The events a Store records for every change it makes to a wallet. Data is
+// the Wallet for EventCreated, the StatusChange for EventStatusChanged and a
+// Movement for EventDebited and EventCredited.
+const (
+	EventCreated       = "wallet.created"
+	EventStatusChanged = "wallet.status_changed"
+	EventDebited       = "wallet.debited"
+	EventCredited      = "wallet.credited"
+)
+
+// Movement is a transaction seen from one of the wallets it touched: how
+// much it moved in or out of the wallet, in the wallet's currency, and the
+// wallet's Balance straight after it. Counterparty is the other wallet of a
+// payment or refund.
+type Movement struct {
+	TransactionId   string      `json:"TransactionId"`
+	Type            string      `json:"Type"`
+	WalletId        string      `json:"WalletId"`
+	Counterparty    string      `json:"Counterparty,omitempty"`
+	Amount          money.Money `json:"Amount"`
+	Currency        string      `json:"Currency"`
+	Balance         money.Money `json:"Balance"`
+	AuthorizationId string      `json:"AuthorizationId,omitempty"`
+	RefundOf        string      `json:"RefundOf,omitempty"`
+	TransactionDetails
+}
+
+// CreatedEvent is the event recorded along with a new wallet.
+func CreatedEvent(w *Wallet) (*event.Event, error) {
+	return event.New(EventCreated, w.UserId, w.Id, w.CreatedAt, w)
+}
+
+// Event is the event recorded along with the change, once the Store has
+// filled in From. userId owns the wallet.
+func (c *StatusChange) Event(userId string) (*event.Event, error) {
+	return event.New(EventStatusChanged, userId, c.WalletId, c.Timestamp, c)
+}
+
+// Events are the events recorded along with an applied transaction: one for
+// the wallet it debited and one for the wallet it credited, in that order,
+// each owned by the user owner returns for it.
+func (t *Transaction) Events(owner func(walletId string) string) ([]*event.Event, error) {
+	events := []*event.Event{}
+	for _, side := range []struct {
+		eventType, walletId, counterparty string
+		balance                           money.Money
+	}{
+		{EventDebited, t.SourceWalletId, t.TargetWalletId, t.SourceBalance},
+		{EventCredited, t.TargetWalletId, t.SourceWalletId, t.TargetBalance},
+	} {
+		if side.walletId == "" {
+			continue
+		}
+		amount := t.AmountFor(side.walletId)
+		e, err := event.New(side.eventType, owner(side.walletId), side.walletId, t.Timestamp, Movement{
+			TransactionId:   t.Id,
+			Type:            t.Type,
+			WalletId:        side.walletId,
+			Counterparty:    side.counterparty,
+			Amount:          amount,
+			Currency:        amount.Currency,
+			Balance:         side.balance,
+			AuthorizationId: t.AuthorizationId,
+			RefundOf:        t.RefundOf,
+			TransactionDetails: TransactionDetails{
+				Reference: t.Reference, Description: t.Description, Metadata: t.Metadata,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
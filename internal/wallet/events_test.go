@@ -0,0 +1,65 @@
+package wallet_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+type wantEvent struct {
+	eventType, userId, data string
+}
+
+func TestTransaction_Events(t *testing.T) {
+	owners := map[string]string{"wallet1": "user1", "wallet2": "user2"}
+	usd := money.Money{Units: 4950, Scale: 2, Currency: "USD"}
+	for name, test := range map[string]struct {
+		transaction wallet.Transaction
+
+		want []wantEvent
+	}{
+		"deposit": {
+			transaction: wallet.Transaction{Type: wallet.TypeDeposit, TargetWalletId: "wallet1", Amount: eur("40"),
+				TargetBalance: eur("140")},
+			want: []wantEvent{{wallet.EventCredited, "user1", `{"TransactionId":"transaction1","Type":"deposit","WalletId":"wallet1",
+				"Amount":"40.00","Currency":"EUR","Balance":"140.00"}`}},
+		},
+		"withdrawal": {
+			transaction: wallet.Transaction{Type: wallet.TypeWithdrawal, SourceWalletId: "wallet1", Amount: eur("40"),
+				SourceBalance: eur("60"), Reference: "cash"},
+			want: []wantEvent{{wallet.EventDebited, "user1", `{"TransactionId":"transaction1","Type":"withdrawal","WalletId":"wallet1",
+				"Amount":"40.00","Currency":"EUR","Balance":"60.00","Reference":"cash"}`}},
+		},
+		"payment between currencies, from each side": {
+			transaction: wallet.Transaction{Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2",
+				Amount: eur("40"), SourceBalance: eur("60"), TargetBalance: usd,
+				Conversion: &wallet.Conversion{ConvertedAmount: usd}},
+			want: []wantEvent{
+				{wallet.EventDebited, "user1", `{"TransactionId":"transaction1","Type":"payment","WalletId":"wallet1",
+					"Counterparty":"wallet2","Amount":"40.00","Currency":"EUR","Balance":"60.00"}`},
+				{wallet.EventCredited, "user2", `{"TransactionId":"transaction1","Type":"payment","WalletId":"wallet2",
+					"Counterparty":"wallet1","Amount":"49.50","Currency":"USD","Balance":"49.50"}`},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			test.transaction.Id, test.transaction.Timestamp = "transaction1", time.Now()
+			events, err := test.transaction.Events(func(walletId string) string { return owners[walletId] })
+			require.NoError(t, err)
+			require.Len(t, events, len(test.want))
+			for i, e := range events {
+				require.Equal(t, test.want[i].eventType, e.Type)
+				require.Equal(t, test.want[i].userId, e.UserId)
+				require.JSONEq(t, test.want[i].data, string(e.Data))
+				var movement wallet.Movement
+				require.NoError(t, json.Unmarshal(e.Data, &movement))
+				require.Equal(t, movement.WalletId, e.WalletId)
+				require.True(t, test.transaction.Timestamp.Equal(e.CreatedAt))
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package wallet
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+const (
+	Incoming = "in"
+	Outgoing = "out"
+)
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+var ErrInvalidQuery = errors.New("invalid transaction query")
+
+// TransactionQuery narrows down a wallet's transactions. Zero values leave a
+// filter unset. Reference must match exactly, and so must every key and
+// value in Metadata. Stores return matches newest first, starting after the
+// transaction whose ID is Before when it is set, and stop at Limit matches
+// unless it is zero. An unknown Before is an ErrInvalidQuery.
+type TransactionQuery struct {
+	From, To       time.Time
+	Direction      string
+	CounterpartyId string
+	MinAmount      *money.Money
+	MaxAmount      *money.Money
+	Reference      string
+	Metadata       map[string]string
+	Before         string
+	Limit          int
+}
+
+// HistoryEntry is a transaction seen from one wallet, with that wallet's
+// balance straight after it.
+type HistoryEntry struct {
+	Id           string            `json:"Id"`
+	Type         string            `json:"Type"`
+	Direction    string            `json:"Direction"`
+	Counterparty string            `json:"Counterparty,omitempty"`
+	Amount       money.Money       `json:"Amount"`
+	Balance      money.Money       `json:"Balance"`
+	Currency     string            `json:"Currency"`
+	Timestamp    time.Time         `json:"Timestamp"`
+	Reference    string            `json:"Reference,omitempty"`
+	Description  string            `json:"Description,omitempty"`
+	Metadata     map[string]string `json:"Metadata,omitempty"`
+	// AuthorizationId is the authorization a payment captured.
+	AuthorizationId string `json:"AuthorizationId,omitempty"`
+	// Status is how much of a payment has been refunded, and RefundOf the
+	// payment a refund returns.
+	Status   string `json:"Status,omitempty"`
+	RefundOf string `json:"RefundOf,omitempty"`
+}
+
+type History struct {
+	Transactions []HistoryEntry `json:"Transactions"`
+	NextCursor   string         `json:"NextCursor,omitempty"`
+}
+
+// History returns one page of the wallet's transactions, newest first. The
+// cursor is the NextCursor of the previous page, or empty for the first page.
+func (w *Wallet) History(ctx context.Context, query TransactionQuery, cursor string) (History, error) {
+	query, err := w.historyQuery(query, cursor)
+	if err != nil {
+		return History{}, err
+	}
+	limit := query.Limit
+	// Fetch one extra transaction to learn whether another page follows.
+	query.Limit++
+	transactions, err := w.store.ListTransactions(w.Id, query)
+	if err != nil {
+		return History{}, err
+	}
+	history := History{Transactions: []HistoryEntry{}}
+	for i, transaction := range transactions {
+		if i == limit {
+			history.NextCursor = encodeCursor(transactions[i-1].Id)
+			break
+		}
+		history.Transactions = append(history.Transactions, w.historyEntry(transaction))
+	}
+	return history, nil
+}
+
+func (w *Wallet) historyQuery(query TransactionQuery, cursor string) (TransactionQuery, error) {
+	switch query.Direction {
+	case "", Incoming, Outgoing:
+	default:
+		return TransactionQuery{}, fmt.Errorf("%w: direction must be %q or %q", ErrInvalidQuery, Incoming, Outgoing)
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return TransactionQuery{}, fmt.Errorf("%w: from must be before to", ErrInvalidQuery)
+	}
+	switch {
+	case query.Limit == 0:
+		query.Limit = DefaultHistoryLimit
+	case query.Limit < 0 || query.Limit > MaxHistoryLimit:
+		return TransactionQuery{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxHistoryLimit)
+	}
+	if len(query.Metadata) > MaxMetadataEntries {
+		return TransactionQuery{}, fmt.Errorf("%w: at most %d metadata keys can be matched", ErrInvalidQuery, MaxMetadataEntries)
+	}
+	for key := range query.Metadata {
+		if !ValidMetadataKey(key) {
+			return TransactionQuery{}, fmt.Errorf("%w: %q is not a metadata key", ErrInvalidQuery, key)
+		}
+	}
+	for _, bound := range []**money.Money{&query.MinAmount, &query.MaxAmount} {
+		if *bound == nil {
+			continue
+		}
+		converted, err := (*bound).In(w.Balance.Currency)
+		if err != nil {
+			return TransactionQuery{}, err
+		}
+		*bound = &converted
+	}
+	if query.MinAmount != nil && query.MaxAmount != nil {
+		if cmp, err := query.MinAmount.Cmp(*query.MaxAmount); err != nil || cmp > 0 {
+			return TransactionQuery{}, fmt.Errorf("%w: minimum amount is above maximum amount", ErrInvalidAmount)
+		}
+	}
+	query.Before = ""
+	if cursor != "" {
+		before, err := decodeCursor(cursor)
+		if err != nil {
+			return TransactionQuery{}, err
+		}
+		query.Before = before
+	}
+	return query, nil
+}
+
+func (w *Wallet) historyEntry(t *Transaction) HistoryEntry {
+	entry := HistoryEntry{
+		Id:              t.Id,
+		Type:            t.Type,
+		Amount:          t.AmountFor(w.Id),
+		Currency:        t.AmountFor(w.Id).Currency,
+		Timestamp:       t.Timestamp,
+		Reference:       t.Reference,
+		Description:     t.Description,
+		Metadata:        t.Metadata,
+		AuthorizationId: t.AuthorizationId,
+		Status:          t.PaymentStatus(),
+		RefundOf:        t.RefundOf,
+	}
+	if t.SourceWalletId == w.Id {
+		entry.Direction = Outgoing
+		entry.Counterparty = t.TargetWalletId
+		entry.Balance = t.SourceBalance
+	} else {
+		entry.Direction = Incoming
+		entry.Counterparty = t.SourceWalletId
+		entry.Balance = t.TargetBalance
+	}
+	return entry
+}
+
+// Matches reports whether a transaction of walletId passes the query's
+// filters. It does not look at Before or Limit.
+func (q TransactionQuery) Matches(walletId string, t *Transaction) bool {
+	outgoing := t.SourceWalletId == walletId
+	counterparty := t.SourceWalletId
+	if outgoing {
+		counterparty = t.TargetWalletId
+	}
+	switch {
+	case !q.From.IsZero() && t.Timestamp.Before(q.From):
+		return false
+	case !q.To.IsZero() && !t.Timestamp.Before(q.To):
+		return false
+	case q.Direction == Incoming && outgoing, q.Direction == Outgoing && !outgoing:
+		return false
+	case q.CounterpartyId != "" && q.CounterpartyId != counterparty:
+		return false
+	case q.Reference != "" && q.Reference != t.Reference:
+		return false
+	}
+	for key, value := range q.Metadata {
+		if found, ok := t.Metadata[key]; !ok || found != value {
+			return false
+		}
+	}
+	amount := t.AmountFor(walletId)
+	if q.MinAmount != nil {
+		if cmp, err := amount.Cmp(*q.MinAmount); err != nil || cmp < 0 {
+			return false
+		}
+	}
+	if q.MaxAmount != nil {
+		if cmp, err := amount.Cmp(*q.MaxAmount); err != nil || cmp > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeCursor(transactionId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(transactionId))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(decoded) == 0 {
+		return "", fmt.Errorf("%w: unreadable cursor", ErrInvalidQuery)
+	}
+	return string(decoded), nil
+}
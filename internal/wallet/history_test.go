@@ -0,0 +1,110 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet_History(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	_, err := source.InitiatePayment(context.Background(), target.Id, money.MustParse("25"), nil)
+	require.NoError(t, err)
+	_, err = source.Withdraw(context.Background(), money.MustParse("5.50"))
+	require.NoError(t, err)
+	_, err = target.InitiatePayment(context.Background(), source.Id, money.MustParse("1"), nil)
+	require.NoError(t, err)
+
+	got, err := source.History(context.Background(), wallet.TransactionQuery{}, "")
+	require.NoError(t, err)
+	require.Empty(t, got.NextCursor)
+	require.Len(t, got.Transactions, 4)
+	for i, want := range []struct {
+		transactionType, direction, counterparty string
+		amount, balance                          money.Money
+	}{
+		{wallet.TypePayment, wallet.Incoming, target.Id, eur("1"), eur("70.50")},
+		{wallet.TypeWithdrawal, wallet.Outgoing, "", eur("5.50"), eur("69.50")},
+		{wallet.TypePayment, wallet.Outgoing, target.Id, eur("25"), eur("75")},
+		{wallet.TypeDeposit, wallet.Incoming, "", eur("100"), eur("100")},
+	} {
+		entry := got.Transactions[i]
+		require.Equal(t, want.transactionType, entry.Type, i)
+		require.Equal(t, want.direction, entry.Direction, i)
+		require.Equal(t, want.counterparty, entry.Counterparty, i)
+		require.Equal(t, want.amount, entry.Amount, i)
+		require.Equal(t, want.balance, entry.Balance, i)
+	}
+
+	got, err = target.History(context.Background(), wallet.TransactionQuery{}, "")
+	require.NoError(t, err)
+	require.Len(t, got.Transactions, 2)
+	require.Equal(t, eur("24"), got.Transactions[0].Balance)
+	require.Equal(t, eur("25"), got.Transactions[1].Balance)
+}
+
+func TestWallet_HistoryPages(t *testing.T) {
+	store := memory.New()
+	w := newWallet(t, store, "0")
+	for i := 0; i < 5; i++ {
+		_, err := w.Deposit(context.Background(), money.MustParse("1"))
+		require.NoError(t, err)
+	}
+
+	var balances []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, err := w.History(context.Background(), wallet.TransactionQuery{Limit: 2}, cursor)
+		require.NoError(t, err)
+		for _, entry := range page.Transactions {
+			balances = append(balances, entry.Balance.String())
+		}
+		if page.NextCursor == "" {
+			require.Equal(t, 3, pages)
+			break
+		}
+		cursor = page.NextCursor
+	}
+	require.Equal(t, []string{"5.00", "4.00", "3.00", "2.00", "1.00"}, balances)
+}
+
+func TestWallet_HistoryInvalidQuery(t *testing.T) {
+	w := newWallet(t, memory.New(), "10")
+	now := time.Now()
+	tooPrecise := money.MustParse("0.001")
+	for name, test := range map[string]struct {
+		query  wallet.TransactionQuery
+		cursor string
+	}{
+		"bad direction": {
+			query: wallet.TransactionQuery{Direction: "sideways"},
+		},
+		"backwards time range": {
+			query: wallet.TransactionQuery{From: now, To: now.Add(-time.Hour)},
+		},
+		"limit too large": {
+			query: wallet.TransactionQuery{Limit: wallet.MaxHistoryLimit + 1},
+		},
+		"unreadable cursor": {
+			cursor: "!!!",
+		},
+		"unknown cursor": {
+			cursor: "bm90LWEtdHJhbnNhY3Rpb24",
+		},
+		"amount too precise": {
+			query: wallet.TransactionQuery{MinAmount: &tooPrecise},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := w.History(context.Background(), test.query, test.cursor)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// Every transaction is posted to the ledger as a debit on the account money
+// leaves and a credit on the account it arrives in. Wallets are accounts
+// named after their wallet ID. Money entering or leaving the service goes
+// through the system accounts returned by CashIn and CashOut, payments
+// between currencies are exchanged through the accounts returned by FX, and
+// operators' corrections are posted against the accounts returned by
+// Adjustments.
+//
+// An account's balance is its credits minus its debits, so wallets hold a
+// positive balance, CashIn grows more negative with every deposit, and the
+// balances of all accounts always sum to zero.
+
+type Direction string
+
+const (
+	Debit  Direction = "debit"
+	Credit Direction = "credit"
+)
+
+type Entry struct {
+	TransactionId string
+	AccountId     string
+	Direction     Direction
+	Amount        money.Money
+	Balance       money.Money
+	Timestamp     time.Time
+}
+
+const systemAccountPrefix = "system:"
+
+var (
+	ErrUnbalanced     = errors.New("ledger entries do not balance")
+	ErrLedgerMismatch = errors.New("wallet balance does not match its ledger")
+)
+
+func CashIn(currency string) string {
+	return systemAccountPrefix + "cash-in:" + currency
+}
+
+func CashOut(currency string) string {
+	return systemAccountPrefix + "cash-out:" + currency
+}
+
+// Adjustments is the system account operators correct balances against.
+func Adjustments(currency string) string {
+	return systemAccountPrefix + "adjustments:" + currency
+}
+
+// FX is the system account a currency is exchanged through.
+func FX(currency string) string {
+	return systemAccountPrefix + "fx:" + currency
+}
+
+func IsSystemAccount(accountId string) bool {
+	return strings.HasPrefix(accountId, systemAccountPrefix)
+}
+
+// SourceAccount is the ledger account debited by the transaction.
+func (t *Transaction) SourceAccount() string {
+	if t.SourceWalletId == "" && t.Type == TypeAdjustment {
+		return Adjustments(t.Amount.Currency)
+	}
+	if t.SourceWalletId == "" {
+		return CashIn(t.Amount.Currency)
+	}
+	return t.SourceWalletId
+}
+
+// TargetAccount is the ledger account credited by the transaction.
+func (t *Transaction) TargetAccount() string {
+	if t.TargetWalletId == "" && t.Type == TypeAdjustment {
+		return Adjustments(t.Amount.Currency)
+	}
+	if t.TargetWalletId == "" {
+		return CashOut(t.Amount.Currency)
+	}
+	return t.TargetWalletId
+}
+
+// Entries returns the balanced debits and credits the transaction posts.
+// Their Balance fields are left for the Store to fill in. A converted
+// payment credits the source currency's FX account and debits the target
+// currency's, so each currency balances on its own.
+func (t *Transaction) Entries() []Entry {
+	entry := func(accountId string, direction Direction, amount money.Money) Entry {
+		return Entry{
+			TransactionId: t.Id,
+			AccountId:     accountId,
+			Direction:     direction,
+			Amount:        amount,
+			Timestamp:     t.Timestamp,
+		}
+	}
+	if t.Conversion == nil {
+		return []Entry{
+			entry(t.SourceAccount(), Debit, t.Amount),
+			entry(t.TargetAccount(), Credit, t.Amount),
+		}
+	}
+	converted := t.Conversion.ConvertedAmount
+	return []Entry{
+		entry(t.SourceAccount(), Debit, t.Amount),
+		entry(FX(t.Amount.Currency), Credit, t.Amount),
+		entry(FX(converted.Currency), Debit, converted),
+		entry(t.TargetAccount(), Credit, converted),
+	}
+}
+
+// Post returns the account balance after applying the entry to balance.
+// Wallets may never be posted below zero; system accounts may.
+func (e Entry) Post(balance money.Money) (money.Money, error) {
+	var (
+		posted money.Money
+		err    error
+	)
+	switch e.Direction {
+	case Debit:
+		posted, err = balance.Sub(e.Amount)
+	case Credit:
+		posted, err = balance.Add(e.Amount)
+	default:
+		return money.Money{}, fmt.Errorf("unknown entry direction %q", e.Direction)
+	}
+	if err != nil {
+		return money.Money{}, err
+	}
+	if posted.IsNegative() && !IsSystemAccount(e.AccountId) {
+		return money.Money{}, ErrInsufficientFunds
+	}
+	return posted, nil
+}
+
+// CheckBalanced verifies that the entries debit exactly as much as they
+// credit, currency by currency.
+func CheckBalanced(entries []Entry) error {
+	totals := map[string]money.Money{}
+	for _, entry := range entries {
+		amount := entry.Amount
+		if entry.Direction == Debit {
+			amount.Units = -amount.Units
+		}
+		total, err := totals[amount.Currency].Add(amount)
+		if err != nil {
+			return err
+		}
+		totals[amount.Currency] = total
+	}
+	for currency, total := range totals {
+		if !total.IsZero() {
+			return fmt.Errorf("%w: %s is off by %s", ErrUnbalanced, currency, total)
+		}
+	}
+	return nil
+}
+
+// SumEntries derives an account balance from its ledger entries.
+func SumEntries(entries []Entry, currency string) (money.Money, error) {
+	balance, err := money.Zero(currency)
+	if err != nil {
+		return money.Money{}, err
+	}
+	for _, entry := range entries {
+		if entry.Direction == Debit {
+			balance, err = balance.Sub(entry.Amount)
+		} else {
+			balance, err = balance.Add(entry.Amount)
+		}
+		if err != nil {
+			return money.Money{}, err
+		}
+	}
+	return balance, nil
+}
+
+func (w *Wallet) Entries() ([]Entry, error) {
+	return w.store.ListEntries(w.Id)
+}
+
+// Reconcile rebuilds the wallet's balance from its ledger entries and checks
+// it against the balance the store holds for it.
+func (w *Wallet) Reconcile() error {
+	stored, err := w.store.GetWallet(w.Id)
+	if err != nil {
+		return err
+	}
+	entries, err := w.store.ListEntries(w.Id)
+	if err != nil {
+		return err
+	}
+	derived, err := SumEntries(entries, stored.Balance.Currency)
+	if err != nil {
+		return err
+	}
+	if cmp, err := derived.Cmp(stored.Balance); err != nil || cmp != 0 {
+		return fmt.Errorf("%w: wallet %s holds %s but its ledger sums to %s", ErrLedgerMismatch, w.Id, stored.Balance, derived)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger_Entries(t *testing.T) {
+	for name, test := range map[string]struct {
+		transaction wallet.Transaction
+
+		wantDebit, wantCredit string
+	}{
+		"deposits come from cash in": {
+			transaction: wallet.Transaction{TargetWalletId: "wallet1", Amount: eur("10")},
+			wantDebit:   wallet.CashIn("EUR"),
+			wantCredit:  "wallet1",
+		},
+		"withdrawals go to cash out": {
+			transaction: wallet.Transaction{SourceWalletId: "wallet1", Amount: eur("10")},
+			wantDebit:   "wallet1",
+			wantCredit:  wallet.CashOut("EUR"),
+		},
+		"payments move between wallets": {
+			transaction: wallet.Transaction{SourceWalletId: "wallet1", TargetWalletId: "wallet2", Amount: eur("10")},
+			wantDebit:   "wallet1",
+			wantCredit:  "wallet2",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries := test.transaction.Entries()
+			require.Len(t, entries, 2)
+			require.Equal(t, wallet.Debit, entries[0].Direction)
+			require.Equal(t, test.wantDebit, entries[0].AccountId)
+			require.Equal(t, wallet.Credit, entries[1].Direction)
+			require.Equal(t, test.wantCredit, entries[1].AccountId)
+			require.NoError(t, wallet.CheckBalanced(entries))
+		})
+	}
+}
+
+func TestLedger_Post(t *testing.T) {
+	for name, test := range map[string]struct {
+		entry   wallet.Entry
+		balance money.Money
+
+		want    money.Money
+		wantErr error
+	}{
+		"credits add": {
+			entry:   wallet.Entry{AccountId: "wallet1", Direction: wallet.Credit, Amount: eur("5")},
+			balance: eur("10"),
+			want:    eur("15"),
+		},
+		"debits subtract": {
+			entry:   wallet.Entry{AccountId: "wallet1", Direction: wallet.Debit, Amount: eur("5")},
+			balance: eur("10"),
+			want:    eur("5"),
+		},
+		"wallets cannot go negative": {
+			entry:   wallet.Entry{AccountId: "wallet1", Direction: wallet.Debit, Amount: eur("10.01")},
+			balance: eur("10"),
+			wantErr: wallet.ErrInsufficientFunds,
+		},
+		"system accounts can go negative": {
+			entry:   wallet.Entry{AccountId: wallet.CashIn("EUR"), Direction: wallet.Debit, Amount: eur("10.01")},
+			balance: eur("10"),
+			want:    eur("-0.01"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := test.entry.Post(test.balance)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestLedger_CheckBalanced(t *testing.T) {
+	err := wallet.CheckBalanced([]wallet.Entry{
+		{AccountId: "wallet1", Direction: wallet.Debit, Amount: eur("10")},
+		{AccountId: "wallet2", Direction: wallet.Credit, Amount: eur("9.99")},
+	})
+	require.ErrorIs(t, err, wallet.ErrUnbalanced)
+}
+
+func TestWallet_Reconcile(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	_, err := source.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), nil)
+	require.NoError(t, err)
+	_, err = target.Withdraw(context.Background(), money.MustParse("15"))
+	require.NoError(t, err)
+
+	require.NoError(t, source.Reconcile())
+	require.NoError(t, target.Reconcile())
+
+	entries, err := target.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, eur("25"), entries[1].Balance)
+}
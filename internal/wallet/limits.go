@@ -0,0 +1,377 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// The periods a limit is counted over. Daily and monthly limits are rolling:
+// they count the Day or Month up to each transaction, not calendar days. A
+// total counts every transaction ever made.
+const (
+	PeriodTransaction = "transaction"
+	PeriodDaily       = "daily"
+	PeriodMonthly     = "monthly"
+	PeriodTotal       = "total"
+)
+
+const (
+	Day   = 24 * time.Hour
+	Month = 30 * Day
+)
+
+var (
+	ErrLimitExceeded = errors.New("limit exceeded")
+	ErrInvalidLimits = errors.New("invalid limits")
+)
+
+// Limit caps one type of transaction made from a wallet. A nil amount is no
+// limit.
+type Limit struct {
+	PerTransaction *money.Money `json:"PerTransaction,omitempty"`
+	Daily          *money.Money `json:"Daily,omitempty"`
+	Monthly        *money.Money `json:"Monthly,omitempty"`
+}
+
+// Limits holds a Limit for each of TypeDeposit, TypeWithdrawal and
+// TypePayment. Deposits count against the wallet paid into, and withdrawals
+// and payments against the wallet paid from.
+type Limits map[string]Limit
+
+// LimitError reports the limit a transaction would break and how much could
+// still be moved without breaking it.
+type LimitError struct {
+	Type      string      `json:"Type"`
+	Period    string      `json:"Period"`
+	Limit     money.Money `json:"Limit"`
+	Remaining money.Money `json:"Remaining"`
+	Currency  string      `json:"Currency"`
+}
+
+func (e *LimitError) Error() string {
+	if e.Period == PeriodTransaction {
+		return fmt.Sprintf("%s: a single %s may be at most %s %s", ErrLimitExceeded, e.Type, e.Limit, e.Currency)
+	}
+	return fmt.Sprintf("%s: the %s %s limit is %s %s, leaving %s %s", ErrLimitExceeded, e.Period, e.Type, e.Limit,
+		e.Currency, e.Remaining, e.Currency)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// WithLimits counts the transaction against the limits for its type, on top
+// of any the wallet overrides them with.
+func WithLimits(limits Limits) TransactionOption {
+	return func(t *Transaction) {
+		if limit, ok := limits[t.Type]; ok {
+			t.Limit = &limit
+		}
+	}
+}
+
+// ConvertFunc returns what amount is worth in currency.
+type ConvertFunc func(amount money.Money, currency string) (money.Money, error)
+
+// UserLimit caps one type of transaction across every wallet of the user
+// owning the wallet it counts against. Cap, when set, is the most such
+// transactions may ever add up to. Its amounts are in Currency, which Convert
+// values each wallet's transactions in.
+type UserLimit struct {
+	Limit    Limit
+	Cap      *money.Money
+	Currency string
+	Convert  ConvertFunc
+}
+
+// WithUserLimits counts the transaction against the limits for its type
+// shared by all of its owner's wallets, which are in currency. convert values
+// the transactions of wallets holding other currencies. Any amount the
+// wallet overrides with its own limits is counted against the wallet alone
+// instead.
+func WithUserLimits(limits Limits, currency string, convert ConvertFunc) TransactionOption {
+	return func(t *Transaction) {
+		if limit, ok := limits[t.Type]; ok {
+			t.userLimit(currency, convert).Limit = limit
+		}
+	}
+}
+
+// WithUserCap caps the total of every transaction of the transaction's type
+// counted against any of its owner's wallets, ever, at cap, which is in
+// currency. convert values the transactions of wallets holding other
+// currencies. Wallets cannot override it.
+func WithUserCap(cap money.Money, currency string, convert ConvertFunc) TransactionOption {
+	return func(t *Transaction) {
+		t.userLimit(currency, convert).Cap = &cap
+	}
+}
+
+// userLimit returns the transaction's UserLimit, setting one in currency
+// when it has none.
+func (t *Transaction) userLimit(currency string, convert ConvertFunc) *UserLimit {
+	if t.UserLimit == nil {
+		t.UserLimit = &UserLimit{Currency: currency, Convert: convert}
+	}
+	return t.UserLimit
+}
+
+// Validate checks that limits are only set for the types of transaction a
+// wallet makes, and are never negative.
+func (l Limits) Validate() error {
+	for transactionType, limit := range l {
+		switch transactionType {
+		case TypeDeposit, TypeWithdrawal, TypePayment:
+		default:
+			return fmt.Errorf("%w: %q transactions have no limits", ErrInvalidLimits, transactionType)
+		}
+		for _, amount := range limit.amounts() {
+			if *amount != nil && (*amount).IsNegative() {
+				return fmt.Errorf("%w: %s limits cannot be negative", ErrInvalidLimits, transactionType)
+			}
+		}
+	}
+	return nil
+}
+
+// Merge returns the limits with every amount set in overrides replacing
+// its own.
+func (l Limits) Merge(overrides Limits) Limits {
+	merged := Limits{}
+	for transactionType, limit := range l {
+		merged[transactionType] = limit
+	}
+	for transactionType, override := range overrides {
+		merged[transactionType] = merged[transactionType].merge(override)
+	}
+	return merged
+}
+
+func (l Limit) merge(override Limit) Limit {
+	overrides := override.amounts()
+	for i, amount := range l.amounts() {
+		if *overrides[i] != nil {
+			*amount = *overrides[i]
+		}
+	}
+	return l
+}
+
+// without returns the limit with every amount set in overrides left out.
+func (l Limit) without(overrides Limit) Limit {
+	dropped := overrides.amounts()
+	for i, amount := range l.amounts() {
+		if *dropped[i] != nil {
+			*amount = nil
+		}
+	}
+	return l
+}
+
+func (l *Limit) amounts() []**money.Money {
+	return []**money.Money{&l.PerTransaction, &l.Daily, &l.Monthly}
+}
+
+func (l Limit) isZero() bool {
+	return l.PerTransaction == nil && l.Daily == nil && l.Monthly == nil
+}
+
+// In returns the limit expressed in the given currency.
+func (l Limit) In(currency string) (Limit, error) {
+	for _, amount := range l.amounts() {
+		if *amount == nil {
+			continue
+		}
+		inCurrency, err := (*amount).In(currency)
+		if err != nil {
+			return Limit{}, fmt.Errorf("%w: %w", ErrInvalidLimits, err)
+		}
+		*amount = &inCurrency
+	}
+	return l, nil
+}
+
+// In returns the limits expressed in the given currency.
+func (l Limits) In(currency string) (Limits, error) {
+	converted := Limits{}
+	for transactionType, limit := range l {
+		inCurrency, err := limit.In(currency)
+		if err != nil {
+			return nil, err
+		}
+		converted[transactionType] = inCurrency
+	}
+	return converted, nil
+}
+
+// Convert returns the limits, held in from, valued in to by convert.
+func (l Limits) Convert(from, to string, convert ConvertFunc) (Limits, error) {
+	inFrom, err := l.In(from)
+	if err != nil {
+		return nil, err
+	}
+	converted := Limits{}
+	for transactionType, limit := range inFrom {
+		for _, amount := range limit.amounts() {
+			if *amount == nil {
+				continue
+			}
+			inTo, err := convert(**amount, to)
+			if err != nil {
+				return nil, err
+			}
+			*amount = &inTo
+		}
+		converted[transactionType] = limit
+	}
+	return converted, nil
+}
+
+// LimitedWalletId is the wallet the transaction counts against.
+func (t *Transaction) LimitedWalletId() string {
+	if t.Type == TypeDeposit {
+		return t.TargetWalletId
+	}
+	return t.SourceWalletId
+}
+
+// Counts reports whether other counts towards the same limits as the
+// transaction, that is whether it is of the same type, made by the same
+// wallet.
+func (t *Transaction) Counts(other *Transaction) bool {
+	if other.Type != t.Type {
+		return false
+	}
+	return other.LimitedWalletId() == t.LimitedWalletId()
+}
+
+// CheckLimit verifies that the transaction keeps within its Limit, if it has
+// one. spent must return the total of the transactions the transaction
+// Counts with since the given time.
+func CheckLimit(t *Transaction, spent func(since time.Time) (money.Money, error)) error {
+	if t.Limit == nil {
+		return nil
+	}
+	return checkLimit(t, *t.Limit, nil, t.Amount, spent)
+}
+
+// CheckUserLimit verifies that the transaction keeps within its UserLimit,
+// if it has one. spent must return the totals, one for each currency, of the
+// transactions of the same type counted against any of the owner's wallets
+// since the given time.
+func CheckUserLimit(t *Transaction, spent func(since time.Time) ([]money.Money, error)) error {
+	if t.UserLimit == nil {
+		return nil
+	}
+	value := func(amounts ...money.Money) (money.Money, error) {
+		total, err := money.Zero(t.UserLimit.Currency)
+		if err != nil {
+			return money.Money{}, err
+		}
+		for _, amount := range amounts {
+			if amount.IsZero() {
+				continue
+			}
+			converted, err := t.UserLimit.Convert(amount, t.UserLimit.Currency)
+			if err != nil {
+				return money.Money{}, err
+			}
+			if total, err = total.Add(converted); err != nil {
+				return money.Money{}, err
+			}
+		}
+		return total, nil
+	}
+	amount, err := value(t.Amount)
+	if err != nil {
+		return err
+	}
+	return checkLimit(t, t.UserLimit.Limit, t.UserLimit.Cap, amount, func(since time.Time) (money.Money, error) {
+		totals, err := spent(since)
+		if err != nil {
+			return money.Money{}, err
+		}
+		return value(totals...)
+	})
+}
+
+// checkLimit verifies that amount, the transaction's amount in the limit's
+// currency, keeps within limit and total, if it is set, given what spent has
+// counted against them.
+func checkLimit(t *Transaction, limit Limit, total *money.Money, amount money.Money,
+	spent func(since time.Time) (money.Money, error)) error {
+	limitError := func(period string, limit, remaining money.Money) error {
+		if remaining.IsNegative() {
+			remaining.Units = 0
+		}
+		return &LimitError{Type: t.Type, Period: period, Limit: limit, Remaining: remaining, Currency: amount.Currency}
+	}
+	if max := limit.PerTransaction; max != nil {
+		if cmp, err := amount.Cmp(*max); err != nil || cmp > 0 {
+			return limitError(PeriodTransaction, *max, *max)
+		}
+	}
+	for _, counted := range []struct {
+		period string
+		max    *money.Money
+		since  time.Time
+	}{
+		{PeriodDaily, limit.Daily, t.Timestamp.Add(-Day)},
+		{PeriodMonthly, limit.Monthly, t.Timestamp.Add(-Month)},
+		// Every transaction is later than the Unix epoch.
+		{PeriodTotal, total, time.Unix(0, 0)},
+	} {
+		if counted.max == nil {
+			continue
+		}
+		sum, err := spent(counted.since)
+		if err != nil {
+			return err
+		}
+		remaining, err := counted.max.Sub(sum)
+		if err != nil {
+			return err
+		}
+		if cmp, err := amount.Cmp(remaining); err != nil || cmp > 0 {
+			return limitError(counted.period, *counted.max, remaining)
+		}
+	}
+	return nil
+}
+
+// SetLimits replaces the wallet's own limits, which override those of its
+// owner's tier amount by amount. Empty limits remove every override.
+func (w *Wallet) SetLimits(ctx context.Context, limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	converted, err := limits.In(w.Currency())
+	if err != nil {
+		return err
+	}
+	for transactionType, limit := range converted {
+		if limit.isZero() {
+			delete(converted, transactionType)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.store.SetWalletLimits(w.Id, converted); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Info("wallet limits set", "wallet_id", w.Id)
+	w.Limits = converted
+	return nil
+}
+
+// EffectiveLimits returns the given limits with the wallet's own applied
+// over them, in the wallet's currency.
+func (w *Wallet) EffectiveLimits(limits Limits) (Limits, error) {
+	return limits.Merge(w.Limits).In(w.Currency())
+}
@@ -0,0 +1,208 @@
+package wallet_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func amount(s string) *money.Money {
+	m := money.MustParse(s)
+	return &m
+}
+
+func TestLimits_Validate(t *testing.T) {
+	for name, test := range map[string]struct {
+		limits  wallet.Limits
+		wantErr bool
+	}{
+		"no limits": {},
+		"every kind of limit": {
+			limits: wallet.Limits{
+				wallet.TypeDeposit:    {Daily: amount("100")},
+				wallet.TypeWithdrawal: {PerTransaction: amount("10"), Monthly: amount("0")},
+				wallet.TypePayment:    {PerTransaction: amount("10")},
+			},
+		},
+		"adjustments have no limits": {
+			limits:  wallet.Limits{wallet.TypeAdjustment: {Daily: amount("100")}},
+			wantErr: true,
+		},
+		"negative amount": {
+			limits:  wallet.Limits{wallet.TypePayment: {Daily: amount("-1")}},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := test.limits.Validate()
+			if test.wantErr {
+				require.ErrorIs(t, err, wallet.ErrInvalidLimits)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestLimits_Merge(t *testing.T) {
+	tier := wallet.Limits{
+		wallet.TypePayment:    {PerTransaction: amount("100"), Daily: amount("500")},
+		wallet.TypeWithdrawal: {Daily: amount("200")},
+	}
+	got := tier.Merge(wallet.Limits{
+		wallet.TypePayment: {Daily: amount("1000")},
+		wallet.TypeDeposit: {Monthly: amount("50")},
+	})
+	require.Equal(t, wallet.Limits{
+		wallet.TypePayment:    {PerTransaction: amount("100"), Daily: amount("1000")},
+		wallet.TypeWithdrawal: {Daily: amount("200")},
+		wallet.TypeDeposit:    {Monthly: amount("50")},
+	}, got)
+	require.Equal(t, amount("500"), tier[wallet.TypePayment].Daily, "merging leaves the limits it started from alone")
+}
+
+func TestWallet_Limits(t *testing.T) {
+	limits := wallet.Limits{
+		wallet.TypeWithdrawal: {PerTransaction: amount("50"), Daily: amount("80"), Monthly: amount("200")},
+	}
+	for name, test := range map[string]struct {
+		// earlier are withdrawals made the given time ago.
+		earlier   map[time.Duration]string
+		overrides wallet.Limits
+		amount    string
+
+		wantErr *wallet.LimitError
+	}{
+		"within every limit": {
+			earlier: map[time.Duration]string{time.Hour: "30"},
+			amount:  "50",
+		},
+		"over the per-transaction limit": {
+			amount:  "50.01",
+			wantErr: &wallet.LimitError{Type: wallet.TypeWithdrawal, Period: wallet.PeriodTransaction, Limit: eur("50"), Remaining: eur("50"), Currency: "EUR"},
+		},
+		"over the daily limit": {
+			earlier: map[time.Duration]string{time.Hour: "45"},
+			amount:  "40",
+			wantErr: &wallet.LimitError{Type: wallet.TypeWithdrawal, Period: wallet.PeriodDaily, Limit: eur("80"), Remaining: eur("35"), Currency: "EUR"},
+		},
+		"the day rolls": {
+			earlier: map[time.Duration]string{25 * time.Hour: "45"},
+			amount:  "40",
+		},
+		"over the monthly limit": {
+			earlier: map[time.Duration]string{2 * wallet.Day: "60", 10 * wallet.Day: "60", 20 * wallet.Day: "40", 40 * wallet.Day: "50"},
+			amount:  "45",
+			wantErr: &wallet.LimitError{Type: wallet.TypeWithdrawal, Period: wallet.PeriodMonthly, Limit: eur("200"), Remaining: eur("40"), Currency: "EUR"},
+		},
+		"wallet overrides raise a limit": {
+			overrides: wallet.Limits{wallet.TypeWithdrawal: {PerTransaction: amount("75")}},
+			amount:    "75",
+		},
+		"wallet overrides lower a limit": {
+			overrides: wallet.Limits{wallet.TypeWithdrawal: {Daily: amount("10")}},
+			amount:    "20",
+			wantErr:   &wallet.LimitError{Type: wallet.TypeWithdrawal, Period: wallet.PeriodDaily, Limit: eur("10"), Remaining: eur("10"), Currency: "EUR"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			w := newWallet(t, store, "500")
+			now := time.Now()
+			for ago, spent := range test.earlier {
+				require.NoError(t, store.ApplyTransaction(&wallet.Transaction{
+					Id:             "earlier-" + ago.String(),
+					Type:           wallet.TypeWithdrawal,
+					SourceWalletId: w.Id,
+					Amount:         eur(spent),
+					Timestamp:      now.Add(-ago),
+				}))
+			}
+			if test.overrides != nil {
+				require.NoError(t, w.SetLimits(context.Background(), test.overrides))
+			}
+
+			_, err := w.Withdraw(context.Background(), money.MustParse(test.amount), wallet.WithLimits(limits))
+			if test.wantErr != nil {
+				var got *wallet.LimitError
+				require.True(t, errors.As(err, &got), err)
+				require.ErrorIs(t, err, wallet.ErrLimitExceeded)
+				require.Equal(t, test.wantErr, got)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestWallet_LimitsByType(t *testing.T) {
+	store := memory.New()
+	source := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	limits := wallet.Limits{wallet.TypePayment: {Daily: amount("10")}}
+
+	_, err := source.InitiatePayment(context.Background(), target.Id, money.MustParse("10"), nil, wallet.WithLimits(limits))
+	require.NoError(t, err)
+	_, err = source.Withdraw(context.Background(), money.MustParse("10"), wallet.WithLimits(limits))
+	require.NoError(t, err, "withdrawals do not count towards payment limits")
+	_, err = target.InitiatePayment(context.Background(), source.Id, money.MustParse("10"), nil, wallet.WithLimits(limits))
+	require.NoError(t, err, "payments received do not count towards the receiver's limits")
+	_, err = source.InitiatePayment(context.Background(), target.Id, money.MustParse("0.01"), nil, wallet.WithLimits(limits))
+	require.ErrorIs(t, err, wallet.ErrLimitExceeded)
+}
+
+func TestWallet_UserLimits(t *testing.T) {
+	store := memory.New()
+	first := newWallet(t, store, "100")
+	second := newWallet(t, store, "100")
+	limits := wallet.Limits{wallet.TypeWithdrawal: {PerTransaction: amount("25"), Daily: amount("30")}}
+	withdraw := func(w *wallet.Wallet, s string) error {
+		_, err := w.Withdraw(context.Background(), money.MustParse(s), wallet.WithUserLimits(limits, "EUR", money.Money.In))
+		return err
+	}
+
+	require.NoError(t, withdraw(first, "20"))
+	err := withdraw(second, "10.01")
+	var got *wallet.LimitError
+	require.True(t, errors.As(err, &got), err)
+	require.Equal(t, &wallet.LimitError{Type: wallet.TypeWithdrawal, Period: wallet.PeriodDaily, Limit: eur("30"), Remaining: eur("10"), Currency: "EUR"},
+		got, "the owner's wallets share the daily limit")
+	require.NoError(t, withdraw(second, "10"))
+
+	require.NoError(t, second.SetLimits(context.Background(), wallet.Limits{wallet.TypeWithdrawal: {Daily: amount("50")}}))
+	require.NoError(t, withdraw(second, "20"), "the wallet's own daily limit replaces the shared one")
+	require.ErrorIs(t, withdraw(second, "25.01"), wallet.ErrLimitExceeded, "amounts it does not override still apply")
+	require.ErrorIs(t, withdraw(first, "0.01"), wallet.ErrLimitExceeded)
+}
+
+func TestWallet_SetLimits(t *testing.T) {
+	store := memory.New()
+	w := newWallet(t, store, "0")
+
+	err := w.SetLimits(context.Background(), wallet.Limits{wallet.TypePayment: {Daily: amount("0.001")}})
+	require.ErrorIs(t, err, wallet.ErrInvalidLimits)
+	err = w.SetLimits(context.Background(), wallet.Limits{wallet.TypePayment: {Daily: &money.Money{Units: 1, Currency: "USD"}}})
+	require.ErrorIs(t, err, wallet.ErrInvalidLimits)
+
+	require.NoError(t, w.SetLimits(context.Background(), wallet.Limits{wallet.TypePayment: {Daily: amount("25")}, wallet.TypeDeposit: {}}))
+	got, err := wallet.Get(store, w.Id)
+	require.NoError(t, err)
+	limit := eur("25")
+	require.Equal(t, wallet.Limits{wallet.TypePayment: {Daily: &limit}}, got.Limits, "empty limits are dropped")
+
+	effective, err := got.EffectiveLimits(wallet.Limits{wallet.TypePayment: {PerTransaction: amount("5")}})
+	require.NoError(t, err)
+	perTransaction := eur("5")
+	require.Equal(t, wallet.Limits{wallet.TypePayment: {PerTransaction: &perTransaction, Daily: &limit}}, effective)
+
+	require.NoError(t, w.SetLimits(context.Background(), wallet.Limits{}))
+	got, err = wallet.Get(store, w.Id)
+	require.NoError(t, err)
+	require.Empty(t, got.Limits)
+}
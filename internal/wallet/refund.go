@@ -0,0 +1,180 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+// The states of a payment, depending on how much of it has been refunded.
+const (
+	PaymentCompleted         = "completed"
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+)
+
+var ErrPaymentRefunded = errors.New("payment is already fully refunded")
+
+// RefundRequest returns Amount, in the currency the payment was made in, or
+// everything not refunded yet when Amount is left out.
+type RefundRequest struct {
+	Amount   *money.Money `json:"Amount,omitempty"`
+	Currency string       `json:"Currency,omitempty"`
+}
+
+// Refund is the transaction returning part or all of a payment, along with
+// the payment as it stands afterwards.
+type Refund struct {
+	Payment
+	RefundOf RefundedPayment `json:"RefundOf"`
+}
+
+// RefundedPayment is how much of a payment has been refunded. Its amounts are
+// in the currency the payment was made in.
+type RefundedPayment struct {
+	TransactionId string      `json:"TransactionId"`
+	Amount        money.Money `json:"Amount"`
+	Refunded      money.Money `json:"Refunded"`
+	Currency      string      `json:"Currency"`
+	Status        string      `json:"Status"`
+}
+
+// PaymentStatus is PaymentCompleted, PaymentPartiallyRefunded or
+// PaymentRefunded for payments, and empty for any other transaction.
+func (t *Transaction) PaymentStatus() string {
+	switch {
+	case t.Type != TypePayment:
+		return ""
+	case t.Refunded.IsZero():
+		return PaymentCompleted
+	case t.Refundable().IsZero():
+		return PaymentRefunded
+	}
+	return PaymentPartiallyRefunded
+}
+
+// Refundable is the part of a payment its refunds have not returned yet.
+func (t *Transaction) Refundable() money.Money {
+	if t.Refunded.IsZero() {
+		return t.Amount
+	}
+	refundable, err := t.Amount.Sub(t.Refunded)
+	if err != nil {
+		return t.Amount
+	}
+	return refundable
+}
+
+// Refund records refund as returning part of the payment. Stores call it on
+// the payment refund names, when they apply refund.
+func (t *Transaction) Refund(refund *Transaction) error {
+	if t.Type != TypePayment || refund.Type != TypeRefund || refund.RefundOf != t.Id ||
+		refund.SourceWalletId != t.TargetWalletId || refund.TargetWalletId != t.SourceWalletId {
+		return fmt.Errorf("%w: payment %s", ErrTransactionNotFound, refund.RefundOf)
+	}
+	refundable := t.Refundable()
+	if refundable.IsZero() {
+		return fmt.Errorf("%w: %s", ErrPaymentRefunded, t.Id)
+	}
+	returned := refund.AmountFor(t.SourceWalletId)
+	if cmp, err := returned.Cmp(refundable); err != nil || cmp > 0 {
+		return fmt.Errorf("%w: only %s %s is left to refund", ErrInvalidAmount, refundable, refundable.Currency)
+	}
+	if !t.Refunded.IsZero() {
+		var err error
+		if returned, err = t.Refunded.Add(returned); err != nil {
+			return err
+		}
+	}
+	t.Refunded = returned
+	return nil
+}
+
+// Refund returns amount, in the currency the payment was made in, of a
+// payment the wallet received, or everything not refunded yet when amount is
+// nil. A payment between currencies is refunded at the rate it was made at,
+// so the payer gets back exactly what is refunded and the wallet pays what
+// that amount was converted into.
+func (w *Wallet) Refund(ctx context.Context, transactionId string, amount *money.Money, options ...TransactionOption) (Refund, error) {
+	payment, err := w.store.GetTransaction(transactionId)
+	if err != nil {
+		return Refund{}, err
+	}
+	if payment.Type != TypePayment || payment.TargetWalletId != w.Id {
+		return Refund{}, fmt.Errorf("%w: payment %s", ErrTransactionNotFound, transactionId)
+	}
+	returned := payment.Refundable()
+	if returned.IsZero() {
+		return Refund{}, fmt.Errorf("%w: %s", ErrPaymentRefunded, transactionId)
+	}
+	if amount != nil {
+		if returned, err = toAmount(*amount, payment.Amount.Currency); err != nil {
+			return Refund{}, err
+		}
+	}
+	transaction, err := w.refund(payment, returned)
+	if err != nil {
+		return Refund{}, err
+	}
+	if err := w.applyOptions(transaction, options); err != nil {
+		return Refund{}, err
+	}
+	if err := w.apply(ctx, transaction); err != nil {
+		return Refund{}, err
+	}
+	w.Balance = transaction.SourceBalance
+	if payment, err = w.store.GetTransaction(transactionId); err != nil {
+		return Refund{}, err
+	}
+	return Refund{
+		Payment: Payment{
+			TransactionId: transaction.Id,
+			Balance:       w.Balance,
+			Available:     w.Available(),
+			Currency:      w.Currency(),
+			Conversion:    transaction.Conversion,
+		},
+		RefundOf: RefundedPayment{
+			TransactionId: payment.Id,
+			Amount:        payment.Amount,
+			Refunded:      payment.Refunded,
+			Currency:      payment.Amount.Currency,
+			Status:        payment.PaymentStatus(),
+		},
+	}, nil
+}
+
+// refund builds, but does not apply, a refund returning returned of payment
+// to its payer.
+func (w *Wallet) refund(payment *Transaction, returned money.Money) (*Transaction, error) {
+	transaction := newTransaction(TypeRefund, returned)
+	transaction.SourceWalletId = w.Id
+	transaction.TargetWalletId = payment.SourceWalletId
+	transaction.RefundOf = payment.Id
+	if payment.Conversion == nil {
+		return transaction, nil
+	}
+	// Price the refund the way the payment was priced, then send it back the
+	// other way.
+	paid := &exchange.Quote{From: payment.Amount.Currency, To: w.Currency(), Rate: payment.Conversion.Rate}
+	debited, err := paid.Convert(returned)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := exchange.Invert(payment.Conversion.Rate)
+	if err != nil {
+		return nil, err
+	}
+	transaction.Amount = debited
+	transaction.Conversion = &Conversion{
+		Rate:            rate,
+		SourceAmount:    debited,
+		SourceCurrency:  debited.Currency,
+		ConvertedAmount: returned,
+		TargetCurrency:  returned.Currency,
+	}
+	return transaction, nil
+}
@@ -0,0 +1,159 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet_Refund(t *testing.T) {
+	for name, test := range map[string]struct {
+		refunds []string
+
+		wantErr           error
+		wantStatus        string
+		wantRefunded      string
+		wantPayerBalance  string
+		wantTargetBalance string
+	}{
+		"refunds everything": {
+			refunds:           []string{""},
+			wantStatus:        wallet.PaymentRefunded,
+			wantRefunded:      "40",
+			wantPayerBalance:  "100",
+			wantTargetBalance: "0",
+		},
+		"refunds part": {
+			refunds:           []string{"15"},
+			wantStatus:        wallet.PaymentPartiallyRefunded,
+			wantRefunded:      "15",
+			wantPayerBalance:  "75",
+			wantTargetBalance: "25",
+		},
+		"refunds the rest": {
+			refunds:           []string{"15", ""},
+			wantStatus:        wallet.PaymentRefunded,
+			wantRefunded:      "40",
+			wantPayerBalance:  "100",
+			wantTargetBalance: "0",
+		},
+		"refunds in parts up to the payment": {
+			refunds:           []string{"15", "25"},
+			wantStatus:        wallet.PaymentRefunded,
+			wantRefunded:      "40",
+			wantPayerBalance:  "100",
+			wantTargetBalance: "0",
+		},
+		"refunds more than was paid": {
+			refunds: []string{"15", "25.01"},
+			wantErr: wallet.ErrInvalidAmount,
+		},
+		"refunds a refunded payment": {
+			refunds: []string{"", "1"},
+			wantErr: wallet.ErrPaymentRefunded,
+		},
+		"refunds nothing": {
+			refunds: []string{"0"},
+			wantErr: wallet.ErrInvalidAmount,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			payer := newWallet(t, store, "100")
+			target := newWallet(t, store, "0")
+			paid, err := payer.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), nil)
+			require.NoError(t, err)
+
+			var got wallet.Refund
+			for i, refunded := range test.refunds {
+				var amount *money.Money
+				if refunded != "" {
+					parsed := money.MustParse(refunded)
+					amount = &parsed
+				}
+				got, err = target.Refund(context.Background(), paid.TransactionId, amount)
+				if test.wantErr != nil && i == len(test.refunds)-1 {
+					require.ErrorIs(t, err, test.wantErr)
+					return
+				}
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.wantStatus, got.RefundOf.Status)
+			require.Equal(t, eur(test.wantRefunded), got.RefundOf.Refunded)
+			require.Equal(t, eur(test.wantTargetBalance), got.Balance)
+
+			payer, err = wallet.Get(store, payer.Id)
+			require.NoError(t, err)
+			require.Equal(t, eur(test.wantPayerBalance), payer.Balance)
+			require.NoError(t, payer.Reconcile())
+			require.NoError(t, target.Reconcile())
+
+			history, err := payer.History(context.Background(), wallet.TransactionQuery{}, "")
+			require.NoError(t, err)
+			require.Equal(t, wallet.TypeRefund, history.Transactions[0].Type)
+			require.Equal(t, wallet.Incoming, history.Transactions[0].Direction)
+			require.Equal(t, paid.TransactionId, history.Transactions[0].RefundOf)
+			original := history.Transactions[len(test.refunds)]
+			require.Equal(t, paid.TransactionId, original.Id)
+			require.Equal(t, test.wantStatus, original.Status)
+		})
+	}
+}
+
+func TestWallet_RefundOnlyReceivedPayments(t *testing.T) {
+	store := memory.New()
+	payer := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	paid, err := payer.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), nil)
+	require.NoError(t, err)
+	deposited, err := store.ListTransactions(payer.Id, wallet.TransactionQuery{Direction: wallet.Incoming})
+	require.NoError(t, err)
+
+	_, err = payer.Refund(context.Background(), paid.TransactionId, nil)
+	require.ErrorIs(t, err, wallet.ErrTransactionNotFound, "payers cannot refund themselves")
+	_, err = payer.Refund(context.Background(), deposited[0].Id, nil)
+	require.ErrorIs(t, err, wallet.ErrTransactionNotFound, "only payments can be refunded")
+	_, err = target.Refund(context.Background(), "missing", nil)
+	require.ErrorIs(t, err, wallet.ErrTransactionNotFound)
+
+	_, err = target.ChangeStatus(context.Background(), wallet.StatusFrozen, "investigating", "operator1")
+	require.NoError(t, err)
+	_, err = target.Refund(context.Background(), paid.TransactionId, nil)
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+}
+
+func TestWallet_RefundConversion(t *testing.T) {
+	store := memory.New()
+	target, err := wallet.New(context.Background(), store, "user2", "USD", "")
+	require.NoError(t, err)
+	payer := newWallet(t, store, "100")
+	paid, err := payer.InitiatePayment(context.Background(), target.Id, money.MustParse("40"), newQuoter(t).Quote)
+	require.NoError(t, err)
+
+	// The payment converted at 1.2375, and so does its refund: 10 euros
+	// back cost 12.37 dollars, truncated.
+	partial := money.MustParse("10")
+	got, err := target.Refund(context.Background(), paid.TransactionId, &partial)
+	require.NoError(t, err)
+	require.Equal(t, "12.37", got.Conversion.SourceAmount.String())
+	require.Equal(t, "USD", got.Conversion.SourceCurrency)
+	require.Equal(t, eur("10"), got.Conversion.ConvertedAmount)
+	require.Equal(t, "37.13", got.Balance.String())
+	require.Equal(t, eur("10"), got.RefundOf.Refunded)
+
+	got, err = target.Refund(context.Background(), paid.TransactionId, nil)
+	require.NoError(t, err)
+	require.Equal(t, "37.12", got.Conversion.SourceAmount.String())
+	require.Equal(t, wallet.PaymentRefunded, got.RefundOf.Status)
+	require.Equal(t, "0.01", got.Balance.String())
+
+	payer, err = wallet.Get(store, payer.Id)
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), payer.Balance)
+	require.NoError(t, payer.Reconcile())
+	require.NoError(t, target.Reconcile())
+}
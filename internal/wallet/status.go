@@ -0,0 +1,190 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
+)
+
+const (
+	StatusActive = "active"
+	// StatusInboundOnly lets money into the wallet but not out of it.
+	StatusInboundOnly = "inbound_only"
+	// StatusFrozen blocks every transaction but an operator's adjustment.
+	StatusFrozen = "frozen"
+	// StatusClosed retires an empty wallet for good.
+	StatusClosed = "closed"
+)
+
+const maxReasonLength = 500
+
+var (
+	ErrWalletFrozen      = errors.New("wallet is frozen")
+	ErrWalletClosed      = errors.New("wallet is closed")
+	ErrInvalidStatus     = errors.New("invalid status change")
+	ErrStatusUnchanged   = errors.New("wallet already has this status")
+	ErrBalanceNotZero    = errors.New("only a wallet with a zero balance can be closed")
+	ErrInvalidAdjustment = errors.New("invalid adjustment")
+)
+
+// WalletQuery narrows down a list of wallets. Zero values leave a filter
+// unset. Stores return matches in order of ID, starting after the wallet
+// whose ID is After, and stop at Limit matches unless it is zero.
+type WalletQuery struct {
+	UserId   string
+	Currency string
+	Status   string
+	IdPrefix string
+	After    string
+	Limit    int
+}
+
+// WalletCount is how many wallets in one currency have one status.
+type WalletCount struct {
+	Currency string
+	Status   string
+	Wallets  int
+}
+
+// Adjustment records who corrected a balance, and why.
+type Adjustment struct {
+	OperatorId string `json:"OperatorId"`
+	Reason     string `json:"Reason"`
+}
+
+// StatusChange records a wallet moving From one status To another. The Store
+// fills in From when it applies the change.
+type StatusChange struct {
+	WalletId  string    `json:"WalletId"`
+	From      string    `json:"From"`
+	To        string    `json:"To"`
+	Reason    string    `json:"Reason"`
+	ChangedBy string    `json:"ChangedBy"`
+	Timestamp time.Time `json:"Timestamp"`
+}
+
+// StatusRequest moves a wallet to a new Status, giving the Reason for it.
+type StatusRequest struct {
+	Status string `json:"Status"`
+	Reason string `json:"Reason"`
+}
+
+// Allows reports whether the wallet's status lets the transaction debit or
+// credit it.
+func (w *Wallet) Allows(t *Transaction, direction Direction) error {
+	switch {
+	case w.Status == StatusClosed:
+		return fmt.Errorf("%w: %s", ErrWalletClosed, w.Id)
+	case t.Type == TypeAdjustment:
+		return nil
+	case w.Status == StatusFrozen, w.Status == StatusInboundOnly && direction == Debit:
+		return fmt.Errorf("%w: %s", ErrWalletFrozen, w.Id)
+	}
+	return nil
+}
+
+// CheckStatusChange reports whether a wallet holding balance may move from
+// one status to another. Stores call it while they hold the wallet, so a
+// wallet cannot be closed while money is moving into it.
+func CheckStatusChange(from, to string, balance money.Money) error {
+	switch {
+	case !validStatus(to):
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidStatus, to)
+	case from == StatusClosed:
+		return ErrWalletClosed
+	case from == to:
+		return fmt.Errorf("%w: %s", ErrStatusUnchanged, to)
+	case to == StatusClosed && !balance.IsZero():
+		return fmt.Errorf("%w: the balance is %s %s", ErrBalanceNotZero, balance, balance.Currency)
+	}
+	return nil
+}
+
+func validStatus(status string) bool {
+	switch status {
+	case StatusActive, StatusInboundOnly, StatusFrozen, StatusClosed:
+		return true
+	}
+	return false
+}
+
+// ChangeStatus moves the wallet to a new status, recording who changed it
+// and why.
+func (w *Wallet) ChangeStatus(ctx context.Context, status, reason, changedBy string) (*StatusChange, error) {
+	reason = strings.TrimSpace(reason)
+	switch {
+	case !validStatus(status):
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidStatus, status)
+	case reason == "":
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidStatus)
+	case len(reason) > maxReasonLength:
+		return nil, fmt.Errorf("%w: the reason must be at most %d characters", ErrInvalidStatus, maxReasonLength)
+	}
+	change := &StatusChange{
+		WalletId:  w.Id,
+		To:        status,
+		Reason:    reason,
+		ChangedBy: changedBy,
+		Timestamp: time.Now().UTC(),
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.store.ChangeWalletStatus(change); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("wallet status changed", "wallet_id", w.Id, "from", change.From, "to", status,
+		"changed_by", changedBy)
+	w.Status = status
+	return change, nil
+}
+
+// StatusChanges returns every change of the wallet's status, oldest first.
+func (w *Wallet) StatusChanges(ctx context.Context) ([]*StatusChange, error) {
+	return w.store.ListStatusChanges(w.Id)
+}
+
+// Adjust corrects the wallet's balance by amount, crediting it when amount is
+// positive and debiting it when it is negative. Adjustments go through even
+// when the wallet is frozen, but not once it is closed, and cannot take it
+// below zero.
+func (w *Wallet) Adjust(ctx context.Context, amount money.Money, operatorId, reason string) (*Transaction, error) {
+	reason = strings.TrimSpace(reason)
+	switch {
+	case operatorId == "":
+		return nil, fmt.Errorf("%w: an operator is required", ErrInvalidAdjustment)
+	case reason == "":
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidAdjustment)
+	case len(reason) > maxReasonLength:
+		return nil, fmt.Errorf("%w: the reason must be at most %d characters", ErrInvalidAdjustment, maxReasonLength)
+	}
+	credit := !amount.IsNegative()
+	if !credit {
+		amount.Units = -amount.Units
+	}
+	amount, err := w.toWalletAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	transaction := newTransaction(TypeAdjustment, amount)
+	transaction.Adjustment = &Adjustment{OperatorId: operatorId, Reason: reason}
+	if credit {
+		transaction.TargetWalletId = w.Id
+	} else {
+		transaction.SourceWalletId = w.Id
+	}
+	if err := w.apply(ctx, transaction); err != nil {
+		return nil, err
+	}
+	if credit {
+		w.Balance = transaction.TargetBalance
+	} else {
+		w.Balance = transaction.SourceBalance
+	}
+	return transaction, nil
+}
@@ -0,0 +1,202 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWallet_Freeze(t *testing.T) {
+	store := memory.New()
+	frozen := newWallet(t, store, "100")
+	other := newWallet(t, store, "100")
+	require.Equal(t, wallet.StatusActive, frozen.Status)
+	_, err := frozen.ChangeStatus(context.Background(), wallet.StatusFrozen, "suspected fraud", "operator1")
+	require.NoError(t, err)
+	require.Equal(t, wallet.StatusFrozen, frozen.Status)
+
+	_, err = frozen.Deposit(context.Background(), money.MustParse("1"))
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+	_, err = frozen.Withdraw(context.Background(), money.MustParse("1"))
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+	_, err = frozen.InitiatePayment(context.Background(), other.Id, money.MustParse("1"), nil)
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+	_, err = other.InitiatePayment(context.Background(), frozen.Id, money.MustParse("1"), nil)
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen, "frozen wallets cannot receive payments either")
+
+	_, err = frozen.Adjust(context.Background(), money.MustParse("5"), "operator1", "refund a duplicate fee")
+	require.NoError(t, err, "operators can still adjust frozen wallets")
+
+	_, err = frozen.ChangeStatus(context.Background(), wallet.StatusInboundOnly, "fraud cleared, pending review", "operator1")
+	require.NoError(t, err)
+	_, err = frozen.Deposit(context.Background(), money.MustParse("1"))
+	require.NoError(t, err)
+	_, err = other.InitiatePayment(context.Background(), frozen.Id, money.MustParse("1"), nil)
+	require.NoError(t, err)
+	_, err = frozen.Withdraw(context.Background(), money.MustParse("1"))
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+	_, err = frozen.InitiatePayment(context.Background(), other.Id, money.MustParse("1"), nil)
+	require.ErrorIs(t, err, wallet.ErrWalletFrozen)
+
+	_, err = frozen.ChangeStatus(context.Background(), wallet.StatusActive, "review complete", "operator1")
+	require.NoError(t, err)
+	got, err := wallet.Get(store, frozen.Id)
+	require.NoError(t, err)
+	require.Equal(t, wallet.StatusActive, got.Status)
+	_, err = got.Withdraw(context.Background(), money.MustParse("1"))
+	require.NoError(t, err)
+	require.Equal(t, eur("106"), got.Balance)
+}
+
+func TestWallet_ChangeStatus(t *testing.T) {
+	for name, test := range map[string]struct {
+		balance string
+		status  string
+		reason  string
+
+		wantErr error
+	}{
+		"freezes": {
+			balance: "100",
+			status:  wallet.StatusFrozen,
+			reason:  "suspected fraud",
+		},
+		"closes an empty wallet": {
+			balance: "0",
+			status:  wallet.StatusClosed,
+			reason:  "customer request",
+		},
+		"cannot close a wallet holding money": {
+			balance: "0.01",
+			status:  wallet.StatusClosed,
+			reason:  "customer request",
+			wantErr: wallet.ErrBalanceNotZero,
+		},
+		"already active": {
+			balance: "100",
+			status:  wallet.StatusActive,
+			reason:  "customer request",
+			wantErr: wallet.ErrStatusUnchanged,
+		},
+		"unknown status": {
+			balance: "100",
+			status:  "paused",
+			reason:  "customer request",
+			wantErr: wallet.ErrInvalidStatus,
+		},
+		"needs a reason": {
+			balance: "100",
+			status:  wallet.StatusFrozen,
+			reason:  " ",
+			wantErr: wallet.ErrInvalidStatus,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			w := newWallet(t, store, test.balance)
+
+			got, err := w.ChangeStatus(context.Background(), test.status, test.reason, "operator1")
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				require.Equal(t, wallet.StatusActive, w.Status)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, wallet.StatusActive, got.From)
+			require.Equal(t, test.status, got.To)
+			require.Equal(t, test.status, w.Status)
+
+			changes, err := w.StatusChanges(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, []*wallet.StatusChange{got}, changes)
+		})
+	}
+}
+
+func TestWallet_Closed(t *testing.T) {
+	store := memory.New()
+	closed := newWallet(t, store, "0")
+	other := newWallet(t, store, "100")
+	_, err := closed.ChangeStatus(context.Background(), wallet.StatusClosed, "customer request", "user1")
+	require.NoError(t, err)
+
+	_, err = closed.Deposit(context.Background(), money.MustParse("1"))
+	require.ErrorIs(t, err, wallet.ErrWalletClosed)
+	_, err = other.InitiatePayment(context.Background(), closed.Id, money.MustParse("1"), nil)
+	require.ErrorIs(t, err, wallet.ErrWalletClosed)
+	_, err = closed.Adjust(context.Background(), money.MustParse("1"), "operator1", "goodwill credit")
+	require.ErrorIs(t, err, wallet.ErrWalletClosed)
+	_, err = closed.ChangeStatus(context.Background(), wallet.StatusActive, "reopen", "operator1")
+	require.ErrorIs(t, err, wallet.ErrWalletClosed)
+}
+
+func TestWallet_Adjust(t *testing.T) {
+	for name, test := range map[string]struct {
+		amount     money.Money
+		operatorId string
+		reason     string
+
+		wantBalance money.Money
+		wantErr     error
+	}{
+		"credits a positive amount": {
+			amount:      money.MustParse("10.50"),
+			operatorId:  "operator1",
+			reason:      "goodwill credit",
+			wantBalance: eur("110.50"),
+		},
+		"debits a negative amount": {
+			amount:      money.MustParse("-10.50"),
+			operatorId:  "operator1",
+			reason:      "reverse a duplicate deposit",
+			wantBalance: eur("89.50"),
+		},
+		"cannot debit below zero": {
+			amount:     money.MustParse("-100.01"),
+			operatorId: "operator1",
+			reason:     "reverse a duplicate deposit",
+			wantErr:    wallet.ErrInsufficientFunds,
+		},
+		"needs a reason": {
+			amount:     money.MustParse("1"),
+			operatorId: "operator1",
+			reason:     "  ",
+			wantErr:    wallet.ErrInvalidAdjustment,
+		},
+		"needs an operator": {
+			amount:  money.MustParse("1"),
+			reason:  "goodwill credit",
+			wantErr: wallet.ErrInvalidAdjustment,
+		},
+		"needs a non-zero amount": {
+			amount:     money.MustParse("0"),
+			operatorId: "operator1",
+			reason:     "goodwill credit",
+			wantErr:    wallet.ErrInvalidAmount,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			w := newWallet(t, store, "100")
+
+			got, err := w.Adjust(context.Background(), test.amount, test.operatorId, test.reason)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, wallet.TypeAdjustment, got.Type)
+			require.Equal(t, &wallet.Adjustment{OperatorId: test.operatorId, Reason: test.reason}, got.Adjustment)
+			require.Equal(t, test.wantBalance, w.Balance)
+			require.NoError(t, w.Reconcile())
+
+			entries, err := store.ListEntries(wallet.Adjustments("EUR"))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+		})
+	}
+}
@@ -1,115 +1,487 @@
 package wallet
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"sync"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	manager "github.com/adrianos93/wallet-manager"
+	"github.com/adrianos93/wallet-manager/internal/exchange"
+	"github.com/adrianos93/wallet-manager/internal/logging"
+	"github.com/adrianos93/wallet-manager/internal/money"
 )
 
+// Wallet is a snapshot of a wallet as it was loaded from its Store. All
+// balance changes go through the Store, which serialises them, so concurrent
+// requests should each load their own Wallet rather than share one.
 type Wallet struct {
-	Id           string  `json:"Id"`
-	Balance      float64 `json:"Balance"`
-	Transactions map[string]*Transaction
-	sync.Mutex
+	Id        string      `json:"Id"`
+	UserId    string      `json:"-"`
+	Name      string      `json:"Name,omitempty"`
+	Balance   money.Money `json:"Balance"`
+	Status    string      `json:"Status"`
+	CreatedAt time.Time   `json:"CreatedAt"`
+	// Limits are the wallet's own limits, which override those of its
+	// owner's tier.
+	Limits Limits `json:"Limits,omitempty"`
+	// Held is what the wallet's authorizations set aside when it was loaded.
+	Held  money.Money `json:"-"`
+	store Store
 }
 
+// Transaction moves Amount out of SourceWalletId and into TargetWalletId.
+// Deposits have no source wallet and withdrawals have no target wallet.
+// Payments between currencies carry a Conversion, and credit the target
+// wallet with its ConvertedAmount.
+// A payment naming an AuthorizationId captures part of that authorization.
+// A refund returns part of the payment it names in RefundOf, and a payment
+// keeps how much its refunds have returned in Refunded.
+// Reference, Description and Metadata are the TransactionDetails it was made
+// with, seen the same way from both sides.
+// The balances are filled in by the Store once the transaction is applied.
 type Transaction struct {
-	Id             string
-	AmountChanged  float64
-	Balance        float64
-	Timestamp      time.Time
-	SourceWalletID string
-	Reference      string
+	Id              string
+	Type            string
+	SourceWalletId  string
+	TargetWalletId  string
+	Amount          money.Money
+	SourceBalance   money.Money
+	TargetBalance   money.Money
+	Timestamp       time.Time
+	Reference       string
+	Description     string
+	Metadata        map[string]string
+	AuthorizationId string
+	RefundOf        string
+	Refunded        money.Money
+	Conversion      *Conversion
+	Adjustment      *Adjustment
+	// Limit, when set, caps the transaction and those it Counts with, and
+	// UserLimit the transaction and those of its type counted against any
+	// of its owner's wallets. Both are checked rather than stored.
+	Limit     *Limit
+	UserLimit *UserLimit
+}
+
+// TransactionOption sets optional parts of a transaction.
+type TransactionOption func(*Transaction)
+
+// Store persists wallets, their transactions and the ledger behind them.
+// ApplyTransaction must post the transaction's Entries and update every
+// wallet they touch atomically, failing with ErrInsufficientFunds rather than
+// take a wallet below zero, with the error from CheckLimit or CheckUserLimit
+// when it would break a limit, and with the error from Wallet.Allows when a
+// wallet's status forbids the transaction. It must also keep every debited
+// wallet holding what its authorizations set aside, checked with
+// CheckAvailable, and record a capture on its authorization with
+// Authorization.Capture, and a refund on its payment with
+// Transaction.Refund. ChangeWalletStatus must likewise check the change with CheckStatusChange, against the wallet's
+// current status and balance, and record it in one step.
+//
+// CreateWallet, ChangeWalletStatus and ApplyTransaction record the events of
+// their change, from CreatedEvent, StatusChange.Event and Transaction.Events,
+// in the event outbox in the same step as the change itself, so a change is
+// never made without its events or its events recorded without it.
+//
+// GetWallet and ListWallets fill in what each wallet has Held at the time.
+// CountWallets counts wallets by currency and status, in that order.
+// CreateAuthorization must check the authorization with CheckAuthorization
+// and save it in one step.
+type Store interface {
+	CreateWallet(w *Wallet) error
+	GetWallet(id string) (*Wallet, error)
+	ListWallets(query WalletQuery) ([]*Wallet, error)
+	CountWallets() ([]WalletCount, error)
+	ChangeWalletStatus(change *StatusChange) error
+	SetWalletLimits(walletId string, limits Limits) error
+	ListStatusChanges(walletId string) ([]*StatusChange, error)
+	ApplyTransaction(t *Transaction) error
+	GetTransaction(id string) (*Transaction, error)
+	ListTransactions(walletId string, query TransactionQuery) ([]*Transaction, error)
+	ListEntries(accountId string) ([]Entry, error)
+	CreateAuthorization(a *Authorization) error
+	GetAuthorization(id string) (*Authorization, error)
+	ListAuthorizations(walletId string) ([]*Authorization, error)
+	UpdateAuthorization(id string, update func(a *Authorization) error) error
 }
 
 type Payment struct {
-	TransactionId string  `json:"TransactionId"`
-	Balance       float64 `json:"Balance"`
+	TransactionId string      `json:"TransactionId"`
+	Balance       money.Money `json:"Balance"`
+	Available     money.Money `json:"Available"`
+	Currency      string      `json:"Currency"`
+	Conversion    *Conversion `json:"Conversion,omitempty"`
 }
 
+// Balance is the wallet's ledger balance, everything posted to it, and the
+// part of it that is Available, not held by authorizations.
 type Balance struct {
-	Balance float64 `json:"Balance"`
+	Balance   money.Money `json:"Balance"`
+	Available money.Money `json:"Available"`
+	Currency  string      `json:"Currency"`
+}
+
+// CreateWalletRequest picks the ISO 4217 currency of a new wallet, and an
+// optional name for it. The default currency is used when it is empty.
+type CreateWalletRequest struct {
+	Currency string `json:"Currency"`
+	Name     string `json:"Name,omitempty"`
 }
 
+// Deposit, Withdraw and PaymentRequest may name the currency of Amount, which
+// must then match the wallet's. Without one the amount is taken to be in the
+// wallet's currency. Each may also carry TransactionDetails.
 type Deposit struct {
-	Amount float64 `json:"Amount"`
+	Amount   money.Money `json:"Amount"`
+	Currency string      `json:"Currency,omitempty"`
+	TransactionDetails
 }
 
 type Withdraw struct {
-	Amount float64 `json:"Amount"`
+	Amount   money.Money `json:"Amount"`
+	Currency string      `json:"Currency,omitempty"`
+	TransactionDetails
 }
 
+// PaymentRequest may also name a QuoteId from the quote endpoint to pay a
+// wallet in another currency at a locked rate.
 type PaymentRequest struct {
-	TargetWallet string  `json:"Creditor"`
-	Amount       float64 `json:"Amount"`
+	TargetWallet string      `json:"Creditor"`
+	Amount       money.Money `json:"Amount"`
+	Currency     string      `json:"Currency,omitempty"`
+	QuoteId      string      `json:"QuoteId,omitempty"`
+	TransactionDetails
 }
 
+const (
+	TypeDeposit    = "deposit"
+	TypeWithdrawal = "withdrawal"
+	TypePayment    = "payment"
+	TypeAdjustment = "adjustment"
+	TypeRefund     = "refund"
+)
+
+// MaxNameLength is the most characters a wallet's name may have.
+const MaxNameLength = 64
+
 const (
 	walletIdSize      = 16
 	transactionIdSize = 32
 )
 
-var Wallets = map[string]*Wallet{}
+var (
+	ErrWalletNotFound      = errors.New("wallet not found")
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrSameWallet          = errors.New("cannot pay a wallet into itself")
+	ErrInvalidName         = errors.New("invalid wallet name")
+	// ErrInvalidAmount is money.ErrInvalidAmount, so either can be matched.
+	// Every amount a wallet rejects wraps it, alongside the money error
+	// giving the reason.
+	ErrInvalidAmount = money.ErrInvalidAmount
+)
 
-func New() *Wallet {
+// New creates a wallet holding currency, or the default currency when
+// currency is empty. The name is optional.
+func New(ctx context.Context, store Store, userId, currency, name string) (*Wallet, error) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return nil, fmt.Errorf("%w: must be at most %d characters", ErrInvalidName, MaxNameLength)
+	}
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	currency, err := money.ParseCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := money.Zero(currency)
+	if err != nil {
+		return nil, err
+	}
 	wallet := &Wallet{
-		Id:      manager.GenerateId(walletIdSize),
-		Balance: 0,
+		Id:        manager.GenerateId(walletIdSize),
+		UserId:    userId,
+		Name:      name,
+		Balance:   balance,
+		Status:    StatusActive,
+		CreatedAt: time.Now().UTC(),
+		store:     store,
 	}
-	Wallets[wallet.Id] = wallet
-	return wallet
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := store.CreateWallet(wallet); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("wallet created", "wallet_id", wallet.Id, "user_id", userId, "currency", currency)
+	return wallet, nil
 }
 
-func (w *Wallet) Deposit(amount float64) Balance {
-	w.Balance += amount
-	return Balance{
-		w.Balance,
+func Get(store Store, id string) (*Wallet, error) {
+	wallet, err := store.GetWallet(id)
+	if err != nil {
+		return nil, err
+	}
+	wallet.store = store
+	return wallet, nil
+}
+
+func (w *Wallet) Deposit(ctx context.Context, amount money.Money, options ...TransactionOption) (Balance, error) {
+	amount, err := w.toWalletAmount(amount)
+	if err != nil {
+		return Balance{}, err
+	}
+	transaction := newTransaction(TypeDeposit, amount)
+	transaction.TargetWalletId = w.Id
+	if err := w.applyOptions(transaction, options); err != nil {
+		return Balance{}, err
 	}
+	if err := w.apply(ctx, transaction); err != nil {
+		return Balance{}, err
+	}
+	w.Balance = transaction.TargetBalance
+	return w.CheckBalance(ctx), nil
 }
 
-func (w *Wallet) Withdraw(amount float64) (Balance, error) {
-	if amount > w.Balance {
-		return Balance{}, errors.New("inssuficient funds in wallet")
+func (w *Wallet) Withdraw(ctx context.Context, amount money.Money, options ...TransactionOption) (Balance, error) {
+	amount, err := w.toWalletAmount(amount)
+	if err != nil {
+		return Balance{}, err
+	}
+	transaction := newTransaction(TypeWithdrawal, amount)
+	transaction.SourceWalletId = w.Id
+	if err := w.applyOptions(transaction, options); err != nil {
+		return Balance{}, err
 	}
-	w.Balance = w.Balance - amount
+	if err := w.apply(ctx, transaction); err != nil {
+		return Balance{}, err
+	}
+	w.Balance = transaction.SourceBalance
+	return w.CheckBalance(ctx), nil
+}
+
+func (w *Wallet) CheckBalance(ctx context.Context) Balance {
 	return Balance{
-		w.Balance,
-	}, nil
+		Balance:   w.Balance,
+		Available: w.Available(),
+		Currency:  w.Currency(),
+	}
+}
+
+func (w *Wallet) Currency() string {
+	return w.Balance.Currency
 }
 
-func (w *Wallet) CheckBalance() Balance {
-	return Balance{w.Balance}
+// MarshalJSON adds the wallet's available balance and currency alongside its
+// balance.
+func (w Wallet) MarshalJSON() ([]byte, error) {
+	type plain Wallet
+	return json.Marshal(struct {
+		plain
+		Available money.Money `json:"Available"`
+		Currency  string      `json:"Currency"`
+	}{plain(w), w.Available(), w.Currency()})
 }
 
-func (w *Wallet) InitiatePayment(walletId string, amount float64) (Payment, error) {
-	w.Lock()
-	defer w.Unlock()
-	targetWallet, found := Wallets[walletId]
-	if !found {
-		return Payment{}, fmt.Errorf("wallet with ID: %s does not exist", walletId)
+// InitiatePayment pays amount, in the wallet's currency, into the wallet
+// with the given ID. When that wallet holds another currency the amount is
+// converted at the quote returned by price.
+func (w *Wallet) InitiatePayment(ctx context.Context, walletId string, amount money.Money, price PriceFunc, options ...TransactionOption) (Payment, error) {
+	transaction, err := w.payment(walletId, amount, price)
+	if err != nil {
+		return Payment{}, err
 	}
-	if amount > w.Balance {
-		return Payment{}, errors.New("insufficient funds")
+	if err := w.applyOptions(transaction, options); err != nil {
+		return Payment{}, err
 	}
-	w.Balance = w.Balance - amount
-	targetWallet.Balance = targetWallet.Balance + amount
-	transactionId := manager.GenerateId(transactionIdSize)
-	w.Transactions[transactionId] = &Transaction{
-		Id:             transactionId,
-		AmountChanged:  amount,
-		Balance:        w.Balance,
-		Timestamp:      time.Now(),
-		SourceWalletID: targetWallet.Id,
-		Reference:      "",
+	if err := w.apply(ctx, transaction); err != nil {
+		return Payment{}, err
 	}
-	Wallets[w.Id] = w
-	Wallets[targetWallet.Id] = targetWallet
+	w.Balance = transaction.SourceBalance
 
 	return Payment{
-		TransactionId: transactionId,
+		TransactionId: transaction.Id,
 		Balance:       w.Balance,
+		Available:     w.Available(),
+		Currency:      w.Currency(),
+		Conversion:    transaction.Conversion,
 	}, nil
 }
+
+// QuotePayment prices a payment without making it. lock should return a
+// quote that stays valid for a while, so the payment can be made at the
+// same rate.
+func (w *Wallet) QuotePayment(ctx context.Context, walletId string, amount money.Money, lock PriceFunc) (PaymentQuote, error) {
+	var quote *exchange.Quote
+	transaction, err := w.payment(walletId, amount, func(from, to string) (*exchange.Quote, error) {
+		var err error
+		quote, err = lock(from, to)
+		return quote, err
+	})
+	if err != nil {
+		return PaymentQuote{}, err
+	}
+	if transaction.Conversion == nil {
+		// Both wallets hold the same currency, so the rate is always 1.
+		if quote, err = lock(w.Currency(), w.Currency()); err != nil {
+			return PaymentQuote{}, err
+		}
+		if transaction.Conversion, err = newConversion(quote, transaction.Amount); err != nil {
+			return PaymentQuote{}, err
+		}
+	}
+	return PaymentQuote{
+		Conversion: *transaction.Conversion,
+		Creditor:   walletId,
+		ExpiresAt:  quote.ExpiresAt,
+	}, nil
+}
+
+// payment builds, but does not apply, a payment into the given wallet.
+func (w *Wallet) payment(walletId string, amount money.Money, price PriceFunc) (*Transaction, error) {
+	if walletId == w.Id {
+		return nil, ErrSameWallet
+	}
+	targetWallet, err := w.store.GetWallet(walletId)
+	if err != nil {
+		if errors.Is(err, ErrWalletNotFound) {
+			return nil, fmt.Errorf("wallet with ID: %s does not exist: %w", walletId, err)
+		}
+		return nil, err
+	}
+	amount, err = w.toWalletAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	transaction := newTransaction(TypePayment, amount)
+	transaction.SourceWalletId = w.Id
+	transaction.TargetWalletId = targetWallet.Id
+	if targetWallet.Currency() == w.Currency() {
+		return transaction, nil
+	}
+	if price == nil {
+		return nil, fmt.Errorf("%w: cannot pay from a %s wallet into a %s wallet",
+			money.ErrCurrencyMismatch, w.Currency(), targetWallet.Currency())
+	}
+	quote, err := price(w.Currency(), targetWallet.Currency())
+	if err != nil {
+		return nil, err
+	}
+	if quote.To != targetWallet.Currency() {
+		return nil, fmt.Errorf("%w: quote converts into %s, not %s", exchange.ErrQuoteMismatch, quote.To, targetWallet.Currency())
+	}
+	if transaction.Conversion, err = newConversion(quote, amount); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// apply has the store apply a transaction, unless ctx is done, and logs
+// whether it was applied or refused.
+func (w *Wallet) apply(ctx context.Context, t *Transaction) error {
+	logger := logging.FromContext(ctx).With("transaction_id", t.Id, "type", t.Type, "wallet_id", w.Id,
+		"amount", t.Amount.String(), "currency", t.Amount.Currency)
+	if t.TargetWalletId != "" && t.TargetWalletId != w.Id {
+		logger = logger.With("counterparty", t.TargetWalletId)
+	}
+	err := ctx.Err()
+	if err == nil {
+		err = w.store.ApplyTransaction(t)
+	}
+	if err != nil {
+		logger.Warn("transaction refused", "error", err)
+		return err
+	}
+	logger.Info("transaction applied")
+	if observe, ok := ctx.Value(appliedContextKey{}).(func(t *Transaction)); ok {
+		observe(t)
+	}
+	return nil
+}
+
+type appliedContextKey struct{}
+
+// OnApplied returns a copy of ctx under which every transaction a wallet
+// applies is handed to observe once the store has applied it, with the
+// balances it left the wallets in.
+func OnApplied(ctx context.Context, observe func(t *Transaction)) context.Context {
+	return context.WithValue(ctx, appliedContextKey{}, observe)
+}
+
+func newTransaction(transactionType string, amount money.Money) *Transaction {
+	return &Transaction{
+		Id:        manager.GenerateId(transactionIdSize),
+		Type:      transactionType,
+		Amount:    amount,
+		Timestamp: time.Now(),
+	}
+}
+
+// applyOptions sets the transaction's optional parts, checking its details,
+// applying the wallet's own limits over any it was given and converting its
+// limit into the wallet's currency. Amounts the wallet overrides are left out
+// of the transaction's user limit.
+func (w *Wallet) applyOptions(t *Transaction, options []TransactionOption) error {
+	for _, option := range options {
+		option(t)
+	}
+	if err := normalizeDetails(t); err != nil {
+		return err
+	}
+	limits := Limits{}
+	if t.Limit != nil {
+		limits[t.Type] = *t.Limit
+	}
+	limits, err := limits.Merge(w.Limits).In(w.Currency())
+	if err != nil {
+		return err
+	}
+	t.Limit = nil
+	if limit, ok := limits[t.Type]; ok && !limit.isZero() {
+		t.Limit = &limit
+	}
+	if t.UserLimit != nil {
+		userLimit := *t.UserLimit
+		if userLimit.Limit, err = userLimit.Limit.without(w.Limits[t.Type]).In(userLimit.Currency); err != nil {
+			return err
+		}
+		if userLimit.Cap != nil {
+			converted, err := userLimit.Cap.In(userLimit.Currency)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidLimits, err)
+			}
+			userLimit.Cap = &converted
+		}
+		t.UserLimit = nil
+		if !userLimit.Limit.isZero() || userLimit.Cap != nil {
+			t.UserLimit = &userLimit
+		}
+	}
+	return nil
+}
+
+// toWalletAmount converts a requested amount into the wallet's currency.
+func (w *Wallet) toWalletAmount(amount money.Money) (money.Money, error) {
+	return toAmount(amount, w.Currency())
+}
+
+// toAmount converts a requested amount into currency, rejecting anything
+// that is not a positive, representable amount.
+func toAmount(amount money.Money, currency string) (money.Money, error) {
+	converted, err := amount.In(currency)
+	if errors.Is(err, ErrInvalidAmount) {
+		return money.Money{}, err
+	}
+	if err != nil {
+		return money.Money{}, fmt.Errorf("%w: %w", ErrInvalidAmount, err)
+	}
+	if !converted.IsPositive() {
+		return money.Money{}, fmt.Errorf("%w: amount must be positive", ErrInvalidAmount)
+	}
+	return converted, nil
+}
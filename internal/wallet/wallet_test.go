@@ -1,11 +1,37 @@
-package wallet
+package wallet_test
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
 	"github.com/stretchr/testify/require"
 )
 
+func eur(amount string) money.Money {
+	m, err := money.MustParse(amount).In("EUR")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func newWallet(t *testing.T, store wallet.Store, balance string) *wallet.Wallet {
+	t.Helper()
+	w, err := wallet.New(context.Background(), store, "user1", "EUR", "")
+	require.NoError(t, err)
+	if balance != "0" {
+		_, err = w.Deposit(context.Background(), money.MustParse(balance))
+		require.NoError(t, err)
+	}
+	return w
+}
+
 func TestWallet_New(t *testing.T) {
 	for name, test := range map[string]struct {
 		wantWallets int
@@ -18,33 +44,183 @@ func TestWallet_New(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
+			store := memory.New()
 			loops := 0
 			for loops < test.wantWallets {
-				New()
+				created, err := wallet.New(context.Background(), store, "user1", "EUR", "")
+				require.NoError(t, err)
+				got, err := store.GetWallet(created.Id)
+				require.NoError(t, err)
+				require.Equal(t, "user1", got.UserId)
+				require.Equal(t, eur("0"), got.Balance)
 				loops++
 			}
-			require.Equal(t, test.wantWallets, len(Wallets))
-			Wallets = map[string]*Wallet{}
 		})
 	}
 }
 
+func TestWallet_NewCurrency(t *testing.T) {
+	for name, test := range map[string]struct {
+		currency string
+
+		wantBalance money.Money
+		wantErr     error
+	}{
+		"defaults to EUR": {
+			wantBalance: eur("0"),
+		},
+		"holds the given currency": {
+			currency:    "JPY",
+			wantBalance: money.Money{Currency: "JPY"},
+		},
+		"accepts lower case codes": {
+			currency:    "usd",
+			wantBalance: money.Money{Scale: 2, Currency: "USD"},
+		},
+		"rejects unknown currencies": {
+			currency: "ABC",
+			wantErr:  money.ErrUnknownCurrency,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := wallet.New(context.Background(), memory.New(), "user1", test.currency, "")
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantBalance, got.Balance)
+			require.Equal(t, wallet.Balance{Balance: test.wantBalance, Available: test.wantBalance, Currency: test.wantBalance.Currency}, got.CheckBalance(context.Background()))
+		})
+	}
+}
+
+func TestWallet_NewName(t *testing.T) {
+	for name, test := range map[string]struct {
+		name string
+
+		wantName string
+		wantErr  error
+	}{
+		"no name": {},
+		"trims the name": {
+			name:     "  Holiday fund ",
+			wantName: "Holiday fund",
+		},
+		"counts characters rather than bytes": {
+			name:     strings.Repeat("€", wallet.MaxNameLength),
+			wantName: strings.Repeat("€", wallet.MaxNameLength),
+		},
+		"rejects long names": {
+			name:    strings.Repeat("a", wallet.MaxNameLength+1),
+			wantErr: wallet.ErrInvalidName,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := memory.New()
+			created, err := wallet.New(context.Background(), store, "user1", "EUR", test.name)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			got, err := wallet.Get(store, created.Id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantName, got.Name)
+			require.False(t, got.CreatedAt.IsZero())
+		})
+	}
+}
+
+func TestWallet_Get(t *testing.T) {
+	store := memory.New()
+	created := newWallet(t, store, "10")
+
+	got, err := wallet.Get(store, created.Id)
+	require.NoError(t, err)
+	require.Equal(t, wallet.Balance{Balance: eur("10"), Available: eur("10"), Currency: "EUR"}, got.CheckBalance(context.Background()))
+
+	_, err = wallet.Get(store, "missing")
+	require.ErrorIs(t, err, wallet.ErrWalletNotFound)
+}
+
 func TestWallet_Deposit(t *testing.T) {
 	for name, test := range map[string]struct {
-		amount      float64
-		wantBalance Balance
+		amount      money.Money
+		wantBalance wallet.Balance
+		wantErr     bool
 	}{
 		"adds money successfully": {
-			amount:      100,
-			wantBalance: Balance{100},
+			amount:      money.MustParse("100"),
+			wantBalance: wallet.Balance{Balance: eur("100"), Available: eur("100"), Currency: "EUR"},
+		},
+		"adds fractional money exactly": {
+			amount:      money.MustParse("100.25"),
+			wantBalance: wallet.Balance{Balance: eur("100.25"), Available: eur("100.25"), Currency: "EUR"},
+		},
+		"fails to add too many decimal places": {
+			amount:  money.MustParse("0.001"),
+			wantErr: true,
+		},
+		"fails to add a negative amount": {
+			amount:  money.MustParse("-10"),
+			wantErr: true,
+		},
+		"fails to add money in another currency": {
+			amount:  money.Money{Units: 100, Scale: 2, Currency: "USD"},
+			wantErr: true,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			wallet := &Wallet{
-				Balance: 0,
+			store := memory.New()
+			w := newWallet(t, store, "0")
+
+			got, err := w.Deposit(context.Background(), test.amount)
+			if test.wantErr {
+				require.Error(t, err)
 			}
+			require.Equal(t, test.wantBalance, got)
+		})
+	}
+}
+
+func TestWallet_DepositUserCap(t *testing.T) {
+	for name, test := range map[string]struct {
+		balance string
+		amount  string
+		cap     money.Money
+
+		wantBalance wallet.Balance
+		wantErr     error
+	}{
+		"deposits up to the cap": {
+			balance:     "60",
+			amount:      "40",
+			cap:         money.MustParse("100"),
+			wantBalance: wallet.Balance{Balance: eur("100"), Available: eur("100"), Currency: "EUR"},
+		},
+		"refuses deposits over the cap": {
+			balance: "60",
+			amount:  "40.01",
+			cap:     money.MustParse("100"),
+			wantErr: wallet.ErrLimitExceeded,
+		},
+		"refuses caps in another currency": {
+			balance: "0",
+			amount:  "1",
+			cap:     money.Money{Units: 100, Currency: "USD"},
+			wantErr: money.ErrCurrencyMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := newWallet(t, memory.New(), test.balance)
 
-			got := wallet.Deposit(test.amount)
+			got, err := w.Deposit(context.Background(), money.MustParse(test.amount), wallet.WithUserCap(test.cap, "EUR", money.Money.In))
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
 			require.Equal(t, test.wantBalance, got)
 		})
 	}
@@ -52,50 +228,89 @@ func TestWallet_Deposit(t *testing.T) {
 
 func TestWallet_Withdraw(t *testing.T) {
 	for name, test := range map[string]struct {
-		amount      float64
-		wantBalance Balance
-		wantErr     bool
+		initialAmount string
+		amount        money.Money
+		wantBalance   wallet.Balance
+		wantErr       error
 	}{
 		"withdraws money successfully": {
-			amount:      100,
-			wantBalance: Balance{0},
+			initialAmount: "100",
+			amount:        money.MustParse("100"),
+			wantBalance:   wallet.Balance{Balance: eur("0"), Available: eur("0"), Currency: "EUR"},
+		},
+		"withdraws without drifting": {
+			initialAmount: "100",
+			amount:        money.MustParse("99.9"),
+			wantBalance:   wallet.Balance{Balance: eur("0.10"), Available: eur("0.10"), Currency: "EUR"},
 		},
 		"fails to withdraw money": {
-			amount:  100,
-			wantErr: true,
+			initialAmount: "0",
+			amount:        money.MustParse("100"),
+			wantErr:       wallet.ErrInsufficientFunds,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			wallet := &Wallet{
-				Balance: 0,
-			}
-			wallet.Balance = 100
-			if test.wantErr {
-				wallet.Balance = 0
-			}
+			store := memory.New()
+			w := newWallet(t, store, test.initialAmount)
 
-			got, err := wallet.Withdraw(test.amount)
-			if test.wantErr {
-				require.Error(t, err)
+			got, err := w.Withdraw(context.Background(), test.amount)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
 			}
 			require.Equal(t, test.wantBalance, got)
 		})
 	}
 }
 
+func TestWallet_CancelledContext(t *testing.T) {
+	store := memory.New()
+	w := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := w.Deposit(ctx, money.MustParse("10"))
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = w.InitiatePayment(ctx, target.Id, money.MustParse("10"), nil)
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = w.ChangeStatus(ctx, wallet.StatusFrozen, "lost card", "user1")
+	require.ErrorIs(t, err, context.Canceled)
+
+	got, err := store.GetWallet(w.Id)
+	require.NoError(t, err)
+	require.Equal(t, eur("100"), got.Balance, "nothing was applied")
+	require.Equal(t, wallet.StatusActive, got.Status)
+}
+
+func TestOnApplied(t *testing.T) {
+	store := memory.New()
+	w := newWallet(t, store, "100")
+	target := newWallet(t, store, "0")
+	var applied []*wallet.Transaction
+	ctx := wallet.OnApplied(context.Background(), func(t *wallet.Transaction) { applied = append(applied, t) })
+
+	payment, err := w.InitiatePayment(ctx, target.Id, money.MustParse("30"), nil)
+	require.NoError(t, err)
+	_, err = w.InitiatePayment(ctx, target.Id, money.MustParse("300"), nil)
+	require.ErrorIs(t, err, wallet.ErrInsufficientFunds)
+
+	require.Len(t, applied, 1, "refused transactions are not handed over")
+	require.Equal(t, payment.TransactionId, applied[0].Id)
+	require.Equal(t, eur("70"), applied[0].SourceBalance)
+	require.Equal(t, eur("30"), applied[0].TargetBalance)
+}
+
 func TestWallet_CheckBalance(t *testing.T) {
 	for name, test := range map[string]struct {
-		wantBalance Balance
+		wantBalance wallet.Balance
 	}{
 		"returns balance": {
-			wantBalance: Balance{100},
+			wantBalance: wallet.Balance{Balance: eur("100"), Available: eur("100"), Currency: "EUR"},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			wallet := &Wallet{
-				Balance: 100,
-			}
-			got := wallet.CheckBalance()
+			w := newWallet(t, memory.New(), "100")
+			got := w.CheckBalance(context.Background())
 			require.Equal(t, test.wantBalance, got)
 		})
 	}
@@ -103,57 +318,105 @@ func TestWallet_CheckBalance(t *testing.T) {
 
 func TestWallet_InitiatePayment(t *testing.T) {
 	for name, test := range map[string]struct {
-		sourceWalletId, targetWalletId string
-		initialAmount, amountToPay     float64
+		initialAmount  string
+		amountToPay    money.Money
+		targetCurrency string
 
-		wantPayment            Payment
+		wantPayment            wallet.Payment
+		wantTargetBalance      money.Money
 		wantErr, wantTargetErr bool
 	}{
 		"successfully initiates a payment": {
-			sourceWalletId: "sourceId",
-			targetWalletId: "targetId",
-			initialAmount:  100,
-			amountToPay:    50,
-			wantPayment: Payment{
-				Balance: 50,
+			initialAmount: "100",
+			amountToPay:   money.MustParse("50"),
+			wantPayment: wallet.Payment{
+				Balance:  eur("50"),
+				Currency: "EUR",
 			},
+			wantTargetBalance: eur("50"),
 		},
 		"fails to pay because due to inssuficient funds": {
-			sourceWalletId: "sourceId",
-			targetWalletId: "targetId",
-			initialAmount:  40,
-			amountToPay:    50,
-			wantErr:        true,
+			initialAmount:     "40",
+			amountToPay:       money.MustParse("50"),
+			wantTargetBalance: eur("0"),
+			wantErr:           true,
+		},
+		"fails to pay into a wallet in another currency": {
+			initialAmount:     "100",
+			amountToPay:       money.MustParse("50"),
+			targetCurrency:    "USD",
+			wantTargetBalance: money.Money{Scale: 2, Currency: "USD"},
+			wantErr:           true,
 		},
 		"fails to pay because target wallet does not exist": {
-			sourceWalletId: "sourceId",
-			targetWalletId: "targetId",
-			initialAmount:  100,
-			amountToPay:    50,
-			wantErr:        true,
-			wantTargetErr:  true,
+			initialAmount: "100",
+			amountToPay:   money.MustParse("50"),
+			wantErr:       true,
+			wantTargetErr: true,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			Wallets[test.targetWalletId] = &Wallet{
-				Id:      test.targetWalletId,
-				Balance: 0,
-			}
-
+			store := memory.New()
+			targetWallet, err := wallet.New(context.Background(), store, "user2", test.targetCurrency, "")
+			require.NoError(t, err)
+			targetWalletId := targetWallet.Id
 			if test.wantTargetErr {
-				delete(Wallets, test.targetWalletId)
+				targetWalletId = "missing"
 			}
+			sourceWallet := newWallet(t, store, test.initialAmount)
 
-			sourceWallet := &Wallet{
-				Id:      test.sourceWalletId,
-				Balance: test.initialAmount,
-			}
-
-			got, err := sourceWallet.InitiatePayment(test.targetWalletId, test.amountToPay)
+			got, err := sourceWallet.InitiatePayment(context.Background(), targetWalletId, test.amountToPay, nil)
 			if test.wantErr {
 				require.Error(t, err)
 			}
 			require.Equal(t, test.wantPayment.Balance, got.Balance)
+			require.Equal(t, test.wantPayment.Currency, got.Currency)
+			if !test.wantTargetErr {
+				target, err := store.GetWallet(targetWallet.Id)
+				require.NoError(t, err)
+				require.Equal(t, test.wantTargetBalance, target.Balance)
+			}
 		})
 	}
 }
+
+func TestWallet_ConcurrentPayments(t *testing.T) {
+	store := memory.New()
+	first, second := newWallet(t, store, "100"), newWallet(t, store, "100")
+	const payments = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, payments)
+	for i := 0; i < payments; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			source, target := first.Id, second.Id
+			if i%2 == 1 {
+				source, target = target, source
+			}
+			// Each goroutine loads its own copy, the way each request does.
+			w, err := wallet.Get(store, source)
+			if err == nil {
+				_, err = w.InitiatePayment(context.Background(), target, money.MustParse("3"), nil)
+			}
+			if err != nil && !errors.Is(err, wallet.ErrInsufficientFunds) {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	total := eur("0")
+	for _, id := range []string{first.Id, second.Id} {
+		w, err := wallet.Get(store, id)
+		require.NoError(t, err)
+		require.NoError(t, w.Reconcile())
+		total, err = total.Add(w.Balance)
+		require.NoError(t, err)
+	}
+	require.Equal(t, eur("200"), total)
+}
@@ -0,0 +1,431 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	manager "github.com/adrianos93/wallet-manager"
+)
+
+// RetryPolicy decides how failed deliveries are retried: up to MaxAttempts
+// attempts in all, waiting InitialInterval after the first failure and twice
+// as long after each one since, but never longer than MaxInterval. A
+// delivery that fails its last attempt is dead.
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+}
+
+// DefaultRetryPolicy makes eight attempts over about an hour and a half.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 8, InitialInterval: 30 * time.Second, MaxInterval: time.Hour}
+
+// backoff returns how long to wait after the given number of failed
+// attempts.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	wait := p.InitialInterval
+	for i := 1; i < attempts && wait < p.MaxInterval; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxInterval {
+		wait = p.MaxInterval
+	}
+	return wait
+}
+
+// DefaultTimeout is how long an endpoint has to answer a delivery.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultConcurrency is how many endpoints DeliverDue posts to at once.
+const DefaultConcurrency = 8
+
+// Dispatcher registers endpoints, turns published events into deliveries
+// and makes the deliveries that are due. Only one Dispatcher should deliver
+// a Store's deliveries at a time.
+type Dispatcher struct {
+	store        Store
+	client       *http.Client
+	now          func() time.Time
+	retry        RetryPolicy
+	concurrency  int
+	allowPrivate bool
+
+	// mu stops two calls to DeliverDue from making the same delivery.
+	mu sync.Mutex
+}
+
+// Option configures optional parts of a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithClock makes the dispatcher tell the time with now rather than the
+// system clock.
+func WithClock(now func() time.Time) Option {
+	return func(d *Dispatcher) {
+		d.now = now
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *Dispatcher) {
+		d.retry = policy
+	}
+}
+
+// WithConcurrency replaces DefaultConcurrency.
+func WithConcurrency(endpoints int) Option {
+	return func(d *Dispatcher) {
+		d.concurrency = endpoints
+	}
+}
+
+// WithClient posts deliveries with client rather than an http.Client with
+// DefaultTimeout that only connects to public addresses and does not follow
+// redirects. Which addresses client may reach is then up to the caller.
+func WithClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithPrivateNetworks lets endpoints be on loopback, private and link-local
+// addresses, such as receivers on the same host in tests, which are refused
+// otherwise.
+func WithPrivateNetworks() Option {
+	return func(d *Dispatcher) {
+		d.allowPrivate = true
+	}
+}
+
+func NewDispatcher(store Store, options ...Option) *Dispatcher {
+	d := &Dispatcher{
+		store:       store,
+		now:         time.Now,
+		retry:       DefaultRetryPolicy,
+		concurrency: DefaultConcurrency,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	if d.concurrency < 1 {
+		d.concurrency = DefaultConcurrency
+	}
+	if d.client == nil {
+		d.client = newClient(d.allowPrivate)
+	}
+	return d
+}
+
+// Register adds an endpoint for the user's events, or a global one when
+// userId is empty. Its URL must not name a host on a private network, unless
+// the dispatcher was made WithPrivateNetworks.
+func (d *Dispatcher) Register(userId string, request EndpointRequest) (*Registration, error) {
+	if err := request.validate(d.allowPrivate); err != nil {
+		return nil, err
+	}
+	events := []string{}
+	for _, event := range EventTypes {
+		for _, requested := range request.Events {
+			if requested == event {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	endpoint := &Endpoint{
+		Id:        manager.GenerateId(idSize),
+		UserId:    userId,
+		URL:       request.URL,
+		Events:    events,
+		Secret:    "whsec_" + manager.GenerateId(secretSize),
+		CreatedAt: d.now().UTC(),
+	}
+	if err := d.store.CreateEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	return &Registration{Endpoint: endpoint, Secret: endpoint.Secret}, nil
+}
+
+// Endpoints returns the user's endpoints, or the global ones when userId is
+// empty, oldest first.
+func (d *Dispatcher) Endpoints(userId string) ([]*Endpoint, error) {
+	return d.store.ListEndpoints(userId)
+}
+
+// Endpoint returns one of the user's endpoints, or a global one when userId
+// is empty.
+func (d *Dispatcher) Endpoint(userId, id string) (*Endpoint, error) {
+	endpoint, err := d.store.GetEndpoint(id)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.UserId != userId {
+		return nil, fmt.Errorf("%w: %s", ErrEndpointNotFound, id)
+	}
+	return endpoint, nil
+}
+
+// Remove deletes one of the user's endpoints, or a global one when userId is
+// empty. Deliveries to it that are still pending die at their next attempt.
+func (d *Dispatcher) Remove(userId, id string) error {
+	if _, err := d.Endpoint(userId, id); err != nil {
+		return err
+	}
+	return d.store.DeleteEndpoint(id)
+}
+
+// Deliveries returns the deliveries to the user's endpoints, or to the
+// global ones when userId is empty, newest first. The query's UserId is
+// ignored.
+func (d *Dispatcher) Deliveries(userId string, query DeliveryQuery) ([]*Delivery, error) {
+	if query.Status != "" && !validDeliveryStatus(query.Status) {
+		return nil, fmt.Errorf("%w: status must be %q, %q or %q", ErrInvalidQuery,
+			DeliveryPending, DeliverySucceeded, DeliveryDead)
+	}
+	switch {
+	case query.Limit == 0:
+		query.Limit = DefaultDeliveryLimit
+	case query.Limit < 0 || query.Limit > MaxDeliveryLimit:
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxDeliveryLimit)
+	}
+	query.UserId = userId
+	return d.store.ListDeliveries(query)
+}
+
+// Delivery returns one of the deliveries to the user's endpoints, or to the
+// global ones when userId is empty.
+func (d *Dispatcher) Delivery(userId, id string) (*Delivery, error) {
+	delivery, err := d.store.GetDelivery(id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.UserId != userId {
+		return nil, fmt.Errorf("%w: %s", ErrDeliveryNotFound, id)
+	}
+	return delivery, nil
+}
+
+// Replay sends a delivery's payload to its endpoint again, as a new delivery
+// due straight away. Deliveries still pending cannot be replayed.
+func (d *Dispatcher) Replay(userId, id string) (*Delivery, error) {
+	original, err := d.Delivery(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	if original.Status == DeliveryPending {
+		return nil, fmt.Errorf("%w: %s", ErrDeliveryPending, id)
+	}
+	if _, err := d.Endpoint(userId, original.EndpointId); err != nil {
+		return nil, err
+	}
+	now := d.now().UTC()
+	replay := &Delivery{
+		Id:            manager.GenerateId(idSize),
+		EndpointId:    original.EndpointId,
+		UserId:        original.UserId,
+		EventId:       original.EventId,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+		ReplayOf:      original.Id,
+		CreatedAt:     now,
+	}
+	if err := d.store.CreateDelivery(replay); err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// Publish records an event about one of the user's wallets, and a delivery
+// of it to every endpoint that subscribes to it: the user's own and the
+// global ones. The deliveries are made by DeliverDue. An event published
+// again is not delivered again to the endpoints that already have it.
+func (d *Dispatcher) Publish(eventType, userId, walletId string, data interface{}) (*Event, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return d.publish(&Event{
+		Id:        manager.GenerateId(idSize),
+		Type:      eventType,
+		UserId:    userId,
+		WalletId:  walletId,
+		Data:      encoded,
+		CreatedAt: d.now().UTC(),
+	})
+}
+
+func (d *Dispatcher) publish(event *Event) (*Event, error) {
+	if !validEventType(event.Type) {
+		return nil, fmt.Errorf("unknown event %q", event.Type)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := d.store.ListEndpoints(event.UserId)
+	if err != nil {
+		return nil, err
+	}
+	global, err := d.store.ListEndpoints("")
+	if err != nil {
+		return nil, err
+	}
+	now := d.now().UTC()
+	for _, endpoint := range append(endpoints, global...) {
+		if !endpoint.Subscribes(event.Type) {
+			continue
+		}
+		err := d.store.CreateDelivery(&Delivery{
+			Id:            manager.GenerateId(idSize),
+			EndpointId:    endpoint.Id,
+			UserId:        endpoint.UserId,
+			EventId:       event.Id,
+			EventType:     event.Type,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		})
+		if err != nil && !errors.Is(err, ErrDuplicateDelivery) {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// DeliverDue attempts every delivery that is due, and returns how many
+// attempts it made and recorded. Different endpoints are posted to at the
+// same time, up to the dispatcher's concurrency, and each endpoint's
+// deliveries are made one after another, earliest first. A delivery whose
+// attempt cannot be recorded does not hold up the others; it is still due,
+// and is attempted again next time.
+func (d *Dispatcher) DeliverDue() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	due, err := d.store.DueDeliveries(d.now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	var endpoints []string
+	byEndpoint := map[string][]*Delivery{}
+	for _, delivery := range due {
+		if _, found := byEndpoint[delivery.EndpointId]; !found {
+			endpoints = append(endpoints, delivery.EndpointId)
+		}
+		byEndpoint[delivery.EndpointId] = append(byEndpoint[delivery.EndpointId], delivery)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		delivered int
+		failures  []error
+	)
+	queue := make(chan []*Delivery)
+	for i := 0; i < d.concurrency && i < len(endpoints); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deliveries := range queue {
+				for _, delivery := range deliveries {
+					err := d.deliver(delivery)
+					mu.Lock()
+					if err != nil {
+						failures = append(failures, fmt.Errorf("delivery %s: %w", delivery.Id, err))
+					} else {
+						delivered++
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, endpointId := range endpoints {
+		queue <- byEndpoint[endpointId]
+	}
+	close(queue)
+	wg.Wait()
+	return delivered, errors.Join(failures...)
+}
+
+// Run calls DeliverDue every interval until ctx is done. Failures are logged
+// and retried on the next tick.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.DeliverDue(); err != nil {
+			slog.Error("delivering webhooks", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver makes one attempt at a delivery and records how it went.
+func (d *Dispatcher) deliver(delivery *Delivery) error {
+	var (
+		code       int
+		attemptErr error
+	)
+	endpoint, err := d.store.GetEndpoint(delivery.EndpointId)
+	switch {
+	case errors.Is(err, ErrEndpointNotFound):
+		attemptErr = errors.New("endpoint was removed")
+	case err != nil:
+		return err
+	default:
+		code, attemptErr = d.post(endpoint, delivery)
+	}
+	now := d.now().UTC()
+	return d.store.UpdateDelivery(delivery.Id, func(current *Delivery) error {
+		current.Attempts++
+		current.LastAttemptAt, current.ResponseCode, current.Error = &now, code, ""
+		switch {
+		case attemptErr == nil:
+			current.Status, current.NextAttemptAt = DeliverySucceeded, nil
+		case endpoint == nil || current.Attempts >= d.retry.MaxAttempts:
+			current.Status, current.NextAttemptAt, current.Error = DeliveryDead, nil, attemptErr.Error()
+		default:
+			next := now.Add(d.retry.backoff(current.Attempts))
+			current.NextAttemptAt, current.Error = &next, attemptErr.Error()
+		}
+		return nil
+	})
+}
+
+// post sends a delivery's payload to the endpoint, and returns the status
+// code of the response, if any, and why the attempt failed, if it did.
+func (d *Dispatcher) post(endpoint *Endpoint, delivery *Delivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, delivery.EventType)
+	request.Header.Set(DeliveryHeader, delivery.Id)
+	request.Header.Set(SignatureHeader, Sign(endpoint.Secret, d.now(), delivery.Payload))
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
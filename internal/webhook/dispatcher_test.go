@@ -0,0 +1,450 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/store/memory"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+	"github.com/adrianos93/wallet-manager/internal/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver is an endpoint that answers each delivery with the next of its
+// status codes, or 200 once they run out, and keeps what it was sent.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received, r.bodies = append(r.received, req), append(r.bodies, body)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.received)
+}
+
+// newDispatcher returns a dispatcher that allows private networks, since
+// receivers listen on loopback.
+func newDispatcher(now *time.Time, options ...webhook.Option) (*webhook.Dispatcher, *memory.Store) {
+	store := memory.New()
+	options = append([]webhook.Option{
+		webhook.WithClock(func() time.Time { return *now }), webhook.WithPrivateNetworks(),
+	}, options...)
+	return webhook.NewDispatcher(store, options...), store
+}
+
+func TestDispatcher_Register(t *testing.T) {
+	for name, test := range map[string]struct {
+		request webhook.EndpointRequest
+
+		wantEvents []string
+		wantErr    error
+	}{
+		"every event": {
+			request:    webhook.EndpointRequest{URL: "https://example.com/hooks"},
+			wantEvents: []string{},
+		},
+		"some events, in documented order": {
+			request: webhook.EndpointRequest{URL: "http://hooks.example.com:9000/hooks",
+				Events: []string{webhook.EventWalletFrozen, webhook.EventPaymentSent, webhook.EventWalletFrozen}},
+			wantEvents: []string{webhook.EventPaymentSent, webhook.EventWalletFrozen},
+		},
+		"unknown event": {
+			request: webhook.EndpointRequest{URL: "https://example.com/hooks", Events: []string{"wallet.deleted"}},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"relative URL": {
+			request: webhook.EndpointRequest{URL: "/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"not HTTP": {
+			request: webhook.EndpointRequest{URL: "ftp://example.com/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"localhost": {
+			request: webhook.EndpointRequest{URL: "http://localhost:9000/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"loopback address": {
+			request: webhook.EndpointRequest{URL: "http://127.0.0.1:9000/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"IPv6 loopback address": {
+			request: webhook.EndpointRequest{URL: "http://[::1]:9000/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"private address": {
+			request: webhook.EndpointRequest{URL: "https://10.0.0.1/hooks"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+		"link-local address": {
+			request: webhook.EndpointRequest{URL: "http://169.254.169.254/latest/meta-data"},
+			wantErr: webhook.ErrInvalidEndpoint,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := webhook.NewDispatcher(memory.New())
+			got, err := d.Register("user1", test.request)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantEvents, got.Events)
+			require.NotEmpty(t, got.Secret)
+
+			encoded, err := json.Marshal(got)
+			require.NoError(t, err)
+			require.Contains(t, string(encoded), got.Secret, "registration shows the secret")
+			found, err := d.Endpoint("user1", got.Id)
+			require.NoError(t, err)
+			encoded, err = json.Marshal(found)
+			require.NoError(t, err)
+			require.NotContains(t, string(encoded), got.Secret, "nothing else does")
+		})
+	}
+}
+
+func TestDispatcher_Delivers(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, _ := newDispatcher(&now)
+	mine, global, other := newReceiver(t), newReceiver(t), newReceiver(t)
+	registered, err := d.Register("user1", webhook.EndpointRequest{URL: mine.URL, Events: []string{webhook.EventPaymentSent}})
+	require.NoError(t, err)
+	_, err = d.Register("", webhook.EndpointRequest{URL: global.URL})
+	require.NoError(t, err)
+	_, err = d.Register("user2", webhook.EndpointRequest{URL: other.URL})
+	require.NoError(t, err)
+
+	amount := money.MustParse("25")
+	event, err := d.Publish(webhook.EventPaymentSent, "user1", "wallet1", webhook.TransactionData{
+		TransactionId: "transaction1", WalletId: "wallet1", Amount: amount, Currency: "EUR",
+	})
+	require.NoError(t, err)
+	_, err = d.Publish(webhook.EventDepositCompleted, "user1", "wallet1", webhook.TransactionData{WalletId: "wallet1"})
+	require.NoError(t, err)
+
+	delivered, err := d.DeliverDue()
+	require.NoError(t, err)
+	require.Equal(t, 3, delivered)
+	require.Equal(t, 1, mine.count(), "only subscribed events reach the user's endpoint")
+	require.Equal(t, 2, global.count(), "global endpoints get every event")
+	require.Equal(t, 0, other.count(), "other users' endpoints get nothing")
+
+	request, body := mine.received[0], mine.bodies[0]
+	require.Equal(t, webhook.EventPaymentSent, request.Header.Get(webhook.EventHeader))
+	require.Equal(t, webhook.Sign(registered.Secret, now, body), request.Header.Get(webhook.SignatureHeader))
+	require.NotEqual(t, webhook.Sign("wrong secret", now, body), request.Header.Get(webhook.SignatureHeader))
+	var got webhook.Event
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Equal(t, event.Id, got.Id)
+	require.Equal(t, "wallet1", got.WalletId)
+	require.JSONEq(t, `{"TransactionId":"transaction1","WalletId":"wallet1","Amount":"25","Currency":"EUR"}`, string(got.Data))
+
+	deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, request.Header.Get(webhook.DeliveryHeader), deliveries[0].Id)
+	require.Equal(t, webhook.DeliverySucceeded, deliveries[0].Status)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Equal(t, 200, deliveries[0].ResponseCode)
+
+	delivered, err = d.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, delivered, "deliveries are made once")
+}
+
+func TestDispatcher_PublicAddressesOnly(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := memory.New()
+	d := webhook.NewDispatcher(store, webhook.WithClock(func() time.Time { return now }))
+	endpoint := newReceiver(t)
+	// As if a public name had come to resolve to loopback since it was
+	// registered.
+	require.NoError(t, store.CreateEndpoint(&webhook.Endpoint{Id: "endpoint1", UserId: "user1", URL: endpoint.URL,
+		Events: []string{}, Secret: "whsec_secret", CreatedAt: now}))
+	_, err := d.Publish(webhook.EventWalletFrozen, "user1", "wallet1", map[string]string{"WalletId": "wallet1"})
+	require.NoError(t, err)
+
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, endpoint.count())
+	deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	require.Equal(t, webhook.DeliveryPending, deliveries[0].Status)
+	require.Contains(t, deliveries[0].Error, "not a public address")
+}
+
+func TestDispatcher_DoesNotFollowRedirects(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, _ := newDispatcher(&now)
+	target := newReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	_, err := d.Register("user1", webhook.EndpointRequest{URL: redirect.URL})
+	require.NoError(t, err)
+	_, err = d.Publish(webhook.EventWalletFrozen, "user1", "wallet1", map[string]string{"WalletId": "wallet1"})
+	require.NoError(t, err)
+
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, target.count())
+	deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	require.Equal(t, webhook.DeliveryPending, deliveries[0].Status, "a redirect is a failed attempt")
+	require.Equal(t, http.StatusFound, deliveries[0].ResponseCode)
+}
+
+func TestDispatcher_DeliversConcurrently(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, _ := newDispatcher(&now, webhook.WithConcurrency(2))
+	// Each endpoint only answers once the other has been posted to, which
+	// never happens if they are posted to one after the other.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	both := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(both)
+	}()
+	for _, userId := range []string{"user1", "user2"} {
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived.Done()
+			select {
+			case <-both:
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+		}))
+		t.Cleanup(endpoint.Close)
+		_, err := d.Register(userId, webhook.EndpointRequest{URL: endpoint.URL})
+		require.NoError(t, err)
+		_, err = d.Publish(webhook.EventWalletFrozen, userId, "wallet1", map[string]string{"WalletId": "wallet1"})
+		require.NoError(t, err)
+	}
+
+	delivered, err := d.DeliverDue()
+	require.NoError(t, err)
+	require.Equal(t, 2, delivered)
+	for _, userId := range []string{"user1", "user2"} {
+		succeeded, err := d.Deliveries(userId, webhook.DeliveryQuery{Status: webhook.DeliverySucceeded})
+		require.NoError(t, err)
+		require.Len(t, succeeded, 1, userId)
+	}
+}
+
+// failingStore fails to record attempts at one delivery.
+type failingStore struct {
+	*memory.Store
+	deliveryId string
+}
+
+func (s *failingStore) UpdateDelivery(id string, update func(d *webhook.Delivery) error) error {
+	if id == s.deliveryId {
+		return errors.New("store unavailable")
+	}
+	return s.Store.UpdateDelivery(id, update)
+}
+
+func TestDispatcher_KeepsGoingPastFailures(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := &failingStore{Store: memory.New()}
+	d := webhook.NewDispatcher(store, webhook.WithClock(func() time.Time { return now }), webhook.WithPrivateNetworks())
+	endpoint := newReceiver(t)
+	_, err := d.Register("user1", webhook.EndpointRequest{URL: endpoint.URL})
+	require.NoError(t, err)
+	for _, walletId := range []string{"wallet1", "wallet2", "wallet3"} {
+		_, err := d.Publish(webhook.EventWalletFrozen, "user1", walletId, map[string]string{"WalletId": walletId})
+		require.NoError(t, err)
+	}
+	deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	store.deliveryId = deliveries[1].Id
+
+	delivered, err := d.DeliverDue()
+	require.ErrorContains(t, err, "store unavailable")
+	require.ErrorContains(t, err, deliveries[1].Id)
+	require.Equal(t, 2, delivered, "the deliveries after the failed one are made")
+	require.Equal(t, 3, endpoint.count())
+	pending, err := d.Deliveries("user1", webhook.DeliveryQuery{Status: webhook.DeliveryPending})
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "the failed one is still due")
+	require.Equal(t, deliveries[1].Id, pending[0].Id)
+}
+
+func TestDispatcher_RetriesUntilDead(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, _ := newDispatcher(&now, webhook.WithRetryPolicy(webhook.RetryPolicy{
+		MaxAttempts: 4, InitialInterval: time.Minute, MaxInterval: 3 * time.Minute,
+	}))
+	endpoint := newReceiver(t, 500, 500, 503, 502, 500)
+	_, err := d.Register("user1", webhook.EndpointRequest{URL: endpoint.URL})
+	require.NoError(t, err)
+	_, err = d.Publish(webhook.EventWalletFrozen, "user1", "wallet1", map[string]string{"WalletId": "wallet1"})
+	require.NoError(t, err)
+
+	// Each wait doubles the one before, up to the maximum.
+	start := now
+	for i, wantNext := range []time.Duration{time.Minute, 3 * time.Minute, 6 * time.Minute} {
+		delivered, err := d.DeliverDue()
+		require.NoError(t, err)
+		require.Equal(t, 1, delivered, "attempt %d", i+1)
+		deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+		require.NoError(t, err)
+		require.Equal(t, webhook.DeliveryPending, deliveries[0].Status)
+		require.Equal(t, start.Add(wantNext), *deliveries[0].NextAttemptAt, "attempt %d", i+1)
+
+		now = start.Add(wantNext).Add(-time.Second)
+		delivered, err = d.DeliverDue()
+		require.NoError(t, err)
+		require.Zero(t, delivered, "waits before attempt %d", i+2)
+		now = start.Add(wantNext)
+	}
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+
+	dead, err := d.Deliveries("user1", webhook.DeliveryQuery{Status: webhook.DeliveryDead})
+	require.NoError(t, err)
+	require.Len(t, dead, 1, "the dead-letter list holds the delivery")
+	require.Equal(t, 4, dead[0].Attempts)
+	require.Equal(t, 502, dead[0].ResponseCode)
+	require.Contains(t, dead[0].Error, "502")
+	require.Nil(t, dead[0].NextAttemptAt)
+
+	replay, err := d.Replay("user1", dead[0].Id)
+	require.NoError(t, err)
+	require.Equal(t, dead[0].Id, replay.ReplayOf)
+	require.Equal(t, webhook.DeliveryPending, replay.Status)
+	_, err = d.Replay("user1", replay.Id)
+	require.ErrorIs(t, err, webhook.ErrDeliveryPending)
+	_, err = d.Replay("user2", dead[0].Id)
+	require.ErrorIs(t, err, webhook.ErrDeliveryNotFound, "deliveries belong to their endpoint's user")
+
+	// The endpoint's fifth response is a 500, and its sixth the default 200.
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+	now = now.Add(time.Minute)
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+	replayed, err := d.Delivery("user1", replay.Id)
+	require.NoError(t, err)
+	require.Equal(t, webhook.DeliverySucceeded, replayed.Status)
+	require.Equal(t, 2, replayed.Attempts)
+	require.Equal(t, 6, endpoint.count())
+	require.Equal(t, endpoint.bodies[0], endpoint.bodies[5], "replays post the same payload")
+}
+
+func TestDispatcher_RemovedEndpoints(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, _ := newDispatcher(&now)
+	endpoint := newReceiver(t)
+	registered, err := d.Register("", webhook.EndpointRequest{URL: endpoint.URL})
+	require.NoError(t, err)
+	_, err = d.Publish(webhook.EventWalletCreated, "user1", "wallet1", map[string]string{"Id": "wallet1"})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, d.Remove("user1", registered.Id), webhook.ErrEndpointNotFound,
+		"users cannot remove global endpoints")
+	require.NoError(t, d.Remove("", registered.Id))
+	_, err = d.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, endpoint.count())
+
+	dead, err := d.Deliveries("", webhook.DeliveryQuery{Status: webhook.DeliveryDead})
+	require.NoError(t, err)
+	require.Len(t, dead, 1, "deliveries to removed endpoints die straight away")
+	require.Equal(t, "endpoint was removed", dead[0].Error)
+	_, err = d.Replay("", dead[0].Id)
+	require.ErrorIs(t, err, webhook.ErrEndpointNotFound)
+
+	_, err = d.Deliveries("", webhook.DeliveryQuery{Status: "lost"})
+	require.ErrorIs(t, err, webhook.ErrInvalidQuery)
+	_, err = d.Deliveries("", webhook.DeliveryQuery{Limit: webhook.MaxDeliveryLimit + 1})
+	require.ErrorIs(t, err, webhook.ErrInvalidQuery)
+}
+
+func TestDispatcher_Handle(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	d, store := newDispatcher(&now)
+	_, err := d.Register("user1", webhook.EndpointRequest{URL: "https://example.com/hooks"})
+	require.NoError(t, err)
+	eur := func(amount string) money.Money {
+		m, err := money.MustParse(amount).In("EUR")
+		require.NoError(t, err)
+		return m
+	}
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet1", UserId: "user1", Balance: eur("0")}))
+	require.NoError(t, store.CreateWallet(&wallet.Wallet{Id: "wallet2", UserId: "user2", Balance: eur("0")}))
+	for _, transaction := range []*wallet.Transaction{
+		{Id: "deposit1", Type: wallet.TypeDeposit, TargetWalletId: "wallet1", Amount: eur("100")},
+		{Id: "payment1", Type: wallet.TypePayment, SourceWalletId: "wallet1", TargetWalletId: "wallet2", Amount: eur("30")},
+		{Id: "refund1", Type: wallet.TypeRefund, SourceWalletId: "wallet2", TargetWalletId: "wallet1", Amount: eur("5"),
+			RefundOf: "payment1"},
+		{Id: "withdrawal1", Type: wallet.TypeWithdrawal, SourceWalletId: "wallet1", Amount: eur("10")},
+	} {
+		transaction.Timestamp = now
+		require.NoError(t, store.ApplyTransaction(transaction))
+	}
+	for _, status := range []string{wallet.StatusInboundOnly, wallet.StatusFrozen} {
+		require.NoError(t, store.ChangeWalletStatus(&wallet.StatusChange{WalletId: "wallet1", To: status, Timestamp: now}))
+	}
+
+	bus := event.NewBus(store)
+	bus.Subscribe("webhooks", d.Handle)
+	_, err = bus.Dispatch()
+	require.NoError(t, err)
+	deliveries, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	types := []string{}
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		types = append(types, deliveries[i].EventType)
+	}
+	require.Equal(t, []string{webhook.EventWalletCreated, webhook.EventDepositCompleted, webhook.EventPaymentSent,
+		webhook.EventWalletFrozen}, types, "only the events webhooks know about")
+
+	var sent webhook.Event
+	require.NoError(t, json.Unmarshal(deliveries[1].Payload, &sent))
+	events, err := store.ListEvents(0, 100)
+	require.NoError(t, err)
+	require.Equal(t, events[3].Id, sent.Id, "webhook events keep the Id of their domain event")
+	require.JSONEq(t, `{"TransactionId":"payment1","WalletId":"wallet1","Counterparty":"wallet2",
+		"Amount":"30.00","Currency":"EUR","Balance":"70.00"}`, string(sent.Data))
+
+	// The bus hands events over at least once, so some come again.
+	for _, e := range events {
+		require.NoError(t, d.Handle(e))
+	}
+	again, err := d.Deliveries("user1", webhook.DeliveryQuery{})
+	require.NoError(t, err)
+	require.Len(t, again, len(deliveries), "events handed over again are not delivered again")
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"encoding/json"
+
+	"github.com/adrianos93/wallet-manager/internal/event"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// Handle is the Dispatcher's event.Handler. It publishes the webhook events
+// a wallet's domain event stands for, and ignores the rest. The webhook
+// event keeps the domain event's Id, so an event the bus hands over twice
+// is only delivered once to each endpoint.
+func (d *Dispatcher) Handle(e *event.Event) error {
+	eventType, data, err := translate(e)
+	if err != nil || eventType == "" {
+		return err
+	}
+	_, err = d.publish(&Event{
+		Id:        e.Id,
+		Type:      eventType,
+		UserId:    e.UserId,
+		WalletId:  e.WalletId,
+		Data:      data,
+		CreatedAt: e.CreatedAt,
+	})
+	return err
+}
+
+// translate returns the webhook event type and data of a domain event, or
+// no type if it has none.
+func translate(e *event.Event) (string, json.RawMessage, error) {
+	switch e.Type {
+	case wallet.EventCreated:
+		return EventWalletCreated, e.Data, nil
+	case wallet.EventStatusChanged:
+		var change wallet.StatusChange
+		if err := json.Unmarshal(e.Data, &change); err != nil {
+			return "", nil, err
+		}
+		if change.To != wallet.StatusFrozen {
+			return "", nil, nil
+		}
+		return EventWalletFrozen, e.Data, nil
+	case wallet.EventDebited, wallet.EventCredited:
+		var movement wallet.Movement
+		if err := json.Unmarshal(e.Data, &movement); err != nil {
+			return "", nil, err
+		}
+		var eventType string
+		switch {
+		case movement.Type == wallet.TypeDeposit && e.Type == wallet.EventCredited:
+			eventType = EventDepositCompleted
+		case movement.Type == wallet.TypePayment && e.Type == wallet.EventDebited:
+			eventType = EventPaymentSent
+		case movement.Type == wallet.TypePayment:
+			eventType = EventPaymentReceived
+		default:
+			return "", nil, nil
+		}
+		// Amounts come out of JSON without their currency, which gives
+		// them back their scale.
+		amount, err := movement.Amount.In(movement.Currency)
+		if err != nil {
+			return "", nil, err
+		}
+		balance, err := movement.Balance.In(movement.Currency)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := json.Marshal(TransactionData{
+			TransactionId:      movement.TransactionId,
+			WalletId:           movement.WalletId,
+			Counterparty:       movement.Counterparty,
+			Amount:             amount,
+			Currency:           movement.Currency,
+			Balance:            &balance,
+			TransactionDetails: movement.TransactionDetails,
+		})
+		return eventType, data, err
+	}
+	return "", nil, nil
+}
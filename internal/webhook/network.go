@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// publicAddress reports whether deliveries may be posted to ip: it must not
+// be a loopback, private, link-local, multicast or unspecified address, so
+// an endpoint cannot reach the service's own host or network.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// publicHost reports whether host, as written in an endpoint's URL, may be
+// registered. Names other than localhost are only checked when they are
+// dialled, since what they resolve to can change.
+func publicHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicAddress(ip)
+	}
+	return true
+}
+
+// dialPublic refuses connections to addresses that are not public. It runs
+// after a name is resolved, so it holds for names that resolve, or come to
+// resolve, to the service's own network.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("refusing to connect to %s: not a public address", host)
+	}
+	return nil
+}
+
+// newClient returns the client deliveries are posted with by default. It
+// does not follow redirects, which would otherwise lead it to addresses the
+// endpoint's URL was never checked against. It connects directly rather
+// than through a proxy, and unless allowPrivate is set only to public
+// addresses.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: DefaultTimeout, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = dialPublic
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   DefaultTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,238 @@
+// Package webhook tells other services what happens to wallets. It posts
+// signed events to the endpoints users and operators register, retries the
+// deliveries that fail and keeps the ones that never get through.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/adrianos93/wallet-manager/internal/money"
+	"github.com/adrianos93/wallet-manager/internal/wallet"
+)
+
+// The events an endpoint can subscribe to.
+const (
+	EventWalletCreated    = "wallet.created"
+	EventDepositCompleted = "deposit.completed"
+	EventPaymentSent      = "payment.sent"
+	EventPaymentReceived  = "payment.received"
+	EventWalletFrozen     = "wallet.frozen"
+)
+
+// EventTypes lists every event, in the order they are documented.
+var EventTypes = []string{EventWalletCreated, EventDepositCompleted, EventPaymentSent, EventPaymentReceived, EventWalletFrozen}
+
+// The states of a delivery. A pending delivery waits for its first attempt
+// or its next retry. A dead one ran out of attempts, and stays on the
+// dead-letter list until it is replayed.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// The headers every delivery carries. SignatureHeader reads
+// "t=<unix seconds>,v1=<hex HMAC-SHA256>"; see Sign.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	DefaultDeliveryLimit = 50
+	MaxDeliveryLimit     = 100
+)
+
+const (
+	idSize     = 16
+	secretSize = 32
+)
+
+var (
+	ErrEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidEndpoint  = errors.New("invalid webhook endpoint")
+	ErrInvalidQuery     = errors.New("invalid delivery query")
+	// ErrDeliveryPending is returned for replays of deliveries that are
+	// still being attempted.
+	ErrDeliveryPending = errors.New("webhook delivery is still pending")
+	// ErrDuplicateDelivery is returned for a second delivery of an event to
+	// the same endpoint. Replays are not duplicates.
+	ErrDuplicateDelivery = errors.New("webhook delivery already exists")
+)
+
+// Endpoint is a URL events are posted to. A user's endpoint receives the
+// events about that user's wallets, while a global one, with no UserId,
+// receives every event. Events lists the events it subscribes to, or is
+// empty for all of them.
+type Endpoint struct {
+	Id        string    `json:"Id"`
+	UserId    string    `json:"UserId,omitempty"`
+	URL       string    `json:"URL"`
+	Events    []string  `json:"Events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+// Subscribes reports whether the endpoint receives events of the given type.
+func (e *Endpoint) Subscribes(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range e.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Registration is a new endpoint along with the secret its deliveries are
+// signed with. The secret is only ever shown here.
+type Registration struct {
+	*Endpoint
+	Secret string `json:"Secret"`
+}
+
+// EndpointRequest registers an endpoint.
+type EndpointRequest struct {
+	URL    string   `json:"URL"`
+	Events []string `json:"Events,omitempty"`
+}
+
+// Event is what happened, as posted to endpoints. Data depends on Type: a
+// wallet for wallet.created, a TransactionData for deposits and payments, and
+// a wallet.StatusChange for wallet.frozen.
+type Event struct {
+	Id        string          `json:"Id"`
+	Type      string          `json:"Type"`
+	UserId    string          `json:"UserId"`
+	WalletId  string          `json:"WalletId"`
+	Data      json.RawMessage `json:"Data"`
+	CreatedAt time.Time       `json:"CreatedAt"`
+}
+
+// TransactionData is the Data of deposit and payment events, seen from
+// WalletId. Balance is the wallet's balance straight after the transaction,
+// when it is known.
+type TransactionData struct {
+	TransactionId string       `json:"TransactionId,omitempty"`
+	WalletId      string       `json:"WalletId"`
+	Counterparty  string       `json:"Counterparty,omitempty"`
+	Amount        money.Money  `json:"Amount"`
+	Currency      string       `json:"Currency"`
+	Balance       *money.Money `json:"Balance,omitempty"`
+	wallet.TransactionDetails
+}
+
+// Delivery is one event on its way to one endpoint. Payload is the body
+// posted, and ReplayOf the delivery a replay repeats.
+type Delivery struct {
+	Id            string          `json:"Id"`
+	EndpointId    string          `json:"EndpointId"`
+	UserId        string          `json:"-"`
+	EventId       string          `json:"EventId"`
+	EventType     string          `json:"EventType"`
+	Payload       json.RawMessage `json:"Payload"`
+	Status        string          `json:"Status"`
+	Attempts      int             `json:"Attempts"`
+	NextAttemptAt *time.Time      `json:"NextAttemptAt,omitempty"`
+	LastAttemptAt *time.Time      `json:"LastAttemptAt,omitempty"`
+	// ResponseCode and Error describe the last attempt, when it failed or
+	// got a response.
+	ResponseCode int       `json:"ResponseCode,omitempty"`
+	Error        string    `json:"Error,omitempty"`
+	ReplayOf     string    `json:"ReplayOf,omitempty"`
+	CreatedAt    time.Time `json:"CreatedAt"`
+}
+
+// DeliveryQuery picks the deliveries to the endpoints of UserId, or to the
+// global endpoints when it is empty. EndpointId and Status narrow them down
+// further when set. Stores return matches newest first, and stop at Limit
+// unless it is zero.
+type DeliveryQuery struct {
+	UserId     string
+	EndpointId string
+	Status     string
+	Limit      int
+}
+
+// Store persists endpoints and deliveries.
+type Store interface {
+	CreateEndpoint(e *Endpoint) error
+	// GetEndpoint returns ErrEndpointNotFound for unknown endpoints.
+	GetEndpoint(id string) (*Endpoint, error)
+	// ListEndpoints returns a user's endpoints, or the global ones when
+	// userId is empty, oldest first.
+	ListEndpoints(userId string) ([]*Endpoint, error)
+	// DeleteEndpoint removes an endpoint but keeps its deliveries.
+	DeleteEndpoint(id string) error
+	// CreateDelivery returns ErrDuplicateDelivery when the endpoint already
+	// has a delivery of the event that is not a replay, and d is not one
+	// either.
+	CreateDelivery(d *Delivery) error
+	// GetDelivery returns ErrDeliveryNotFound for unknown deliveries.
+	GetDelivery(id string) (*Delivery, error)
+	ListDeliveries(query DeliveryQuery) ([]*Delivery, error)
+	// UpdateDelivery loads a delivery, applies update to it and saves the
+	// result in one step, saving nothing if update fails.
+	UpdateDelivery(id string, update func(d *Delivery) error) error
+	// DueDeliveries returns the pending deliveries whose NextAttemptAt is at
+	// or before the given time, earliest first.
+	DueDeliveries(at time.Time) ([]*Delivery, error)
+}
+
+// Sign returns the SignatureHeader of a payload posted at the given time:
+// the HMAC-SHA256, keyed with the endpoint's secret, of the unix time in
+// seconds, a full stop and the payload. Receivers should compute it
+// themselves, compare it in constant time and reject old timestamps.
+func Sign(secret string, at time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r EndpointRequest) validate(allowPrivate bool) error {
+	parsed, err := url.Parse(r.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: URL must be an absolute http or https URL", ErrInvalidEndpoint)
+	}
+	if !allowPrivate && !publicHost(parsed.Hostname()) {
+		return fmt.Errorf("%w: URL must not be on a loopback, private or link-local address", ErrInvalidEndpoint)
+	}
+	for _, event := range r.Events {
+		if !validEventType(event) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidEndpoint, event)
+		}
+	}
+	return nil
+}
+
+func validEventType(eventType string) bool {
+	for _, known := range EventTypes {
+		if eventType == known {
+			return true
+		}
+	}
+	return false
+}
+
+func validDeliveryStatus(status string) bool {
+	switch status {
+	case DeliveryPending, DeliverySucceeded, DeliveryDead:
+		return true
+	}
+	return false
+}